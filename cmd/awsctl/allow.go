@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/google/cel-go/cel"
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// allowPolicy is the -allow expressions of a proxy. A request is forwarded
+// only if one of them evaluates to true, regardless of the Lambda's policy.
+type allowPolicy struct {
+	exprs    []string
+	programs []cel.Program
+	targets  *proxy.Targets
+	env      map[string]string
+}
+
+// newAllowPolicy compiles the -allow expressions. They see `request` like
+// -on-request hooks, `target` with the alias, url and host of the target and
+// `env`, and must evaluate to a bool.
+func newAllowPolicy(exprs []string, targets *proxy.Targets) (*allowPolicy, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("target", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("env", cel.MapType(cel.StringType, cel.StringType)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create CEL environment: %w", err)
+	}
+	policy := &allowPolicy{exprs: exprs, targets: targets, env: environment()}
+	for _, expr := range exprs {
+		ast, issues := env.Compile(expr)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("compile %q: %w", expr, issues.Err())
+		}
+		if !ast.OutputType().IsExactType(cel.BoolType) && !ast.OutputType().IsExactType(cel.DynType) {
+			return nil, fmt.Errorf("failed to use %q: evaluates to %s, expected bool", expr, ast.OutputType())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("plan %q: %w", expr, err)
+		}
+		policy.programs = append(policy.programs, program)
+	}
+	return policy, nil
+}
+
+func (p *allowPolicy) targetVars(privateApiUrl string) map[string]string {
+	vars := map[string]string{
+		"alias": p.targets.Alias(privateApiUrl),
+		"url":   privateApiUrl,
+		"host":  "",
+	}
+	if u, err := url.Parse(privateApiUrl); err == nil {
+		vars["host"] = u.Hostname()
+	}
+	return vars
+}
+
+// hook denies requests none of the expressions allow with 403. An
+// expression that fails to evaluate, e.g. on a missing header, doesn't allow
+// the request.
+func (p *allowPolicy) hook() proxy.RequestHook {
+	return func(ctx context.Context, request *proxy.ProxyRequest) (*proxy.ProxyResponse, error) {
+		vars := map[string]any{
+			"request": requestVars(request),
+			"target":  p.targetVars(request.PrivateApiUrl),
+			"env":     p.env,
+		}
+		var evalErr error
+		for i, program := range p.programs {
+			out, _, err := program.ContextEval(ctx, vars)
+			if err != nil {
+				evalErr = fmt.Errorf("evaluate %q: %w", p.exprs[i], err)
+				continue
+			}
+			if allowed, ok := out.Value().(bool); ok && allowed {
+				return nil, nil
+			}
+		}
+		reason := fmt.Sprintf("Denied by -allow: %s %s%s matches no expression", request.Method, request.PrivateApiUrl, request.Path)
+		if evalErr != nil {
+			reason += fmt.Sprintf(" (failed to %v)", evalErr)
+		}
+		return proxy.TextResponse(http.StatusForbidden, reason), nil
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// newAuditTransport wraps next with an audit trail shipped to a CloudWatch
+// log group or an s3://bucket/prefix, attributing requests to caller. Each
+// -session gets its own stream and buffer, the default session has no name.
+func newAuditTransport(awsCfg aws.Config, next proxy.Transport, caller, logGroup, s3URL, sessionName string, verbose bool) (*proxy.AuditTransport, error) {
+	if logGroup != "" && s3URL != "" {
+		return nil, fmt.Errorf("failed to configure audit log: -audit-log-group and -audit-s3 cannot be combined")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	name := fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().Unix())
+	bufferName := "audit-buffer.jsonl"
+	if sessionName != "" {
+		name += "-" + sessionName
+		bufferName = fmt.Sprintf("audit-buffer-%s.jsonl", sessionName)
+	}
+
+	var sink proxy.AuditSink
+	if logGroup != "" {
+		sink = proxy.NewCloudWatchAuditSink(awsCfg, logGroup, name)
+	} else {
+		sink, err = proxy.NewS3AuditSink(awsCfg, s3URL, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stateDir, err := proxy.StateDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, fmt.Errorf("create state directory: %w", err)
+	}
+
+	return proxy.NewAuditTransport(next, sink, caller, filepath.Join(stateDir, bufferName), verbose), nil
+}
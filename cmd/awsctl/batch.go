@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// batchSpec is a line of awsctl batch input
+type batchSpec struct {
+	// ID is copied to the output line, to match responses with requests
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Target  string          `json:"target"`
+	Path    string          `json:"path,omitempty"`
+	Headers map[string]any  `json:"headers,omitempty"`
+	// Body is sent as is, JSON as JSON with Content-Type application/json
+	Body string          `json:"body,omitempty"`
+	JSON json.RawMessage `json:"json,omitempty"`
+}
+
+// batchResult is a line of awsctl batch output. The body is JSON if the
+// response is, text if it is UTF-8 and base64 otherwise.
+type batchResult struct {
+	Line       int                 `json:"line"`
+	ID         json.RawMessage     `json:"id,omitempty"`
+	Status     int                 `json:"status,omitempty"`
+	LatencyMs  int64               `json:"latencyMs"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	JSON       json.RawMessage     `json:"json,omitempty"`
+	Body       string              `json:"body,omitempty"`
+	BodyBase64 string              `json:"bodyBase64,omitempty"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// request returns the request of the spec
+func (s batchSpec) request(ctx context.Context) (*http.Request, error) {
+	if s.Target == "" {
+		return nil, fmt.Errorf("failed to parse request: missing target")
+	}
+	path := s.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	headers := http.Header{}
+	for name, value := range s.Headers {
+		switch value := value.(type) {
+		case string:
+			headers.Add(name, value)
+		case []any:
+			for _, v := range value {
+				headers.Add(name, fmt.Sprint(v))
+			}
+		default:
+			headers.Add(name, fmt.Sprint(value))
+		}
+	}
+	body := []byte(s.Body)
+	if s.JSON != nil {
+		body = s.JSON
+		if headers.Get("Content-Type") == "" {
+			headers.Set("Content-Type", "application/json")
+		}
+	}
+	method := strings.ToUpper(s.Method)
+	if method == "" {
+		method = http.MethodGet
+		if len(body) > 0 {
+			method = http.MethodPost
+		}
+	}
+	return localRequest(ctx, method, s.Target, path, headers, body)
+}
+
+// runBatchLine sends the request of an input line through handler
+func runBatchLine(ctx context.Context, handler http.Handler, number int, line []byte, withHeaders bool) batchResult {
+	result := batchResult{Line: number}
+	var spec batchSpec
+	if err := json.Unmarshal(line, &spec); err != nil {
+		result.Error = fmt.Sprintf("failed to parse request: %v", err)
+		return result
+	}
+	result.ID = spec.ID
+	request, err := spec.request(ctx)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	response, took := serveLocal(handler, request)
+	body, _ := io.ReadAll(response.Body)
+	result.Status = response.StatusCode
+	result.LatencyMs = took.Milliseconds()
+	if withHeaders {
+		result.Headers = response.Header
+	}
+	switch {
+	case len(body) == 0:
+	case strings.Contains(response.Header.Get("Content-Type"), "json") && json.Valid(body):
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, body); err == nil {
+			result.JSON = compact.Bytes()
+		}
+	case utf8.Valid(body):
+		result.Body = string(body)
+	default:
+		result.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+	return result
+}
+
+func runBatch() {
+	local := registerLocalProxyFlags()
+	var (
+		concurrency = flag.Int("concurrency", 4, "Requests sent at the same time, responses are written in input order")
+		withHeaders = flag.Bool("headers", false, "Include the response headers in the output")
+	)
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl batch [flags] < requests.ndjson > responses.ndjson")
+		fmt.Println(`Each input line is a request, e.g. {"id": 1, "method": "GET", "target": "billing", "path": "/v1/invoices?page=2"}`)
+		fmt.Println(`with optional "headers" and a "body" string or "json" value. Each output line is`)
+		fmt.Println(`{"line": 1, "id": 1, "status": 200, "latencyMs": 84, "json": ...}, with "body" for text`)
+		fmt.Println(`and "bodyBase64" for binary responses, or "error" if the line isn't a valid request.`)
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *concurrency < 1 {
+		log.Fatalf("Failed to run batch: -concurrency must be at least 1")
+	}
+
+	ctx := context.Background()
+	_, handler, _, err := local.server(ctx)
+	if err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+
+	// The writer waits for the oldest request while the others run, up to
+	// -concurrency in total
+	pending := make(chan chan batchResult, *concurrency-1)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(pending)
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 64*1024), 10<<20)
+		for number := 1; scanner.Scan(); number++ {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			line = bytes.Clone(line)
+			done := make(chan batchResult, 1)
+			pending <- done
+			go func() {
+				done <- runBatchLine(ctx, handler, number, line, *withHeaders)
+			}()
+		}
+		readErr <- scanner.Err()
+	}()
+
+	output := bufio.NewWriter(os.Stdout)
+	encoder := json.NewEncoder(output)
+	encoder.SetEscapeHTML(false)
+	failed := 0
+	for done := range pending {
+		result := <-done
+		if result.Error != "" {
+			failed++
+		}
+		if err := encoder.Encode(result); err != nil {
+			log.Fatalf("Failed to write response: %v", err)
+		}
+		// Let consumers of the pipe see each response as it arrives
+		if err := output.Flush(); err != nil {
+			log.Fatalf("Failed to write response: %v", err)
+		}
+	}
+	if err := <-readErr; err != nil {
+		log.Fatalf("Failed to read requests: %v", err)
+	}
+	if failed > 0 {
+		log.Printf("Failed to parse %d of the requests, see the error of their lines", failed)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certificateAuthority issues leaf certificates for intercepted CONNECT
+// tunnels. Browsers must trust its certificate for this to work.
+type certificateAuthority struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certPath string
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// caLifetime is how long a new CA is valid, caRenewal how long before it
+// expires it is replaced
+const (
+	caLifetime = 365 * 24 * time.Hour
+	caRenewal  = 30 * 24 * time.Hour
+)
+
+// loadOrCreateCA loads the CA from dir, creating and persisting a new one on
+// first use. The CA is name constrained to domains, a stored CA for other
+// domains or close to expiry is replaced and must be trusted again.
+func loadOrCreateCA(dir string, domains []string) (*certificateAuthority, error) {
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil && !caUsable(certPEM, domains) {
+		log.Printf("Replacing the local CA at %s for -pac-domains %s, trust it in your browser again", certPath, strings.Join(domains, ","))
+		certErr, keyErr = os.ErrNotExist, os.ErrNotExist
+	}
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		var err error
+		certPEM, keyPEM, err = createCA(domains)
+		if err != nil {
+			return nil, fmt.Errorf("create CA: %w", err)
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("create CA directory: %w", err)
+		}
+		if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+			return nil, fmt.Errorf("write CA key: %w", err)
+		}
+		if err := os.WriteFile(certPath, certPEM, 0o644); err != nil {
+			return nil, fmt.Errorf("write CA certificate: %w", err)
+		}
+	} else if certErr != nil {
+		return nil, fmt.Errorf("read CA certificate: %w", certErr)
+	} else if keyErr != nil {
+		return nil, fmt.Errorf("read CA key: %w", keyErr)
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA key pair: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse CA certificate: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("failed to use CA key: expected ECDSA key")
+	}
+
+	return &certificateAuthority{
+		cert:     cert,
+		key:      key,
+		certPath: certPath,
+		leaves:   make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// caUsable reports whether the CA in certPEM is constrained to exactly
+// domains and not about to expire
+func caUsable(certPEM []byte, domains []string) bool {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || time.Until(cert.NotAfter) < caRenewal {
+		return false
+	}
+	names, ranges := nameConstraints(domains)
+	if !cert.PermittedDNSDomainsCritical || !slices.Equal(cert.PermittedDNSDomains, names) {
+		return false
+	}
+	return slices.EqualFunc(cert.PermittedIPRanges, ranges, func(a, b *net.IPNet) bool {
+		return a.String() == b.String()
+	})
+}
+
+// nameConstraints returns the DNS domains and IP ranges the CA may issue
+// certificates for, the PAC domains without a leading "." and the PAC domains
+// that are IP addresses
+func nameConstraints(domains []string) (names []string, ranges []*net.IPNet) {
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if ip := net.ParseIP(domain); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		names = append(names, domain)
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+	return names, ranges
+}
+
+func createCA(domains []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "awsctl proxy local CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	// A trusted CA that can sign for any host is a liability, limit it to
+	// the domains the proxy intercepts. Without IP addresses among them no
+	// IP address is permitted at all.
+	names, ranges := nameConstraints(domains)
+	template.PermittedDNSDomainsCritical = true
+	template.PermittedDNSDomains = names
+	template.PermittedIPRanges = ranges
+	if len(ranges) == 0 {
+		template.ExcludedIPRanges = []*net.IPNet{
+			{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)},
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal key: %w", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// leafFor returns a certificate for host signed by the CA, caching it per host
+func (ca *certificateAuthority) leafFor(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if leaf, ok := ca.leaves[host]; ok {
+		return leaf, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number: %w", err)
+	}
+
+	// A leaf must not outlive the CA that signed it
+	notAfter := time.Now().AddDate(0, 0, 30)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("create certificate: %w", err)
+	}
+
+	leaf := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+	}
+	ca.leaves[host] = leaf
+	return leaf, nil
+}
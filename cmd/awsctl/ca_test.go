@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestCANameConstraints(t *testing.T) {
+	ca, err := loadOrCreateCA(t.TempDir(), []string{".internal.example.com", "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.cert.NotAfter.After(time.Now().Add(caLifetime)) {
+		t.Errorf("CA valid until %s, want at most %s", ca.cert.NotAfter, caLifetime)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"internal.example.com", true},
+		{"api.internal.example.com", true},
+		{"10.0.0.1", true},
+		{"example.com", false},
+		{"www.google.com", false},
+		{"notinternal.example.com", false},
+		{"10.0.0.2", false},
+	}
+	for _, test := range tests {
+		leaf, err := ca.leafFor(test.host)
+		if err != nil {
+			t.Fatalf("leafFor(%s): %v", test.host, err)
+		}
+		cert, err := x509.ParseCertificate(leaf.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = cert.Verify(x509.VerifyOptions{DNSName: test.host, Roots: roots})
+		if got := err == nil; got != test.want {
+			t.Errorf("leaf for %s verifies = %v (%v), want %v", test.host, got, err, test.want)
+		}
+	}
+}
+
+func TestCANoIPAddresses(t *testing.T) {
+	ca, err := loadOrCreateCA(t.TempDir(), []string{"internal.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	leaf, err := ca.leafFor("192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(leaf.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: "192.168.1.1", Roots: roots}); err == nil {
+		t.Error("leaf for an IP address verifies, want it outside the name constraints")
+	}
+}
+
+func TestCAReplacedForOtherDomains(t *testing.T) {
+	dir := t.TempDir()
+	first, err := loadOrCreateCA(dir, []string{"internal.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := loadOrCreateCA(dir, []string{"internal.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same.cert.Equal(first.cert) {
+		t.Error("CA replaced for the same domains, want it kept")
+	}
+	other, err := loadOrCreateCA(dir, []string{"corp.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.cert.Equal(first.cert) {
+		t.Error("CA kept for other domains, want it replaced")
+	}
+	if got := other.cert.PermittedDNSDomains; len(got) != 1 || got[0] != "corp.local" {
+		t.Errorf("PermittedDNSDomains = %q, want [corp.local]", got)
+	}
+}
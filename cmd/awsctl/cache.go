@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+func runCache() {
+	if len(os.Args) < 2 || (os.Args[1] != "stats" && os.Args[1] != "purge") {
+		fmt.Println("Usage: awsctl cache <command>")
+		fmt.Println("Commands:")
+		fmt.Println("  stats    Show the number, size and age of cached responses")
+		fmt.Println("  purge    Remove cached responses")
+		os.Exit(1)
+	}
+	command := os.Args[1]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+
+	var (
+		cacheDir  = flag.String("cache-dir", "", "Cache directory (default ~/.awsctl/cache)")
+		staleOnly = flag.Bool("stale", false, "Purge only entries that are no longer fresh")
+	)
+	flag.Parse()
+
+	dir := *cacheDir
+	if dir == "" {
+		var err error
+		if dir, err = proxy.DefaultCacheDir(); err != nil {
+			log.Fatalf("Failed to find cache directory: %v", err)
+		}
+	}
+
+	switch command {
+	case "stats":
+		info, err := proxy.CacheStats(dir)
+		if err != nil {
+			log.Fatalf("Failed to read cache: %v", err)
+		}
+		fmt.Printf("Directory: %s\n", dir)
+		fmt.Printf("Entries:   %d (%d fresh)\n", info.Entries, info.Fresh)
+		fmt.Printf("Size:      %.1f MB\n", float64(info.Bytes)/(1<<20))
+		if info.Entries > 0 {
+			fmt.Printf("Stored:    %s to %s\n", info.Oldest.Format(time.DateTime), info.Newest.Format(time.DateTime))
+		}
+	case "purge":
+		removed, bytes, err := proxy.PurgeCache(dir, *staleOnly)
+		if err != nil {
+			log.Fatalf("Failed to purge cache: %v", err)
+		}
+		fmt.Printf("Removed %d entries (%.1f MB) from %s\n", removed, float64(bytes)/(1<<20), dir)
+	}
+}
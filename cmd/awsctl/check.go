@@ -0,0 +1,526 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/ingress"
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// checkMethod marks check envelopes for policies, which may allow or deny
+// them like any other method
+const checkMethod = "CONNECT"
+
+// connectToUsage describes -connect-to of check tcp and check tls
+const connectToUsage = "IP address to connect to instead of resolving the host, which is still used as TLS server name"
+
+// checkOptions are the flags of check commands that reach the Lambda
+type checkOptions struct {
+	function    *string
+	functionURL *string
+	region      *string
+	profile     *string
+	endpointURL *string
+	transport   *string
+	signKMSKey  *string
+	forwardUser *bool
+	timeout     *time.Duration
+}
+
+func registerCheckFlags() checkOptions {
+	return checkOptions{
+		function:    flag.String("function", "awsctl-proxy-ingress-lambda", "Lambda function name"),
+		functionURL: flag.String("function-url", "", "Function URL of the ingress Lambda, for -transport function-url"),
+		region:      flag.String("region", "eu-central-1", "AWS region"),
+		profile:     flag.String("profile", "", "AWS profile to use"),
+		endpointURL: flag.String("lambda-endpoint-url", "", "Lambda API endpoint to invoke through, e.g. a VPC interface endpoint or localstack"),
+		transport:   flag.String("transport", "lambda", fmt.Sprintf("How the check reaches the ingress handler: %s", strings.Join(proxy.TransportNames(), ", "))),
+		signKMSKey:  flag.String("sign-kms-key", "", "KMS HMAC key to sign the envelope with, must match the Lambda's SIGNING_KMS_KEY"),
+		forwardUser: flag.Bool("forward-user", false, "Send the caller ARN from STS GetCallerIdentity upstream as X-Forwarded-User"),
+		timeout:     flag.Duration("timeout", 10*time.Second, "Timeout of the connect and of the TLS handshake"),
+	}
+}
+
+// checkClient sends check envelopes to the ingress handler
+type checkClient struct {
+	transport proxy.Transport
+	// signer signs every check, also those inside a batch envelope
+	signer  *proxy.SigningTransport
+	caller  string
+	timeout time.Duration
+}
+
+func (o checkOptions) client(ctx context.Context) (*checkClient, error) {
+	transport, err := proxy.NewTransport(ctx, *o.transport, proxy.TransportOptions{
+		FunctionName: *o.function,
+		FunctionURL:  *o.functionURL,
+		Region:       *o.region,
+		Profile:      *o.profile,
+		EndpointURL:  *o.endpointURL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create %s transport: %w", *o.transport, err)
+	}
+	client := &checkClient{transport: transport, timeout: *o.timeout}
+	if *o.signKMSKey != "" {
+		client.signer, err = proxy.NewSigningTransport(ctx, transport, *o.signKMSKey, *o.region, *o.profile)
+		if err != nil {
+			return nil, fmt.Errorf("create signing transport: %w", err)
+		}
+	}
+	if *o.forwardUser {
+		awsCfg, err := proxy.LoadAWSConfig(ctx, *o.region, *o.profile)
+		if err != nil {
+			return nil, err
+		}
+		if client.caller, err = proxy.CallerIdentity(ctx, awsCfg); err != nil {
+			return nil, fmt.Errorf("determine caller identity: %w", err)
+		}
+	}
+	return client, nil
+}
+
+// request returns the signed envelope of a check of target, e.g.
+// tls://host:port
+func (c *checkClient) request(ctx context.Context, target string, hostOverrides map[string]string) (proxy.ProxyRequest, error) {
+	timeoutMs := c.timeout.Milliseconds()
+	request := proxy.ProxyRequest{
+		Method:        checkMethod,
+		Headers:       map[string][]string{},
+		PrivateApiUrl: target,
+		HostOverrides: hostOverrides,
+		Caller:        c.caller,
+		Timeouts:      &ingress.UpstreamTimeouts{DialMs: timeoutMs, TLSHandshakeMs: timeoutMs},
+	}
+	if c.signer != nil {
+		if err := c.signer.Sign(ctx, &request); err != nil {
+			return proxy.ProxyRequest{}, err
+		}
+	}
+	return request, nil
+}
+
+// check has the Lambda connect to host:port, and complete a TLS handshake
+// for scheme tls. connectTo replaces the addresses of the host if set.
+func (c *checkClient) check(ctx context.Context, scheme, address, connectTo string) (*ingress.CheckResult, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("failed to parse %q: expected host:port", address)
+	}
+	var hostOverrides map[string]string
+	if connectTo != "" {
+		hostOverrides = map[string]string{host: connectTo}
+	}
+	request, err := c.request(ctx, scheme+"://"+address, hostOverrides)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.transport.Invoke(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("invoke %s: %w", proxy.DescribeTransport(c.transport), err)
+	}
+	if response.Check == nil {
+		return nil, fmt.Errorf("failed to check %s: the Lambda answered %d: %s", address, response.StatusCode, response.Body)
+	}
+	return response.Check, nil
+}
+
+// probe has the Lambda connect to each address n times, with all probes in
+// one batch envelope
+func (c *checkClient) probe(ctx context.Context, addresses []string, n int) ([]*ingress.CheckResult, error) {
+	var batch []proxy.ProxyRequest
+	for _, address := range addresses {
+		if host, _, err := net.SplitHostPort(address); err != nil || host == "" {
+			return nil, fmt.Errorf("failed to parse %q: expected host:port", address)
+		}
+		request, err := c.request(ctx, fmt.Sprintf("tcp://%s?probes=%d", address, n), nil)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, request)
+	}
+	// The Lambda verifies the envelope before the probes in it
+	envelope := proxy.ProxyRequest{Batch: batch}
+	if c.signer != nil {
+		if err := c.signer.Sign(ctx, &envelope); err != nil {
+			return nil, err
+		}
+	}
+	response, err := c.transport.Invoke(ctx, envelope)
+	if err != nil {
+		return nil, fmt.Errorf("invoke %s: %w", proxy.DescribeTransport(c.transport), err)
+	}
+	if len(response.Batch) != len(batch) {
+		return nil, fmt.Errorf("failed to probe: the Lambda answered %d: %s", response.StatusCode, response.Body)
+	}
+	results := make([]*ingress.CheckResult, len(batch))
+	for i, probed := range response.Batch {
+		if probed.Check == nil {
+			return nil, fmt.Errorf("failed to probe %s: the Lambda answered %d: %s", addresses[i], probed.StatusCode, probed.Body)
+		}
+		results[i] = probed.Check
+	}
+	return results, nil
+}
+
+func runCheck() {
+	commands := map[string]func(){
+		"tcp":   runCheckTCP,
+		"tls":   runCheckTLS,
+		"probe": runCheckProbe,
+	}
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Println("Usage: awsctl check <command> [flags] host:port")
+		fmt.Println("Commands:")
+		fmt.Println("  tcp    Connect to a host from inside the VPC through the ingress Lambda")
+		fmt.Println("  tls    Show the certificate chain and TLS parameters a host offers the Lambda")
+		fmt.Println("  probe  Time repeated connects to several hosts to find where traffic is dropped")
+		os.Exit(1)
+	}
+	command := commands[os.Args[1]]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	command()
+}
+
+func runCheckTCP() {
+	options := registerCheckFlags()
+	connectTo := flag.String("connect-to", "", connectToUsage)
+	handshake := flag.Bool("tls", false, "Complete a TLS handshake after connecting and print the server's certificate chain")
+	showPEM := flag.Bool("pem", false, "Print the certificates of -tls as PEM")
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl check tcp [flags] host:port")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	address := flag.Arg(0)
+	scheme := "tcp"
+	if *handshake {
+		scheme = "tls"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*(*options.timeout)+time.Minute)
+	defer cancel()
+	client, err := options.client(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create check client: %v", err)
+	}
+	result, err := client.check(ctx, scheme, address, *connectTo)
+	if err != nil {
+		log.Fatalf("Failed to check %s: %v", address, err)
+	}
+
+	printConnection(address, result)
+	if result.TLS != nil {
+		serverName := cmp.Or(result.TLS.ServerName, "no server name")
+		fmt.Printf("Completed %s handshake with %s (%dms)\n", result.TLS.Version, serverName, result.TLS.HandshakeMs)
+		for i, cert := range result.TLS.Certificates {
+			fmt.Printf("  %d subject %s\n", i, cert.Subject)
+			fmt.Printf("    issuer %s\n", cert.Issuer)
+			fmt.Printf("    valid %s to %s\n", cert.NotBefore.Format(time.DateOnly), cert.NotAfter.Format(time.DateOnly))
+			if *showPEM {
+				fmt.Print(cert.PEM)
+			}
+		}
+	}
+	exitOnFailedCheck(result)
+}
+
+func runCheckTLS() {
+	options := registerCheckFlags()
+	connectTo := flag.String("connect-to", "", connectToUsage)
+	showPEM := flag.Bool("pem", false, "Print the certificates as PEM")
+	caFile := flag.String("ca-file", "", "PEM file with CA certificates to verify the chain against too, e.g. an internal CA")
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl check tls [flags] host:port")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	address := flag.Arg(0)
+	host, _, _ := net.SplitHostPort(address)
+	var roots *x509.CertPool
+	if *caFile != "" {
+		pemData, err := os.ReadFile(*caFile)
+		if err != nil {
+			log.Fatalf("Failed to read CA file: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemData) {
+			log.Fatalf("Failed to read CA file: %s has no PEM certificates", *caFile)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*(*options.timeout)+time.Minute)
+	defer cancel()
+	client, err := options.client(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create check client: %v", err)
+	}
+	result, err := client.check(ctx, "tls", address, *connectTo)
+	if err != nil {
+		log.Fatalf("Failed to check %s: %v", address, err)
+	}
+	printConnection(address, result)
+	exitOnFailedCheck(result)
+
+	handshake := result.TLS
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Server name\t%s\n", cmp.Or(handshake.ServerName, "(none, the host is an IP address)"))
+	fmt.Fprintf(w, "Protocol\t%s\n", handshake.Version)
+	fmt.Fprintf(w, "Cipher suite\t%s\n", handshake.CipherSuite)
+	fmt.Fprintf(w, "ALPN\t%s\n", cmp.Or(handshake.ALPN, "(none)"))
+	fmt.Fprintf(w, "Handshake\t%dms\n", handshake.HandshakeMs)
+	w.Flush()
+
+	now := time.Now()
+	for i, cert := range handshake.Certificates {
+		fmt.Printf("\nCertificate %d\n", i)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "  Subject\t%s\n", cert.Subject)
+		fmt.Fprintf(w, "  Issuer\t%s\n", cert.Issuer)
+		var sans []string
+		for _, name := range cert.DNSNames {
+			sans = append(sans, "DNS:"+name)
+		}
+		for _, ip := range cert.IPAddresses {
+			sans = append(sans, "IP:"+ip)
+		}
+		if len(sans) > 0 {
+			fmt.Fprintf(w, "  SANs\t%s\n", strings.Join(sans, ", "))
+		}
+		fmt.Fprintf(w, "  Valid\t%s to %s (%s)\n", cert.NotBefore.Format(time.DateOnly), cert.NotAfter.Format(time.DateOnly), expiry(cert, now))
+		fmt.Fprintf(w, "  SHA-256\t%s\n", cert.SHA256)
+		w.Flush()
+		if *showPEM {
+			fmt.Print(cert.PEM)
+		}
+	}
+
+	fmt.Println()
+	switch {
+	case handshake.Verified:
+		fmt.Printf("The chain is valid for %s with the Lambda's system roots, calls to the target don't rely on skip-verify\n", host)
+	case roots != nil && verifyWithRoots(handshake.Certificates, host, roots) == nil:
+		fmt.Printf("The chain is valid for %s with %s but not with the Lambda's system roots (%s)\n", host, *caFile, handshake.VerifyError)
+	default:
+		fmt.Printf("The chain is not valid for %s, calls to the target rely on skip-verify: %s\n", host, handshake.VerifyError)
+		if roots != nil {
+			fmt.Printf("With %s: %v\n", *caFile, verifyWithRoots(handshake.Certificates, host, roots))
+		}
+	}
+}
+
+func runCheckProbe() {
+	options := registerCheckFlags()
+	count := flag.Int("count", 3, fmt.Sprintf("Connects to each host, at most %d", ingress.MaxProbes))
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl check probe [flags] host:port...")
+		fmt.Println("List hosts nearest first, e.g. one in the Lambda's subnet, one in the target's and the target.")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || flag.NArg() > ingress.MaxBatch || *count < 1 || *count > ingress.MaxProbes {
+		flag.Usage()
+		os.Exit(1)
+	}
+	addresses := flag.Args()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*count)*(*options.timeout)+time.Minute)
+	defer cancel()
+	client, err := options.client(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create check client: %v", err)
+	}
+	results, err := client.probe(ctx, addresses, *count)
+	if err != nil {
+		log.Fatalf("Failed to probe: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOP\tHOST\tADDRESS\tLOSS\tMIN\tAVG\tMAX\tRESULT")
+	firstFailed := -1
+	for i, result := range results {
+		verdict, _ := probeVerdict(result)
+		address := "-"
+		if len(result.Addresses) > 0 {
+			address = result.Addresses[0]
+		}
+		loss, minMs, avgMs, maxMs := probeStats(result.Probes)
+		latency := []string{"-", "-", "-"}
+		if loss < 100 {
+			latency = []string{fmt.Sprintf("%dms", minMs), fmt.Sprintf("%dms", avgMs), fmt.Sprintf("%dms", maxMs)}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d%%\t%s\t%s\t%s\t%s\n", i+1, addresses[i], address, loss, latency[0], latency[1], latency[2], verdict)
+		if firstFailed < 0 && result.FailedPhase != "" {
+			firstFailed = i
+		}
+	}
+	w.Flush()
+
+	if firstFailed < 0 {
+		fmt.Println("\nAll hops accept connections from the Lambda")
+		return
+	}
+	_, explanation := probeVerdict(results[firstFailed])
+	fmt.Printf("\nHop %d (%s) is the first that fails: %s\n", firstFailed+1, addresses[firstFailed], explanation)
+	os.Exit(2)
+}
+
+// probeStats returns the loss in percent and the minimum, average and
+// maximum connect time of the successful probes
+func probeStats(probes []ingress.CheckProbe) (loss int, minMs, avgMs, maxMs int64) {
+	var succeeded int64
+	var totalMs int64
+	for _, probe := range probes {
+		if probe.Error != "" {
+			continue
+		}
+		if succeeded == 0 || probe.ConnectMs < minMs {
+			minMs = probe.ConnectMs
+		}
+		maxMs = max(maxMs, probe.ConnectMs)
+		totalMs += probe.ConnectMs
+		succeeded++
+	}
+	if len(probes) == 0 {
+		return 100, 0, 0, 0
+	}
+	loss = 100 - int(succeeded*100/int64(len(probes)))
+	if succeeded > 0 {
+		avgMs = totalMs / succeeded
+	}
+	return loss, minMs, avgMs, maxMs
+}
+
+// probeVerdict classifies the probes of a host by how its connects failed,
+// which tells security groups and NACLs, which drop packets, from missing
+// routes and closed ports
+func probeVerdict(result *ingress.CheckResult) (verdict, explanation string) {
+	if result.FailedPhase == ingress.CheckPhaseResolve {
+		return "unresolved", "the Lambda can't resolve the host, check DNS_SERVER"
+	}
+	var failures []string
+	for _, probe := range result.Probes {
+		if probe.Error != "" {
+			failures = append(failures, probe.Error)
+		}
+	}
+	last := result.Error
+	if len(failures) > 0 {
+		last = failures[len(failures)-1]
+	}
+	switch {
+	case len(failures) == 0:
+		return "open", ""
+	case result.FailedPhase == "":
+		return "lossy", "some connects failed, the path or the host is unstable: " + last
+	case strings.Contains(last, "connection refused"):
+		return "closed", "the host is routable and answered, but nothing listens on the port or a firewall on it rejects the connection"
+	case strings.Contains(last, "no route to host") || strings.Contains(last, "network is unreachable"):
+		return "unroutable", "the Lambda's subnet has no route to the address, check route tables, peering and transit gateway attachments"
+	case strings.Contains(last, "timeout"):
+		return "filtered", "connects time out, so packets are dropped on the way: by the Lambda's security group (it only allows 80 and 443), the host's security group, a NACL in either direction, or a missing return route"
+	}
+	return "failed", last
+}
+
+// printConnection writes how the Lambda resolved and connected to address
+func printConnection(address string, result *ingress.CheckResult) {
+	if host, _, _ := net.SplitHostPort(address); len(result.Addresses) > 0 && net.ParseIP(host) == nil {
+		fmt.Printf("Resolved %s to %s (%dms)\n", host, strings.Join(result.Addresses, ", "), result.ResolveMs)
+	}
+	if result.RemoteAddress != "" {
+		fmt.Printf("Connected to %s from %s (%dms)\n", result.RemoteAddress, result.LocalAddress, result.ConnectMs)
+	}
+}
+
+// exitOnFailedCheck reports the failed phase of result and exits
+func exitOnFailedCheck(result *ingress.CheckResult) {
+	if result.FailedPhase == "" {
+		return
+	}
+	fmt.Printf("Failed to %s: %s\n", checkPhases[result.FailedPhase], result.Error)
+	if hint := checkHint(result); hint != "" {
+		fmt.Println(hint)
+	}
+	os.Exit(2)
+}
+
+// expiry describes how long cert is still valid at now
+func expiry(cert ingress.CheckCertificate, now time.Time) string {
+	switch {
+	case now.Before(cert.NotBefore):
+		return "not yet valid"
+	case now.After(cert.NotAfter):
+		return fmt.Sprintf("expired %d days ago", int(now.Sub(cert.NotAfter).Hours()/24))
+	}
+	return fmt.Sprintf("expires in %d days", int(cert.NotAfter.Sub(now).Hours()/24))
+}
+
+// verifyWithRoots verifies the chain of a check for host against roots
+func verifyWithRoots(chain []ingress.CheckCertificate, host string, roots *x509.CertPool) error {
+	var certs []*x509.Certificate
+	for _, checked := range chain {
+		block, _ := pem.Decode([]byte(checked.PEM))
+		if block == nil {
+			return fmt.Errorf("failed to decode certificate %s", checked.Subject)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("parse certificate %s: %w", checked.Subject, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("failed to verify chain: the server sent no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+// checkPhases describe the phases of a check for failure messages
+var checkPhases = map[string]string{
+	ingress.CheckPhaseResolve: "resolve the host",
+	ingress.CheckPhaseConnect: "connect",
+	ingress.CheckPhaseTLS:     "complete the TLS handshake",
+}
+
+// checkHint suggests the likely cause of a failed check
+func checkHint(result *ingress.CheckResult) string {
+	switch {
+	case result.FailedPhase == ingress.CheckPhaseResolve:
+		return "The Lambda can't resolve the host, check DNS_SERVER or use -connect-to"
+	case result.FailedPhase == ingress.CheckPhaseConnect && strings.Contains(result.Error, "connection refused"):
+		return "The host answered but nothing listens on the port"
+	case result.FailedPhase == ingress.CheckPhaseConnect && strings.Contains(result.Error, "timeout"):
+		return "No answer, check the security groups of the Lambda and the host, NACLs and routes"
+	case result.FailedPhase == ingress.CheckPhaseTLS:
+		return "The port accepts connections but the TLS handshake failed, it may not speak TLS"
+	}
+	return ""
+}
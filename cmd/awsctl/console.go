@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+	"golang.org/x/term"
+)
+
+// ANSI styles of the console output
+const (
+	styleReset  = "\x1b[0m"
+	styleBold   = "\x1b[1m"
+	styleDim    = "\x1b[2m"
+	styleRed    = "\x1b[31m"
+	styleGreen  = "\x1b[32m"
+	styleYellow = "\x1b[33m"
+	styleCyan   = "\x1b[36m"
+)
+
+// slowRequest and verySlowRequest are the durations highlighted in request
+// lines
+const (
+	slowRequest     = time.Second
+	verySlowRequest = 5 * time.Second
+)
+
+// console prints the startup information and a line per request of a proxy.
+// Colors are used on terminals unless disabled with -no-color or NO_COLOR.
+type console struct {
+	targets *proxy.Targets
+	noColor bool
+	quiet   bool
+	// json logs request lines as slog records, for -log-format json
+	json bool
+}
+
+// colored reports whether output to f is styled
+func (c *console) colored(f *os.File) bool {
+	return !c.noColor && os.Getenv("NO_COLOR") == "" && term.IsTerminal(int(f.Fd()))
+}
+
+// style wraps s in an ANSI style if output to f is colored
+func (c *console) style(f *os.File, style, s string) string {
+	if !c.colored(f) {
+		return s
+	}
+	return style + s + styleReset
+}
+
+// startup prints the startup information as aligned columns
+func (c *console) startup(info startupInfo) {
+	if c.quiet {
+		return
+	}
+	out := os.Stdout
+	row := func(label, value string) {
+		fmt.Fprintf(out, "  %s %s\n", c.style(out, styleDim, fmt.Sprintf("%-10s", label)), value)
+	}
+
+	fmt.Fprintf(out, "%s %s\n", c.style(out, styleBold, "awsctl proxy"), version)
+	for _, addr := range info.Listen {
+		row("Listening", c.style(out, styleCyan, "http://"+addr))
+	}
+	row("Transport", info.Transport)
+	row("Region", info.Region)
+	if info.Profile != "" {
+		row("Profile", info.Profile)
+	}
+	row("Usage", info.Usage)
+	row("", fmt.Sprintf("or any path with header %s: <alias-or-url>", proxy.TargetHeader))
+	if info.LegacyUsage != "" {
+		row("Legacy", info.LegacyUsage)
+	}
+	if info.PacURL != "" {
+		row("PAC file", info.PacURL)
+		row("CA", fmt.Sprintf("%s, trust it in your browser for HTTPS", info.CACertificate))
+	}
+	for _, s := range info.Sessions {
+		row("Session", fmt.Sprintf("%s %s -> %s (region %s)", s.Name, c.style(out, styleCyan, s.URL), s.Transport, s.Region))
+	}
+	if info.Ready {
+		fmt.Fprintln(out, c.style(out, styleGreen, "Ready"))
+	}
+}
+
+// requestLine is what the console reports of a request
+type requestLine struct {
+	method   string
+	status   int
+	duration time.Duration
+	target   string
+	path     string
+	// tag is the request's proxy.TagHeader
+	tag string
+}
+
+// print writes the line to stderr in one write, so concurrent requests don't
+// interleave
+func (c *console) print(line requestLine) {
+	if c.json {
+		slog.Info("request", "method", line.method, "status", line.status, "durationMs", line.duration.Milliseconds(), "target", line.target, "path", line.path, "tag", line.tag)
+		return
+	}
+	out := os.Stderr
+
+	status := "---"
+	statusStyle := styleRed
+	if line.status != 0 {
+		status = fmt.Sprint(line.status)
+		switch {
+		case line.status >= 500:
+		case line.status >= 400:
+			statusStyle = styleYellow
+		case line.status >= 300:
+			statusStyle = styleCyan
+		default:
+			statusStyle = styleGreen
+		}
+	}
+
+	duration := fmt.Sprintf("%dms", line.duration.Milliseconds())
+	if line.duration >= slowRequest {
+		duration = fmt.Sprintf("%.2fs", line.duration.Seconds())
+	}
+	duration = fmt.Sprintf("%7s", duration)
+	switch {
+	case line.duration >= verySlowRequest:
+		duration = c.style(out, styleRed, duration)
+	case line.duration >= slowRequest:
+		duration = c.style(out, styleYellow, duration)
+	}
+
+	tag := ""
+	if line.tag != "" {
+		tag = " " + c.style(out, styleCyan, "["+line.tag+"]")
+	}
+	fmt.Fprintf(out, "%s %-7s %s %s  %-16s %s%s\n",
+		c.style(out, styleDim, time.Now().Format(time.TimeOnly)),
+		line.method,
+		c.style(out, statusStyle, status),
+		duration,
+		line.target,
+		line.path,
+		tag,
+	)
+}
+
+// describeRequest returns the target, as its alias if it has one, and the
+// upstream path of a proxy request
+func describeRequest(targets *proxy.Targets, r *http.Request) (target, path string) {
+	path = r.URL.Path
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	label := func(privateApiUrl string) string {
+		if alias := targets.Alias(privateApiUrl); alias != "" {
+			return alias
+		}
+		return privateApiUrl
+	}
+
+	switch {
+	case r.Header.Get(proxy.TargetHeader) != "":
+		return r.Header.Get(proxy.TargetHeader), path
+	case r.URL.IsAbs():
+		return r.URL.Host, path
+	}
+	// Sessions are mounted below a prefix, so the scheme may not start the
+	// path
+	if _, rest, ok := strings.Cut(path, "/t/"); ok {
+		segment, upstreamPath, _ := strings.Cut(rest, "/")
+		if decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "=")); err == nil {
+			return label(string(decoded)), "/" + upstreamPath
+		}
+	}
+	if _, rest, ok := strings.Cut(path, "/api_url/"); ok {
+		if encoded, upstreamPath, ok := strings.Cut(rest, "/proxy/"); ok {
+			return label(encoded), "/" + upstreamPath
+		}
+	}
+	return "-", path
+}
+
+// reportedRequest reports whether r is proxied traffic. awsctl's own
+// endpoints, e.g. the status endpoint polled by probes, and CONNECT tunnels
+// are not reported.
+func reportedRequest(r *http.Request) bool {
+	return r.Method != http.MethodConnect && !strings.HasPrefix(r.URL.Path, "/_awsctl/") && r.URL.Path != "/proxy.pac"
+}
+
+// middleware prints a line per request once it completes
+func (c *console) middleware(next http.Handler) http.Handler {
+	if c.quiet {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !reportedRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target, path := describeRequest(c.targets, r)
+		tag := r.Header.Get(proxy.TagHeader)
+		recorder := &statusWriter{ResponseWriter: w}
+		started := time.Now()
+		next.ServeHTTP(recorder, r)
+		c.print(requestLine{
+			method:   r.Method,
+			status:   recorder.status,
+			duration: time.Since(started),
+			target:   target,
+			path:     path,
+			tag:      tag,
+		})
+	})
+}
+
+// statusWriter remembers the status written, 0 if the client went away
+// before a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	// Informational responses such as 103 Early Hints precede the final one
+	if w.status == 0 && statusCode >= 200 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsConfig controls how the proxy answers browser cross-origin requests
+type corsConfig struct {
+	allowedOrigins []string
+	allowedMethods []string
+	allowedHeaders []string
+}
+
+// splitList splits a comma-separated flag value and drops empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// allowOrigin returns the value for Access-Control-Allow-Origin, or "" if the
+// origin is not allowed
+func (c corsConfig) allowOrigin(origin string) string {
+	if slices.Contains(c.allowedOrigins, "*") {
+		return "*"
+	}
+	if slices.Contains(c.allowedOrigins, origin) {
+		return origin
+	}
+	return ""
+}
+
+// corsWriter replaces any CORS headers from the upstream with our own right
+// before the status line is written
+type corsWriter struct {
+	http.ResponseWriter
+	allowOrigin string
+	wroteHeader bool
+}
+
+func (w *corsWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		header := w.Header()
+		for key := range header {
+			if strings.HasPrefix(key, "Access-Control-") {
+				header.Del(key)
+			}
+		}
+		header.Set("Access-Control-Allow-Origin", w.allowOrigin)
+		header.Set("Access-Control-Expose-Headers", "*")
+		header.Add("Vary", "Origin")
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *corsWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// corsMiddleware answers preflight requests locally and injects CORS headers
+// on proxied responses
+func corsMiddleware(config corsConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowOrigin := config.allowOrigin(origin)
+		if allowOrigin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Preflight requests never reach the upstream
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			header := w.Header()
+			header.Set("Access-Control-Allow-Origin", allowOrigin)
+			header.Set("Access-Control-Allow-Methods", strings.Join(config.allowedMethods, ", "))
+			if slices.Contains(config.allowedHeaders, "*") {
+				// Echo the requested headers, "*" is not honoured with credentials
+				header.Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+			} else {
+				header.Set("Access-Control-Allow-Headers", strings.Join(config.allowedHeaders, ", "))
+			}
+			header.Set("Access-Control-Max-Age", "600")
+			header.Add("Vary", "Origin")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(&corsWriter{ResponseWriter: w, allowOrigin: allowOrigin}, r)
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+	"golang.org/x/term"
+)
+
+func runCreds() {
+	if len(os.Args) < 2 || (os.Args[1] != "set" && os.Args[1] != "delete") {
+		fmt.Println("Usage: awsctl creds <command> [flags] <target>")
+		fmt.Println("Commands:")
+		fmt.Println("  set       Store the credentials of a target in the OS keychain")
+		fmt.Println("  delete    Remove the credentials of a target from the OS keychain")
+		os.Exit(1)
+	}
+	command := os.Args[1]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+
+	var (
+		targetsFile = flag.String("targets", "", "Targets file mapping aliases to private API URLs (default ~/.awsctl/targets.json)")
+		user        = flag.String("user", "", "User name for a target with basic auth (prompted for if not set)")
+	)
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Printf("Usage: awsctl creds %s [flags] <target>\n", command)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	alias := flag.Arg(0)
+
+	targets, err := proxy.LoadTargets(*targetsFile)
+	if err != nil {
+		log.Fatalf("Failed to load targets: %v", err)
+	}
+	target, ok := targets.Targets[alias]
+	if !ok {
+		log.Fatalf("Failed to find target alias %q", alias)
+	}
+
+	if command == "delete" {
+		if err := proxy.DeleteTargetCredentials(alias); err != nil {
+			log.Fatalf("Failed to delete credentials: %v", err)
+		}
+		fmt.Printf("Deleted credentials of %s\n", alias)
+		return
+	}
+
+	input := bufio.NewReader(os.Stdin)
+	var secret string
+	switch target.Auth {
+	case proxy.AuthBasic:
+		if *user == "" {
+			if *user, err = prompt(input, "User: ", false); err != nil {
+				log.Fatalf("Failed to read user: %v", err)
+			}
+		}
+		if strings.Contains(*user, ":") {
+			log.Fatalf("Failed to store credentials: basic auth user names can't contain ':'")
+		}
+		password, err := prompt(input, "Password: ", true)
+		if err != nil {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		if *user == "" || password == "" {
+			log.Fatalf("Failed to store credentials: empty user or password")
+		}
+		secret = *user + ":" + password
+	case proxy.AuthBearer:
+		if secret, err = prompt(input, "Token: ", true); err != nil {
+			log.Fatalf("Failed to read token: %v", err)
+		}
+	case proxy.AuthOAuth2:
+		if secret, err = prompt(input, "Client secret: ", true); err != nil {
+			log.Fatalf("Failed to read client secret: %v", err)
+		}
+	default:
+		log.Fatalf("Failed to store credentials: target %s has no \"auth\", set it to %q, %q or %q in the targets file", alias, proxy.AuthBasic, proxy.AuthBearer, proxy.AuthOAuth2)
+	}
+	if secret == "" {
+		log.Fatalf("Failed to store credentials: empty secret")
+	}
+
+	if err := proxy.SetTargetCredentials(alias, secret); err != nil {
+		log.Fatalf("Failed to store credentials: %v", err)
+	}
+	fmt.Printf("Stored %s credentials of %s in the OS keychain\n", target.Auth, alias)
+}
+
+// prompt reads a line from the terminal, without echo if secret. Piped input
+// is read as is, so secrets can come from a password manager.
+func prompt(input *bufio.Reader, label string, secret bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := input.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, label)
+	if !secret {
+		line, err := input.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	value, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(value), err
+}
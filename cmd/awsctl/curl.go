@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// curlFailExit is curl's exit status for HTTP errors with -f
+const curlFailExit = 22
+
+// curlOptions are the curl flags awsctl curl understands, each under its
+// short and long name
+type curlOptions struct {
+	method     string
+	headers    stringsFlag
+	data       stringsFlag
+	dataBinary string
+	json       string
+	include    bool
+	head       bool
+	output     string
+	silent     bool
+	fail       bool
+	writeOut   string
+	verbose    bool
+}
+
+func registerCurlFlags() *curlOptions {
+	o := &curlOptions{}
+	for _, name := range []string{"X", "request"} {
+		flag.StringVar(&o.method, name, "", "Request method (default GET, or POST with a body)")
+	}
+	for _, name := range []string{"H", "header"} {
+		flag.Var(&o.headers, name, "Request header \"Name: value\" (repeatable)")
+	}
+	for _, name := range []string{"d", "data"} {
+		flag.Var(&o.data, name, "Form body, @file reads a file without newlines, @- stdin; several are joined with & (repeatable)")
+	}
+	flag.StringVar(&o.dataBinary, "data-binary", "", "Body sent as is, @file reads a file, @- stdin")
+	flag.StringVar(&o.json, "json", "", "JSON body, @file reads a file, @- stdin; sets Content-Type and Accept")
+	for _, name := range []string{"i", "include"} {
+		flag.BoolVar(&o.include, name, false, "Print the status line and response headers before the body")
+	}
+	for _, name := range []string{"I", "head"} {
+		flag.BoolVar(&o.head, name, false, "Send a HEAD request and print the response headers")
+	}
+	for _, name := range []string{"o", "output"} {
+		flag.StringVar(&o.output, name, "", "Write the body to this file instead of stdout")
+	}
+	for _, name := range []string{"s", "silent"} {
+		flag.BoolVar(&o.silent, name, false, "Don't print errors")
+	}
+	for _, name := range []string{"f", "fail"} {
+		flag.BoolVar(&o.fail, name, false, fmt.Sprintf("Exit with %d and print no body on status 400 and above", curlFailExit))
+	}
+	for _, name := range []string{"w", "write-out"} {
+		flag.StringVar(&o.writeOut, name, "", "Print this after the response, with %{http_code}, %{time_total}, %{size_download} and %{content_type} replaced")
+	}
+	for _, name := range []string{"v", "verbose"} {
+		flag.BoolVar(&o.verbose, name, false, "Print request and response headers to stderr")
+	}
+	return o
+}
+
+// readData returns value, or the content of the file or stdin for @file and
+// @-
+func readData(value string) ([]byte, error) {
+	name, ok := strings.CutPrefix(value, "@")
+	if !ok {
+		return []byte(value), nil
+	}
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+// body returns the request body and the Content-Type curl would send it
+// with
+func (o *curlOptions) body() ([]byte, string, error) {
+	switch {
+	case o.json != "":
+		data, err := readData(o.json)
+		return data, "application/json", err
+	case o.dataBinary != "":
+		data, err := readData(o.dataBinary)
+		return data, "application/x-www-form-urlencoded", err
+	case len(o.data) > 0:
+		var parts []string
+		for _, value := range o.data {
+			data, err := readData(value)
+			if err != nil {
+				return nil, "", err
+			}
+			parts = append(parts, strings.NewReplacer("\r", "", "\n", "").Replace(string(data)))
+		}
+		return []byte(strings.Join(parts, "&")), "application/x-www-form-urlencoded", nil
+	}
+	return nil, "", nil
+}
+
+// splitTarget splits <alias-or-url><path> into the target and the path. A
+// URL belongs to the target with the longest URL it starts with, or to its
+// scheme and host.
+func splitTarget(targets *proxy.Targets, arg string) (target, path string, err error) {
+	if !strings.Contains(arg, "://") {
+		i := strings.IndexAny(arg, "/?")
+		if i < 0 {
+			return arg, "/", nil
+		}
+		if arg[i] == '?' {
+			return arg[:i], "/" + arg[i:], nil
+		}
+		return arg[:i], arg[i:], nil
+	}
+
+	u, err := url.Parse(arg)
+	if err != nil || u.Host == "" {
+		return "", "", fmt.Errorf("failed to parse URL %q", arg)
+	}
+	base := u.Scheme + "://" + u.Host
+	for _, t := range targets.Targets {
+		known := strings.TrimSuffix(t.URL, "/")
+		if len(known) > len(base) && (arg == known || strings.HasPrefix(arg, known+"/") || strings.HasPrefix(arg, known+"?")) {
+			base = known
+		}
+	}
+	path = strings.TrimPrefix(arg, base)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return base, path, nil
+}
+
+func runCurl() {
+	local := registerLocalProxyFlags()
+	options := registerCurlFlags()
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl curl [flags] <alias-or-url><path>")
+		fmt.Println("e.g. awsctl curl -X POST -H 'Content-Type: application/json' -d @order.json billing/v1/orders")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	// Like curl, flags may follow the URL
+	flag.Parse()
+	var args []string
+	for flag.NArg() > 0 {
+		args = append(args, flag.Arg(0))
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fail := func(format string, v ...any) {
+		if !options.silent {
+			log.Printf(format, v...)
+		}
+		os.Exit(1)
+	}
+
+	body, contentType, err := options.body()
+	if err != nil {
+		fail("Failed to read body: %v", err)
+	}
+	method := options.method
+	switch {
+	case method != "":
+	case options.head:
+		method = http.MethodHead
+	case body != nil:
+		method = http.MethodPost
+	default:
+		method = http.MethodGet
+	}
+
+	ctx := context.Background()
+	targets, handler, _, err := local.server(ctx)
+	if err != nil {
+		fail("Failed to start: %v", err)
+	}
+	target, path, err := splitTarget(targets, args[0])
+	if err != nil {
+		fail("Failed to send request: %v", err)
+	}
+
+	headers := http.Header{}
+	headers.Set("Accept", "*/*")
+	if body != nil {
+		headers.Set("Content-Type", contentType)
+	}
+	if options.json != "" {
+		headers.Set("Accept", "application/json")
+	}
+	// -H replaces the defaults above, repeating it adds values
+	set := map[string]bool{}
+	for _, header := range options.headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || name == "" {
+			fail("Failed to parse header %q: expected \"Name: value\"", header)
+		}
+		// Like curl, "Name:" removes a header
+		if value = strings.TrimSpace(value); value == "" {
+			headers.Del(name)
+			continue
+		}
+		if set[http.CanonicalHeaderKey(name)] {
+			headers.Add(name, value)
+			continue
+		}
+		set[http.CanonicalHeaderKey(name)] = true
+		headers.Set(name, value)
+	}
+	request, err := localRequest(ctx, method, target, path, headers, body)
+	if err != nil {
+		fail("Failed to send request: %v", err)
+	}
+	if options.verbose {
+		fmt.Fprintf(os.Stderr, "> %s %s (target %s)\n", method, path, target)
+		writeHeaders(os.Stderr, "> ", request.Header)
+		fmt.Fprintln(os.Stderr, ">")
+	}
+
+	response, took := serveLocal(handler, request)
+	responseBody, _ := io.ReadAll(response.Body)
+
+	if options.verbose {
+		fmt.Fprintf(os.Stderr, "< %s %s\n", response.Proto, response.Status)
+		writeHeaders(os.Stderr, "< ", response.Header)
+		fmt.Fprintln(os.Stderr, "<")
+	}
+	failed := options.fail && response.StatusCode >= http.StatusBadRequest
+	if options.include || options.head {
+		fmt.Printf("%s %s\n", response.Proto, response.Status)
+		writeHeaders(os.Stdout, "", response.Header)
+		fmt.Println()
+	}
+	if !failed && !options.head {
+		if options.output != "" {
+			if err := os.WriteFile(options.output, responseBody, 0644); err != nil {
+				fail("Failed to write %s: %v", options.output, err)
+			}
+		} else {
+			os.Stdout.Write(responseBody)
+		}
+	}
+	if options.writeOut != "" {
+		fmt.Print(strings.NewReplacer(
+			"%{http_code}", strconv.Itoa(response.StatusCode),
+			"%{time_total}", fmt.Sprintf("%.6f", took.Seconds()),
+			"%{size_download}", strconv.Itoa(len(responseBody)),
+			"%{content_type}", response.Header.Get("Content-Type"),
+			`\n`, "\n",
+			`\t`, "\t",
+		).Replace(options.writeOut))
+	}
+	if failed {
+		if !options.silent {
+			log.Printf("The requested URL returned error: %d", response.StatusCode)
+		}
+		os.Exit(curlFailExit)
+	}
+}
+
+// writeHeaders writes headers sorted by name, each line prefixed
+func writeHeaders(w io.Writer, prefix string, headers http.Header) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range headers[name] {
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, name, value)
+		}
+	}
+}
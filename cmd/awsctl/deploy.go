@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// canary describes a new version receiving part of an alias's traffic
+type canary struct {
+	lambda       *lambda.Client
+	cloudwatch   *cloudwatch.Client
+	functionName string
+	alias        string
+	oldVersion   string
+	newVersion   string
+	started      time.Time
+}
+
+func runDeploy() {
+	var (
+		functionName = flag.String("function", "awsctl-proxy-ingress-lambda", "Lambda function name")
+		region       = flag.String("region", "eu-central-1", "AWS region")
+		profile      = flag.String("profile", "", "AWS profile to use")
+		packagePath  = flag.String("package", "cmd/proxy-ingress-lambda/function.zip", "Zip package built by build-lambda")
+		alias        = flag.String("alias", "live", "Alias the proxy invokes, e.g. -function awsctl-proxy-ingress-lambda:live")
+		percent      = flag.Float64("canary-percent", 10, "Percentage of the alias traffic sent to the new version while baking, 0 promotes immediately")
+		bake         = flag.Duration("bake", 10*time.Minute, "How long the canary runs before it is promoted")
+		interval     = flag.Duration("check-interval", time.Minute, "How often error rates are compared while baking")
+		margin       = flag.Float64("max-error-rate-increase", 0.01, "Roll back if the new version's error rate exceeds the old one's by more than this fraction")
+		minCalls     = flag.Float64("min-invocations", 10, "Invocations of the new version needed before its error rate is judged")
+	)
+	flag.Parse()
+
+	if *percent < 0 || *percent >= 100 {
+		log.Fatalf("Failed to deploy: -canary-percent must be at least 0 and below 100")
+	}
+	code, err := os.ReadFile(*packagePath)
+	if err != nil {
+		log.Fatalf("Failed to read package: %v", err)
+	}
+
+	// Interrupting a bake rolls back instead of leaving the split in place
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	awsCfg, err := proxy.LoadAWSConfig(ctx, *region, *profile)
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	lambdaClient := lambda.NewFromConfig(awsCfg)
+
+	newVersion, err := publishVersion(ctx, lambdaClient, *functionName, code)
+	if err != nil {
+		log.Fatalf("Failed to publish %s: %v", *functionName, err)
+	}
+	fmt.Printf("Published version %s of %s\n", newVersion, *functionName)
+
+	current, err := lambdaClient.GetAlias(ctx, &lambda.GetAliasInput{FunctionName: functionName, Name: alias})
+	var notFound *lambdatypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		// Nothing runs on the alias yet, so there's nothing to compare with
+		_, err = lambdaClient.CreateAlias(ctx, &lambda.CreateAliasInput{FunctionName: functionName, Name: alias, FunctionVersion: &newVersion})
+		if err != nil {
+			log.Fatalf("Failed to create alias %s: %v", *alias, err)
+		}
+		fmt.Printf("Created alias %s for version %s\n", *alias, newVersion)
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to get alias %s: %v", *alias, err)
+	}
+
+	c := &canary{
+		lambda:       lambdaClient,
+		cloudwatch:   cloudwatch.NewFromConfig(awsCfg),
+		functionName: *functionName,
+		alias:        *alias,
+		oldVersion:   aws.ToString(current.FunctionVersion),
+		newVersion:   newVersion,
+	}
+	if c.oldVersion == newVersion {
+		fmt.Printf("Alias %s already points to version %s\n", *alias, newVersion)
+		return
+	}
+
+	if *percent > 0 {
+		if err := c.bake(ctx, *percent, *bake, *interval, *margin, *minCalls); err != nil {
+			fmt.Printf("Rolling back %s to version %s: %v\n", *alias, c.oldVersion, err)
+			// The interrupted context must not cancel the rollback
+			if err := c.route(context.WithoutCancel(ctx), c.oldVersion); err != nil {
+				log.Fatalf("Failed to roll back alias %s: %v", *alias, err)
+			}
+			os.Exit(1)
+		}
+	}
+
+	if err := c.route(ctx, newVersion); err != nil {
+		log.Fatalf("Failed to promote version %s: %v", newVersion, err)
+	}
+	fmt.Printf("Alias %s now points to version %s\n", *alias, newVersion)
+}
+
+// publishVersion uploads code and publishes it as a new version
+func publishVersion(ctx context.Context, client *lambda.Client, functionName string, code []byte) (string, error) {
+	updated, err := client.UpdateFunctionCode(ctx, &lambda.UpdateFunctionCodeInput{FunctionName: &functionName, ZipFile: code})
+	if err != nil {
+		return "", fmt.Errorf("update code: %w", err)
+	}
+	waiter := lambda.NewFunctionUpdatedV2Waiter(client)
+	if err := waiter.Wait(ctx, &lambda.GetFunctionInput{FunctionName: &functionName}, 5*time.Minute); err != nil {
+		return "", fmt.Errorf("wait for code update: %w", err)
+	}
+
+	// The hash makes publishing fail if someone else uploaded code meanwhile
+	published, err := client.PublishVersion(ctx, &lambda.PublishVersionInput{FunctionName: &functionName, CodeSha256: updated.CodeSha256})
+	if err != nil {
+		return "", fmt.Errorf("publish version: %w", err)
+	}
+	return aws.ToString(published.Version), nil
+}
+
+// bake sends percent of the traffic to the new version for duration and
+// returns an error if its error rate regresses
+func (c *canary) bake(ctx context.Context, percent float64, duration, interval time.Duration, margin, minCalls float64) error {
+	_, err := c.lambda.UpdateAlias(ctx, &lambda.UpdateAliasInput{
+		FunctionName:    &c.functionName,
+		Name:            &c.alias,
+		FunctionVersion: &c.oldVersion,
+		RoutingConfig: &lambdatypes.AliasRoutingConfiguration{
+			AdditionalVersionWeights: map[string]float64{c.newVersion: percent / 100},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("shift traffic: %w", err)
+	}
+	c.started = time.Now()
+	fmt.Printf("Sending %g%% of %s to version %s for %s\n", percent, c.alias, c.newVersion, duration)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.After(duration)
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("interrupted")
+		case <-ticker.C:
+			if err := c.check(ctx, margin, minCalls); err != nil {
+				return err
+			}
+		case <-deadline:
+			return c.check(ctx, margin, minCalls)
+		}
+	}
+}
+
+// check compares the error rates of both versions since the canary started
+func (c *canary) check(ctx context.Context, margin, minCalls float64) error {
+	newCalls, newErrors, err := c.metrics(ctx, c.newVersion)
+	if err != nil {
+		return err
+	}
+	oldCalls, oldErrors, err := c.metrics(ctx, c.oldVersion)
+	if err != nil {
+		return err
+	}
+
+	newRate, oldRate := errorRate(newErrors, newCalls), errorRate(oldErrors, oldCalls)
+	fmt.Printf("Version %s: %.0f invocations, %.2f%% errors; version %s: %.0f invocations, %.2f%% errors\n",
+		c.newVersion, newCalls, newRate*100, c.oldVersion, oldCalls, oldRate*100)
+	if newCalls >= minCalls && newRate > oldRate+margin {
+		return fmt.Errorf("failed canary: error rate %.2f%% exceeds %.2f%% of version %s", newRate*100, oldRate*100, c.oldVersion)
+	}
+	return nil
+}
+
+// metrics returns the invocations and errors of version through the alias
+// since the canary started
+func (c *canary) metrics(ctx context.Context, version string) (invocations, errs float64, err error) {
+	now := time.Now()
+	// Sums over a single period, which must be a multiple of a minute
+	period := int32(now.Sub(c.started).Minutes()+1) * 60
+
+	sum := func(metric string) (float64, error) {
+		out, err := c.cloudwatch.GetMetricStatistics(ctx, &cloudwatch.GetMetricStatisticsInput{
+			Namespace:  aws.String("AWS/Lambda"),
+			MetricName: &metric,
+			Dimensions: []cwtypes.Dimension{
+				{Name: aws.String("FunctionName"), Value: &c.functionName},
+				{Name: aws.String("Resource"), Value: aws.String(c.functionName + ":" + c.alias)},
+				{Name: aws.String("ExecutedVersion"), Value: &version},
+			},
+			StartTime:  &c.started,
+			EndTime:    &now,
+			Period:     &period,
+			Statistics: []cwtypes.Statistic{cwtypes.StatisticSum},
+		})
+		if err != nil {
+			return 0, fmt.Errorf("get %s of version %s: %w", metric, version, err)
+		}
+		var total float64
+		for _, point := range out.Datapoints {
+			total += aws.ToFloat64(point.Sum)
+		}
+		return total, nil
+	}
+
+	if invocations, err = sum("Invocations"); err != nil {
+		return 0, 0, err
+	}
+	if errs, err = sum("Errors"); err != nil {
+		return 0, 0, err
+	}
+	return invocations, errs, nil
+}
+
+// route points the alias completely at version
+func (c *canary) route(ctx context.Context, version string) error {
+	_, err := c.lambda.UpdateAlias(ctx, &lambda.UpdateAliasInput{
+		FunctionName:    &c.functionName,
+		Name:            &c.alias,
+		FunctionVersion: &version,
+		RoutingConfig:   &lambdatypes.AliasRoutingConfiguration{AdditionalVersionWeights: map[string]float64{}},
+	})
+	if err != nil {
+		return fmt.Errorf("update alias: %w", err)
+	}
+	return nil
+}
+
+func errorRate(errs, invocations float64) float64 {
+	if invocations == 0 {
+		return 0
+	}
+	return errs / invocations
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diffResponse is a response awsctl diff compares
+type diffResponse struct {
+	status  int
+	headers http.Header
+	body    []byte
+	took    time.Duration
+}
+
+// jsonDifference is a difference between two JSON documents at a dotted path.
+// A nil side means the value is missing there.
+type jsonDifference struct {
+	path string
+	a, b any
+	inA  bool
+	inB  bool
+}
+
+// diffJSON appends the differences between a and b below path, skipping
+// ignored paths
+func diffJSON(differences []jsonDifference, path []string, a, b any, ignored [][]string) []jsonDifference {
+	for _, pattern := range ignored {
+		if matchesPath(pattern, path) {
+			return differences
+		}
+	}
+	child := func(key string) []string {
+		return append(path[:len(path):len(path)], key)
+	}
+
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(a)+len(b))
+		for key := range a {
+			keys = append(keys, key)
+		}
+		for key := range b {
+			if _, ok := a[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			valueA, inA := a[key]
+			valueB, inB := b[key]
+			if inA && inB {
+				differences = diffJSON(differences, child(key), valueA, valueB, ignored)
+			} else if !ignoredPath(child(key), ignored) {
+				differences = append(differences, jsonDifference{path: dottedPath(child(key)), a: valueA, b: valueB, inA: inA, inB: inB})
+			}
+		}
+		return differences
+	case []any:
+		b, ok := b.([]any)
+		if !ok {
+			break
+		}
+		for i := range max(len(a), len(b)) {
+			key := strconv.Itoa(i)
+			switch {
+			case i < len(a) && i < len(b):
+				differences = diffJSON(differences, child(key), a[i], b[i], ignored)
+			case ignoredPath(child(key), ignored):
+			case i < len(a):
+				differences = append(differences, jsonDifference{path: dottedPath(child(key)), a: a[i], inA: true})
+			default:
+				differences = append(differences, jsonDifference{path: dottedPath(child(key)), b: b[i], inB: true})
+			}
+		}
+		return differences
+	}
+	if !reflect.DeepEqual(a, b) {
+		differences = append(differences, jsonDifference{path: dottedPath(path), a: a, b: b, inA: true, inB: true})
+	}
+	return differences
+}
+
+// matchesPath reports whether path is at or below the dotted pattern, where
+// "*" matches any key or index like in -redact-json
+func matchesPath(pattern, path []string) bool {
+	if len(path) < len(pattern) {
+		return false
+	}
+	for i, key := range pattern {
+		if key != "*" && key != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func ignoredPath(path []string, ignored [][]string) bool {
+	for _, pattern := range ignored {
+		if matchesPath(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func dottedPath(path []string) string {
+	if len(path) == 0 {
+		return "."
+	}
+	return strings.Join(path, ".")
+}
+
+// compactJSON formats a value of a difference on one line
+func compactJSON(value any) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+func runDiff() {
+	local := registerLocalProxyFlags()
+	var (
+		method      = flag.String("X", http.MethodGet, "Request method")
+		data        = flag.String("d", "", "Request body, @file reads a file, @- stdin")
+		withHeaders = flag.Bool("headers", false, "Also compare response headers, except Date, Content-Length, Server-Timing and the ones in -ignore-header")
+		headers     stringsFlag
+		ignored     stringsFlag
+		ignoredHdrs stringsFlag
+	)
+	flag.Var(&headers, "H", "Request header \"Name: value\" (repeatable)")
+	flag.Var(&ignored, "ignore", "Dotted JSON body path not to compare, \"*\" matches any key or index, e.g. items.*.updatedAt (repeatable)")
+	flag.Var(&ignoredHdrs, "ignore-header", "Response header not to compare with -headers (repeatable)")
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl diff [flags] <alias-or-url-a> <alias-or-url-b> <path>")
+		fmt.Println("Sends the same request to both targets and prints how the responses differ,")
+		fmt.Println("structurally for JSON bodies. Exits with 1 if they differ and 2 on errors.")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 3 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	targetA, targetB, path := flag.Arg(0), flag.Arg(1), flag.Arg(2)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	fail := func(format string, v ...any) {
+		log.Printf(format, v...)
+		os.Exit(2)
+	}
+
+	var body []byte
+	if *data != "" {
+		var err error
+		if body, err = readData(*data); err != nil {
+			fail("Failed to read body: %v", err)
+		}
+	}
+	requestHeaders := http.Header{}
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || name == "" {
+			fail("Failed to parse header %q: expected \"Name: value\"", header)
+		}
+		requestHeaders.Add(name, strings.TrimSpace(value))
+	}
+	var ignoredPaths [][]string
+	for _, pattern := range ignored {
+		ignoredPaths = append(ignoredPaths, strings.Split(pattern, "."))
+	}
+
+	ctx := context.Background()
+	_, handler, _, err := local.server(ctx)
+	if err != nil {
+		fail("Failed to start: %v", err)
+	}
+
+	// Both requests run at the same time, so the targets are compared at the
+	// same moment
+	targets := []string{targetA, targetB}
+	responses := make([]diffResponse, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request, err := localRequest(ctx, strings.ToUpper(*method), target, path, requestHeaders.Clone(), body)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			response, took := serveLocal(handler, request)
+			responseBody, _ := io.ReadAll(response.Body)
+			responses[i] = diffResponse{status: response.StatusCode, headers: response.Header, body: responseBody, took: took}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			fail("Failed to send request to %s: %v", targets[i], err)
+		}
+	}
+
+	a, b := responses[0], responses[1]
+	fmt.Printf("--- %s %s (%d, %dms)\n", targetA, path, a.status, a.took.Milliseconds())
+	fmt.Printf("+++ %s %s (%d, %dms)\n", targetB, path, b.status, b.took.Milliseconds())
+	differs := false
+	if a.status != b.status {
+		fmt.Printf("~ status: %d -> %d\n", a.status, b.status)
+		differs = true
+	}
+	if *withHeaders && diffHeaders(a.headers, b.headers, ignoredHdrs) {
+		differs = true
+	}
+	if diffBodies(a, b, ignoredPaths) {
+		differs = true
+	}
+	if !differs {
+		fmt.Println("Responses are identical")
+		return
+	}
+	os.Exit(1)
+}
+
+// diffHeaders prints the headers that differ and reports whether any do
+func diffHeaders(a, b http.Header, ignored []string) bool {
+	// These differ between any two responses, or whenever the bodies do
+	skip := map[string]bool{"Date": true, "Server-Timing": true, "Content-Length": true}
+	for _, name := range ignored {
+		skip[http.CanonicalHeaderKey(name)] = true
+	}
+	names := map[string]bool{}
+	for name := range a {
+		names[name] = true
+	}
+	for name := range b {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !skip[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	differs := false
+	for _, name := range sorted {
+		valueA, inA := a[name]
+		valueB, inB := b[name]
+		switch {
+		case !inB:
+			fmt.Printf("- header %s: %s\n", name, strings.Join(valueA, ", "))
+		case !inA:
+			fmt.Printf("+ header %s: %s\n", name, strings.Join(valueB, ", "))
+		case !reflect.DeepEqual(valueA, valueB):
+			fmt.Printf("~ header %s: %s -> %s\n", name, strings.Join(valueA, ", "), strings.Join(valueB, ", "))
+		default:
+			continue
+		}
+		differs = true
+	}
+	return differs
+}
+
+// diffBodies prints how the bodies differ and reports whether they do. JSON
+// bodies are compared structurally, others byte by byte.
+func diffBodies(a, b diffResponse, ignored [][]string) bool {
+	var valueA, valueB any
+	errA := json.Unmarshal(a.body, &valueA)
+	errB := json.Unmarshal(b.body, &valueB)
+	if errA == nil && errB == nil {
+		differences := diffJSON(nil, nil, valueA, valueB, ignored)
+		for _, d := range differences {
+			switch {
+			case !d.inB:
+				fmt.Printf("- %s: %s\n", d.path, compactJSON(d.a))
+			case !d.inA:
+				fmt.Printf("+ %s: %s\n", d.path, compactJSON(d.b))
+			default:
+				fmt.Printf("~ %s: %s -> %s\n", d.path, compactJSON(d.a), compactJSON(d.b))
+			}
+		}
+		return len(differences) > 0
+	}
+
+	if bytes.Equal(a.body, b.body) {
+		return false
+	}
+	fmt.Printf("~ body: %d bytes -> %d bytes", len(a.body), len(b.body))
+	linesA := strings.Split(string(a.body), "\n")
+	linesB := strings.Split(string(b.body), "\n")
+	for i := range min(len(linesA), len(linesB)) {
+		if linesA[i] != linesB[i] {
+			fmt.Printf(", first difference in line %d", i+1)
+			break
+		}
+	}
+	fmt.Println()
+	return true
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/jkblume/awsctl/pkg/proxy"
+	"golang.org/x/term"
+)
+
+// ingressTagKey and ingressTagValue tag the ingress Lambdas deployed by the
+// Terraform module and generate-infra, awsctl discover finds them by it
+const (
+	ingressTagKey   = "awsctl-proxy"
+	ingressTagValue = "ingress"
+)
+
+// discoverTagWorkers bounds the concurrent ListTags calls per region
+const discoverTagWorkers = 8
+
+// discoveredFunction is an ingress Lambda found by awsctl discover
+type discoveredFunction struct {
+	profile string
+	region  string
+	config  lambdatypes.FunctionConfiguration
+}
+
+// parseTagFilter parses key=value,... into the tags a function must have,
+// a key without a value matches any value
+func parseTagFilter(value string) map[string]string {
+	filter := map[string]string{ingressTagKey: ingressTagValue}
+	for _, item := range splitList(value) {
+		key, val, _ := strings.Cut(item, "=")
+		filter[key] = val
+	}
+	return filter
+}
+
+// matchesTags reports whether tags has all tags of filter
+func matchesTags(tags, filter map[string]string) bool {
+	for key, value := range filter {
+		tag, ok := tags[key]
+		if !ok || (value != "" && tag != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// discoverFunctions lists the functions of an account and region whose tags
+// match filter. Lambda only returns tags per function, so they are fetched
+// concurrently.
+func discoverFunctions(ctx context.Context, profile, region, endpointURL string, filter map[string]string) ([]discoveredFunction, error) {
+	awsCfg, err := proxy.LoadAWSConfig(ctx, region, profile)
+	if err != nil {
+		return nil, err
+	}
+	client := lambda.NewFromConfig(awsCfg, func(o *lambda.Options) {
+		if endpointURL != "" {
+			o.BaseEndpoint = aws.String(endpointURL)
+		}
+	})
+
+	var configs []lambdatypes.FunctionConfiguration
+	pages := lambda.NewListFunctionsPaginator(client, &lambda.ListFunctionsInput{})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list functions: %w", err)
+		}
+		configs = append(configs, page.Functions...)
+	}
+
+	functions := make([]*discoveredFunction, len(configs))
+	errs := make([]error, len(configs))
+	workers := make(chan struct{}, discoverTagWorkers)
+	var wg sync.WaitGroup
+	for i, config := range configs {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+			tags, err := client.ListTags(ctx, &lambda.ListTagsInput{Resource: config.FunctionArn})
+			if err != nil {
+				errs[i] = fmt.Errorf("list tags of %s: %w", aws.ToString(config.FunctionName), err)
+				return
+			}
+			if matchesTags(tags.Tags, filter) {
+				functions[i] = &discoveredFunction{profile: profile, region: region, config: config}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var found []discoveredFunction
+	for i, function := range functions {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if function != nil {
+			found = append(found, *function)
+		}
+	}
+	return found, nil
+}
+
+// account returns the account ID in the ARN of f
+func (f discoveredFunction) account() string {
+	// arn:aws:lambda:<region>:<account>:function:<name>
+	parts := strings.Split(aws.ToString(f.config.FunctionArn), ":")
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[4]
+}
+
+// proxyCommand returns the awsctl proxy command line that uses f
+func (f discoveredFunction) proxyCommand() string {
+	command := fmt.Sprintf("awsctl proxy -function %s -region %s", aws.ToString(f.config.FunctionName), f.region)
+	if f.profile != "" {
+		command += " -profile " + f.profile
+	}
+	return command
+}
+
+// printFunctions writes functions as a numbered table
+func printFunctions(functions []discoveredFunction) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tFUNCTION\tACCOUNT\tREGION\tPROFILE\tVPC\tSUBNETS")
+	for i, f := range functions {
+		vpc, subnets := "-", "-"
+		if config := f.config.VpcConfig; config != nil && aws.ToString(config.VpcId) != "" {
+			vpc = aws.ToString(config.VpcId)
+			subnets = strings.Join(config.SubnetIds, ",")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", i+1, aws.ToString(f.config.FunctionName), f.account(), f.region, cmp.Or(f.profile, "-"), vpc, subnets)
+	}
+	w.Flush()
+}
+
+func runDiscover() {
+	var (
+		regions     = flag.String("regions", "eu-central-1", "Comma-separated AWS regions to search")
+		profiles    = flag.String("profiles", "", "Comma-separated AWS profiles to search, one per account (default the default credentials)")
+		tagFilter   = flag.String("tag-filter", "", "Additional tags the function must have, as key=value,... (a key alone matches any value)")
+		endpointURL = flag.String("lambda-endpoint-url", "", "Lambda API endpoint, e.g. a VPC interface endpoint or localstack")
+	)
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl discover [flags]")
+		fmt.Printf("Lists the Lambda functions tagged %s=%s and picks the one to proxy through.\n", ingressTagKey, ingressTagValue)
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	profileList := splitList(*profiles)
+	if len(profileList) == 0 {
+		profileList = []string{""}
+	}
+	filter := parseTagFilter(*tagFilter)
+
+	ctx := context.Background()
+	var functions []discoveredFunction
+	for _, profile := range profileList {
+		for _, region := range splitList(*regions) {
+			found, err := discoverFunctions(ctx, profile, region, *endpointURL, filter)
+			if err != nil {
+				log.Printf("Failed to search %s with profile %q: %v", region, profile, err)
+				continue
+			}
+			functions = append(functions, found...)
+		}
+	}
+	sort.SliceStable(functions, func(i, j int) bool {
+		return aws.ToString(functions[i].config.FunctionName) < aws.ToString(functions[j].config.FunctionName)
+	})
+
+	if len(functions) == 0 {
+		log.Fatalf("Failed to find a Lambda function tagged %s=%s matching the filter", ingressTagKey, ingressTagValue)
+	}
+	printFunctions(functions)
+
+	chosen := functions[0]
+	if len(functions) > 1 {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			fmt.Println("\nNarrow the list down with -tag-filter, or run in a terminal to pick one.")
+			return
+		}
+		input := bufio.NewReader(os.Stdin)
+		for {
+			answer, err := prompt(input, fmt.Sprintf("\nPick a function [1-%d]: ", len(functions)), false)
+			if err != nil {
+				log.Fatalf("Failed to read choice: %v", err)
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(answer))
+			if err == nil && n >= 1 && n <= len(functions) {
+				chosen = functions[n-1]
+				break
+			}
+			fmt.Fprintf(os.Stderr, "Expected a number from 1 to %d\n", len(functions))
+		}
+	}
+	fmt.Printf("\nProxy through %s with:\n  %s\n", aws.ToString(chosen.config.FunctionArn), chosen.proxyCommand())
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// Formats of awsctl targets export
+const (
+	exportPostman        = "postman"
+	exportOpenAPIOverlay = "openapi-overlay"
+)
+
+// postmanSchema is the collection format Postman and Insomnia import
+const postmanSchema = "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"
+
+// pathParameter matches the {name} parameters of OpenAPI paths
+var pathParameter = regexp.MustCompile(`\{([^}/]+)\}`)
+
+// postmanCollection is a Postman collection with a folder per target
+type postmanCollection struct {
+	Info     postmanInfo       `json:"info"`
+	Item     []postmanItem     `json:"item"`
+	Variable []postmanVariable `json:"variable"`
+}
+
+type postmanInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Schema      string `json:"schema"`
+}
+
+// postmanItem is a folder if it has items, a request otherwise
+type postmanItem struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Item        []postmanItem   `json:"item,omitempty"`
+	Request     *postmanRequest `json:"request,omitempty"`
+}
+
+type postmanRequest struct {
+	Method string          `json:"method"`
+	Header []postmanHeader `json:"header"`
+	URL    postmanURL      `json:"url"`
+	Body   *postmanBody    `json:"body,omitempty"`
+}
+
+type postmanHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type postmanURL struct {
+	Raw      string            `json:"raw"`
+	Host     []string          `json:"host"`
+	Path     []string          `json:"path,omitempty"`
+	Query    []postmanQuery    `json:"query,omitempty"`
+	Variable []postmanVariable `json:"variable,omitempty"`
+}
+
+type postmanQuery struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+type postmanBody struct {
+	Mode string `json:"mode"`
+	Raw  string `json:"raw"`
+}
+
+type postmanVariable struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Description string `json:"description,omitempty"`
+}
+
+// openAPIOverlay is an OpenAPI Overlay 1.0 document
+type openAPIOverlay struct {
+	Overlay string               `json:"overlay"`
+	Info    openAPIOverlayInfo   `json:"info"`
+	Actions []openAPIOverlayStep `json:"actions"`
+}
+
+type openAPIOverlayInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIOverlayStep struct {
+	Target      string         `json:"target"`
+	Description string         `json:"description,omitempty"`
+	Update      map[string]any `json:"update,omitempty"`
+	Remove      bool           `json:"remove,omitempty"`
+}
+
+// postmanFolder returns the folder of a target, with a request per
+// operation of its OpenAPI document or a single GET of its base URL. The
+// requests start with the {{alias}} variable holding the target's proxy URL.
+func postmanFolder(alias string, t proxy.Target) (postmanItem, error) {
+	folder := postmanItem{Name: alias, Description: t.URL}
+	if t.OpenAPI == "" {
+		folder.Item = []postmanItem{{
+			Name:    "GET /",
+			Request: &postmanRequest{Method: http.MethodGet, Header: []postmanHeader{}, URL: postmanRequestURL(alias, "/")},
+		}}
+		return folder, nil
+	}
+
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+	doc, err := loader.LoadFromFile(t.OpenAPI)
+	if err != nil {
+		return postmanItem{}, fmt.Errorf("load OpenAPI document of %s: %w", alias, err)
+	}
+	if doc.Info != nil && doc.Info.Description != "" {
+		folder.Description = doc.Info.Description
+	}
+	paths := doc.Paths.InMatchingOrder()
+	sort.Strings(paths)
+	for _, path := range paths {
+		item := doc.Paths.Value(path)
+		operations := item.Operations()
+		var methods []string
+		for method := range operations {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		for _, method := range methods {
+			operation := operations[method]
+			request := &postmanRequest{Method: method, Header: []postmanHeader{}, URL: postmanRequestURL(alias, path)}
+			for _, ref := range append(item.Parameters, operation.Parameters...) {
+				parameter := ref.Value
+				if parameter == nil {
+					continue
+				}
+				switch parameter.In {
+				case openapi3.ParameterInQuery:
+					request.URL.Query = append(request.URL.Query, postmanQuery{Key: parameter.Name, Disabled: !parameter.Required})
+				case openapi3.ParameterInHeader:
+					request.Header = append(request.Header, postmanHeader{Key: parameter.Name})
+				}
+			}
+			if operation.RequestBody != nil && operation.RequestBody.Value != nil {
+				if media := operation.RequestBody.Value.Content.Get("application/json"); media != nil {
+					request.Header = append(request.Header, postmanHeader{Key: "Content-Type", Value: "application/json"})
+					request.Body = &postmanBody{Mode: "raw", Raw: exampleJSON(media)}
+				}
+			}
+			name := operation.Summary
+			if name == "" {
+				name = operation.OperationID
+			}
+			if name == "" {
+				name = method + " " + path
+			}
+			folder.Item = append(folder.Item, postmanItem{Name: name, Description: operation.Description, Request: request})
+		}
+	}
+	return folder, nil
+}
+
+// postmanRequestURL returns the URL of path below the {{alias}} variable,
+// with OpenAPI {parameters} as Postman :variables
+func postmanRequestURL(alias, path string) postmanURL {
+	path = pathParameter.ReplaceAllString(path, ":$1")
+	u := postmanURL{
+		Raw:  "{{" + alias + "}}" + path,
+		Host: []string{"{{" + alias + "}}"},
+	}
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		u.Path = append(u.Path, segment)
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			u.Variable = append(u.Variable, postmanVariable{Key: name})
+		}
+	}
+	return u
+}
+
+// exampleJSON returns the example of a JSON request body, or an empty
+// object if the document has none
+func exampleJSON(media *openapi3.MediaType) string {
+	example := media.Example
+	if example == nil {
+		for _, named := range media.Examples {
+			if named.Value != nil {
+				example = named.Value.Value
+				break
+			}
+		}
+	}
+	if example == nil && media.Schema != nil && media.Schema.Value != nil {
+		example = media.Schema.Value.Example
+	}
+	if example == nil {
+		return "{}"
+	}
+	body, err := json.MarshalIndent(example, "", "  ")
+	if err != nil {
+		return "{}"
+	}
+	return string(body)
+}
+
+func runTargetsExport() {
+	var (
+		targetsFile = flag.String("targets", "", "Targets file to export (default ~/.awsctl/targets.json)")
+		format      = flag.String("format", exportPostman, fmt.Sprintf("Output format: %s (also imported by Insomnia) or %s", exportPostman, exportOpenAPIOverlay))
+		proxyURL    = flag.String("proxy-url", "http://localhost:8001", "URL of the local proxy, including a session's path prefix")
+		only        = flag.String("target", "", "Comma-separated aliases to export (default all); exactly one for "+exportOpenAPIOverlay)
+		output      = flag.String("o", "", "File to write to (default stdout)")
+	)
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl targets export [flags]")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	targets, err := proxy.LoadTargets(*targetsFile)
+	if err != nil {
+		log.Fatalf("Failed to load targets: %v", err)
+	}
+	aliases := splitList(*only)
+	if len(aliases) == 0 {
+		for alias := range targets.Targets {
+			aliases = append(aliases, alias)
+		}
+		sort.Strings(aliases)
+	}
+	if len(aliases) == 0 {
+		log.Fatalf("Failed to export targets: the targets file has none")
+	}
+	for _, alias := range aliases {
+		if _, ok := targets.Targets[alias]; !ok {
+			log.Fatalf("Failed to export targets: unknown target %s", alias)
+		}
+	}
+	base := strings.TrimSuffix(*proxyURL, "/")
+
+	var document any
+	switch *format {
+	case exportPostman:
+		collection := postmanCollection{
+			Info: postmanInfo{
+				Name:        "awsctl targets",
+				Description: fmt.Sprintf("Private APIs through the awsctl proxy at %s, start it with awsctl proxy", base),
+				Schema:      postmanSchema,
+			},
+		}
+		for _, alias := range aliases {
+			t := targets.Targets[alias]
+			folder, err := postmanFolder(alias, t)
+			if err != nil {
+				log.Fatalf("Failed to export targets: %v", err)
+			}
+			collection.Item = append(collection.Item, folder)
+			collection.Variable = append(collection.Variable, postmanVariable{
+				Key:         alias,
+				Value:       base + proxy.TargetPath(t.URL),
+				Description: t.URL,
+			})
+		}
+		document = collection
+	case exportOpenAPIOverlay:
+		if len(aliases) != 1 {
+			log.Fatalf("Failed to export targets: %s needs exactly one -target", exportOpenAPIOverlay)
+		}
+		t := targets.Targets[aliases[0]]
+		document = openAPIOverlay{
+			Overlay: "1.0.0",
+			Info:    openAPIOverlayInfo{Title: "awsctl proxy servers for " + aliases[0], Version: "1.0.0"},
+			Actions: []openAPIOverlayStep{
+				{Target: "$.servers", Remove: true},
+				{
+					Target:      "$",
+					Description: "Call " + t.URL + " through the local awsctl proxy",
+					Update: map[string]any{
+						"servers": []map[string]string{{"url": base + proxy.TargetPath(t.URL), "description": "awsctl proxy to " + t.URL}},
+					},
+				},
+			},
+		}
+	default:
+		log.Fatalf("Failed to export targets: unknown format %q, expected %s or %s", *format, exportPostman, exportOpenAPIOverlay)
+	}
+
+	data, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode %s: %v", *format, err)
+	}
+	data = append(data, '\n')
+	if *output == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		log.Fatalf("Failed to write %s: %v", *output, err)
+	}
+	fmt.Printf("Wrote %s with %d targets\n", *output, len(aliases))
+}
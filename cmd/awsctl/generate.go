@@ -0,0 +1,124 @@
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+)
+
+//go:embed infra/*.tmpl
+var infraTemplates embed.FS
+
+// infraFormats maps -format values to their template
+var infraFormats = map[string]string{
+	"terraform": "infra/terraform.tmpl",
+	"sam":       "infra/sam.tmpl",
+	"cdk":       "infra/cdk.tmpl",
+}
+
+// infraConfig parameterizes the infrastructure templates
+type infraConfig struct {
+	FunctionName string
+	Region       string
+	VPCID        string
+	VPCCIDR      string
+	SubnetIDs    []string
+	Package      string
+	FunctionURL  bool
+	// Architecture and Runtime are Lambda names, e.g. arm64 and
+	// provided.al2023. The CDK ones are the matching aws-lambda constants.
+	Architecture    string
+	Runtime         string
+	CDKArchitecture string
+	CDKRuntime      string
+	// ENIActions let the Lambda attach to the VPC, they can't be scoped to
+	// resources
+	ENIActions []string
+}
+
+func runGenerateInfra() {
+	var (
+		format       = flag.String("format", "terraform", "Output format: terraform, sam or cdk")
+		functionName = flag.String("function", "awsctl-proxy-ingress-lambda", "Lambda function name")
+		region       = flag.String("region", "eu-central-1", "AWS region")
+		vpcID        = flag.String("vpc-id", "", "VPC to attach the Lambda to (required)")
+		vpcCIDR      = flag.String("vpc-cidr", "", "CIDR of the VPC the Lambda may reach, required for -format sam")
+		subnetIDs    = flag.String("subnet-ids", "", "Comma-separated subnets for the Lambda (required)")
+		packagePath  = flag.String("package", "cmd/proxy-ingress-lambda/function.zip", "Path of the Lambda zip package")
+		functionURL  = flag.Bool("function-url", false, "Create an AWS_IAM authorized function URL for -transport function-url")
+		archArg      = flag.String("arch", "arm64", "Lambda architecture: arm64 (Graviton) or x86_64, must match build-lambda -arch")
+		runtime      = flag.String("runtime", "provided.al2023", fmt.Sprintf("Lambda runtime: %s", strings.Join(lambdaRuntimes, " or ")))
+		output       = flag.String("o", "", "Write to this file instead of stdout")
+	)
+	flag.Parse()
+
+	name, ok := infraFormats[*format]
+	if !ok {
+		log.Fatalf("Failed to generate infrastructure: unknown format %q, expected terraform, sam or cdk", *format)
+	}
+	if *vpcID == "" || *subnetIDs == "" {
+		log.Fatalf("Failed to generate infrastructure: -vpc-id and -subnet-ids are required")
+	}
+	if *format == "sam" && *vpcCIDR == "" {
+		log.Fatalf("Failed to generate infrastructure: -format sam requires -vpc-cidr")
+	}
+	arch, _, err := lambdaArchitecture(*archArg)
+	if err != nil {
+		log.Fatalf("Failed to generate infrastructure: %v", err)
+	}
+	if err := checkLambdaRuntime(*runtime); err != nil {
+		log.Fatalf("Failed to generate infrastructure: %v", err)
+	}
+
+	config := infraConfig{
+		FunctionName:    *functionName,
+		Region:          *region,
+		VPCID:           *vpcID,
+		VPCCIDR:         *vpcCIDR,
+		SubnetIDs:       splitList(*subnetIDs),
+		Package:         *packagePath,
+		FunctionURL:     *functionURL,
+		Architecture:    arch,
+		Runtime:         *runtime,
+		CDKArchitecture: map[string]string{"arm64": "ARM_64", "x86_64": "X86_64"}[arch],
+		CDKRuntime:      strings.ToUpper(strings.ReplaceAll(*runtime, ".", "_")),
+		ENIActions: []string{
+			"ec2:CreateNetworkInterface",
+			"ec2:DescribeNetworkInterfaces",
+			"ec2:DescribeSubnets",
+			"ec2:DeleteNetworkInterface",
+			"ec2:AssignPrivateIpAddresses",
+			"ec2:UnassignPrivateIpAddresses",
+		},
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if err := generateInfra(w, name, config); err != nil {
+		log.Fatalf("Failed to generate infrastructure: %v", err)
+	}
+}
+
+func generateInfra(w io.Writer, name string, config infraConfig) error {
+	tmpl, err := template.ParseFS(infraTemplates, name)
+	if err != nil {
+		return fmt.Errorf("parse template: %w", err)
+	}
+	if err := tmpl.Execute(w, config); err != nil {
+		return fmt.Errorf("render template: %w", err)
+	}
+	return nil
+}
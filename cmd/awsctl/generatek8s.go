@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// k8sTemplates are the templates of generate-k8s, which define the
+// deployment, sidecar-manifest and sidecar-patch documents
+var k8sTemplates = []string{"infra/k8s-common.tmpl", "infra/k8s-deployment.tmpl", "infra/k8s-sidecar.tmpl"}
+
+// k8sConfig parameterizes the Kubernetes templates
+type k8sConfig struct {
+	Name         string
+	Namespace    string
+	Image        string
+	FunctionName string
+	Region       string
+	RoleARN      string
+	Replicas     int
+	Port         int
+	// Targets is the targets file, TargetsHash its SHA-256 so pods restart
+	// when it changes
+	Targets     string
+	TargetsHash string
+	PatchFile   string
+}
+
+func runGenerateK8s() {
+	var (
+		mode         = flag.String("mode", "deployment", "What to generate: deployment for a Deployment and Service, or sidecar for a patch injecting the proxy into a workload")
+		name         = flag.String("name", "awsctl-proxy", "Name of the Deployment, Service, ServiceAccount and ConfigMap")
+		namespace    = flag.String("namespace", "default", "Namespace of the resources")
+		image        = flag.String("image", "", "Image built from the Dockerfile, e.g. with make docker_image (required)")
+		functionName = flag.String("function", "awsctl-proxy-ingress-lambda", "Lambda function name")
+		region       = flag.String("region", "eu-central-1", "AWS region")
+		roleARN      = flag.String("role-arn", "", "IAM role for IRSA, it needs lambda:InvokeFunction on the function (required)")
+		targetsFile  = flag.String("targets", "", "Targets file to put in the ConfigMap (default ~/.awsctl/targets.json)")
+		replicas     = flag.Int("replicas", 1, "Replicas of the Deployment")
+		port         = flag.Int("port", 8001, "Port of the Service")
+		patchFile    = flag.String("patch", "", "File to write the patch of -mode sidecar to (required for sidecar)")
+		output       = flag.String("o", "", "Write the manifests to this file instead of stdout")
+	)
+	flag.Parse()
+
+	if *image == "" || *roleARN == "" {
+		log.Fatalf("Failed to generate manifests: -image and -role-arn are required")
+	}
+	if *mode != "deployment" && *mode != "sidecar" {
+		log.Fatalf("Failed to generate manifests: unknown mode %q, expected deployment or sidecar", *mode)
+	}
+	if *mode == "sidecar" && *patchFile == "" {
+		log.Fatalf("Failed to generate manifests: -mode sidecar requires -patch")
+	}
+
+	targets, err := readTargetsFile(*targetsFile)
+	if err != nil {
+		log.Fatalf("Failed to generate manifests: %v", err)
+	}
+	hash := sha256.Sum256([]byte(targets))
+	config := k8sConfig{
+		Name:         *name,
+		Namespace:    *namespace,
+		Image:        *image,
+		FunctionName: *functionName,
+		Region:       *region,
+		RoleARN:      *roleARN,
+		Replicas:     *replicas,
+		Port:         *port,
+		Targets:      targets,
+		TargetsHash:  hex.EncodeToString(hash[:])[:16],
+		PatchFile:    *patchFile,
+	}
+
+	tmpl, err := template.New("k8s").Funcs(template.FuncMap{"indent": indent}).ParseFS(infraTemplates, k8sTemplates...)
+	if err != nil {
+		log.Fatalf("Failed to parse templates: %v", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if *mode == "deployment" {
+		if err := tmpl.ExecuteTemplate(w, "deployment", config); err != nil {
+			log.Fatalf("Failed to generate manifests: %v", err)
+		}
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, "sidecar-manifest", config); err != nil {
+		log.Fatalf("Failed to generate manifests: %v", err)
+	}
+	patch, err := os.Create(*patchFile)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %v", *patchFile, err)
+	}
+	defer patch.Close()
+	if err := tmpl.ExecuteTemplate(patch, "sidecar-patch", config); err != nil {
+		log.Fatalf("Failed to generate patch: %v", err)
+	}
+}
+
+// readTargetsFile returns the targets file after checking that the proxy
+// can load it, an empty one if the default file doesn't exist
+func readTargetsFile(path string) (string, error) {
+	if _, err := proxy.LoadTargets(path); err != nil {
+		return "", fmt.Errorf("load targets: %w", err)
+	}
+	if path == "" {
+		var err error
+		if path, err = proxy.DefaultTargetsPath(); err != nil {
+			return "", err
+		}
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return `{"targets": {}}`, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read targets file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\n"), nil
+}
+
+// indent prefixes every line of s with n spaces, for YAML block scalars
+func indent(n int, s string) string {
+	prefix := strings.Repeat(" ", n)
+	return prefix + strings.ReplaceAll(s, "\n", "\n"+prefix)
+}
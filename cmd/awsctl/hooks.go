@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// CEL hooks let CLI users transform or block traffic without writing Go.
+// Expressions see `request`, `response` (response hooks only) and `env`, and
+// may evaluate to:
+//   - a bool: false blocks with 403
+//   - a string: a non-empty reason blocks with 403
+//   - a map of header names to values: headers to set, "" deletes a header
+func newCELEnv() (*cel.Env, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("response", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("env", cel.MapType(cel.StringType, cel.StringType)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create CEL environment: %w", err)
+	}
+	return env, nil
+}
+
+func compileCEL(env *cel.Env, expr string) (cel.Program, error) {
+	ast, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("compile %q: %w", expr, issues.Err())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("plan %q: %w", expr, err)
+	}
+	return program, nil
+}
+
+// firstValues flattens a header map to its first values with canonical keys
+func firstValues(headers map[string][]string) map[string]string {
+	flat := make(map[string]string, len(headers))
+	for key, values := range headers {
+		if len(values) > 0 {
+			flat[http.CanonicalHeaderKey(key)] = values[0]
+		}
+	}
+	return flat
+}
+
+func environment() map[string]string {
+	vars := make(map[string]string)
+	for _, entry := range os.Environ() {
+		if key, value, ok := strings.Cut(entry, "="); ok {
+			vars[key] = value
+		}
+	}
+	return vars
+}
+
+func requestVars(request *proxy.ProxyRequest) map[string]any {
+	body, _ := base64.StdEncoding.DecodeString(request.Body)
+	return map[string]any{
+		"method":  request.Method,
+		"path":    request.Path,
+		"query":   request.Query,
+		"target":  request.PrivateApiUrl,
+		"caller":  request.Caller,
+		"headers": firstValues(request.Headers),
+		"body":    string(body),
+	}
+}
+
+func responseVars(response *proxy.ProxyResponse) map[string]any {
+	body, _ := base64.StdEncoding.DecodeString(response.Body)
+	return map[string]any{
+		"status":  int64(response.StatusCode),
+		"headers": firstValues(response.Headers),
+		"body":    string(body),
+	}
+}
+
+// celOutcome interprets a hook result as either a block reason or headers
+func celOutcome(out ref.Val, expr string) (blockReason string, headers map[string]string, err error) {
+	switch out.Type() {
+	case types.BoolType:
+		if out.Value() == false {
+			return fmt.Sprintf("Blocked by hook: %s", expr), nil, nil
+		}
+		return "", nil, nil
+	case types.StringType:
+		return out.Value().(string), nil, nil
+	case types.MapType:
+		native, err := out.ConvertToNative(reflect.TypeOf(map[string]string{}))
+		if err != nil {
+			return "", nil, fmt.Errorf("convert result of %q to headers: %w", expr, err)
+		}
+		return "", native.(map[string]string), nil
+	default:
+		return "", nil, fmt.Errorf("failed to use result of %q: expected bool, string or map, got %s", expr, out.Type())
+	}
+}
+
+// applyHeaders sets headers in place, an empty value deletes the header
+func applyHeaders(target map[string][]string, headers map[string]string) map[string][]string {
+	if target == nil {
+		target = make(map[string][]string)
+	}
+	for key, value := range headers {
+		http.Header(target).Del(key)
+		if value != "" {
+			http.Header(target).Set(key, value)
+		}
+	}
+	return target
+}
+
+func celRequestHook(program cel.Program, expr string) proxy.RequestHook {
+	vars := environment()
+	return func(ctx context.Context, request *proxy.ProxyRequest) (*proxy.ProxyResponse, error) {
+		out, _, err := program.ContextEval(ctx, map[string]any{
+			"request":  requestVars(request),
+			"response": map[string]any{},
+			"env":      vars,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("evaluate %q: %w", expr, err)
+		}
+
+		blockReason, headers, err := celOutcome(out, expr)
+		if err != nil {
+			return nil, err
+		}
+		if blockReason != "" {
+			return proxy.TextResponse(http.StatusForbidden, blockReason), nil
+		}
+		request.Headers = applyHeaders(request.Headers, headers)
+		return nil, nil
+	}
+}
+
+func celResponseHook(program cel.Program, expr string) proxy.ResponseHook {
+	vars := environment()
+	return func(ctx context.Context, request *proxy.ProxyRequest, response *proxy.ProxyResponse) error {
+		out, _, err := program.ContextEval(ctx, map[string]any{
+			"request":  requestVars(request),
+			"response": responseVars(response),
+			"env":      vars,
+		})
+		if err != nil {
+			return fmt.Errorf("evaluate %q: %w", expr, err)
+		}
+
+		blockReason, headers, err := celOutcome(out, expr)
+		if err != nil {
+			return err
+		}
+		if blockReason != "" {
+			*response = *proxy.TextResponse(http.StatusForbidden, blockReason)
+			return nil
+		}
+		response.Headers = applyHeaders(response.Headers, headers)
+		return nil
+	}
+}
+
+// registerCELHooks compiles the expressions and registers them on the server
+func registerCELHooks(server *proxy.Server, onRequest, onResponse []string) error {
+	if len(onRequest) == 0 && len(onResponse) == 0 {
+		return nil
+	}
+
+	env, err := newCELEnv()
+	if err != nil {
+		return err
+	}
+
+	for _, expr := range onRequest {
+		program, err := compileCEL(env, expr)
+		if err != nil {
+			return err
+		}
+		server.OnRequest(celRequestHook(program, expr))
+	}
+	for _, expr := range onResponse {
+		program, err := compileCEL(env, expr)
+		if err != nil {
+			return err
+		}
+		server.OnResponse(celResponseHook(program, expr))
+	}
+	return nil
+}
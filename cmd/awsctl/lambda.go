@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/jkblume/awsctl/pkg/ingress"
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// lambdaEnvVars describes the environment variables the ingress Lambda reads
+var lambdaEnvVars = map[string]string{
+	ingress.PolicySSMParameterEnv:    "SSM parameter holding the authorization policy",
+	ingress.PolicyDynamoDBTableEnv:   "DynamoDB table holding the authorization policy rules",
+	ingress.SigningKMSKeyEnv:         "KMS HMAC key envelopes must be signed with",
+	ingress.DNSServerEnv:             "DNS server for upstream host names",
+	ingress.AsyncResponseBucketEnv:   "S3 bucket for responses to asynchronous invocations",
+	ingress.MaxResponseBytesEnv:      "Largest response body returned, e.g. 5MB",
+	ingress.AllowedContentTypesEnv:   "Comma-separated media types returned, e.g. application/json,text/*",
+	ingress.ResponseLimitsEnv:        "JSON list of per-target response limits",
+	ingress.DialTimeoutEnv:           "Time to connect to upstreams, e.g. 10s",
+	ingress.TLSHandshakeTimeoutEnv:   "Time for the TLS handshake with upstreams, e.g. 10s",
+	ingress.ResponseHeaderTimeoutEnv: "Time upstreams may take to send response headers",
+	ingress.TotalTimeoutEnv:          "Time for a whole upstream call, e.g. 30s",
+	ingress.HTTP2Env:                 "false to call upstreams over HTTP/1.1 only",
+	ingress.MaxConnsPerHostEnv:       "Connections kept to one upstream host, 0 for no limit",
+	ingress.IdleConnTimeoutEnv:       "Time idle upstream connections are kept, e.g. 50s",
+	ingress.UpstreamAuthEnv:          "JSON list of targets called with NTLM or Kerberos credentials from Secrets Manager",
+	ingress.K8sClustersEnv:           "Cluster DNS servers for k8s:// targets, e.g. prod=10.0.12.10",
+	ingress.K8sClusterDomainEnv:      "Cluster domain of k8s:// targets, default cluster.local",
+	"HTTPS_PROXY":                    "Forward proxy for https upstreams",
+	"HTTP_PROXY":                     "Forward proxy for http upstreams",
+	"NO_PROXY":                       "Hosts reached without the forward proxy",
+}
+
+func lambdaUsage() {
+	fmt.Println("Usage: awsctl lambda env [flags] [show | set KEY=VALUE... | unset KEY...]")
+	fmt.Println("Flags:")
+	flag.PrintDefaults()
+}
+
+func runLambda() {
+	if len(os.Args) < 2 || (os.Args[1] != "env" && os.Args[1] != "provisioned-concurrency") {
+		fmt.Println("Usage: awsctl lambda <command>")
+		fmt.Println("Commands:")
+		fmt.Println("  env                      Show or update the ingress Lambda's environment variables")
+		fmt.Println("  provisioned-concurrency  Show or set the initialized environments of the ingress Lambda's alias")
+		os.Exit(1)
+	}
+	command := os.Args[1]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	if command == "provisioned-concurrency" {
+		runProvisionedConcurrency()
+		return
+	}
+
+	var (
+		functionName = flag.String("function", "awsctl-proxy-ingress-lambda", "Lambda function name")
+		region       = flag.String("region", "eu-central-1", "AWS region")
+		profile      = flag.String("profile", "", "AWS profile to use")
+		endpointURL  = flag.String("lambda-endpoint-url", "", "Lambda API endpoint, e.g. a VPC interface endpoint or localstack")
+		wait         = flag.Bool("wait", true, "Wait until the update is active before returning")
+		waitTimeout  = flag.Duration("wait-timeout", 2*time.Minute, "Maximum time to wait for the update")
+	)
+	flag.Usage = lambdaUsage
+	flag.Parse()
+
+	action, args := "show", flag.Args()
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+
+	ctx := context.Background()
+	awsCfg, err := proxy.LoadAWSConfig(ctx, *region, *profile)
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	client := lambda.NewFromConfig(awsCfg, func(o *lambda.Options) {
+		if *endpointURL != "" {
+			o.BaseEndpoint = aws.String(*endpointURL)
+		}
+	})
+
+	current, err := client.GetFunctionConfiguration(ctx, &lambda.GetFunctionConfigurationInput{FunctionName: functionName})
+	if err != nil {
+		log.Fatalf("Failed to get configuration of %s: %v", *functionName, err)
+	}
+	env := map[string]string{}
+	if current.Environment != nil {
+		for key, value := range current.Environment.Variables {
+			env[key] = value
+		}
+	}
+
+	switch action {
+	case "show":
+		printLambdaEnv(env)
+		return
+	case "set":
+		if len(args) == 0 {
+			log.Fatalf("Failed to set environment: expected KEY=VALUE arguments")
+		}
+		for _, arg := range args {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok || key == "" {
+				log.Fatalf("Failed to parse %q: expected KEY=VALUE", arg)
+			}
+			warnUnknownLambdaEnv(key)
+			env[key] = value
+		}
+	case "unset":
+		if len(args) == 0 {
+			log.Fatalf("Failed to unset environment: expected KEY arguments")
+		}
+		for _, key := range args {
+			warnUnknownLambdaEnv(key)
+			delete(env, key)
+		}
+	default:
+		lambdaUsage()
+		os.Exit(1)
+	}
+
+	// The revision makes the update fail instead of silently dropping a
+	// concurrent change to the configuration
+	_, err = client.UpdateFunctionConfiguration(ctx, &lambda.UpdateFunctionConfigurationInput{
+		FunctionName: functionName,
+		Environment:  &lambdatypes.Environment{Variables: env},
+		RevisionId:   current.RevisionId,
+	})
+	if err != nil {
+		log.Fatalf("Failed to update environment of %s: %v", *functionName, err)
+	}
+
+	if *wait {
+		fmt.Printf("Waiting for %s to apply the update...\n", *functionName)
+		waiter := lambda.NewFunctionUpdatedV2Waiter(client)
+		if err := waiter.Wait(ctx, &lambda.GetFunctionInput{FunctionName: functionName}, *waitTimeout); err != nil {
+			log.Fatalf("Failed to wait for the update of %s: %v", *functionName, err)
+		}
+	}
+	printLambdaEnv(env)
+}
+
+func printLambdaEnv(env map[string]string) {
+	var keys []string
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if description, ok := lambdaEnvVars[key]; ok {
+			fmt.Printf("%s=%s\t# %s\n", key, env[key], description)
+		} else {
+			fmt.Printf("%s=%s\n", key, env[key])
+		}
+	}
+}
+
+// warnUnknownLambdaEnv catches typos, the ingress ignores unknown variables
+func warnUnknownLambdaEnv(key string) {
+	if _, ok := lambdaEnvVars[key]; !ok {
+		fmt.Fprintf(os.Stderr, "Warning: %s is not read by the ingress Lambda\n", key)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// serverLimits bound how long clients may hold a connection and how large
+// their headers may be, so slow or malicious clients can't exhaust a proxy
+// that is bound to a shared interface
+type serverLimits struct {
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+}
+
+// newHTTPServer creates an http.Server for handler with the limits applied
+func newHTTPServer(handler http.Handler, limits serverLimits) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: limits.readHeaderTimeout,
+		ReadTimeout:       limits.readTimeout,
+		WriteTimeout:      limits.writeTimeout,
+		IdleTimeout:       limits.idleTimeout,
+		MaxHeaderBytes:    limits.maxHeaderBytes,
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// stringsFlag collects the values of a repeatable string flag
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// pipePrefix marks a -listen address as a Windows named pipe, e.g.
+// npipe:awsctl for \\.\pipe\awsctl
+const pipePrefix = "npipe:"
+
+// listen opens a listener for every address. TCP addresses may be IPv6
+// ("[::1]:8001") and use port 0 to let the OS pick a free port, addresses
+// starting with npipe: are named pipes.
+func listen(addrs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		var listener net.Listener
+		var err error
+		if name, ok := strings.CutPrefix(addr, pipePrefix); ok {
+			listener, err = listenPipe(pipePath(name))
+		} else {
+			listener, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// pipePath expands a bare pipe name to its path below \\.\pipe\
+func pipePath(name string) string {
+	if strings.HasPrefix(name, `\\`) {
+		return name
+	}
+	return `\\.\pipe\` + name
+}
+
+// proxyBaseAddr returns host:port of the first TCP listener for the URLs in
+// the startup output. Named pipes have no host, their clients may send any.
+func proxyBaseAddr(listeners []net.Listener) string {
+	for _, l := range listeners {
+		if _, ok := l.Addr().(*net.TCPAddr); ok {
+			return listenerHostPort(l.Addr())
+		}
+	}
+	return "localhost"
+}
+
+// listenerHostPort returns host:port under which a local client reaches the
+// listener, using localhost for wildcard addresses
+func listenerHostPort(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+	host := "localhost"
+	if !tcpAddr.IP.IsUnspecified() && tcpAddr.IP != nil {
+		host = tcpAddr.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(tcpAddr.Port))
+}
+
+// writeAddrFile writes one listener address per line, so scripts using port 0
+// can find the chosen port
+func writeAddrFile(path string, listeners []net.Listener) error {
+	var lines []string
+	for _, l := range listeners {
+		lines = append(lines, listenerHostPort(l.Addr()))
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		return fmt.Errorf("write address file: %w", err)
+	}
+	return nil
+}
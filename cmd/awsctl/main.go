@@ -1,258 +1,559 @@
 package main
 
 import (
+	"cmp"
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/jkblume/awsctl/pkg/ingress"
+	"github.com/jkblume/awsctl/pkg/proxy"
 )
 
-// ProxyRequest represents the request to send to Lambda
-type ProxyRequest struct {
-	Method        string              `json:"method"`
-	Path          string              `json:"path"`
-	Headers       map[string][]string `json:"headers"`
-	Body          string              `json:"body"`
-	Query         string              `json:"query"`
-	PrivateApiUrl string              `json:"privateApiUrl"`
-}
-
-// ProxyResponse represents the response from Lambda
-type ProxyResponse struct {
-	StatusCode int                 `json:"statusCode"`
-	Headers    map[string][]string `json:"headers"`
-	Body       string              `json:"body"`
-}
-
-type Server struct {
-	lambdaClient       *lambda.Client
-	lambdaFunctionName string
-	verbose            bool
-}
+func runProxy() {
+	// Command line flags
+	var (
+		functionName = flag.String("function", "awsctl-proxy-ingress-lambda", "Lambda function name (required)")
+		region       = flag.String("region", "eu-central-1", "AWS region")
+		profile      = flag.String("profile", "", "AWS profile to use")
+		port         = flag.Int("port", 8001, "Local proxy port")
+		verbose      = flag.Bool("verbose", false, "Also log envelopes, Lambda logs and upstream timing of every request")
+		noColor      = flag.Bool("no-color", false, "Don't color the console output, which is also off with NO_COLOR or when it isn't a terminal")
+		quiet        = flag.Bool("quiet", false, "Print no startup information and request lines, only errors")
+		transportArg = flag.String("transport", "lambda", fmt.Sprintf("How requests reach the ingress handler: %s", strings.Join(proxy.TransportNames(), ", ")))
+		endpointURL  = flag.String("lambda-endpoint-url", "", "Lambda API endpoint to invoke through, e.g. a VPC interface endpoint or localstack")
+		functionURL  = flag.String("function-url", "", "Function URL of the ingress Lambda, used by -transport function-url")
+		recordDir    = flag.String("record", "", "Record responses to this directory")
+		debugDir     = flag.String("debug-dir", "", "Write a file per request with the envelope, Lambda log tail, timing and response to this directory, named by request ID")
+		playbackDir  = flag.String("playback", "", "Serve recorded responses from this directory instead of invoking the transport")
+		cors         = flag.Bool("cors", false, "Answer CORS preflight requests locally and add CORS headers to responses")
+		corsOrigins  = flag.String("cors-origins", "*", "Comma-separated origins allowed by -cors")
+		corsMethods  = flag.String("cors-methods", "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS", "Comma-separated methods allowed by -cors")
+		corsHeaders  = flag.String("cors-headers", "*", "Comma-separated request headers allowed by -cors")
+		pacDomains   = flag.String("pac-domains", "", "Comma-separated internal domains to serve a PAC file and browser proxying for")
+		legacyPaths  = flag.Bool("legacy-paths", true, "Also serve the /api_url/<encoded-api-url>/proxy/<path> scheme")
+		targetsFile  = flag.String("targets", "", "Targets file mapping aliases to private API URLs (default ~/.awsctl/targets.json)")
+		addrFile     = flag.String("addr-file", "", "Write the actual listen addresses to this file, one per line")
+		waitReadyArg = flag.Bool("wait-ready", false, "Block until a verification invoke succeeds before reporting ready")
+		openTarget   = flag.String("open", "", "Open the browser at <alias-or-url>[/path] through the proxy once ready")
+		jsonOutput   = flag.Bool("json", false, "Print startup information as a single JSON line")
+		rewriteLinks = flag.Bool("rewrite-links", false, "Rewrite links and redirects to known private URLs into local proxy URLs")
+		compression  = flag.Bool("upstream-compression", false, "Ask upstreams for gzip for clients that don't and decompress locally, so bodies cross the tunnel compressed")
+		compressMB   = flag.Int("upstream-compression-max-mb", 256, "Largest body -upstream-compression decompresses, larger ones fail the request")
+		cacheArg     = flag.Bool("cache", false, "Cache cacheable GET responses on disk and revalidate them with ETag/Last-Modified")
+		cacheDir     = flag.String("cache-dir", "", "Directory for -cache (default ~/.awsctl/cache)")
+		cacheMaxMB   = flag.Int("cache-max-mb", 512, "Size limit of -cache, least recently used entries are evicted beyond it (0 means no limit)")
+		auditGroup   = flag.String("audit-log-group", "", "Ship an audit record of every request to this CloudWatch log group")
+		auditS3      = flag.String("audit-s3", "", "Ship an audit record of every request to this s3://bucket/prefix")
+		auditEvery   = flag.Duration("audit-interval", 30*time.Second, "How often buffered audit records are shipped")
+		headerWait   = flag.Duration("read-header-timeout", 10*time.Second, "Maximum time to read request headers")
+		readWait     = flag.Duration("read-timeout", time.Minute, "Maximum time to read a whole request including its body")
+		writeWait    = flag.Duration("write-timeout", 15*time.Minute, "Maximum time from the end of the request headers to the end of the response")
+		idleWait     = flag.Duration("idle-timeout", 2*time.Minute, "Maximum time an idle keep-alive connection stays open")
+		maxHeader    = flag.Int("max-header-bytes", 1<<20, "Maximum size of request headers in bytes")
+		errorFormat  = flag.String("error-format", proxy.ErrorFormatText, "Body format of errors generated by the proxy: text or json (application/problem+json)")
+		pprofAddr    = flag.String("pprof", "", "Serve net/http/pprof on this address, e.g. localhost:6060")
+		encryptArg   = flag.Bool("encrypt-payload", false, "Encrypt request and response bodies with a data key from -kms-key")
+		payloadKey   = flag.String("kms-key", "", "KMS key for -encrypt-payload, the Lambda needs kms:Decrypt on it")
+		signKMSKey   = flag.String("sign-kms-key", "", "KMS HMAC key to sign envelopes with, must match the Lambda's SIGNING_KMS_KEY")
+		forwardUser  = flag.Bool("forward-user", false, "Send the caller ARN from STS GetCallerIdentity upstream as X-Forwarded-User")
+		redactDefs   = flag.Bool("redact-defaults", true, "Redact well-known credential headers and token fields in recordings and verbose logs")
+		notifyArg    = flag.Bool("notify", false, "Show desktop notifications when credentials expire or the proxy fails")
+		queueSlots   = flag.Int("queue-slots", 0, "Invocations in flight per session, more wait in a fair queue (0 disables queueing)")
+		queueBy      = flag.String("queue-by", proxy.QueueByClient, "Share -queue-slots fairly per client (IP) or per target")
+		deltaMin     = flag.Int("delta-min-bytes", 64<<10, "Send the hash of remembered GET bodies of at least this size, so the Lambda can omit unchanged ones (0 disables)")
+		queueLimit   = flag.Int("queue-limit", 0, "Requests a client or target may have waiting before getting 429 (0 means no limit)")
+		batchWindow  = flag.Duration("batch-window", 0, "Wait this long for small GET, HEAD and OPTIONS requests to share an invocation (0 disables batching)")
+		asyncBucket  = flag.String("async-bucket", "", "S3 bucket the Lambda stores responses to long-running requests in (its ASYNC_RESPONSE_BUCKET), enables async invocation of them")
+		stateMachine = flag.String("state-machine", "", "Step Functions state machine ARN to run long-running requests as executions of, responses come from -async-bucket if set")
+		reliableQ    = flag.String("reliable-queue", "", "SQS queue URL requests to targets marked reliable are enqueued to, the Lambda consumes it")
+		batchMax     = flag.Int("batch-max", 10, "Requests per batch invocation, a full batch is sent without waiting for -batch-window")
+		userAgent    = flag.String("user-agent", proxy.UserAgentPreserve, "User-Agent sent upstream: preserve the client's, replace it with awsctl-proxy/<version> or append that")
+		versionHdr   = flag.Bool("version-header", false, "Send the awsctl version upstream as X-Awsctl-Version")
+		openapiMode  = flag.Bool("openapi-strict", false, "Block requests violating a target's OpenAPI document with 422 and replace violating responses with 502, instead of only reporting violations")
+		injectDelay  = flag.Duration("inject-latency", 0, "Delay every request by this long before invoking the Lambda, targets with \"chaos\" use their own")
+		injectRate   = flag.Float64("inject-error-rate", 0, "Share of requests, between 0 and 1, answered with -inject-status instead of invoking the Lambda")
+		injectStatus = flag.Int("inject-status", http.StatusServiceUnavailable, "Status of errors injected with -inject-error-rate")
+		idempotency  = flag.String("idempotency-key", "", "Send a random key in this header, e.g. "+proxy.DefaultIdempotencyHeader+", with every POST, PUT, PATCH and DELETE the client sent none for")
+		dialTimeout  = flag.Duration("upstream-dial-timeout", 0, "Time the Lambda may take to connect to the upstream, including DNS (0 keeps the Lambda's, 10s by default)")
+		tlsTimeout   = flag.Duration("upstream-tls-timeout", 0, "Time the Lambda may take for the TLS handshake with the upstream (0 keeps the Lambda's, 10s by default)")
+		hdrTimeout   = flag.Duration("upstream-header-timeout", 0, "Time the upstream may take to send response headers after the request (0 keeps the Lambda's, no limit by default)")
+		totalTimeout = flag.Duration("upstream-timeout", 0, "Time the Lambda may take for the whole upstream call including the body (0 keeps the Lambda's, 30s by default)")
+		healthEvery  = flag.Duration("health-interval", 30*time.Second, "How often upstreams of targets with \"upstreams\" are health-checked")
+		throttleArg  = flag.String("throttle", "", "Deliver response bodies to clients at most at this rate, e.g. 1Mbps, 512kbps or 2MB/s")
+		autoProvArg  = flag.Int("auto-provision", 0, "Provision this many concurrent executions of the alias in -function on start and release them on exit (0 disables)")
+		logBodyLimit = flag.Int("log-body-limit", proxy.DefaultLogBodyLimit, "Bytes of request and response bodies shown in verbose logs, JSON is pretty-printed and binary bodies are shown as a hexdump (0 omits bodies)")
+		coalesceArg  = flag.Bool("coalesce", true, "Send concurrent identical GET requests as a single invocation and give all of them its response")
+		headerDefs   = flag.Bool("header-defaults", true, "Strip awsctl control headers from requests and AWS-internal and server software headers from responses")
+		logFormat    = flag.String("log-format", "text", "Log format: text, or json for a JSON object per line, e.g. in containers; json prints startup information as JSON too")
+		drainWait    = flag.Duration("shutdown-timeout", 10*time.Second, "Time requests in flight may take to complete on SIGTERM or interrupt before the proxy exits")
+		listenAddrs  stringsFlag
+		sessionArgs  stringsFlag
+		onRequest    stringsFlag
+		onResponse   stringsFlag
+		resolverCmds stringsFlag
+		allowExprs   stringsFlag
+		redactHeader stringsFlag
+		redactJSON   stringsFlag
+		redactRegex  stringsFlag
+		queueWeights stringsFlag
+		allowReqHdr  stringsFlag
+		denyReqHdr   stringsFlag
+		allowRespHdr stringsFlag
+		denyRespHdr  stringsFlag
+	)
+	flag.Var(&listenAddrs, "listen", "Address to listen on, e.g. 127.0.0.1:8001, [::1]:0 or npipe:awsctl on Windows (repeatable, default \":<port>\")")
+	flag.Var(&sessionArgs, "session", "Additional session name:profile=...,region=...,function=...,prefix=/<name> or port=<port> (repeatable)")
+	flag.Var(&queueWeights, "queue-priority", "Share of a client IP or target alias/URL in the queue as key=weight, default 1 (repeatable)")
+	flag.Var(&onRequest, "on-request", "CEL expression run before each request, may block or set headers (repeatable)")
+	flag.Var(&onResponse, "on-response", "CEL expression run after each response, may block or set headers (repeatable)")
+	flag.Var(&allowExprs, "allow", "CEL expression a request must match to be forwarded, e.g. 'request.method == \"GET\" && target.alias in [\"billing\"]' (repeatable)")
+	flag.Var(&resolverCmds, "resolver", "Command resolving target aliases missing from the targets file, e.g. from a service catalog (repeatable)")
+
+	flag.Var(&redactHeader, "redact-header", "Header to redact in recordings and verbose logs (repeatable)")
+	flag.Var(&redactJSON, "redact-json", "Dotted JSON body path to redact, \"*\" matches any key or index (repeatable)")
+	flag.Var(&redactRegex, "redact-regex", "Regular expression to redact in header values, queries and bodies (repeatable)")
+
+	flag.Var(&allowReqHdr, "allow-request-header", "Only forward request headers matching this pattern upstream, \"*\" is a wildcard (repeatable)")
+	flag.Var(&denyReqHdr, "deny-request-header", "Don't forward request headers matching this pattern upstream (repeatable)")
+	flag.Var(&allowRespHdr, "allow-response-header", "Only pass response headers matching this pattern to clients (repeatable)")
+	flag.Var(&denyRespHdr, "deny-response-header", "Don't pass response headers matching this pattern to clients (repeatable)")
 
-func NewProxyServer(functionName, region, profile string, verbose bool) (*Server, error) {
-	ctx := context.Background()
+	flag.Parse()
 
-	// Load AWS configuration
-	var awsConfigOptions []func(*config.LoadOptions) error
+	switch *logFormat {
+	case "text":
+	case "json":
+		// The log package writes through the default slog handler from here
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+		*jsonOutput = true
+	default:
+		log.Fatalf("Failed to configure logging: unknown -log-format %q, expected text or json", *logFormat)
+	}
 
-	// Set region
-	if region != "" {
-		awsConfigOptions = append(awsConfigOptions, config.WithRegion(region))
+	if *quiet {
+		*verbose = false
 	}
 
-	// Set profile if specified
-	if profile != "" {
-		awsConfigOptions = append(awsConfigOptions, config.WithSharedConfigProfile(profile))
+	if *pprofAddr != "" {
+		go servePprof(*pprofAddr)
 	}
 
-	awsCfg, err := config.LoadDefaultConfig(ctx, awsConfigOptions...)
+	if len(listenAddrs) == 0 {
+		listenAddrs = stringsFlag{fmt.Sprintf(":%d", *port)}
+	}
+	listeners, err := listen(listenAddrs)
 	if err != nil {
-		return nil, fmt.Errorf("load AWS config: %w", err)
+		log.Fatalf("Failed to listen: %v", err)
 	}
+	if *addrFile != "" {
+		if err := writeAddrFile(*addrFile, listeners); err != nil {
+			log.Fatalf("Failed to export listen addresses: %v", err)
+		}
+	}
+	baseAddr := proxyBaseAddr(listeners)
 
-	// Create Lambda client
-	lambdaClient := lambda.NewFromConfig(awsCfg)
+	if *recordDir != "" && *playbackDir != "" {
+		log.Fatalf("Flags -record and -playback cannot be combined")
+	}
 
-	return &Server{
-		lambdaClient:       lambdaClient,
-		lambdaFunctionName: functionName,
-		verbose:            verbose,
-	}, nil
-}
+	if *encryptArg && *payloadKey == "" {
+		log.Fatalf("Flag -encrypt-payload requires -kms-key")
+	}
 
-func (s *Server) invokeLambda(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
-	// Marshal the request to JSON
-	requestJSON, err := json.Marshal(request)
+	redactor, err := proxy.NewRedactor(redactHeader, redactJSON, redactRegex, *redactDefs)
 	if err != nil {
-		return nil, fmt.Errorf("marshal request: %w", err)
+		log.Fatalf("Failed to create redactor: %v", err)
 	}
 
-	if s.verbose {
-		log.Printf("Invoking Lambda function %s with payload: %s", s.lambdaFunctionName, string(requestJSON))
+	requestHeaders, err := proxy.NewHeaderFilter(allowReqHdr, denyReqHdr, proxy.DefaultDeniedRequestHeaders, *headerDefs)
+	if err != nil {
+		log.Fatalf("Failed to create request header filter: %v", err)
 	}
-
-	// Invoke Lambda function
-	result, err := s.lambdaClient.Invoke(ctx, &lambda.InvokeInput{
-		FunctionName: &s.lambdaFunctionName,
-		Payload:      requestJSON,
-		LogType:      "Tail", // Include logs in response
-	})
-
+	responseHeaders, err := proxy.NewHeaderFilter(allowRespHdr, denyRespHdr, proxy.DefaultDeniedResponseHeaders, *headerDefs)
 	if err != nil {
-		return nil, fmt.Errorf("invoke Lambda: %w", err)
+		log.Fatalf("Failed to create response header filter: %v", err)
 	}
 
-	// Check if Lambda returned an error
-	if result.FunctionError != nil {
-		return nil, fmt.Errorf("lambda function error: %s", *result.FunctionError)
+	var throttle int64
+	if *throttleArg != "" {
+		if throttle, err = proxy.ParseBandwidth(*throttleArg); err != nil {
+			log.Fatalf("Failed to parse -throttle: %v", err)
+		}
 	}
 
-	// Parse Lambda response
-	var lambdaResp ProxyResponse
-	if err := json.Unmarshal(result.Payload, &lambdaResp); err != nil {
-		return nil, fmt.Errorf("unmarshal Lambda response: %w", err)
+	targets, err := proxy.LoadTargets(*targetsFile)
+	if err != nil {
+		log.Fatalf("Failed to load targets: %v", err)
 	}
-
-	if s.verbose && result.LogResult != nil {
-		log.Printf("Lambda logs: %s", *result.LogResult)
+	for _, command := range resolverCmds {
+		resolver, err := proxy.ExecResolver(command)
+		if err != nil {
+			log.Fatalf("Failed to configure -resolver: %v", err)
+		}
+		targets.AddResolver(resolver)
 	}
-
-	return &lambdaResp, nil
-}
-
-func (s *Server) handler(w http.ResponseWriter, r *http.Request) {
-	if s.verbose {
-		log.Printf("Received %s request to %s", r.Method, r.URL.Path)
+	// Redeliveries more than 5 minutes after signing fail the signature check
+	if *reliableQ != "" && *signKMSKey != "" {
+		log.Fatalf("Failed to configure -reliable-queue: it can't be combined with -sign-kms-key, redeliveries would be rejected")
 	}
-
-	// Get the path parameter which contains everything after /api_url/
-	path := r.PathValue("path")
-	if path == "" {
-		http.Error(w, "Missing path", http.StatusBadRequest)
-		return
+	// Invoking a reliable target directly would lose requests silently
+	for alias, target := range targets.Targets {
+		if target.Reliable && *reliableQ == "" {
+			log.Fatalf("Failed to load targets: %s is marked reliable, which needs -reliable-queue", alias)
+		}
 	}
 
-	// Split on /proxy/ to separate the encoded API URL from the actual path
-	parts := strings.Split(path, "/proxy/")
-	if len(parts) != 2 {
-		http.Error(w, "Invalid path format. Expected: /api_url/<encoded-api-url>/proxy/<path>", http.StatusBadRequest)
-		return
+	var allow *allowPolicy
+	if len(allowExprs) > 0 {
+		if allow, err = newAllowPolicy(allowExprs, targets); err != nil {
+			log.Fatalf("Failed to configure -allow: %v", err)
+		}
 	}
 
-	encodedApiUrl := parts[0]
-	apiPath := "/" + parts[1]
-
-	// Decode the API URL
-	privateApiUrl, err := url.QueryUnescape(encodedApiUrl)
+	weights, err := parseQueueWeights(queueWeights, *queueBy, targets)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to decode API URL: %v", err), http.StatusBadRequest)
-		return
+		log.Fatalf("Failed to parse -queue-priority: %v", err)
 	}
 
-	if s.verbose {
-		log.Printf("Target API URL: %s", privateApiUrl)
-		log.Printf("API Path: %s", apiPath)
+	notes := notifier{desktop: *notifyArg}
+	output := &console{targets: targets, noColor: *noColor, quiet: *quiet, json: *logFormat == "json"}
+	exporter, err := newOTLPExporter(targets)
+	if err != nil {
+		log.Fatalf("Failed to configure OpenTelemetry export: %v", err)
+	}
+	// observe reports the requests of a listener on the console and over OTLP
+	observe := func(handler http.Handler) http.Handler {
+		if exporter != nil {
+			handler = exporter.middleware(handler)
+		}
+		return output.middleware(handler)
+	}
+	transports := pipeline{
+		transport:    *transportArg,
+		endpointURL:  *endpointURL,
+		verbose:      *verbose,
+		redactor:     redactor,
+		logBodyLimit: *logBodyLimit,
+		playbackDir:  *playbackDir,
+		recordDir:    *recordDir,
+		encrypt:      *encryptArg,
+		payloadKey:   *payloadKey,
+		signKMSKey:   *signKMSKey,
+		cache:        *cacheArg,
+		cacheDir:     *cacheDir,
+		cacheMaxMB:   *cacheMaxMB,
+		auditGroup:   *auditGroup,
+		auditS3:      *auditS3,
+		auditEvery:   *auditEvery,
+		forwardUser:  *forwardUser,
+		notifier:     notes,
+		queueSlots:   *queueSlots,
+		queueBy:      *queueBy,
+		queueLimit:   *queueLimit,
+		queueWeights: weights,
+		deltaMin:     *deltaMin,
+		batchWindow:  *batchWindow,
+		batchMax:     *batchMax,
+		asyncBucket:  *asyncBucket,
+		stateMachine: *stateMachine,
+		reliableQ:    *reliableQ,
+		healthEvery:  *healthEvery,
+		coalesce:     *coalesceArg,
+		compression:  *compression,
+		compressMB:   *compressMB,
+		targets:      targets,
+	}
+	servers := serverOptions{
+		targets:         targets,
+		verbose:         *verbose,
+		forwardUser:     *forwardUser,
+		onRequest:       onRequest,
+		onResponse:      onResponse,
+		allow:           allow,
+		rewriteLinks:    *rewriteLinks,
+		errorFormat:     *errorFormat,
+		legacyPaths:     *legacyPaths,
+		asyncBucket:     *asyncBucket,
+		requestHeaders:  requestHeaders,
+		responseHeaders: responseHeaders,
+		userAgent:       *userAgent,
+		versionHeader:   *versionHdr,
+		openapiStrict:   *openapiMode,
+		throttle:        throttle,
+		idempotency:     *idempotency,
+		upstreamTimeouts: ingress.UpstreamTimeouts{
+			DialMs:           dialTimeout.Milliseconds(),
+			TLSHandshakeMs:   tlsTimeout.Milliseconds(),
+			ResponseHeaderMs: hdrTimeout.Milliseconds(),
+			TotalMs:          totalTimeout.Milliseconds(),
+		},
+		requestTimeout: *writeWait,
+		debugDir:       *debugDir,
+		redactor:       redactor,
+		chaos: proxy.ChaosConfig{
+			LatencyMs: int(injectDelay.Milliseconds()),
+			ErrorRate: *injectRate,
+			Status:    *injectStatus,
+		},
+	}
+	if *cors {
+		servers.cors = &corsConfig{
+			allowedOrigins: splitList(*corsOrigins),
+			allowedMethods: splitList(*corsMethods),
+			allowedHeaders: splitList(*corsHeaders),
+		}
 	}
 
-	// Read request body
-	bodyBytes, err := io.ReadAll(r.Body)
+	defaultSession := session{
+		profile:     *profile,
+		region:      *region,
+		function:    *functionName,
+		functionURL: *functionURL,
+	}
+	proxyTransport, caller, err := transports.newTransport(context.Background(), defaultSession)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusInternalServerError)
-		return
+		log.Fatalf("Failed to create transport: %v", err)
+	}
+	proxyServer, mux, handler, err := servers.newServer(proxyTransport, caller, "")
+	if err != nil {
+		log.Fatalf("Failed to create proxy server: %v", err)
 	}
-	defer r.Body.Close()
 
-	// Convert headers to map[string][]string
-	headers := make(map[string][]string)
-	for key, values := range r.Header {
-		headers[key] = values
+	limits := serverLimits{
+		readHeaderTimeout: *headerWait,
+		readTimeout:       *readWait,
+		writeTimeout:      *writeWait,
+		idleTimeout:       *idleWait,
+		maxHeaderBytes:    *maxHeader,
 	}
 
-	// Encode body as base64 to handle binary data
-	bodyEncoded := base64.StdEncoding.EncodeToString(bodyBytes)
+	status := &statusHandler{started: time.Now().UTC(), baseURL: "http://" + baseAddr, targets: targets}
+	status.addSession(context.Background(), defaultSession, sessionInfo{
+		URL:       "http://" + baseAddr,
+		Transport: proxy.DescribeTransport(proxyTransport),
+		Region:    *region,
+		Profile:   *profile,
+	}, proxyServer)
+
+	// Additional sessions are mounted below their prefix on the default
+	// listeners or served on a port of their own
+	serveErrors := make(chan error, len(listeners)+len(sessionArgs))
+	var httpServers []*http.Server
+	var sessions []sessionInfo
+	provisioned := []session{defaultSession}
+	prefixed := map[string]http.Handler{}
+	for _, arg := range sessionArgs {
+		s, err := parseSession(arg, defaultSession)
+		if err != nil {
+			log.Fatalf("Failed to configure session: %v", err)
+		}
+		provisioned = append(provisioned, s)
+		transport, caller, err := transports.newTransport(context.Background(), s)
+		if err != nil {
+			log.Fatalf("Failed to create transport of session %s: %v", s.name, err)
+		}
+		sessionServer, _, sessionHandler, err := servers.newServer(transport, caller, s.prefix)
+		if err != nil {
+			log.Fatalf("Failed to create proxy server of session %s: %v", s.name, err)
+		}
 
-	// Prepare proxy request
-	proxyReq := ProxyRequest{
-		Method:        r.Method,
-		Path:          apiPath,
-		Headers:       headers,
-		Body:          bodyEncoded,
-		Query:         r.URL.RawQuery,
-		PrivateApiUrl: privateApiUrl,
+		info := sessionInfo{Name: s.name, Transport: proxy.DescribeTransport(transport), Region: s.region, Profile: s.profile}
+		if s.port != 0 {
+			sessionListeners, err := listen([]string{fmt.Sprintf(":%d", s.port)})
+			if err != nil {
+				log.Fatalf("Failed to listen for session %s: %v", s.name, err)
+			}
+			sessionServer := newHTTPServer(notes.recoverPanics(observe(sessionHandler)), limits)
+			httpServers = append(httpServers, sessionServer)
+			go func() {
+				serveErrors <- sessionServer.Serve(sessionListeners[0])
+			}()
+			info.URL = fmt.Sprintf("http://%s", listenerHostPort(sessionListeners[0].Addr()))
+		} else {
+			if _, ok := prefixed[s.prefix]; ok {
+				log.Fatalf("Failed to configure session %s: prefix %s is used twice", s.name, s.prefix)
+			}
+			prefixed[s.prefix] = sessionHandler
+			info.URL = fmt.Sprintf("http://%s%s", baseAddr, s.prefix)
+		}
+		sessions = append(sessions, info)
+		status.addSession(context.Background(), s, info, sessionServer)
 	}
-
-	// Invoke Lambda function
-	ctx := r.Context()
-	lambdaResp, err := s.invokeLambda(ctx, proxyReq)
-	if err != nil {
-		log.Printf("Lambda invocation error: %v", err)
-		http.Error(w, fmt.Sprintf("Lambda invocation failed: %v", err), http.StatusBadGateway)
-		return
+	if len(prefixed) > 0 {
+		handler = mountSessions(prefixed, handler)
 	}
 
-	// Set response headers
-	for key, values := range lambdaResp.Headers {
-		for _, value := range values {
-			w.Header().Add(key, value)
+	var browser *browserProxy
+	if *pacDomains != "" {
+		dir, err := proxy.StateDir()
+		if err != nil {
+			log.Fatalf("Failed to locate awsctl directory: %v", err)
+		}
+		domains := splitList(*pacDomains)
+		ca, err := loadOrCreateCA(dir, domains)
+		if err != nil {
+			log.Fatalf("Failed to load local CA: %v", err)
 		}
+		browser = &browserProxy{
+			server:    proxyServer,
+			domains:   domains,
+			ca:        ca,
+			proxyAddr: baseAddr,
+			limits:    limits,
+		}
+		mux.HandleFunc("GET /proxy.pac", browser.pacHandler)
+		handler = browser.middleware(handler)
+		status.pacURL = fmt.Sprintf("http://%s/proxy.pac", baseAddr)
+	}
+	for _, listener := range listeners {
+		status.listen = append(status.listen, listenerHostPort(listener.Addr()))
 	}
+	mux.Handle("GET "+statusPath, status)
 
-	// Write status code
-	w.WriteHeader(lambdaResp.StatusCode)
+	server := newHTTPServer(notes.recoverPanics(observe(handler)), limits)
+	httpServers = append(httpServers, server)
 
-	// Decode base64 response body
-	responseBody, err := base64.StdEncoding.DecodeString(lambdaResp.Body)
-	if err != nil {
-		log.Printf("Failed to decode base64 response: %v", err)
-		responseBody = []byte(lambdaResp.Body)
+	for _, listener := range listeners {
+		go func() {
+			serveErrors <- server.Serve(listener)
+		}()
 	}
 
-	if _, err := w.Write(responseBody); err != nil {
-		log.Printf("Failed to write response: %v", err)
+	info := startupInfo{
+		Transport: proxy.DescribeTransport(proxyTransport),
+		Region:    *region,
+		Profile:   *profile,
+		Usage:     fmt.Sprintf("http://%s/t/<base64url-internal-api-url>/<path>", baseAddr),
+		Sessions:  sessions,
 	}
-
-	if s.verbose {
-		log.Printf("Response: %d", lambdaResp.StatusCode)
+	for _, listener := range listeners {
+		info.Listen = append(info.Listen, listenerHostPort(listener.Addr()))
 	}
-}
-
-func runProxy() {
-	// Command line flags
-	var (
-		functionName = flag.String("function", "awsctl-proxy-ingress-lambda", "Lambda function name (required)")
-		region       = flag.String("region", "eu-central-1", "AWS region")
-		profile      = flag.String("profile", "", "AWS profile to use")
-		port         = flag.Int("port", 8001, "Local proxy port")
-		verbose      = flag.Bool("verbose", true, "Enable verbose logging")
-	)
-
-	flag.Parse()
-
-	// Create proxy server
-	proxy, err := NewProxyServer(*functionName, *region, *profile, *verbose)
-	if err != nil {
-		log.Fatalf("Failed to create proxy server: %v", err)
+	if *legacyPaths {
+		info.LegacyUsage = fmt.Sprintf("http://%s/api_url/<url-encoded-internal-api-url>/proxy/<path>", baseAddr)
+	}
+	if browser != nil {
+		info.PacURL = fmt.Sprintf("http://%s/proxy.pac", baseAddr)
+		info.CACertificate = browser.ca.certPath
 	}
 
-	// Create HTTP server with path parameters
-	mux := http.NewServeMux()
+	// Playback serves recordings only, a probe would never find one
+	if *waitReadyArg && *playbackDir == "" {
+		if err := waitReady(context.Background(), proxyTransport, 2*time.Minute); err != nil {
+			log.Fatalf("Proxy did not become ready: %v", err)
+		}
+		info.Ready = true
+	}
 
-	mux.HandleFunc("/api_url/{path...}", proxy.handler)
+	if *jsonOutput {
+		printStartupJSON(info)
+	} else {
+		output.startup(info)
+	}
 
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", *port),
-		Handler: mux,
+	if *openTarget != "" {
+		openURL, err := targetProxyURL(baseAddr, targets, *openTarget)
+		if err != nil {
+			log.Fatalf("Failed to build URL to open: %v", err)
+		}
+		if err := openBrowser(openURL); err != nil {
+			log.Printf("Failed to open browser: %v", err)
+		}
 	}
 
-	fmt.Println(fmt.Sprintf("Starting to serve on http://localhost:%d", *port))
-	fmt.Println(fmt.Sprintf("Proxying requests to lambda function: %s", proxy.lambdaFunctionName))
-	fmt.Println(fmt.Sprintf("AWS Region: %s", *region))
-	if *profile != "" {
-		fmt.Println(fmt.Sprintf("AWS Profile: %s", *profile))
+	// Provision last, so a failed start leaves no environments behind
+	release := func() {}
+	if *autoProvArg > 0 {
+		if *transportArg == "local" || *playbackDir != "" {
+			log.Fatalf("Failed to provision concurrency: -transport local and -playback invoke no Lambda")
+		}
+		release, err = autoProvision(context.Background(), provisioned, int32(*autoProvArg), *endpointURL)
+		if err != nil {
+			log.Fatalf("Failed to provision concurrency: %v", err)
+		}
 	}
-	fmt.Println(fmt.Sprintf("Usage: http://localhost:%d/api_url/<url-encoded-internal-api-url>/proxy/<path>", *port))
 
-	if err := server.ListenAndServe(); err != nil {
+	// Without a handler a proxy running as PID 1 in a container would ignore
+	// SIGTERM until the runtime kills it
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErrors:
+		notes.notify(fmt.Sprintf("Proxy stopped: %v", err))
+		release()
 		log.Fatalf("Server failed: %v", err)
+	case sig := <-interrupts:
+		// A second signal exits right away
+		signal.Stop(interrupts)
+		log.Printf("Received %s, waiting up to %s for requests in flight", sig, *drainWait)
+		if err := shutdown(httpServers, *drainWait); err != nil {
+			log.Printf("Failed to complete requests in flight: %v", err)
+		}
+		if exporter != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), otlpDefaultTimeout)
+			if err := exporter.shutdown(ctx); err != nil {
+				log.Printf("Failed to export over OTLP: %v", err)
+			}
+			cancel()
+		}
+		release()
 	}
 }
 
+// shutdown stops the servers from accepting connections and waits for their
+// requests in flight, at most for timeout
+func shutdown(servers []*http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			errs <- server.Shutdown(ctx)
+		}()
+	}
+	var err error
+	for range servers {
+		err = cmp.Or(err, <-errs)
+	}
+	return err
+}
+
+// usage prints the commands of awsctl
+func usage() {
+	fmt.Println("Commands:")
+	fmt.Println("  proxy           Start the local proxy server")
+	fmt.Println("  discover        Find the ingress Lambdas tagged awsctl-proxy=ingress")
+	fmt.Println("  lambda          Manage the ingress Lambda's environment and provisioned concurrency")
+	fmt.Println("  generate-infra  Print Terraform, SAM or CDK code for the ingress Lambda")
+	fmt.Println("  generate-k8s    Print Kubernetes manifests running the proxy in a cluster")
+	fmt.Println("  build-lambda    Cross-compile and zip the ingress Lambda")
+	fmt.Println("  deploy          Publish the ingress Lambda as a canary behind an alias")
+	fmt.Println("  cache           Show or purge the response cache of -cache")
+	fmt.Println("  self-update     Replace awsctl with the latest verified release")
+	fmt.Println("  status          Show the outcome of a fire-and-forget request")
+	fmt.Println("  creds           Store target credentials in the OS keychain")
+	fmt.Println("  targets         Discover private APIs and add them to the targets file")
+	fmt.Println("  check           Test connectivity to a host from inside the VPC")
+	fmt.Println("  repl            Send ad-hoc requests to targets interactively")
+	fmt.Println("  curl            Send a single request to a target, with curl's flags")
+	fmt.Println("  batch           Send requests read as NDJSON from stdin, write responses as NDJSON")
+	fmt.Println("  diff            Send a request to two targets and compare the responses")
+	fmt.Println("  monitor         Run checks against targets periodically and export the results")
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println("Usage: awsctl <command>")
-		fmt.Println("Commands:")
-		fmt.Println("  proxy    Start the local proxy server")
+		usage()
 		os.Exit(1)
 	}
 
@@ -264,10 +565,43 @@ func main() {
 	switch command {
 	case "proxy":
 		runProxy()
+	case "discover":
+		runDiscover()
+	case "lambda":
+		runLambda()
+	case "generate-infra":
+		runGenerateInfra()
+	case "generate-k8s":
+		runGenerateK8s()
+	case "build-lambda":
+		runBuildLambda()
+	case "deploy":
+		runDeploy()
+	case "cache":
+		runCache()
+	case "self-update":
+		runSelfUpdate()
+	case "status":
+		runStatus()
+	case "creds":
+		runCreds()
+	case "targets":
+		runTargets()
+	case "check":
+		runCheck()
+	case "repl":
+		runRepl()
+	case "curl":
+		runCurl()
+	case "batch":
+		runBatch()
+	case "diff":
+		runDiff()
+	case "monitor":
+		runMonitor()
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
-		fmt.Println("Available commands:")
-		fmt.Println("  proxy    Start the local proxy server")
+		usage()
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// defaultCheckInterval and defaultCheckTimeout apply to checks whose spec
+// sets neither
+const (
+	defaultCheckInterval = time.Minute
+	defaultCheckTimeout  = 30 * time.Second
+)
+
+// monitorSpec is the checks file of awsctl monitor
+type monitorSpec struct {
+	// Interval and Timeout are the defaults of the checks
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Checks   []checkSpec   `yaml:"checks"`
+}
+
+// checkSpec is a request run periodically and the assertions on its response
+type checkSpec struct {
+	Name     string            `yaml:"name"`
+	Target   string            `yaml:"target"`
+	Method   string            `yaml:"method"`
+	Path     string            `yaml:"path"`
+	Headers  map[string]string `yaml:"headers"`
+	Body     string            `yaml:"body"`
+	Interval time.Duration     `yaml:"interval"`
+	Timeout  time.Duration     `yaml:"timeout"`
+	Expect   checkExpectation  `yaml:"expect"`
+}
+
+// checkExpectation are the assertions of a check. Without a status any 2xx
+// passes.
+type checkExpectation struct {
+	Status     []int           `yaml:"status"`
+	MaxLatency time.Duration   `yaml:"maxLatency"`
+	JSON       []jsonAssertion `yaml:"json"`
+}
+
+// jsonAssertion checks the value at a dotted path of a JSON body, where
+// numbers index arrays, e.g. invoices.0.id
+type jsonAssertion struct {
+	Path    string `yaml:"path"`
+	Exists  *bool  `yaml:"exists"`
+	Equals  any    `yaml:"equals"`
+	Matches string `yaml:"matches"`
+	// matches compiled
+	pattern *regexp.Regexp
+}
+
+// UnmarshalYAML accepts a single status as well as a list
+func (e *checkExpectation) UnmarshalYAML(node *yaml.Node) error {
+	var raw struct {
+		Status     yaml.Node       `yaml:"status"`
+		MaxLatency time.Duration   `yaml:"maxLatency"`
+		JSON       []jsonAssertion `yaml:"json"`
+	}
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	e.MaxLatency, e.JSON = raw.MaxLatency, raw.JSON
+	switch raw.Status.Kind {
+	case 0:
+	case yaml.SequenceNode:
+		return raw.Status.Decode(&e.Status)
+	default:
+		var status int
+		if err := raw.Status.Decode(&status); err != nil {
+			return err
+		}
+		e.Status = []int{status}
+	}
+	return nil
+}
+
+// loadMonitorSpec reads and validates a checks file
+func loadMonitorSpec(path string) (*monitorSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read spec: %w", err)
+	}
+	var spec monitorSpec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("parse spec: %w", err)
+	}
+	if len(spec.Checks) == 0 {
+		return nil, fmt.Errorf("failed to load %s: no checks", path)
+	}
+	names := map[string]bool{}
+	for i := range spec.Checks {
+		check := &spec.Checks[i]
+		if check.Target == "" {
+			return nil, fmt.Errorf("failed to load check %d: missing target", i+1)
+		}
+		check.Method = cmp.Or(strings.ToUpper(check.Method), http.MethodGet)
+		if !strings.HasPrefix(check.Path, "/") {
+			check.Path = "/" + check.Path
+		}
+		if check.Name == "" {
+			check.Name = check.Target + check.Path
+		}
+		if names[check.Name] {
+			return nil, fmt.Errorf("failed to load check %s: name is used twice", check.Name)
+		}
+		names[check.Name] = true
+		check.Interval = cmp.Or(check.Interval, spec.Interval, defaultCheckInterval)
+		check.Timeout = cmp.Or(check.Timeout, spec.Timeout, defaultCheckTimeout)
+		for j := range check.Expect.JSON {
+			assertion := &check.Expect.JSON[j]
+			if assertion.Matches == "" {
+				continue
+			}
+			if assertion.pattern, err = regexp.Compile(assertion.Matches); err != nil {
+				return nil, fmt.Errorf("compile pattern of check %s: %w", check.Name, err)
+			}
+		}
+	}
+	return &spec, nil
+}
+
+// checkResult is the outcome of a run of a check
+type checkResult struct {
+	status  int
+	latency time.Duration
+	// failure says why the check failed, empty if it passed
+	failure string
+	at      time.Time
+}
+
+// run sends the check's request through handler and evaluates the
+// assertions
+func (c checkSpec) run(ctx context.Context, handler http.Handler) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	result := checkResult{at: time.Now()}
+
+	headers := http.Header{}
+	for name, value := range c.Headers {
+		headers.Set(name, value)
+	}
+	var body []byte
+	if c.Body != "" {
+		body = []byte(c.Body)
+	}
+	request, err := localRequest(ctx, c.Method, c.Target, c.Path, headers, body)
+	if err != nil {
+		result.failure = err.Error()
+		return result
+	}
+	response, took := serveLocal(handler, request)
+	result.latency = took
+	if ctx.Err() != nil {
+		result.failure = fmt.Sprintf("timed out after %s", c.Timeout)
+		return result
+	}
+	result.status = response.StatusCode
+	responseBody, _ := io.ReadAll(response.Body)
+
+	var failures []string
+	expected := "2xx"
+	if len(c.Expect.Status) > 0 {
+		expected = joinStatuses(c.Expect.Status)
+	}
+	if (len(c.Expect.Status) == 0 && response.StatusCode/100 != 2) || (len(c.Expect.Status) > 0 && !slices.Contains(c.Expect.Status, response.StatusCode)) {
+		failures = append(failures, fmt.Sprintf("status %d%s, expected %s", response.StatusCode, bodySnippet(responseBody), expected))
+	}
+	if c.Expect.MaxLatency > 0 && took > c.Expect.MaxLatency {
+		failures = append(failures, fmt.Sprintf("latency %dms, expected at most %dms", took.Milliseconds(), c.Expect.MaxLatency.Milliseconds()))
+	}
+	if len(c.Expect.JSON) > 0 {
+		var document any
+		if err := json.Unmarshal(responseBody, &document); err != nil {
+			failures = append(failures, fmt.Sprintf("body is not JSON: %v", err))
+		} else {
+			for _, assertion := range c.Expect.JSON {
+				if failure := assertion.check(document); failure != "" {
+					failures = append(failures, failure)
+				}
+			}
+		}
+	}
+	result.failure = strings.Join(failures, "; ")
+	return result
+}
+
+// bodySnippet returns the start of the first line of a text body in
+// parentheses, for failure messages, e.g. the error of a 502
+func bodySnippet(body []byte) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(string(body)), "\n")
+	if line == "" || !utf8.ValidString(line) {
+		return ""
+	}
+	if len(line) > 120 {
+		line = line[:120] + "..."
+	}
+	return " (" + line + ")"
+}
+
+func joinStatuses(statuses []int) string {
+	parts := make([]string, len(statuses))
+	for i, status := range statuses {
+		parts[i] = strconv.Itoa(status)
+	}
+	return strings.Join(parts, " or ")
+}
+
+// lookupJSON returns the value at a dotted path of document
+func lookupJSON(document any, path string) (any, bool) {
+	if path == "" || path == "." {
+		return document, true
+	}
+	node := document
+	for _, key := range strings.Split(path, ".") {
+		switch n := node.(type) {
+		case map[string]any:
+			value, ok := n[key]
+			if !ok {
+				return nil, false
+			}
+			node = value
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, false
+			}
+			node = n[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// check returns why document violates the assertion, empty if it doesn't
+func (a jsonAssertion) check(document any) string {
+	value, found := lookupJSON(document, a.Path)
+	if a.Exists != nil && found != *a.Exists {
+		if found {
+			return fmt.Sprintf("%s exists, expected it not to", a.Path)
+		}
+		return fmt.Sprintf("%s is missing", a.Path)
+	}
+	if a.Equals == nil && a.pattern == nil {
+		return ""
+	}
+	if !found {
+		return fmt.Sprintf("%s is missing", a.Path)
+	}
+	if a.Equals != nil && !jsonEqual(value, a.Equals) {
+		return fmt.Sprintf("%s is %s, expected %s", a.Path, compactJSON(value), compactJSON(a.Equals))
+	}
+	if a.pattern != nil {
+		text, ok := value.(string)
+		if !ok {
+			text = compactJSON(value)
+		}
+		if !a.pattern.MatchString(text) {
+			return fmt.Sprintf("%s is %s, expected it to match %s", a.Path, compactJSON(value), a.Matches)
+		}
+	}
+	return ""
+}
+
+// jsonEqual compares a decoded JSON value with a value from the spec, whose
+// numbers YAML decodes as ints
+func jsonEqual(value, expected any) bool {
+	data, err := json.Marshal(expected)
+	if err != nil {
+		return false
+	}
+	var normalized any
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(value, normalized)
+}
+
+// monitor runs the checks and keeps their latest results and run counts
+type monitor struct {
+	spec    *monitorSpec
+	handler http.Handler
+	output  *console
+
+	mu      sync.Mutex
+	latest  map[string]checkResult
+	passed  map[string]int64
+	failed  map[string]int64
+	printMu sync.Mutex
+}
+
+// runCheck runs a check once, records and prints the result and reports
+// whether it passed
+func (m *monitor) runCheck(ctx context.Context, check checkSpec) bool {
+	result := check.run(ctx, m.handler)
+	// A run cut short by an interrupt says nothing about the target
+	if ctx.Err() != nil {
+		return false
+	}
+
+	m.mu.Lock()
+	m.latest[check.Name] = result
+	if result.failure == "" {
+		m.passed[check.Name]++
+	} else {
+		m.failed[check.Name]++
+	}
+	m.mu.Unlock()
+
+	out := os.Stdout
+	m.printMu.Lock()
+	defer m.printMu.Unlock()
+	timestamp := m.output.style(out, styleDim, result.at.Format(time.TimeOnly))
+	if result.failure == "" {
+		fmt.Fprintf(out, "%s %s %s %d %dms\n", timestamp, m.output.style(out, styleGreen, "PASS"), check.Name, result.status, result.latency.Milliseconds())
+		return true
+	}
+	fmt.Fprintf(out, "%s %s %s: %s\n", timestamp, m.output.style(out, styleRed, "FAIL"), check.Name, result.failure)
+	return false
+}
+
+// failing returns the names of the checks whose latest run failed
+func (m *monitor) failing() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name, result := range m.latest {
+		if result.failure != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServeHTTP writes the results in the Prometheus text format
+func (m *monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric := func(name, kind, help string, values func(check checkSpec, result checkResult) []string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, check := range m.spec.Checks {
+			result, ok := m.latest[check.Name]
+			if !ok {
+				continue
+			}
+			for _, line := range values(check, result) {
+				fmt.Fprintf(w, "%s%s\n", name, line)
+			}
+		}
+	}
+	label := func(check checkSpec) string {
+		return fmt.Sprintf("check=%q,target=%q", check.Name, check.Target)
+	}
+
+	metric("awsctl_check_up", "gauge", "Whether the latest run of the check passed.", func(check checkSpec, result checkResult) []string {
+		up := 0
+		if result.failure == "" {
+			up = 1
+		}
+		return []string{fmt.Sprintf("{%s} %d", label(check), up)}
+	})
+	metric("awsctl_check_status", "gauge", "HTTP status of the latest run of the check, 0 if it got no response.", func(check checkSpec, result checkResult) []string {
+		return []string{fmt.Sprintf("{%s} %d", label(check), result.status)}
+	})
+	metric("awsctl_check_latency_seconds", "gauge", "Latency of the latest run of the check.", func(check checkSpec, result checkResult) []string {
+		return []string{fmt.Sprintf("{%s} %g", label(check), result.latency.Seconds())}
+	})
+	metric("awsctl_check_last_run_timestamp_seconds", "gauge", "Time of the latest run of the check.", func(check checkSpec, result checkResult) []string {
+		return []string{fmt.Sprintf("{%s} %d", label(check), result.at.Unix())}
+	})
+	metric("awsctl_check_runs_total", "counter", "Runs of the check by result.", func(check checkSpec, result checkResult) []string {
+		return []string{
+			fmt.Sprintf("{%s,result=\"pass\"} %d", label(check), m.passed[check.Name]),
+			fmt.Sprintf("{%s,result=\"fail\"} %d", label(check), m.failed[check.Name]),
+		}
+	})
+}
+
+func runMonitor() {
+	local := registerLocalProxyFlags()
+	var (
+		specFile = flag.String("spec", "checks.yaml", "Checks file")
+		once     = flag.Bool("once", false, "Run every check once and exit, with status 1 if any failed, e.g. in CI")
+		addr     = flag.String("listen", "", "Serve the results as Prometheus metrics on this address at /metrics, e.g. localhost:9464")
+		noColor  = flag.Bool("no-color", false, "Don't color the output, which is also off with NO_COLOR or when it isn't a terminal")
+	)
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl monitor [flags]")
+		fmt.Println("Runs the requests of the checks file periodically and evaluates their assertions.")
+		fmt.Println("Until interrupted, or once with -once; the exit status is 1 if the latest run of")
+		fmt.Println("any check failed and 2 if the checks can't run.")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	spec, err := loadMonitorSpec(*specFile)
+	if err != nil {
+		log.Printf("Failed to load checks: %v", err)
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	_, handler, _, err := local.server(ctx)
+	if err != nil {
+		log.Printf("Failed to start: %v", err)
+		os.Exit(2)
+	}
+
+	m := &monitor{
+		spec:    spec,
+		handler: handler,
+		output:  &console{noColor: *noColor},
+		latest:  map[string]checkResult{},
+		passed:  map[string]int64{},
+		failed:  map[string]int64{},
+	}
+	if *addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", m)
+		server := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				log.Printf("Failed to serve metrics: %v", err)
+				os.Exit(2)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for _, check := range spec.Checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.runCheck(ctx, check)
+			if *once {
+				return
+			}
+			ticker := time.NewTicker(check.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					m.runCheck(ctx, check)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failing := m.failing(); len(failing) > 0 {
+		log.Printf("Failed checks: %s", strings.Join(failing, ", "))
+		os.Exit(1)
+	}
+}
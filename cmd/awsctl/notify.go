@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// windowsToast shows a toast as PowerShell, which Windows lets post
+// notifications without registering an app. Title and message come from the
+// environment so they need no escaping.
+const windowsToast = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$toast = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $toast.GetElementsByTagName('text')
+$text.Item(0).AppendChild($toast.CreateTextNode($env:AWSCTL_NOTIFY_TITLE)) > $null
+$text.Item(1).AppendChild($toast.CreateTextNode($env:AWSCTL_NOTIFY_MESSAGE)) > $null
+$app = '{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe'
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($app).Show([Windows.UI.Notifications.ToastNotification]::new($toast))`
+
+// notifier reports proxy state changes in the log and, with -notify, as
+// desktop notifications, so they're noticed when the proxy runs in the
+// background
+type notifier struct {
+	desktop bool
+}
+
+func (n notifier) notify(message string) {
+	log.Print(message)
+	if !n.desktop {
+		return
+	}
+	if err := desktopNotification("awsctl proxy", message); err != nil {
+		log.Printf("Failed to show notification: %v", err)
+	}
+}
+
+// recoverPanics notifies about requests that crash the handler. The panic is
+// passed on, so net/http still logs it and aborts the connection.
+func (n notifier) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err != http.ErrAbortHandler {
+					n.notify(fmt.Sprintf("Proxy crashed serving %s %s: %v", r.Method, r.URL.Path, err))
+				}
+				panic(err)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// desktopNotification shows a notification with the tools each OS ships:
+// osascript on macOS, PowerShell on Windows and notify-send elsewhere
+func desktopNotification(title, message string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript",
+			"-e", "on run argv",
+			"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+			"-e", "end run",
+			title, message)
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", windowsToast)
+		cmd.Env = append(os.Environ(), "AWSCTL_NOTIFY_TITLE="+title, "AWSCTL_NOTIFY_MESSAGE="+message)
+	default:
+		cmd = exec.Command("notify-send", "--app-name", "awsctl", title, message)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %s: %w", cmd.Path, err)
+	}
+	go cmd.Wait()
+	return nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// otlpProtocol is the only OTLP protocol the exporter speaks. Collectors
+// accept it on the same port as http/protobuf, 4318 by default.
+const otlpProtocol = "http/json"
+
+// OTLP enum values, see the opentelemetry-proto definitions
+const (
+	otlpSpanKindServer   = 2
+	otlpStatusError      = 2
+	otlpSeverityInfo     = 9
+	otlpSeverityWarn     = 13
+	otlpSeverityError    = 17
+	otlpScopeName        = "awsctl-proxy"
+	otlpDefaultService   = "awsctl-proxy"
+	otlpDefaultDelay     = 5 * time.Second
+	otlpDefaultTimeout   = 10 * time.Second
+	otlpDefaultQueueSize = 2048
+	otlpDefaultBatchSize = 512
+)
+
+// otlpSignal is where the records of a signal, traces or logs, are sent
+type otlpSignal struct {
+	url     string
+	headers http.Header
+}
+
+// otlpExporter sends a span and a log record per proxied request to an
+// OpenTelemetry collector over OTLP/HTTP with JSON encoding. Records are
+// batched like the SDK's batch processors do and dropped when the collector
+// can't keep up.
+type otlpExporter struct {
+	targets  *proxy.Targets
+	traces   *otlpSignal
+	logs     *otlpSignal
+	resource map[string]any
+	scope    map[string]any
+	client   *http.Client
+	delay    time.Duration
+	maxQueue int
+	maxBatch int
+
+	mu      sync.Mutex
+	spans   []map[string]any
+	records []map[string]any
+	dropped int
+	flush   chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newOTLPExporter configures an exporter from the standard OTEL_* variables.
+// It returns nil unless an OTLP endpoint is set.
+func newOTLPExporter(targets *proxy.Targets) (*otlpExporter, error) {
+	if disabled, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); disabled {
+		return nil, nil
+	}
+	traces, err := otlpSignalConfig("TRACES", "/v1/traces")
+	if err != nil {
+		return nil, err
+	}
+	logs, err := otlpSignalConfig("LOGS", "/v1/logs")
+	if err != nil {
+		return nil, err
+	}
+	if traces == nil && logs == nil {
+		return nil, nil
+	}
+
+	serviceName := otlpDefaultService
+	resource := map[string]string{}
+	for _, pair := range splitList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES")) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("failed to parse OTEL_RESOURCE_ATTRIBUTES: %q is not key=value", pair)
+		}
+		if value, err = url.PathUnescape(strings.TrimSpace(value)); err != nil {
+			return nil, fmt.Errorf("parse OTEL_RESOURCE_ATTRIBUTES: %w", err)
+		}
+		resource[strings.TrimSpace(key)] = value
+	}
+	if name, ok := resource["service.name"]; ok {
+		serviceName = name
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		serviceName = name
+	}
+	resource["service.name"] = serviceName
+	if _, ok := resource["service.version"]; !ok {
+		resource["service.version"] = version
+	}
+	attributes := otlpAttributes{}
+	for key, value := range resource {
+		attributes.add(key, value)
+	}
+
+	e := &otlpExporter{
+		targets:  targets,
+		traces:   traces,
+		logs:     logs,
+		resource: map[string]any{"attributes": attributes},
+		scope:    map[string]any{"name": otlpScopeName, "version": version},
+		delay:    otlpDurationEnv("OTEL_BSP_SCHEDULE_DELAY", otlpDefaultDelay),
+		maxQueue: otlpIntEnv("OTEL_BSP_MAX_QUEUE_SIZE", otlpDefaultQueueSize),
+		maxBatch: otlpIntEnv("OTEL_BSP_MAX_EXPORT_BATCH_SIZE", otlpDefaultBatchSize),
+		client:   &http.Client{Timeout: otlpDurationEnv("OTEL_EXPORTER_OTLP_TIMEOUT", otlpDefaultTimeout)},
+		flush:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// otlpSignalConfig returns the endpoint and headers of a signal, nil if its
+// exporter is none or no endpoint is set
+func otlpSignalConfig(signal, path string) (*otlpSignal, error) {
+	if exporter := os.Getenv("OTEL_" + signal + "_EXPORTER"); exporter != "" && exporter != "otlp" {
+		if exporter == "none" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to use OTEL_%s_EXPORTER %q, expected otlp or none", signal, exporter)
+	}
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_" + signal + "_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && protocol != otlpProtocol {
+		return nil, fmt.Errorf("failed to use protocol %q, only %s is supported", protocol, otlpProtocol)
+	}
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_" + signal + "_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + path
+	}
+	if u, err := url.Parse(endpoint); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("failed to parse OTLP endpoint %q", endpoint)
+	}
+
+	headers := http.Header{}
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_" + signal + "_HEADERS"} {
+		for _, pair := range splitList(os.Getenv(name)) {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("failed to parse %s: %q is not key=value", name, pair)
+			}
+			value, err := url.PathUnescape(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: %w", name, err)
+			}
+			headers.Set(strings.TrimSpace(key), value)
+		}
+	}
+	headers.Set("Content-Type", "application/json")
+	return &otlpSignal{url: endpoint, headers: headers}, nil
+}
+
+// otlpDurationEnv reads a duration in milliseconds, as the OTEL_* variables
+// specify them
+func otlpDurationEnv(name string, fallback time.Duration) time.Duration {
+	ms, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || ms <= 0 {
+		return fallback
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func otlpIntEnv(name string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
+
+// otlpAttributes is a list of OTLP key-value attributes in JSON encoding
+type otlpAttributes []map[string]any
+
+func (a *otlpAttributes) add(key string, value any) {
+	var encoded map[string]any
+	switch value := value.(type) {
+	case int:
+		// int64 values are strings in OTLP/JSON
+		encoded = map[string]any{"intValue": strconv.Itoa(value)}
+	default:
+		encoded = map[string]any{"stringValue": fmt.Sprint(value)}
+	}
+	*a = append(*a, map[string]any{"key": key, "value": encoded})
+}
+
+// traceContext returns the trace ID and parent span ID of a W3C traceparent
+// header, or a new trace ID if it is missing or invalid
+func traceContext(traceparent string) (traceID, parentID, flags string) {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 && len(parts[3]) == 2 &&
+		isHex(parts[1]) && isHex(parts[2]) && parts[1] != strings.Repeat("0", 32) {
+		return parts[1], parts[2], parts[3]
+	}
+	return randomHex(16), "", "01"
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// middleware records a span and a log record per request. With traces
+// exported the upstream gets a traceparent naming the proxy's span, so its
+// spans nest below it.
+func (e *otlpExporter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !reportedRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target, path := describeRequest(e.targets, r)
+		tag := r.Header.Get(proxy.TagHeader)
+		traceID, parentID, flags := traceContext(r.Header.Get("Traceparent"))
+		spanID := randomHex(8)
+		if e.traces != nil {
+			r.Header.Set("Traceparent", fmt.Sprintf("00-%s-%s-%s", traceID, spanID, flags))
+		}
+
+		recorder := &statusWriter{ResponseWriter: w}
+		started := time.Now()
+		next.ServeHTTP(recorder, r)
+		ended := time.Now()
+
+		attributes := otlpAttributes{}
+		attributes.add("http.request.method", r.Method)
+		attributes.add("url.path", path)
+		attributes.add("awsctl.target", target)
+		attributes.add("client.address", r.RemoteAddr)
+		if recorder.status != 0 {
+			attributes.add("http.response.status_code", recorder.status)
+		}
+		if tag != "" {
+			attributes.add("awsctl.tag", tag)
+		}
+
+		span := map[string]any{
+			"traceId":           traceID,
+			"spanId":            spanID,
+			"name":              r.Method + " " + target,
+			"kind":              otlpSpanKindServer,
+			"startTimeUnixNano": strconv.FormatInt(started.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(ended.UnixNano(), 10),
+			"attributes":        attributes,
+		}
+		if parentID != "" {
+			span["parentSpanId"] = parentID
+		}
+		severity, severityText := otlpSeverityInfo, "INFO"
+		switch {
+		case recorder.status == 0 || recorder.status >= http.StatusInternalServerError:
+			span["status"] = map[string]any{"code": otlpStatusError}
+			severity, severityText = otlpSeverityError, "ERROR"
+		case recorder.status >= http.StatusBadRequest:
+			severity, severityText = otlpSeverityWarn, "WARN"
+		}
+		record := map[string]any{
+			"timeUnixNano":         strconv.FormatInt(ended.UnixNano(), 10),
+			"observedTimeUnixNano": strconv.FormatInt(ended.UnixNano(), 10),
+			"severityNumber":       severity,
+			"severityText":         severityText,
+			"body":                 map[string]any{"stringValue": fmt.Sprintf("%s %s %s %d %dms", r.Method, target, path, recorder.status, ended.Sub(started).Milliseconds())},
+			"attributes":           attributes,
+			"traceId":              traceID,
+			"spanId":               spanID,
+		}
+		e.add(span, record)
+	})
+}
+
+// add queues the records of a request, dropping them if the queue is full
+func (e *otlpExporter) add(span, record map[string]any) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if max(len(e.spans), len(e.records)) >= e.maxQueue {
+		e.dropped++
+		return
+	}
+	if e.traces != nil {
+		e.spans = append(e.spans, span)
+	}
+	if e.logs != nil {
+		e.records = append(e.records, record)
+	}
+	if len(e.spans) >= e.maxBatch || len(e.records) >= e.maxBatch {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run exports the queued records every schedule delay or once a batch is
+// full, until shutdown
+func (e *otlpExporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(e.delay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			e.export()
+			return
+		case <-ticker.C:
+		case <-e.flush:
+		}
+		e.export()
+	}
+}
+
+// export sends the queued records in batches of at most maxBatch
+func (e *otlpExporter) export() {
+	for {
+		e.mu.Lock()
+		spans := e.spans[:min(len(e.spans), e.maxBatch)]
+		records := e.records[:min(len(e.records), e.maxBatch)]
+		e.spans = e.spans[len(spans):]
+		e.records = e.records[len(records):]
+		dropped := e.dropped
+		e.dropped = 0
+		e.mu.Unlock()
+
+		if dropped > 0 {
+			log.Printf("Failed to export %d requests over OTLP: queue full", dropped)
+		}
+		if len(spans) == 0 && len(records) == 0 {
+			return
+		}
+		if len(spans) > 0 {
+			e.send(e.traces, map[string]any{"resourceSpans": []any{map[string]any{
+				"resource":   e.resource,
+				"scopeSpans": []any{map[string]any{"scope": e.scope, "spans": spans}},
+			}}})
+		}
+		if len(records) > 0 {
+			e.send(e.logs, map[string]any{"resourceLogs": []any{map[string]any{
+				"resource":  e.resource,
+				"scopeLogs": []any{map[string]any{"scope": e.scope, "logRecords": records}},
+			}}})
+		}
+	}
+}
+
+// send posts a request to the collector. Failed batches are dropped, like
+// the SDK's exporters do after their retries.
+func (e *otlpExporter) send(signal *otlpSignal, payload any) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to marshal OTLP payload: %v", err)
+		return
+	}
+	request, err := http.NewRequest(http.MethodPost, signal.url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to export over OTLP: %v", err)
+		return
+	}
+	request.Header = signal.headers.Clone()
+	response, err := e.client.Do(request)
+	if err != nil {
+		log.Printf("Failed to export over OTLP: %v", err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		log.Printf("Failed to export over OTLP: %s answered %d: %s", signal.url, response.StatusCode, bytes.TrimSpace(message))
+	}
+}
+
+// shutdown exports the queued records, waiting at most until ctx is done
+func (e *otlpExporter) shutdown(ctx context.Context) error {
+	close(e.done)
+	select {
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("export queued records: %w", ctx.Err())
+	}
+}
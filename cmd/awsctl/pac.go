@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// browserProxy lets a browser use awsctl as its HTTP proxy for selected
+// internal domains. The generated PAC file routes only those domains to us,
+// plain HTTP arrives in absolute form and HTTPS arrives as CONNECT, which is
+// terminated with a certificate from the local CA.
+type browserProxy struct {
+	server    *proxy.Server
+	domains   []string
+	ca        *certificateAuthority
+	proxyAddr string
+	limits    serverLimits
+}
+
+// matches reports whether host (without port) belongs to one of the domains
+func (b *browserProxy) matches(host string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range b.domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *browserProxy) pacHandler(w http.ResponseWriter, r *http.Request) {
+	var conditions []string
+	for _, domain := range b.domains {
+		domain = strings.TrimPrefix(domain, ".")
+		conditions = append(conditions, fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", domain, "."+domain))
+	}
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprintf(w, "function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(w, "  if (%s) {\n", strings.Join(conditions, " ||\n      "))
+	fmt.Fprintf(w, "    return \"PROXY %s\";\n", b.proxyAddr)
+	fmt.Fprintf(w, "  }\n")
+	fmt.Fprintf(w, "  return \"DIRECT\";\n")
+	fmt.Fprintf(w, "}\n")
+}
+
+// middleware intercepts proxy-style requests before they reach the mux
+func (b *browserProxy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodConnect:
+			b.handleConnect(w, r)
+		case r.URL.IsAbs():
+			b.handleAbsolute(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// handleAbsolute forwards a plain HTTP proxy request such as
+// "GET http://internal.example/path"
+func (b *browserProxy) handleAbsolute(w http.ResponseWriter, r *http.Request) {
+	if !b.matches(r.URL.Hostname()) {
+		b.server.WriteError(w, http.StatusForbidden, proxy.ErrorCodeNotProxied, fmt.Sprintf("Host %s is not proxied by awsctl", r.URL.Hostname()), "")
+		return
+	}
+
+	r.Header.Del("Proxy-Connection")
+	r.Header.Del("Proxy-Authorization")
+
+	b.server.Forward(w, r, fmt.Sprintf("%s://%s", r.URL.Scheme, r.URL.Host), r.URL.EscapedPath())
+}
+
+// handleConnect terminates the TLS tunnel locally and serves the inner HTTP
+// requests through the transport
+func (b *browserProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		b.server.WriteError(w, http.StatusBadRequest, proxy.ErrorCodeBadRequest, fmt.Sprintf("Invalid CONNECT target: %v", err), "")
+		return
+	}
+	if !b.matches(host) {
+		b.server.WriteError(w, http.StatusForbidden, proxy.ErrorCodeNotProxied, fmt.Sprintf("Host %s is not proxied by awsctl", host), "")
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		b.server.WriteError(w, http.StatusInternalServerError, proxy.ErrorCodeInternal, "CONNECT is not supported by this connection", "")
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Failed to hijack CONNECT connection: %v", err)
+		return
+	}
+
+	// The tunnel applies its own limits per request, the deadlines of the
+	// CONNECT request must not cut it off
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to reset CONNECT deadlines: %v", err)
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		log.Printf("Failed to answer CONNECT: %v", err)
+		conn.Close()
+		return
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				if !b.matches(hello.ServerName) {
+					return nil, fmt.Errorf("failed to issue certificate: %s is not proxied by awsctl", hello.ServerName)
+				}
+				return b.ca.leafFor(hello.ServerName)
+			}
+			return b.ca.leafFor(host)
+		},
+	})
+
+	target := "https://" + host
+	if port != "443" {
+		target = "https://" + net.JoinHostPort(host, port)
+	}
+
+	tunnel := newHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.server.Forward(w, r, target, r.URL.EscapedPath())
+	}), b.limits)
+	if err := tunnel.Serve(newSingleConnListener(tlsConn)); err != nil && err != net.ErrClosed {
+		log.Printf("CONNECT tunnel to %s failed: %v", r.Host, err)
+	}
+}
+
+// singleConnListener serves exactly one connection and returns net.ErrClosed
+// once that connection is closed
+type singleConnListener struct {
+	conn     net.Conn
+	accepted bool
+	mu       sync.Mutex
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, done: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if !l.accepted {
+		l.accepted = true
+		l.mu.Unlock()
+		return &notifyCloseConn{Conn: l.conn, listener: l}, nil
+	}
+	l.mu.Unlock()
+
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// notifyCloseConn closes its listener once the connection is closed
+type notifyCloseConn struct {
+	net.Conn
+	listener *singleConnListener
+}
+
+func (c *notifyCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.listener.Close()
+	return err
+}
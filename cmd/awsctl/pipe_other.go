@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenPipe(path string) (net.Listener, error) {
+	return nil, fmt.Errorf("failed to listen on %s: named pipes are only available on Windows", path)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// provisionedPollInterval is how often the status of provisioned
+// concurrency is checked while it is allocated
+const provisionedPollInterval = 5 * time.Second
+
+// provisionedReadyTimeout bounds the wait for -auto-provision environments
+const provisionedReadyTimeout = 15 * time.Minute
+
+// provisionedConcurrency manages the provisioned concurrency of an alias or
+// version of a function, $LATEST can't have any
+type provisionedConcurrency struct {
+	client    *lambda.Client
+	function  string
+	qualifier string
+}
+
+// newProvisionedConcurrency manages the provisioned concurrency of function,
+// which may be qualified like awsctl-proxy-ingress-lambda:live or a
+// qualified ARN. An unqualified function uses qualifier.
+func newProvisionedConcurrency(ctx context.Context, function, qualifier, region, profile, endpointURL string) (*provisionedConcurrency, error) {
+	name, ownQualifier := splitQualifier(function)
+	qualifier = cmp.Or(ownQualifier, qualifier)
+	if qualifier == "" || qualifier == "$LATEST" {
+		return nil, fmt.Errorf("failed to find the alias or version of %s: provisioned concurrency needs one, e.g. %s:live", function, name)
+	}
+	awsCfg, err := proxy.LoadAWSConfig(ctx, region, profile)
+	if err != nil {
+		return nil, err
+	}
+	client := lambda.NewFromConfig(awsCfg, func(o *lambda.Options) {
+		if endpointURL != "" {
+			o.BaseEndpoint = aws.String(endpointURL)
+		}
+	})
+	return &provisionedConcurrency{client: client, function: name, qualifier: qualifier}, nil
+}
+
+func (p *provisionedConcurrency) String() string {
+	return p.function + ":" + p.qualifier
+}
+
+// get returns the current configuration, nil if there is none
+func (p *provisionedConcurrency) get(ctx context.Context) (*lambda.GetProvisionedConcurrencyConfigOutput, error) {
+	config, err := p.client.GetProvisionedConcurrencyConfig(ctx, &lambda.GetProvisionedConcurrencyConfigInput{
+		FunctionName: &p.function,
+		Qualifier:    &p.qualifier,
+	})
+	var notFound *lambdatypes.ProvisionedConcurrencyConfigNotFoundException
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get provisioned concurrency of %s: %w", p, err)
+	}
+	return config, nil
+}
+
+// set requests executions initialized environments, 0 removes the
+// configuration
+func (p *provisionedConcurrency) set(ctx context.Context, executions int32) error {
+	if executions == 0 {
+		_, err := p.client.DeleteProvisionedConcurrencyConfig(ctx, &lambda.DeleteProvisionedConcurrencyConfigInput{
+			FunctionName: &p.function,
+			Qualifier:    &p.qualifier,
+		})
+		var notFound *lambdatypes.ResourceNotFoundException
+		if err != nil && !errors.As(err, &notFound) {
+			return fmt.Errorf("remove provisioned concurrency of %s: %w", p, err)
+		}
+		return nil
+	}
+	_, err := p.client.PutProvisionedConcurrencyConfig(ctx, &lambda.PutProvisionedConcurrencyConfigInput{
+		FunctionName:                    &p.function,
+		Qualifier:                       &p.qualifier,
+		ProvisionedConcurrentExecutions: &executions,
+	})
+	if err != nil {
+		return fmt.Errorf("set provisioned concurrency of %s: %w", p, err)
+	}
+	return nil
+}
+
+// waitReady waits until the requested environments are initialized, Lambda
+// takes a few minutes for that
+func (p *provisionedConcurrency) waitReady(ctx context.Context, timeout time.Duration) (*lambda.GetProvisionedConcurrencyConfigOutput, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		config, err := p.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			return nil, fmt.Errorf("failed to wait for provisioned concurrency of %s: it was removed", p)
+		}
+		switch config.Status {
+		case lambdatypes.ProvisionedConcurrencyStatusEnumReady:
+			return config, nil
+		case lambdatypes.ProvisionedConcurrencyStatusEnumFailed:
+			return nil, fmt.Errorf("failed to provision concurrency of %s: %s", p, aws.ToString(config.StatusReason))
+		}
+		select {
+		case <-time.After(provisionedPollInterval):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("wait for provisioned concurrency of %s: %w", p, ctx.Err())
+		}
+	}
+}
+
+// splitQualifier splits the alias or version off a function name or ARN
+func splitQualifier(function string) (name, qualifier string) {
+	// arn:aws:lambda:<region>:<account>:function:<name>[:<qualifier>]
+	if strings.HasPrefix(function, "arn:") {
+		parts := strings.Split(function, ":")
+		if len(parts) == 8 {
+			return strings.Join(parts[:7], ":"), parts[7]
+		}
+		return function, ""
+	}
+	name, qualifier, _ = strings.Cut(function, ":")
+	return name, qualifier
+}
+
+// formatProvisioned describes config in one line
+func formatProvisioned(p *provisionedConcurrency, config *lambda.GetProvisionedConcurrencyConfigOutput) string {
+	if config == nil {
+		return fmt.Sprintf("%s: no provisioned concurrency", p)
+	}
+	line := fmt.Sprintf("%s: %d requested, %d allocated, %d available (%s)", p,
+		aws.ToInt32(config.RequestedProvisionedConcurrentExecutions),
+		aws.ToInt32(config.AllocatedProvisionedConcurrentExecutions),
+		aws.ToInt32(config.AvailableProvisionedConcurrentExecutions),
+		config.Status)
+	if reason := aws.ToString(config.StatusReason); reason != "" {
+		line += ": " + reason
+	}
+	return line
+}
+
+func provisionedUsage() {
+	fmt.Println("Usage: awsctl lambda provisioned-concurrency [flags] [status | set N]")
+	fmt.Println("Flags:")
+	flag.PrintDefaults()
+}
+
+// runProvisionedConcurrency shows or sets the provisioned concurrency of the
+// ingress Lambda's alias
+func runProvisionedConcurrency() {
+	var (
+		functionName = flag.String("function", "awsctl-proxy-ingress-lambda", "Lambda function name, may be qualified like awsctl-proxy-ingress-lambda:live")
+		qualifier    = flag.String("qualifier", "live", "Alias or version of an unqualified -function")
+		region       = flag.String("region", "eu-central-1", "AWS region")
+		profile      = flag.String("profile", "", "AWS profile to use")
+		endpointURL  = flag.String("lambda-endpoint-url", "", "Lambda API endpoint, e.g. a VPC interface endpoint or localstack")
+		wait         = flag.Bool("wait", true, "Wait until the environments are initialized before returning")
+		waitTimeout  = flag.Duration("wait-timeout", 10*time.Minute, "Maximum time to wait for the environments")
+	)
+	flag.Usage = provisionedUsage
+	flag.Parse()
+
+	action, args := "status", flag.Args()
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+
+	ctx := context.Background()
+	provisioned, err := newProvisionedConcurrency(ctx, *functionName, *qualifier, *region, *profile, *endpointURL)
+	if err != nil {
+		log.Fatalf("Failed to set up provisioned concurrency: %v", err)
+	}
+
+	switch action {
+	case "status":
+	case "set":
+		if len(args) != 1 {
+			log.Fatalf("Failed to set provisioned concurrency: expected the number of executions")
+		}
+		executions, err := strconv.ParseInt(args[0], 10, 32)
+		if err != nil || executions < 0 {
+			log.Fatalf("Failed to parse %q: expected a number of executions, 0 removes provisioned concurrency", args[0])
+		}
+		if err := provisioned.set(ctx, int32(executions)); err != nil {
+			log.Fatalf("Failed to set provisioned concurrency: %v", err)
+		}
+		if *wait && executions > 0 {
+			fmt.Printf("Waiting for %d initialized environments of %s...\n", executions, provisioned)
+			config, err := provisioned.waitReady(ctx, *waitTimeout)
+			if err != nil {
+				log.Fatalf("Failed to wait for provisioned concurrency: %v", err)
+			}
+			fmt.Println(formatProvisioned(provisioned, config))
+			return
+		}
+	default:
+		provisionedUsage()
+		os.Exit(1)
+	}
+
+	config, err := provisioned.get(ctx)
+	if err != nil {
+		log.Fatalf("Failed to get provisioned concurrency: %v", err)
+	}
+	fmt.Println(formatProvisioned(provisioned, config))
+}
+
+// autoProvision provisions executions of the functions of sessions, which
+// must be qualified, and returns a function that restores the provisioned
+// concurrency they had before
+func autoProvision(ctx context.Context, sessions []session, executions int32, endpointURL string) (func(), error) {
+	var restores []func()
+	restore := func() {
+		for _, r := range restores {
+			r()
+		}
+	}
+	seen := map[session]bool{}
+	for _, s := range sessions {
+		key := session{function: s.function, region: s.region, profile: s.profile}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		provisioned, err := newProvisionedConcurrency(ctx, s.function, "", s.region, s.profile, endpointURL)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		previous, err := provisioned.get(ctx)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		if err := provisioned.set(ctx, executions); err != nil {
+			restore()
+			return nil, err
+		}
+		log.Printf("Provisioning %d concurrent executions of %s", executions, provisioned)
+		go func() {
+			if _, err := provisioned.waitReady(ctx, provisionedReadyTimeout); err != nil {
+				log.Printf("Provisioned concurrency is not ready: %v", err)
+				return
+			}
+			log.Printf("Provisioned concurrency of %s is ready", provisioned)
+		}()
+
+		restores = append(restores, func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+			defer cancel()
+			executions := int32(0)
+			if previous != nil {
+				executions = aws.ToInt32(previous.RequestedProvisionedConcurrentExecutions)
+			}
+			if err := provisioned.set(ctx, executions); err != nil {
+				log.Printf("Failed to release provisioned concurrency: %v", err)
+				return
+			}
+			if executions > 0 {
+				log.Printf("Restored provisioned concurrency of %s to %d", provisioned, executions)
+			} else {
+				log.Printf("Released provisioned concurrency of %s", provisioned)
+			}
+		})
+	}
+	return restore, nil
+}
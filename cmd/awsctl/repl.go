@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// replHistoryLimit is how many lines of the history file are loaded
+const replHistoryLimit = 500
+
+// replMethods are the request commands of awsctl repl
+var replMethods = map[string]string{
+	"get":     http.MethodGet,
+	"head":    http.MethodHead,
+	"post":    http.MethodPost,
+	"put":     http.MethodPut,
+	"patch":   http.MethodPatch,
+	"delete":  http.MethodDelete,
+	"options": http.MethodOptions,
+}
+
+const replHelp = `Requests:
+  <method> <target> <path> [Name:value ...] [body]
+      method is get, head, post, put, patch, delete or options, target an
+      alias from the targets file or a URL. A body starts with { or [ and
+      runs to the end of the line, @file reads it from a file.
+      e.g. get billing /v1/invoices?limit=5
+           post billing /v1/invoices Idempotency-Key:abc {"amount": 5}
+Variables, expanded as $name or ${name} in every line, falling back to the
+environment:
+  set <name> <value>   unset <name>   vars
+History, kept in ~/.awsctl/repl_history:
+  history              !<n> runs entry n again, !! the last one
+  help                 exit`
+
+// repl runs request commands through an in-process proxy server
+type repl struct {
+	handler http.Handler
+	vars    map[string]string
+	history []string
+	// historyFile receives every line run, nil if it couldn't be opened
+	historyFile *os.File
+	out         io.Writer
+}
+
+// localProxyOptions are the flags of commands that send requests through an
+// in-process proxy server instead of a listener
+type localProxyOptions struct {
+	targets     *string
+	function    *string
+	functionURL *string
+	region      *string
+	profile     *string
+	endpointURL *string
+	transport   *string
+	signKMSKey  *string
+	forwardUser *bool
+}
+
+func registerLocalProxyFlags() localProxyOptions {
+	return localProxyOptions{
+		targets:     flag.String("targets", "", "Targets file mapping aliases to private API URLs (default ~/.awsctl/targets.json)"),
+		function:    flag.String("function", "awsctl-proxy-ingress-lambda", "Lambda function name"),
+		functionURL: flag.String("function-url", "", "Function URL of the ingress Lambda, for -transport function-url"),
+		region:      flag.String("region", "eu-central-1", "AWS region"),
+		profile:     flag.String("profile", "", "AWS profile to use"),
+		endpointURL: flag.String("lambda-endpoint-url", "", "Lambda API endpoint to invoke through, e.g. a VPC interface endpoint or localstack"),
+		transport:   flag.String("transport", "lambda", fmt.Sprintf("How requests reach the ingress handler: %s", strings.Join(proxy.TransportNames(), ", "))),
+		signKMSKey:  flag.String("sign-kms-key", "", "KMS HMAC key to sign envelopes with, must match the Lambda's SIGNING_KMS_KEY"),
+		forwardUser: flag.Bool("forward-user", false, "Send the caller ARN from STS GetCallerIdentity upstream as X-Forwarded-User"),
+	}
+}
+
+// server returns the targets and the handler of a proxy server for the
+// default session, with the hooks of the targets like awsctl proxy
+func (o localProxyOptions) server(ctx context.Context) (*proxy.Targets, http.Handler, proxy.Transport, error) {
+	targets, err := proxy.LoadTargets(*o.targets)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("load targets: %w", err)
+	}
+	transports := pipeline{
+		transport:   *o.transport,
+		endpointURL: *o.endpointURL,
+		signKMSKey:  *o.signKMSKey,
+		forwardUser: *o.forwardUser,
+		targets:     targets,
+	}
+	defaultSession := session{
+		profile:     *o.profile,
+		region:      *o.region,
+		function:    *o.function,
+		functionURL: *o.functionURL,
+	}
+	transport, caller, err := transports.newTransport(ctx, defaultSession)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("create transport: %w", err)
+	}
+	servers := serverOptions{
+		targets:     targets,
+		forwardUser: *o.forwardUser,
+		errorFormat: proxy.ErrorFormatText,
+		userAgent:   proxy.UserAgentPreserve,
+	}
+	_, _, handler, err := servers.newServer(transport, caller, "")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("create proxy server: %w", err)
+	}
+	return targets, handler, transport, nil
+}
+
+// localRequest returns a request of path on target for an in-process proxy
+// server, with awsctl's User-Agent unless headers have one
+func localRequest(ctx context.Context, method, target, path string, headers http.Header, body []byte) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, "http://awsctl"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	request.Header = headers
+	if request.Header == nil {
+		request.Header = http.Header{}
+	}
+	if request.Header.Get("User-Agent") == "" {
+		request.Header.Set("User-Agent", "awsctl/"+version)
+	}
+	request.Header.Set(proxy.TargetHeader, target)
+	request.RemoteAddr = "127.0.0.1:0"
+	return request, nil
+}
+
+// serveLocal serves request with handler and returns the response, its body
+// buffered, and how long it took
+func serveLocal(handler http.Handler, request *http.Request) (*http.Response, time.Duration) {
+	recorder := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Result(), time.Since(start)
+}
+
+func runRepl() {
+	options := registerLocalProxyFlags()
+	noHistory := flag.Bool("no-history", false, "Don't read or write ~/.awsctl/repl_history")
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl repl [flags]")
+		fmt.Println()
+		fmt.Println(replHelp)
+		fmt.Println()
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	_, handler, transport, err := options.server(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+
+	r := &repl{handler: handler, vars: map[string]string{}, out: os.Stdout}
+	if !*noHistory {
+		if err := r.openHistory(); err != nil {
+			log.Printf("Failed to open history, it won't be kept: %v", err)
+		}
+	}
+	if r.historyFile != nil {
+		defer r.historyFile.Close()
+	}
+
+	fmt.Printf("Sending requests to %s, type help for commands\n", proxy.DescribeTransport(transport))
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 10<<20)
+	for {
+		fmt.Print("awsctl> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			break
+		}
+		if !r.run(context.Background(), scanner.Text()) {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Failed to read input: %v", err)
+	}
+}
+
+// openHistory loads the end of the history file and keeps it open for
+// appending
+func (r *repl) openHistory() error {
+	dir, err := proxy.StateDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("create awsctl directory: %w", err)
+	}
+	path := filepath.Join(dir, "repl_history")
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read history: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			r.history = append(r.history, line)
+		}
+	}
+	if len(r.history) > replHistoryLimit {
+		r.history = r.history[len(r.history)-replHistoryLimit:]
+	}
+	r.historyFile, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open history: %w", err)
+	}
+	return nil
+}
+
+// run runs a line and reports whether to read the next one
+func (r *repl) run(ctx context.Context, line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return true
+	}
+	if strings.HasPrefix(line, "!") {
+		recalled, err := r.recall(line)
+		if err != nil {
+			fmt.Fprintf(r.out, "Failed to recall %s: %v\n", line, err)
+			return true
+		}
+		line = recalled
+		fmt.Fprintln(r.out, line)
+	}
+	r.remember(line)
+
+	command, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+	switch strings.ToLower(command) {
+	case "exit", "quit":
+		return false
+	case "help":
+		fmt.Fprintln(r.out, replHelp)
+	case "history":
+		for i, entry := range r.history {
+			fmt.Fprintf(r.out, "%4d  %s\n", i+1, entry)
+		}
+	case "vars":
+		names := make([]string, 0, len(r.vars))
+		for name := range r.vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(r.out, "%s=%s\n", name, r.vars[name])
+		}
+	case "set":
+		name, value, ok := strings.Cut(rest, " ")
+		if !ok || name == "" {
+			fmt.Fprintln(r.out, "Usage: set <name> <value>")
+			return true
+		}
+		r.vars[name] = r.expand(strings.TrimSpace(value))
+	case "unset":
+		delete(r.vars, rest)
+	default:
+		method, ok := replMethods[strings.ToLower(command)]
+		if !ok {
+			fmt.Fprintf(r.out, "Unknown command %q, type help for commands\n", command)
+			return true
+		}
+		if err := r.request(ctx, method, r.expand(rest)); err != nil {
+			fmt.Fprintf(r.out, "Failed to send request: %v\n", err)
+		}
+	}
+	return true
+}
+
+// recall returns the history entry of !n or !!
+func (r *repl) recall(line string) (string, error) {
+	if len(r.history) == 0 {
+		return "", fmt.Errorf("the history is empty")
+	}
+	if line == "!!" {
+		return r.history[len(r.history)-1], nil
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(line, "!"))
+	if err != nil || n < 1 || n > len(r.history) {
+		return "", fmt.Errorf("expected !! or !<n> with n from 1 to %d", len(r.history))
+	}
+	return r.history[n-1], nil
+}
+
+func (r *repl) remember(line string) {
+	r.history = append(r.history, line)
+	if r.historyFile != nil {
+		fmt.Fprintln(r.historyFile, line)
+	}
+}
+
+// expand replaces $name and ${name} with variables or, failing that,
+// environment variables
+func (r *repl) expand(s string) string {
+	return os.Expand(s, func(name string) string {
+		if value, ok := r.vars[name]; ok {
+			return value
+		}
+		return os.Getenv(name)
+	})
+}
+
+// request parses <target> <path> [Name:value ...] [body], sends it and
+// prints the response
+func (r *repl) request(ctx context.Context, method, args string) error {
+	target, args, _ := strings.Cut(args, " ")
+	path, args, _ := strings.Cut(strings.TrimSpace(args), " ")
+	if target == "" || path == "" {
+		return fmt.Errorf("expected <target> <path> [Name:value ...] [body]")
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	headers := http.Header{}
+	var body []byte
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		if args[0] == '{' || args[0] == '[' {
+			body = []byte(args)
+			break
+		}
+		var token string
+		token, args, _ = strings.Cut(args, " ")
+		if file, ok := strings.CutPrefix(token, "@"); ok {
+			var err error
+			if body, err = os.ReadFile(file); err != nil {
+				return fmt.Errorf("read body: %w", err)
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(token, ":")
+		if !ok || name == "" {
+			return fmt.Errorf("parse %q: expected Name:value, a body starting with { or [, or @file", token)
+		}
+		headers.Add(name, value)
+	}
+	if body != nil && headers.Get("Content-Type") == "" && json.Valid(body) {
+		headers.Set("Content-Type", "application/json")
+	}
+
+	request, err := localRequest(ctx, method, target, path, headers, body)
+	if err != nil {
+		return err
+	}
+	response, took := serveLocal(r.handler, request)
+	r.printResponse(response, took)
+	return nil
+}
+
+// printResponse prints the status, the headers sorted by name and the body,
+// indenting JSON
+func (r *repl) printResponse(response *http.Response, took time.Duration) {
+	fmt.Fprintf(r.out, "%s %s (%dms)\n", response.Proto, response.Status, took.Milliseconds())
+	writeHeaders(r.out, "", response.Header)
+
+	body, _ := io.ReadAll(response.Body)
+	if len(body) == 0 {
+		return
+	}
+	fmt.Fprintln(r.out)
+	var indented bytes.Buffer
+	if strings.Contains(response.Header.Get("Content-Type"), "json") && json.Indent(&indented, body, "", "  ") == nil {
+		body = indented.Bytes()
+	}
+	r.out.Write(body)
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		fmt.Fprintln(r.out)
+	}
+}
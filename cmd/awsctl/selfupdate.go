@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// version is the release tag of this binary, set with
+	// -ldflags "-X main.version=v1.2.3"
+	version = "dev"
+	// releasePublicKey is the base64 Ed25519 key release checksums are signed
+	// with, set with -ldflags "-X main.releasePublicKey=..." by release builds
+	releasePublicKey = ""
+)
+
+// release is the part of a GitHub release self-update needs
+type release struct {
+	TagName    string         `json:"tag_name"`
+	Prerelease bool           `json:"prerelease"`
+	Draft      bool           `json:"draft"`
+	Assets     []releaseAsset `json:"assets"`
+	// version is TagName parsed
+	version semver
+}
+
+// semver is a vMAJOR.MINOR.PATCH[-PRERELEASE] release tag, build metadata
+// is ignored
+type semver struct {
+	major, minor, patch int
+	prerelease          []string
+}
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+func runSelfUpdate() {
+	var (
+		channel = flag.String("channel", "stable", "Release channel: stable (releases) or edge (also pre-releases)")
+		repo    = flag.String("repo", "jkblume/awsctl", "GitHub repository publishing the releases")
+		apiURL  = flag.String("api-url", "https://api.github.com", "GitHub API endpoint, e.g. of GitHub Enterprise")
+		check   = flag.Bool("check", false, "Only report whether an update is available")
+	)
+	flag.Parse()
+
+	if *channel != "stable" && *channel != "edge" {
+		log.Fatalf("Failed to update: unknown channel %q, expected stable or edge", *channel)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Failed to locate awsctl binary: %v", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		log.Fatalf("Failed to locate awsctl binary: %v", err)
+	}
+	// Package managers track their files, replacing them behind their back
+	// breaks the next upgrade
+	if manager := packageManager(exe); manager != "" {
+		log.Fatalf("Failed to update: awsctl was installed by %s, update it there", manager)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	latest, err := latestRelease(ctx, *apiURL, *repo, *channel == "edge")
+	if err != nil {
+		log.Fatalf("Failed to find latest release: %v", err)
+	}
+	// Development builds have no version to compare, any release replaces
+	// them
+	if current, ok := parseVersion(version); ok && compareVersions(latest.version, current) <= 0 {
+		fmt.Printf("awsctl %s is up to date (%s channel)\n", version, *channel)
+		return
+	}
+	if *check {
+		fmt.Printf("awsctl %s is available (%s channel), this is %s\n", latest.TagName, *channel, version)
+		return
+	}
+
+	binary, err := downloadRelease(ctx, latest)
+	if err != nil {
+		log.Fatalf("Failed to download awsctl %s: %v", latest.TagName, err)
+	}
+	if err := replaceExecutable(exe, binary); err != nil {
+		log.Fatalf("Failed to install awsctl %s: %v", latest.TagName, err)
+	}
+	fmt.Printf("Updated %s from %s to %s\n", exe, version, latest.TagName)
+}
+
+// packageManager returns the package manager exe was installed with, if any
+func packageManager(exe string) string {
+	path := filepath.ToSlash(strings.ToLower(exe))
+	switch {
+	case strings.Contains(path, "/cellar/"):
+		return "Homebrew (brew upgrade awsctl)"
+	case strings.Contains(path, "/scoop/apps/"):
+		return "Scoop (scoop update awsctl)"
+	}
+	return ""
+}
+
+// latestRelease returns the published release with the highest version,
+// pre-releases only if edge is set. Tags that aren't versions are skipped.
+func latestRelease(ctx context.Context, apiURL, repo string, edge bool) (*release, error) {
+	url := fmt.Sprintf("%s/repos/%s/releases?per_page=30", strings.TrimSuffix(apiURL, "/"), repo)
+	body, err := download(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	var releases []release
+	if err := json.Unmarshal(body, &releases); err != nil {
+		return nil, fmt.Errorf("unmarshal releases: %w", err)
+	}
+	var latest *release
+	for _, r := range releases {
+		if r.Draft || (r.Prerelease && !edge) {
+			continue
+		}
+		v, ok := parseVersion(r.TagName)
+		if !ok {
+			continue
+		}
+		if latest == nil || compareVersions(v, latest.version) > 0 {
+			r.version = v
+			latest = &r
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("failed to find a release of %s", repo)
+	}
+	return latest, nil
+}
+
+// parseVersion parses a tag like v1.2.3 or v1.2.3-rc.1
+func parseVersion(tag string) (semver, bool) {
+	rest, ok := strings.CutPrefix(tag, "v")
+	if !ok {
+		return semver{}, false
+	}
+	rest, _, _ = strings.Cut(rest, "+")
+	core, prerelease, hasPrerelease := strings.Cut(rest, "-")
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	var numbers [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || part != strconv.Itoa(n) {
+			return semver{}, false
+		}
+		numbers[i] = n
+	}
+	v := semver{major: numbers[0], minor: numbers[1], patch: numbers[2]}
+	if hasPrerelease {
+		v.prerelease = strings.Split(prerelease, ".")
+		for _, identifier := range v.prerelease {
+			if identifier == "" {
+				return semver{}, false
+			}
+		}
+	}
+	return v, true
+}
+
+// compareVersions returns -1, 0 or 1 as a is older than, the same as or
+// newer than b, with semver precedence: a pre-release is older than its
+// release, numeric identifiers compare as numbers and before others
+func compareVersions(a, b semver) int {
+	for _, d := range []int{a.major - b.major, a.minor - b.minor, a.patch - b.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	switch {
+	case len(a.prerelease) == 0 && len(b.prerelease) == 0:
+		return 0
+	case len(a.prerelease) == 0:
+		return 1
+	case len(b.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.prerelease) && i < len(b.prerelease); i++ {
+		x, y := a.prerelease[i], b.prerelease[i]
+		xn, xErr := strconv.Atoi(x)
+		yn, yErr := strconv.Atoi(y)
+		switch {
+		case xErr == nil && yErr == nil:
+			if xn != yn {
+				return sign(xn - yn)
+			}
+		case xErr == nil:
+			return -1
+		case yErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(a.prerelease) - len(b.prerelease))
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// downloadRelease downloads the binary for this OS and architecture and
+// verifies it against the signed checksums of the release
+func downloadRelease(ctx context.Context, r *release) ([]byte, error) {
+	name := fmt.Sprintf("awsctl_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	assets := map[string]string{}
+	for _, asset := range r.Assets {
+		assets[asset.Name] = asset.URL
+	}
+	for _, required := range []string{name, "checksums.txt", "checksums.txt.sig"} {
+		if assets[required] == "" {
+			return nil, fmt.Errorf("failed to find %s in release %s", required, r.TagName)
+		}
+	}
+
+	checksums, err := download(ctx, assets["checksums.txt"])
+	if err != nil {
+		return nil, err
+	}
+	signature, err := download(ctx, assets["checksums.txt.sig"])
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksums(r.TagName, checksums, signature); err != nil {
+		return nil, err
+	}
+	want, err := checksumOf(checksums, name)
+	if err != nil {
+		return nil, err
+	}
+
+	binary, err := download(ctx, assets[name])
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(binary)
+	if hex.EncodeToString(sum[:]) != want {
+		return nil, fmt.Errorf("failed to verify %s: checksum mismatch", name)
+	}
+	return binary, nil
+}
+
+// signedChecksums is what a release signs: a line naming the release
+// followed by the checksums file. Without the tag an older signed release
+// could be served as the latest one.
+func signedChecksums(tag string, checksums []byte) []byte {
+	return append([]byte("awsctl "+tag+"\n"), checksums...)
+}
+
+// verifyChecksums checks the base64 Ed25519 signature of the checksums file
+// of the release tag
+func verifyChecksums(tag string, checksums, signature []byte) error {
+	if releasePublicKey == "" {
+		return fmt.Errorf("failed to verify release: this build has no release key, reinstall from a release")
+	}
+	key, err := base64.StdEncoding.DecodeString(releasePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("failed to verify release: invalid release key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("decode checksums signature: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), signedChecksums(tag, checksums), sig) {
+		return fmt.Errorf("failed to verify release: invalid checksums signature for %s", tag)
+	}
+	return nil
+}
+
+// checksumOf finds name in a sha256sum style checksums file
+func checksumOf(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(string(checksums)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("failed to find checksum of %s", name)
+}
+
+func download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get %s: status %d", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", url, err)
+	}
+	return body, nil
+}
+
+// replaceExecutable swaps exe for binary with renames in the same directory,
+// so exe is never partially written. Windows can't overwrite a running
+// binary but can rename it, the old one is left as .old next to it.
+func replaceExecutable(exe string, binary []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".awsctl-update-*")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temporary file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return fmt.Errorf("make executable: %w", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return fmt.Errorf("move old binary: %w", err)
+		}
+		if err := os.Rename(tmp.Name(), exe); err != nil {
+			os.Rename(old, exe)
+			return fmt.Errorf("move new binary: %w", err)
+		}
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		return fmt.Errorf("move new binary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "v1.2.3", 0},
+		{"v1.2.4", "v1.2.3", 1},
+		{"v1.10.0", "v1.9.9", 1},
+		{"v2.0.0", "v10.0.0", -1},
+		{"v1.2.3-rc.1", "v1.2.3", -1},
+		{"v1.2.3-rc.2", "v1.2.3-rc.10", -1},
+		{"v1.2.3-rc.1", "v1.2.3-rc.1.1", -1},
+		{"v1.2.3-1", "v1.2.3-alpha", -1},
+		{"v1.2.3-beta", "v1.2.3-alpha", 1},
+		{"v1.2.3+build.5", "v1.2.3", 0},
+	}
+	for _, test := range tests {
+		a, ok := parseVersion(test.a)
+		if !ok {
+			t.Fatalf("parseVersion(%s) failed", test.a)
+		}
+		b, ok := parseVersion(test.b)
+		if !ok {
+			t.Fatalf("parseVersion(%s) failed", test.b)
+		}
+		if got := compareVersions(a, b); got != test.want {
+			t.Errorf("compareVersions(%s, %s) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+
+	for _, tag := range []string{"dev", "1.2.3", "v1.2", "v1.2.x", "v01.2.3", "v1.2.3-", "v1.2.3-rc..1"} {
+		if _, ok := parseVersion(tag); ok {
+			t.Errorf("parseVersion(%s) succeeded, want it rejected", tag)
+		}
+	}
+}
+
+// Regression: the first listed release was installed whenever its tag
+// differed from the running version, also when it was older
+func TestLatestReleaseHighestVersion(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"tag_name": "v1.2.0"},
+			{"tag_name": "v1.4.0-rc.1", "prerelease": true},
+			{"tag_name": "v1.3.0"},
+			{"tag_name": "v1.5.0", "draft": true},
+			{"tag_name": "nightly"}
+		]`))
+	}))
+	defer api.Close()
+
+	for edge, want := range map[bool]string{false: "v1.3.0", true: "v1.4.0-rc.1"} {
+		latest, err := latestRelease(context.Background(), api.URL, "jkblume/awsctl", edge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest.TagName != want {
+			t.Errorf("latest release with edge=%v = %s, want %s", edge, latest.TagName, want)
+		}
+	}
+}
+
+// Regression: the signature only covered the checksums, so an older signed
+// release could be served as the latest one
+func TestVerifyChecksumsTag(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(key string) { releasePublicKey = key }(releasePublicKey)
+	releasePublicKey = base64.StdEncoding.EncodeToString(public)
+
+	checksums := []byte("0123  awsctl_linux_amd64\n")
+	signature := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, signedChecksums("v1.2.0", checksums))))
+
+	if err := verifyChecksums("v1.2.0", checksums, signature); err != nil {
+		t.Errorf("checksums of v1.2.0: %v", err)
+	}
+	if err := verifyChecksums("v1.3.0", checksums, signature); err == nil {
+		t.Error("checksums signed for v1.2.0 accepted for v1.3.0")
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/jkblume/awsctl/pkg/ingress"
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// session is an AWS profile, region and function served by the proxy. The
+// top-level flags describe the default session, -session adds more under
+// their own path prefix or port.
+type session struct {
+	name        string
+	profile     string
+	region      string
+	function    string
+	functionURL string
+	prefix      string
+	port        int
+}
+
+// parseSession parses name:key=value,... with the keys profile, region,
+// function, function-url, prefix and port. Omitted keys are taken from base,
+// exactly one of prefix and port is required.
+func parseSession(value string, base session) (session, error) {
+	name, options, ok := strings.Cut(value, ":")
+	if !ok || name == "" {
+		return session{}, fmt.Errorf("failed to parse session %q: expected name:key=value,...", value)
+	}
+
+	s := base
+	s.name = name
+	for _, option := range splitList(options) {
+		key, val, ok := strings.Cut(option, "=")
+		if !ok {
+			return session{}, fmt.Errorf("failed to parse session %s: expected key=value, got %q", name, option)
+		}
+		switch key {
+		case "profile":
+			s.profile = val
+		case "region":
+			s.region = val
+		case "function":
+			s.function = val
+		case "function-url":
+			s.functionURL = val
+		case "prefix":
+			s.prefix = "/" + strings.Trim(val, "/")
+		case "port":
+			port, err := strconv.Atoi(val)
+			if err != nil {
+				return session{}, fmt.Errorf("parse port of session %s: %w", name, err)
+			}
+			s.port = port
+		default:
+			return session{}, fmt.Errorf("failed to parse session %s: unknown key %q", name, key)
+		}
+	}
+
+	if (s.prefix == "" || s.prefix == "/") == (s.port == 0) {
+		return session{}, fmt.Errorf("failed to parse session %s: set either prefix or port", name)
+	}
+	return s, nil
+}
+
+// pipeline holds the flags that build the transport chain of every session
+type pipeline struct {
+	transport    string
+	endpointURL  string
+	verbose      bool
+	redactor     *proxy.Redactor
+	logBodyLimit int
+	playbackDir  string
+	recordDir    string
+	encrypt      bool
+	payloadKey   string
+	signKMSKey   string
+	cache        bool
+	cacheDir     string
+	cacheMaxMB   int
+	auditGroup   string
+	auditS3      string
+	auditEvery   time.Duration
+	forwardUser  bool
+	notifier     notifier
+	queueSlots   int
+	queueBy      string
+	queueLimit   int
+	queueWeights map[string]float64
+	deltaMin     int
+	batchWindow  time.Duration
+	batchMax     int
+	asyncBucket  string
+	stateMachine string
+	reliableQ    string
+	healthEvery  time.Duration
+	coalesce     bool
+	compression  bool
+	compressMB   int
+	targets      *proxy.Targets
+}
+
+func (p pipeline) auditing() bool {
+	return p.auditGroup != "" || p.auditS3 != ""
+}
+
+// newTransport builds the transport chain for s. It also returns the caller
+// ARN of the session's AWS identity if identity stamping or auditing needs it.
+func (p pipeline) newTransport(ctx context.Context, s session) (proxy.Transport, string, error) {
+	// Resolve the AWS identity once for identity stamping and the audit log
+	var awsCfg aws.Config
+	var caller string
+	var err error
+	if p.forwardUser || p.auditing() {
+		awsCfg, err = proxy.LoadAWSConfig(ctx, s.region, s.profile)
+		if err != nil {
+			return nil, "", err
+		}
+		caller, err = proxy.CallerIdentity(ctx, awsCfg)
+		if err != nil {
+			return nil, "", fmt.Errorf("determine caller identity: %w", err)
+		}
+	}
+
+	var transport proxy.Transport
+	if p.playbackDir != "" {
+		transport = proxy.NewPlaybackTransport(p.playbackDir, p.verbose)
+	} else {
+		options := proxy.TransportOptions{
+			FunctionName: s.function,
+			FunctionURL:  s.functionURL,
+			EndpointURL:  p.endpointURL,
+			Region:       s.region,
+			Profile:      s.profile,
+			Verbose:      p.verbose,
+			Redactor:     p.redactor,
+			LogBodyLimit: p.logBodyLimit,
+		}
+		transport, err = proxy.NewTransport(ctx, p.transport, options)
+		if err != nil {
+			return nil, "", fmt.Errorf("create %s transport: %w", p.transport, err)
+		}
+
+		// Targets with their own ingress Lambda get a transport each, in the
+		// function's region if it is an ARN
+		if functions := p.targets.Functions(); len(functions) > 0 {
+			if p.transport == "function-url" {
+				return nil, "", fmt.Errorf("failed to create transports of target functions: -transport function-url posts to a single function URL")
+			}
+			byFunction := map[string]proxy.Transport{}
+			for _, function := range functions {
+				functionOptions := options
+				functionOptions.FunctionName = function
+				if region := functionRegion(function); region != "" {
+					functionOptions.Region = region
+				}
+				byFunction[function], err = proxy.NewTransport(ctx, p.transport, functionOptions)
+				if err != nil {
+					return nil, "", fmt.Errorf("create %s transport of %s: %w", p.transport, function, err)
+				}
+			}
+			transport = proxy.NewFunctionTransport(transport, byFunction, p.targets)
+		}
+
+		// Fire-and-forget requests are invoked asynchronously, long-running
+		// ones too unless they go through Step Functions. The bucket holds
+		// the responses either way.
+		if p.asyncBucket != "" {
+			transport, err = proxy.NewAsyncTransport(ctx, transport, p.asyncBucket, s.region, s.profile, p.verbose)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		if p.stateMachine != "" {
+			transport, err = proxy.NewStepFunctionsTransport(ctx, transport, p.stateMachine, p.asyncBucket, s.region, s.profile, p.verbose)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		if p.reliableQ != "" {
+			transport, err = proxy.NewReliableTransport(ctx, transport, p.reliableQ, p.asyncBucket, s.region, s.profile, p.verbose)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+
+		// Batch right at the invocation, so encryption and signing still
+		// apply to each request
+		if p.batchWindow > 0 {
+			transport, err = proxy.NewBatchTransport(transport, p.batchWindow, p.batchMax, p.verbose)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+
+		// Sign last, right before the envelope leaves the process, so the
+		// signature covers the encrypted body the Lambda receives
+		if p.signKMSKey != "" {
+			transport, err = proxy.NewSigningTransport(ctx, transport, p.signKMSKey, s.region, s.profile)
+			if err != nil {
+				return nil, "", fmt.Errorf("create signing transport: %w", err)
+			}
+		}
+
+		if p.encrypt {
+			transport, err = proxy.NewEncryptingTransport(ctx, transport, p.payloadKey, s.region, s.profile)
+			if err != nil {
+				return nil, "", fmt.Errorf("create encrypting transport: %w", err)
+			}
+		}
+
+		// SigV4 signatures for the upstream cover the plain body and the
+		// final headers, and are made after any queueing
+		if p.targets.HasSigV4() {
+			transport, err = proxy.NewSigV4Transport(ctx, transport, p.targets, s.region, s.profile)
+			if err != nil {
+				return nil, "", fmt.Errorf("create SigV4 transport: %w", err)
+			}
+		}
+
+		// Pick the upstream before signing, the signature covers its host
+		if p.targets.HasUpstreams() {
+			routing := proxy.NewRoutingTransport(transport, p.targets)
+			go routing.Run(context.Background(), p.healthEvery)
+			transport = routing
+		}
+
+		// Hold requests while the credentials are expired instead of failing
+		// them, the guard covers the KMS calls and signing above as well
+		transport = proxy.NewCredentialGuardTransport(transport, s.profile, proxy.CredentialsCheck(s.region, s.profile), func(message string) {
+			p.notifier.notify(sessionLabel(s) + message)
+		})
+
+		if p.queueSlots > 0 {
+			transport, err = proxy.NewFairQueueTransport(transport, p.queueSlots, p.queueBy, p.queueWeights, p.queueLimit)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+
+		// Outside of encryption to compare plaintext, inside of recording and
+		// caching so they get complete bodies
+		if p.deltaMin > 0 {
+			transport = proxy.NewDeltaTransport(transport, p.deltaMin, p.verbose)
+		}
+
+		// Bodies stay compressed through delta responses and are
+		// decompressed before caching, hooks and the client see them
+		if p.compression {
+			transport = proxy.NewCompressionTransport(transport, int64(p.compressMB)<<20)
+		}
+
+		// Coalesced requests share a queue slot and an invocation, recording,
+		// caching and auditing still see each of them
+		if p.coalesce {
+			transport = proxy.NewCoalesceTransport(transport, p.verbose)
+		}
+	}
+
+	if p.recordDir != "" {
+		recordTransport, err := proxy.NewRecordTransport(transport, p.recordDir, p.verbose)
+		if err != nil {
+			return nil, "", fmt.Errorf("create record transport: %w", err)
+		}
+		recordTransport.SetRedactor(p.redactor)
+		transport = recordTransport
+	}
+
+	if p.cache {
+		dir := p.cacheDir
+		if dir == "" {
+			if dir, err = proxy.DefaultCacheDir(); err != nil {
+				return nil, "", fmt.Errorf("find cache directory: %w", err)
+			}
+		}
+		cacheTransport, err := proxy.NewCacheTransport(transport, dir, p.verbose)
+		if err != nil {
+			return nil, "", fmt.Errorf("create cache transport: %w", err)
+		}
+		cacheTransport.SetMaxSize(int64(p.cacheMaxMB) << 20)
+		transport = cacheTransport
+	}
+
+	// Prefetched pages are audited when the client asks for them
+	if p.targets.Paginated() {
+		transport = proxy.NewPrefetchTransport(transport, p.targets.Pagination, p.verbose)
+	}
+
+	if p.auditing() {
+		auditTransport, err := newAuditTransport(awsCfg, transport, caller, p.auditGroup, p.auditS3, s.name, p.verbose)
+		if err != nil {
+			return nil, "", fmt.Errorf("create audit log: %w", err)
+		}
+		go auditTransport.Run(context.Background(), p.auditEvery)
+		transport = auditTransport
+	}
+
+	return transport, caller, nil
+}
+
+// serverOptions holds the flags that configure the proxy server of every
+// session
+type serverOptions struct {
+	targets      *proxy.Targets
+	verbose      bool
+	forwardUser  bool
+	onRequest    []string
+	onResponse   []string
+	allow        *allowPolicy
+	rewriteLinks bool
+	errorFormat  string
+	legacyPaths  bool
+	cors         *corsConfig
+	asyncBucket  string
+	// requestHeaders and responseHeaders filter the forwarded headers
+	requestHeaders  *proxy.HeaderFilter
+	responseHeaders *proxy.HeaderFilter
+	userAgent       string
+	versionHeader   bool
+	openapiStrict   bool
+	chaos           proxy.ChaosConfig
+	throttle        int64
+	idempotency     string
+	// upstreamTimeouts override the Lambda's timeouts of upstream calls
+	upstreamTimeouts ingress.UpstreamTimeouts
+	// requestTimeout is the local server's write timeout
+	requestTimeout time.Duration
+	// debugDir receives a file per request, redacted by redactor
+	debugDir string
+	redactor *proxy.Redactor
+}
+
+// newServer returns the proxy server for a session, the mux its routes are
+// registered on and the handler serving them
+func (o serverOptions) newServer(transport proxy.Transport, caller, prefix string) (*proxy.Server, *http.ServeMux, http.Handler, error) {
+	server := proxy.NewServer(transport, o.targets, o.verbose)
+	server.SetPathPrefix(prefix)
+	server.SetHeaderFilters(o.requestHeaders, o.responseHeaders)
+	server.SetThrottle(o.throttle)
+	server.SetUpstreamTimeouts(o.upstreamTimeouts)
+	server.SetRequestTimeout(o.requestTimeout)
+	if err := server.SetDebugDir(o.debugDir, o.redactor); err != nil {
+		return nil, nil, nil, err
+	}
+	// Denied requests must not reach any other hook, e.g. fetch tokens
+	if o.allow != nil {
+		server.OnRequest(o.allow.hook())
+	}
+	// Injected faults come next, they stand in for the whole way upstream
+	if o.chaos.Enabled() || o.targets.HasChaos() {
+		chaos, err := proxy.ChaosHook(o.chaos, o.targets)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		server.OnRequest(chaos)
+	}
+	if o.forwardUser {
+		server.OnRequest(proxy.CallerHook(caller))
+	}
+	server.OnRequest(proxy.KeychainAuthHook(o.targets))
+	if o.targets.HasResolvers() {
+		server.OnRequest(proxy.ResolverHeadersHook(o.targets))
+	}
+	server.OnRequest(proxy.OAuth2Hook(o.targets, transport))
+	if o.idempotency != "" {
+		server.OnRequest(proxy.IdempotencyHook(o.idempotency))
+	}
+	// Contracts are checked against the client's request and the upstream
+	// response, before -on-request and -on-response hooks change them
+	if o.targets.HasOpenAPI() {
+		contracts, err := proxy.NewContractValidator(o.targets, o.openapiStrict)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		server.OnRequest(contracts.RequestHook())
+		server.OnResponse(contracts.ResponseHook())
+	}
+	// Mirrors are compared with the upstream response, too
+	if o.targets.HasMirror() {
+		server.OnResponse(proxy.MirrorHook(o.targets, transport))
+	}
+	if err := registerCELHooks(server, o.onRequest, o.onResponse); err != nil {
+		return nil, nil, nil, fmt.Errorf("register hooks: %w", err)
+	}
+	if o.rewriteLinks {
+		server.EnableLinkRewriting()
+	}
+	if o.asyncBucket != "" {
+		server.EnableFireAndForget()
+	}
+	if err := server.SetErrorFormat(o.errorFormat); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := server.SetUserAgent(o.userAgent, version, o.versionHeader); err != nil {
+		return nil, nil, nil, err
+	}
+
+	mux := http.NewServeMux()
+	server.Register(mux, o.legacyPaths)
+
+	var handler http.Handler = server.TargetHeaderMiddleware(mux)
+	if o.cors != nil {
+		handler = corsMiddleware(*o.cors, handler)
+	}
+	return server, mux, handler, nil
+}
+
+// mountSessions sends requests below a session's prefix to its handler with
+// the prefix removed. It runs before the target header and path routing of
+// the default session, which gets all other requests.
+func mountSessions(prefixed map[string]http.Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for prefix, handler := range prefixed {
+			if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+				http.StripPrefix(prefix, handler).ServeHTTP(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionLabel prefixes log messages of named sessions
+func sessionLabel(s session) string {
+	if s.name == "" {
+		return ""
+	}
+	return fmt.Sprintf("Session %s: ", s.name)
+}
+
+// parseQueueWeights parses -queue-priority key=weight values. Targets may be
+// given by alias, the queue sees their URL.
+func parseQueueWeights(values []string, by string, targets *proxy.Targets) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, value := range values {
+		key, weightArg, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("failed to parse %q: expected key=weight", value)
+		}
+		weight, err := strconv.ParseFloat(weightArg, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse weight of %s: %w", key, err)
+		}
+		if by == proxy.QueueByTarget {
+			if key, err = targets.Resolve(key); err != nil {
+				return nil, err
+			}
+		}
+		weights[key] = weight
+	}
+	return weights, nil
+}
+
+// functionRegion returns the region of a function ARN, empty for names
+func functionRegion(function string) string {
+	// arn:aws:lambda:<region>:<account>:function:<name>[:<qualifier>]
+	parts := strings.Split(function, ":")
+	if len(parts) >= 7 && parts[0] == "arn" && parts[2] == "lambda" {
+		return parts[3]
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// startupInfo describes a running proxy, printed as text or as one JSON line
+type startupInfo struct {
+	Listen        []string      `json:"listen"`
+	Transport     string        `json:"transport"`
+	Region        string        `json:"region"`
+	Profile       string        `json:"profile,omitempty"`
+	Usage         string        `json:"usage"`
+	LegacyUsage   string        `json:"legacyUsage,omitempty"`
+	PacURL        string        `json:"pacUrl,omitempty"`
+	CACertificate string        `json:"caCertificate,omitempty"`
+	Ready         bool          `json:"ready"`
+	Sessions      []sessionInfo `json:"sessions,omitempty"`
+}
+
+// sessionInfo describes a session added with -session
+type sessionInfo struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Transport string `json:"transport"`
+	Region    string `json:"region"`
+	Profile   string `json:"profile,omitempty"`
+}
+
+// printStartupJSON prints the startup information as one JSON line
+func printStartupJSON(info startupInfo) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(info); err != nil {
+		log.Fatalf("Failed to write startup info: %v", err)
+	}
+}
+
+// waitReady blocks until a verification invoke succeeds. The probe carries no
+// target, so a deployed Lambda answers it without calling any upstream.
+func waitReady(ctx context.Context, t proxy.Transport, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	probe := proxy.ProxyRequest{Method: "GET", Path: "/"}
+	for {
+		_, err := t.Invoke(ctx, probe)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Waiting for %s to become ready: %v", proxy.DescribeTransport(t), err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wait for transport: %w", err)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// targetProxyURL returns the local proxy URL for "<alias-or-url>[/path]"
+func targetProxyURL(baseAddr string, targets *proxy.Targets, aliasOrURL string) (string, error) {
+	var privateApiUrl, path string
+	if strings.Contains(aliasOrURL, "://") {
+		u, err := url.Parse(aliasOrURL)
+		if err != nil {
+			return "", fmt.Errorf("parse URL: %w", err)
+		}
+		privateApiUrl = u.Scheme + "://" + u.Host
+		path = u.EscapedPath()
+		if u.RawQuery != "" {
+			path += "?" + u.RawQuery
+		}
+	} else {
+		alias, rest, _ := strings.Cut(aliasOrURL, "/")
+		resolved, err := targets.Resolve(alias)
+		if err != nil {
+			return "", err
+		}
+		privateApiUrl = resolved
+		path = "/" + rest
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(privateApiUrl))
+	return fmt.Sprintf("http://%s/t/%s%s", baseAddr, encoded, path), nil
+}
+
+// openBrowser opens url with the platform's default browser
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start browser: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+func runStatus() {
+	var (
+		bucket  = flag.String("async-bucket", "", "S3 bucket the Lambda stores responses in, as passed to awsctl proxy")
+		region  = flag.String("region", "eu-central-1", "AWS region")
+		profile = flag.String("profile", "", "AWS profile to use")
+		wait    = flag.Duration("wait", 0, "Wait this long for a request that is still running")
+	)
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl status [flags] <tracking-id>")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *bucket == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	trackingID := flag.Arg(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *wait+time.Minute)
+	defer cancel()
+	deadline := time.Now().Add(*wait)
+	for {
+		response, err := proxy.FetchAsyncResponse(ctx, *bucket, *region, *profile, trackingID)
+		if err != nil {
+			log.Fatalf("Failed to fetch outcome of %s: %v", trackingID, err)
+		}
+		if response != nil {
+			printResponse(response)
+			return
+		}
+		if time.Now().After(deadline) {
+			fmt.Printf("%s is still running, or its outcome expired\n", trackingID)
+			os.Exit(2)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// printResponse writes the status line, headers and body of response
+func printResponse(response *proxy.ProxyResponse) {
+	fmt.Printf("%d %s\n", response.StatusCode, http.StatusText(response.StatusCode))
+	var names []string
+	for name := range response.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range response.Headers[name] {
+			fmt.Printf("%s: %s\n", name, value)
+		}
+	}
+	fmt.Println()
+
+	if response.Encrypted {
+		fmt.Println("(body encrypted with the request's data key)")
+		return
+	}
+	body, err := base64.StdEncoding.DecodeString(response.Body)
+	if err != nil {
+		body = []byte(response.Body)
+	}
+	os.Stdout.Write(body)
+}
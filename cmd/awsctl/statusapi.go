@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// statusPath serves the state of the running proxy as JSON, for editor
+// extensions and scripts
+const statusPath = "/_awsctl/status"
+
+// credentialsTimeout bounds retrieving a session's credentials for a status
+// report, which may refresh them
+const credentialsTimeout = 5 * time.Second
+
+// proxyStatus is the body of statusPath
+type proxyStatus struct {
+	Version   string          `json:"version"`
+	StartedAt time.Time       `json:"startedAt"`
+	Listen    []string        `json:"listen"`
+	PacURL    string          `json:"pacUrl,omitempty"`
+	Sessions  []sessionStatus `json:"sessions"`
+	Targets   []targetStatus  `json:"targets"`
+}
+
+// sessionStatus describes a session, the default one has no name
+type sessionStatus struct {
+	sessionInfo
+	Credentials credentialsStatus `json:"credentials"`
+	Stats       proxy.ServerStats `json:"stats"`
+}
+
+// credentialsStatus describes the AWS credentials of a session. Expires is
+// nil for credentials that don't expire.
+type credentialsStatus struct {
+	Source  string     `json:"source,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+type targetStatus struct {
+	Alias    string `json:"alias"`
+	URL      string `json:"url"`
+	ProxyURL string `json:"proxyUrl"`
+}
+
+// statusSession is a session as the status handler sees it
+type statusSession struct {
+	info   sessionInfo
+	server *proxy.Server
+	// credentials are nil if the AWS config failed to load, loadErr says why
+	credentials aws.CredentialsProvider
+	loadErr     error
+}
+
+// statusHandler reports the listeners, targets, credential expiry, Lambda
+// version and error counters of every session
+type statusHandler struct {
+	started  time.Time
+	listen   []string
+	pacURL   string
+	baseURL  string
+	targets  *proxy.Targets
+	sessions []statusSession
+}
+
+// addSession adds a session to the report, loading its AWS config for the
+// credentials
+func (h *statusHandler) addSession(ctx context.Context, s session, info sessionInfo, server *proxy.Server) {
+	session := statusSession{info: info, server: server}
+	awsCfg, err := proxy.LoadAWSConfig(ctx, s.region, s.profile)
+	if err != nil {
+		session.loadErr = err
+	} else {
+		session.credentials = awsCfg.Credentials
+	}
+	h.sessions = append(h.sessions, session)
+}
+
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := proxyStatus{
+		Version:   version,
+		StartedAt: h.started,
+		Listen:    h.listen,
+		PacURL:    h.pacURL,
+		Sessions:  []sessionStatus{},
+		Targets:   []targetStatus{},
+	}
+	for _, s := range h.sessions {
+		status.Sessions = append(status.Sessions, sessionStatus{
+			sessionInfo: s.info,
+			Credentials: s.credentialsStatus(r.Context()),
+			Stats:       s.server.Stats(),
+		})
+	}
+	for alias, t := range h.targets.Targets {
+		status.Targets = append(status.Targets, targetStatus{Alias: alias, URL: t.URL, ProxyURL: h.baseURL + proxy.TargetPath(t.URL)})
+	}
+	sort.Slice(status.Targets, func(i, j int) bool { return status.Targets[i].Alias < status.Targets[j].Alias })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(status)
+}
+
+// credentialsStatus retrieves the session's credentials from the SDK's
+// cache, refreshing them if they expired
+func (s statusSession) credentialsStatus(ctx context.Context) credentialsStatus {
+	if s.credentials == nil {
+		if s.loadErr != nil {
+			return credentialsStatus{Error: s.loadErr.Error()}
+		}
+		return credentialsStatus{Error: "failed to find AWS credentials"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, credentialsTimeout)
+	defer cancel()
+	credentials, err := s.credentials.Retrieve(ctx)
+	if err != nil {
+		return credentialsStatus{Error: err.Error()}
+	}
+	status := credentialsStatus{Source: credentials.Source}
+	if credentials.CanExpire {
+		expires := credentials.Expires.UTC()
+		status.Expires = &expires
+	}
+	return status
+}
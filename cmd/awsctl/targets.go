@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigateway"
+	apigatewaytypes "github.com/aws/aws-sdk-go-v2/service/apigateway/types"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewayv2"
+	apigatewayv2types "github.com/aws/aws-sdk-go-v2/service/apigatewayv2/types"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbtypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdtypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/jkblume/awsctl/pkg/proxy"
+	"golang.org/x/term"
+)
+
+// discoveredTarget is a private API found by awsctl targets discover
+type discoveredTarget struct {
+	alias string
+	url   string
+	// kind is rest-api, http-api, alb or cloudmap
+	kind   string
+	detail string
+}
+
+// targetDiscoverer lists the private APIs of one kind
+type targetDiscoverer struct {
+	name     string
+	discover func(ctx context.Context, awsCfg aws.Config) ([]discoveredTarget, error)
+}
+
+var targetDiscoverers = []targetDiscoverer{
+	{"private REST APIs", discoverRestAPIs},
+	{"HTTP APIs", discoverHTTPAPIs},
+	{"internal ALBs", discoverLoadBalancers},
+	{"Cloud Map services", discoverCloudMapServices},
+}
+
+// discoverRestAPIs lists a target per stage of the private REST APIs, which
+// the Lambda reaches through the VPC's execute-api endpoint with private DNS
+func discoverRestAPIs(ctx context.Context, awsCfg aws.Config) ([]discoveredTarget, error) {
+	client := apigateway.NewFromConfig(awsCfg)
+	var found []discoveredTarget
+	pages := apigateway.NewGetRestApisPaginator(client, &apigateway.GetRestApisInput{})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list REST APIs: %w", err)
+		}
+		for _, api := range page.Items {
+			if api.EndpointConfiguration == nil || !slices.Contains(api.EndpointConfiguration.Types, apigatewaytypes.EndpointTypePrivate) {
+				continue
+			}
+			stages, err := client.GetStages(ctx, &apigateway.GetStagesInput{RestApiId: api.Id})
+			if err != nil {
+				return nil, fmt.Errorf("list stages of %s: %w", aws.ToString(api.Name), err)
+			}
+			for _, stage := range stages.Item {
+				name := aws.ToString(stage.StageName)
+				found = append(found, discoveredTarget{
+					alias:  aliasFor(aws.ToString(api.Name), name, len(stages.Item)),
+					url:    fmt.Sprintf("https://%s.execute-api.%s.amazonaws.com/%s", aws.ToString(api.Id), awsCfg.Region, name),
+					kind:   "rest-api",
+					detail: aws.ToString(api.Name) + " stage " + name,
+				})
+			}
+		}
+	}
+	return found, nil
+}
+
+// discoverHTTPAPIs lists a target per stage of the HTTP APIs with their
+// default endpoint, e.g. for APIs restricted to IAM authorization
+func discoverHTTPAPIs(ctx context.Context, awsCfg aws.Config) ([]discoveredTarget, error) {
+	client := apigatewayv2.NewFromConfig(awsCfg)
+	var found []discoveredTarget
+	input := &apigatewayv2.GetApisInput{}
+	for {
+		page, err := client.GetApis(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("list HTTP APIs: %w", err)
+		}
+		for _, api := range page.Items {
+			if api.ProtocolType != apigatewayv2types.ProtocolTypeHttp || aws.ToBool(api.DisableExecuteApiEndpoint) {
+				continue
+			}
+			stages, err := client.GetStages(ctx, &apigatewayv2.GetStagesInput{ApiId: api.ApiId})
+			if err != nil {
+				return nil, fmt.Errorf("list stages of %s: %w", aws.ToString(api.Name), err)
+			}
+			for _, stage := range stages.Items {
+				name := aws.ToString(stage.StageName)
+				url := aws.ToString(api.ApiEndpoint)
+				if name != "$default" {
+					url += "/" + name
+				}
+				found = append(found, discoveredTarget{
+					alias:  aliasFor(aws.ToString(api.Name), strings.TrimPrefix(name, "$"), len(stages.Items)),
+					url:    url,
+					kind:   "http-api",
+					detail: aws.ToString(api.Name) + " stage " + name,
+				})
+			}
+		}
+		if page.NextToken == nil {
+			return found, nil
+		}
+		input.NextToken = page.NextToken
+	}
+}
+
+// discoverLoadBalancers lists the internal application load balancers by
+// their DNS name, over HTTPS if they have an HTTPS listener
+func discoverLoadBalancers(ctx context.Context, awsCfg aws.Config) ([]discoveredTarget, error) {
+	client := elasticloadbalancingv2.NewFromConfig(awsCfg)
+	var found []discoveredTarget
+	pages := elasticloadbalancingv2.NewDescribeLoadBalancersPaginator(client, &elasticloadbalancingv2.DescribeLoadBalancersInput{})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list load balancers: %w", err)
+		}
+		for _, lb := range page.LoadBalancers {
+			if lb.Scheme != elbtypes.LoadBalancerSchemeEnumInternal || lb.Type != elbtypes.LoadBalancerTypeEnumApplication {
+				continue
+			}
+			listeners, err := client.DescribeListeners(ctx, &elasticloadbalancingv2.DescribeListenersInput{LoadBalancerArn: lb.LoadBalancerArn})
+			if err != nil {
+				return nil, fmt.Errorf("list listeners of %s: %w", aws.ToString(lb.LoadBalancerName), err)
+			}
+			url := listenerURL(aws.ToString(lb.DNSName), listeners.Listeners)
+			if url == "" {
+				continue
+			}
+			found = append(found, discoveredTarget{
+				alias:  aliasFor(aws.ToString(lb.LoadBalancerName), "", 1),
+				url:    url,
+				kind:   "alb",
+				detail: aws.ToString(lb.LoadBalancerName) + " in " + aws.ToString(lb.VpcId),
+			})
+		}
+	}
+	return found, nil
+}
+
+// listenerURL returns the URL of the HTTPS listener of a load balancer, or
+// of its HTTP listener, preferring the default ports
+func listenerURL(dnsName string, listeners []elbtypes.Listener) string {
+	var best *elbtypes.Listener
+	rank := func(l *elbtypes.Listener) int {
+		r := 0
+		if l.Protocol == elbtypes.ProtocolEnumHttps {
+			r += 2
+		}
+		if port := aws.ToInt32(l.Port); port == 443 || port == 80 {
+			r++
+		}
+		return r
+	}
+	for i := range listeners {
+		l := &listeners[i]
+		if l.Protocol != elbtypes.ProtocolEnumHttps && l.Protocol != elbtypes.ProtocolEnumHttp {
+			continue
+		}
+		if best == nil || rank(l) > rank(best) {
+			best = l
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	scheme, defaultPort := "http", int32(80)
+	if best.Protocol == elbtypes.ProtocolEnumHttps {
+		scheme, defaultPort = "https", 443
+	}
+	if port := aws.ToInt32(best.Port); port != defaultPort {
+		return fmt.Sprintf("%s://%s:%d", scheme, dnsName, port)
+	}
+	return fmt.Sprintf("%s://%s", scheme, dnsName)
+}
+
+// discoverCloudMapServices lists the services of private DNS namespaces by
+// their DNS name, with the port of a registered instance
+func discoverCloudMapServices(ctx context.Context, awsCfg aws.Config) ([]discoveredTarget, error) {
+	client := servicediscovery.NewFromConfig(awsCfg)
+	var found []discoveredTarget
+	namespaces := servicediscovery.NewListNamespacesPaginator(client, &servicediscovery.ListNamespacesInput{
+		Filters: []sdtypes.NamespaceFilter{{
+			Name:      sdtypes.NamespaceFilterNameType,
+			Values:    []string{string(sdtypes.NamespaceTypeDnsPrivate)},
+			Condition: sdtypes.FilterConditionEq,
+		}},
+	})
+	for namespaces.HasMorePages() {
+		page, err := namespaces.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list namespaces: %w", err)
+		}
+		for _, namespace := range page.Namespaces {
+			services := servicediscovery.NewListServicesPaginator(client, &servicediscovery.ListServicesInput{
+				Filters: []sdtypes.ServiceFilter{{
+					Name:      sdtypes.ServiceFilterNameNamespaceId,
+					Values:    []string{aws.ToString(namespace.Id)},
+					Condition: sdtypes.FilterConditionEq,
+				}},
+			})
+			for services.HasMorePages() {
+				page, err := services.NextPage(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("list services of %s: %w", aws.ToString(namespace.Name), err)
+				}
+				for _, service := range page.Services {
+					host := aws.ToString(service.Name) + "." + aws.ToString(namespace.Name)
+					url := "http://" + host
+					instances, err := client.ListInstances(ctx, &servicediscovery.ListInstancesInput{ServiceId: service.Id, MaxResults: aws.Int32(1)})
+					if err != nil {
+						return nil, fmt.Errorf("list instances of %s: %w", host, err)
+					}
+					if len(instances.Instances) > 0 {
+						if port := instances.Instances[0].Attributes["AWS_INSTANCE_PORT"]; port != "" && port != "80" {
+							url += ":" + port
+						}
+					}
+					found = append(found, discoveredTarget{
+						alias:  aliasFor(aws.ToString(service.Name), "", 1),
+						url:    url,
+						kind:   "cloudmap",
+						detail: host,
+					})
+				}
+			}
+		}
+	}
+	return found, nil
+}
+
+var aliasInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+
+// aliasFor derives an alias from the name of an API, with the stage if it
+// has several
+func aliasFor(name, stage string, stages int) string {
+	alias := strings.Trim(aliasInvalid.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if stages > 1 && stage != "" {
+		alias += "-" + strings.Trim(aliasInvalid.ReplaceAllString(strings.ToLower(stage), "-"), "-")
+	}
+	if alias == "" {
+		alias = "target"
+	}
+	return alias
+}
+
+// newDiscoveredTargets drops the targets whose URL the targets file has and
+// makes the aliases unique
+func newDiscoveredTargets(found []discoveredTarget, targets *proxy.Targets) []discoveredTarget {
+	taken := map[string]bool{}
+	known := map[string]bool{}
+	for alias, t := range targets.Targets {
+		taken[alias] = true
+		known[strings.TrimSuffix(t.URL, "/")] = true
+	}
+	var fresh []discoveredTarget
+	for _, t := range found {
+		if known[strings.TrimSuffix(t.url, "/")] {
+			continue
+		}
+		alias := t.alias
+		for n := 2; taken[alias]; n++ {
+			alias = fmt.Sprintf("%s-%d", t.alias, n)
+		}
+		taken[alias] = true
+		t.alias = alias
+		fresh = append(fresh, t)
+	}
+	return fresh
+}
+
+// parseSelection parses numbers and ranges like 1,3-4 or all into indexes
+// of a list of n items
+func parseSelection(value string, n int) ([]int, error) {
+	if strings.TrimSpace(value) == "all" {
+		all := make([]int, n)
+		for i := range all {
+			all[i] = i
+		}
+		return all, nil
+	}
+	var indexes []int
+	for _, item := range splitList(value) {
+		first, last, isRange := strings.Cut(item, "-")
+		from, err := strconv.Atoi(first)
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(last)
+		}
+		if err != nil || from < 1 || to > n || from > to {
+			return nil, fmt.Errorf("failed to parse %q: expected numbers from 1 to %d", item, n)
+		}
+		for i := from; i <= to; i++ {
+			if !slices.Contains(indexes, i-1) {
+				indexes = append(indexes, i-1)
+			}
+		}
+	}
+	return indexes, nil
+}
+
+func runTargets() {
+	commands := map[string]func(){
+		"discover": runTargetsDiscover,
+		"export":   runTargetsExport,
+	}
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Println("Usage: awsctl targets <command> [flags]")
+		fmt.Println("Commands:")
+		fmt.Println("  discover  Add private APIs, internal ALBs and Cloud Map services of an account as targets")
+		fmt.Println("  export    Write a Postman collection or OpenAPI overlay calling the targets through the proxy")
+		os.Exit(1)
+	}
+	command := commands[os.Args[1]]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	command()
+}
+
+func runTargetsDiscover() {
+	var (
+		region      = flag.String("region", "eu-central-1", "AWS region")
+		profile     = flag.String("profile", "", "AWS profile to use")
+		targetsFile = flag.String("targets", "", "Targets file to add the targets to (default ~/.awsctl/targets.json)")
+		all         = flag.Bool("all", false, "Add all discovered targets without asking")
+	)
+	flag.Usage = func() {
+		fmt.Println("Usage: awsctl targets discover [flags]")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// A missing file is created
+	targets := &proxy.Targets{Targets: map[string]proxy.Target{}}
+	if _, err := os.Stat(*targetsFile); *targetsFile == "" || !errors.Is(err, os.ErrNotExist) {
+		if targets, err = proxy.LoadTargets(*targetsFile); err != nil {
+			log.Fatalf("Failed to load targets: %v", err)
+		}
+	}
+	ctx := context.Background()
+	awsCfg, err := proxy.LoadAWSConfig(ctx, *region, *profile)
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+
+	var found []discoveredTarget
+	for _, d := range targetDiscoverers {
+		discovered, err := d.discover(ctx, awsCfg)
+		if err != nil {
+			log.Printf("Failed to discover %s: %v", d.name, err)
+			continue
+		}
+		found = append(found, discovered...)
+	}
+	found = newDiscoveredTargets(found, targets)
+	if len(found) == 0 {
+		fmt.Println("No new targets found")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tALIAS\tKIND\tURL\tSOURCE")
+	for i, t := range found {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", i+1, t.alias, t.kind, t.url, t.detail)
+	}
+	w.Flush()
+
+	var selected []int
+	switch {
+	case *all:
+		selected, _ = parseSelection("all", len(found))
+	case term.IsTerminal(int(os.Stdin.Fd())):
+		input := bufio.NewReader(os.Stdin)
+		for {
+			answer, err := prompt(input, "\nAdd which targets (e.g. 1,3-4 or all, empty for none): ", false)
+			if err != nil {
+				log.Fatalf("Failed to read choice: %v", err)
+			}
+			if selected, err = parseSelection(answer, len(found)); err == nil {
+				break
+			}
+			fmt.Fprintln(os.Stderr, err)
+		}
+	default:
+		fmt.Println("\nRun in a terminal to pick targets, or add them all with -all.")
+		return
+	}
+	if len(selected) == 0 {
+		return
+	}
+
+	add := map[string]proxy.Target{}
+	for _, i := range selected {
+		add[found[i].alias] = proxy.Target{URL: found[i].url}
+	}
+	if err := proxy.AddTargets(*targetsFile, add); err != nil {
+		log.Fatalf("Failed to add targets: %v", err)
+	}
+	fmt.Printf("Added %d targets\n", len(add))
+}
@@ -0,0 +1,93 @@
+package ingress
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// AsyncResponseBucketEnv names the S3 bucket responses to asynchronous
+// invocations are stored in
+const AsyncResponseBucketEnv = "ASYNC_RESPONSE_BUCKET"
+
+// AsyncResponsePrefix is the key prefix of stored responses, e.g. for a
+// lifecycle rule deleting those nobody collected
+const AsyncResponsePrefix = "awsctl-responses/"
+
+// responseKeyPattern keeps response keys to random IDs, so an envelope can't
+// write elsewhere in the bucket
+var responseKeyPattern = regexp.MustCompile(`^[0-9a-f]{16,64}$`)
+
+var s3Client = sync.OnceValues(func() (*s3.Client, error) {
+	awsCfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	return s3.NewFromConfig(awsCfg), nil
+})
+
+// AsyncResponseKey returns the S3 key the response to the envelope with
+// responseKey is stored under
+func AsyncResponseKey(responseKey string) string {
+	return AsyncResponsePrefix + responseKey + ".json"
+}
+
+// IsResponseKey reports whether responseKey is a valid ResponseKey
+func IsResponseKey(responseKey string) bool {
+	return responseKeyPattern.MatchString(responseKey)
+}
+
+// handleAsync runs request, which Handler has admitted, and stores the
+// response in the bucket instead of returning it, for the CLI to collect
+// after invoking asynchronously
+func handleAsync(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	responseKey := request.ResponseKey
+	if !IsResponseKey(responseKey) {
+		return &ProxyResponse{
+			StatusCode: 400,
+			Body:       "failed to store response: invalid response key",
+		}, nil
+	}
+	bucket := os.Getenv(AsyncResponseBucketEnv)
+	if bucket == "" {
+		log.Printf("Dropped response %s: %s is not set", responseKey, AsyncResponseBucketEnv)
+		return &ProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("failed to store response: %s is not set", AsyncResponseBucketEnv),
+		}, nil
+	}
+
+	response, err := forward(ctx, request)
+	if err != nil {
+		response = &ProxyResponse{StatusCode: 502, Body: err.Error()}
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("marshal response: %w", err)
+	}
+
+	client, err := s3Client()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         aws.String(AsyncResponseKey(responseKey)),
+		Body:        bytes.NewReader(responseJSON),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return nil, fmt.Errorf("store response: %w", err)
+	}
+	// Only the status is returned, the output of a Step Functions execution
+	// is limited to 256 KB
+	return &ProxyResponse{StatusCode: response.StatusCode, Rejected: response.Rejected}, nil
+}
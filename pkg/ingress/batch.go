@@ -0,0 +1,49 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	// MaxBatch caps the sub-requests of a batch envelope
+	MaxBatch = 25
+	// batchConcurrency caps the sub-requests of a batch running at a time
+	batchConcurrency = 10
+)
+
+// handleBatch runs the sub-requests of a batch envelope concurrently through
+// Handler, so each one is verified, authorized and forwarded as if it had
+// been invoked on its own. A failing sub-request fails only its response.
+func handleBatch(ctx context.Context, batch []ProxyRequest) *ProxyResponse {
+	if len(batch) > MaxBatch {
+		return &ProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("failed to run batch: %d requests exceed the limit of %d", len(batch), MaxBatch),
+		}
+	}
+
+	responses := make([]ProxyResponse, len(batch))
+	slots := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, request := range batch {
+		if len(request.Batch) > 0 {
+			responses[i] = ProxyResponse{StatusCode: 400, Body: "failed to run batch: batches can't be nested"}
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			response, err := Handler(ctx, request)
+			if err != nil {
+				response = &ProxyResponse{StatusCode: 502, Body: err.Error()}
+			}
+			responses[i] = *response
+		}()
+	}
+	wg.Wait()
+	return &ProxyResponse{StatusCode: 200, Batch: responses}
+}
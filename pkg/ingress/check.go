@@ -0,0 +1,298 @@
+package ingress
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schemes of privateApiUrl values that ask for a connectivity check instead
+// of an HTTP call: tcp://host:port connects, tls://host:port also completes
+// a TLS handshake
+const (
+	tcpCheckScheme = "tcp"
+	tlsCheckScheme = "tls"
+)
+
+// MaxProbes caps the connects of a probe, tcp://host:port?probes=n. A
+// probe of a host dropping packets then ends within the default Lambda
+// timeout.
+const MaxProbes = 5
+
+// probeInterval separates the connects of a probe
+const probeInterval = 200 * time.Millisecond
+
+// Phases of a check, CheckResult.FailedPhase names the one that failed
+const (
+	CheckPhaseResolve = "resolve"
+	CheckPhaseConnect = "connect"
+	CheckPhaseTLS     = "tls"
+)
+
+// CheckResult reports what the Lambda saw connecting to a check target
+type CheckResult struct {
+	// Addresses are the IP addresses the host resolved to
+	Addresses []string `json:"addresses,omitempty"`
+	ResolveMs int64    `json:"resolveMs"`
+	// RemoteAddress is the address that accepted the connection
+	RemoteAddress string    `json:"remoteAddress,omitempty"`
+	LocalAddress  string    `json:"localAddress,omitempty"`
+	ConnectMs     int64     `json:"connectMs,omitempty"`
+	TLS           *TLSCheck `json:"tls,omitempty"`
+	// Probes are the connects of a probe in their order
+	Probes []CheckProbe `json:"probes,omitempty"`
+	// FailedPhase is resolve, connect or tls if the check failed
+	FailedPhase string `json:"failedPhase,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// CheckProbe is one connect of a probe
+type CheckProbe struct {
+	ConnectMs int64  `json:"connectMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// TLSCheck describes the TLS handshake of a check. The handshake accepts
+// any certificate like upstream calls do, the chain is returned as
+// presented by the server.
+type TLSCheck struct {
+	ServerName  string `json:"serverName,omitempty"`
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipherSuite"`
+	// ALPN is the application protocol the server chose, h2 or http/1.1
+	ALPN        string `json:"alpn,omitempty"`
+	HandshakeMs int64  `json:"handshakeMs"`
+	// Verified means the chain is valid for the host against the Lambda's
+	// system roots, VerifyError says why not
+	Verified     bool               `json:"verified"`
+	VerifyError  string             `json:"verifyError,omitempty"`
+	Certificates []CheckCertificate `json:"certificates"`
+}
+
+// CheckCertificate is a certificate of the chain a server presented
+type CheckCertificate struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dnsNames,omitempty"`
+	IPAddresses []string  `json:"ipAddresses,omitempty"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	// SHA256 is the fingerprint of the certificate, hex encoded
+	SHA256 string `json:"sha256"`
+	PEM    string `json:"pem"`
+}
+
+// isCheck reports whether privateApiUrl asks for a connectivity check
+func isCheck(privateApiUrl string) bool {
+	return strings.HasPrefix(privateApiUrl, tcpCheckScheme+"://") || strings.HasPrefix(privateApiUrl, tlsCheckScheme+"://")
+}
+
+// handleCheck connects to the host and port of request's privateApiUrl the
+// way upstream calls do, with the host overrides, DNS_SERVER and timeouts of
+// the envelope, but never through a forward proxy. A probes query parameter
+// on a tcp:// target repeats the connect to measure latency and loss.
+func handleCheck(ctx context.Context, request ProxyRequest) *ProxyResponse {
+	target, err := url.Parse(request.PrivateApiUrl)
+	if err != nil || target.Hostname() == "" || target.Port() == "" || (target.Path != "" && target.Path != "/") {
+		return &ProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("failed to check %q: expected tcp://host:port or tls://host:port", request.PrivateApiUrl),
+		}
+	}
+	probes, err := parseProbes(target)
+	if err != nil {
+		return &ProxyResponse{
+			StatusCode: 400,
+			Body:       err.Error(),
+		}
+	}
+	limits, err := resolveTimeouts(request.Timeouts)
+	if err != nil {
+		return &ProxyResponse{
+			StatusCode: 400,
+			Body:       err.Error(),
+		}
+	}
+
+	result := &CheckResult{}
+	response := &ProxyResponse{StatusCode: 502, Check: result}
+	fail := func(phase string, err error) *ProxyResponse {
+		result.FailedPhase = phase
+		result.Error = err.Error()
+		return response
+	}
+
+	host, port := target.Hostname(), target.Port()
+	dialer := &upstreamDialer{
+		resolver:      upstreamResolver(os.Getenv(DNSServerEnv)),
+		hostOverrides: request.HostOverrides,
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, limits.dial)
+	defer cancel()
+	start := time.Now()
+	result.Addresses, err = dialer.lookup(dialCtx, host)
+	result.ResolveMs = time.Since(start).Milliseconds()
+	if err != nil {
+		return fail(CheckPhaseResolve, err)
+	}
+	if probes > 0 {
+		probe(ctx, result, net.JoinHostPort(result.Addresses[0], port), probes, min(dialAttemptTimeout, limits.dial))
+		if result.RemoteAddress != "" {
+			response.StatusCode = 200
+		}
+		return response
+	}
+
+	// Unlike upstream calls a check tries the addresses only once, and
+	// reports the last error
+	var conn net.Conn
+	start = time.Now()
+	for _, ip := range result.Addresses {
+		d := net.Dialer{Timeout: min(dialAttemptTimeout, limits.dial)}
+		conn, err = d.DialContext(dialCtx, "tcp", net.JoinHostPort(ip, port))
+		if err == nil || dialCtx.Err() != nil {
+			break
+		}
+	}
+	result.ConnectMs = time.Since(start).Milliseconds()
+	if err != nil {
+		return fail(CheckPhaseConnect, err)
+	}
+	defer conn.Close()
+	result.RemoteAddress = conn.RemoteAddr().String()
+	result.LocalAddress = conn.LocalAddr().String()
+
+	if target.Scheme == tlsCheckScheme {
+		config := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}}
+		if net.ParseIP(host) == nil {
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		tlsCtx, cancel := context.WithTimeout(ctx, limits.tlsHandshake)
+		defer cancel()
+		start = time.Now()
+		err := tlsConn.HandshakeContext(tlsCtx)
+		handshakeMs := time.Since(start).Milliseconds()
+		if err != nil {
+			return fail(CheckPhaseTLS, err)
+		}
+		state := tlsConn.ConnectionState()
+		result.TLS = &TLSCheck{
+			ServerName:  config.ServerName,
+			Version:     tls.VersionName(state.Version),
+			CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+			ALPN:        state.NegotiatedProtocol,
+			HandshakeMs: handshakeMs,
+		}
+		if err := verifyChain(state.PeerCertificates, host); err != nil {
+			result.TLS.VerifyError = err.Error()
+		} else {
+			result.TLS.Verified = true
+		}
+		for _, cert := range state.PeerCertificates {
+			fingerprint := sha256.Sum256(cert.Raw)
+			checked := CheckCertificate{
+				Subject:   cert.Subject.String(),
+				Issuer:    cert.Issuer.String(),
+				DNSNames:  cert.DNSNames,
+				NotBefore: cert.NotBefore,
+				NotAfter:  cert.NotAfter,
+				SHA256:    hex.EncodeToString(fingerprint[:]),
+				PEM:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+			}
+			for _, ip := range cert.IPAddresses {
+				checked.IPAddresses = append(checked.IPAddresses, ip.String())
+			}
+			result.TLS.Certificates = append(result.TLS.Certificates, checked)
+		}
+	}
+
+	response.StatusCode = 200
+	return response
+}
+
+// verifyChain verifies the chain a server presented for host against the
+// system roots, the way a client without skip-verify would
+func verifyChain(chain []*x509.Certificate, host string) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("failed to verify chain: the server sent no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+	return err
+}
+
+// parseProbes returns the probes query parameter of a check target, 0 if
+// there is none
+func parseProbes(target *url.URL) (int, error) {
+	query := target.Query()
+	for name := range query {
+		if name != "probes" {
+			return 0, fmt.Errorf("failed to check %s: unknown parameter %q", target.Redacted(), name)
+		}
+	}
+	value := query.Get("probes")
+	if value == "" {
+		return 0, nil
+	}
+	probes, err := strconv.Atoi(value)
+	if err != nil || probes < 1 || probes > MaxProbes {
+		return 0, fmt.Errorf("failed to check %s: probes must be between 1 and %d", target.Redacted(), MaxProbes)
+	}
+	if target.Scheme != tcpCheckScheme {
+		return 0, fmt.Errorf("failed to check %s: only tcp:// targets can be probed", target.Redacted())
+	}
+	return probes, nil
+}
+
+// probe connects to address n times, each bounded by timeout, and records
+// every connect in result. Unlike a check it sticks to one address, so the
+// connects measure the same path like the rounds of a traceroute. Probes
+// that fail set the failed phase only if none succeeded.
+func probe(ctx context.Context, result *CheckResult, address string, n int, timeout time.Duration) {
+	var lastErr error
+	for i := range n {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				lastErr = ctx.Err()
+				result.Probes = append(result.Probes, CheckProbe{Error: lastErr.Error()})
+				continue
+			case <-time.After(probeInterval):
+			}
+		}
+		d := net.Dialer{Timeout: timeout}
+		start := time.Now()
+		conn, err := d.DialContext(ctx, "tcp", address)
+		probe := CheckProbe{ConnectMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			lastErr = err
+			probe.Error = err.Error()
+		} else {
+			if result.RemoteAddress == "" {
+				result.RemoteAddress = conn.RemoteAddr().String()
+				result.LocalAddress = conn.LocalAddr().String()
+				result.ConnectMs = probe.ConnectMs
+			}
+			conn.Close()
+		}
+		result.Probes = append(result.Probes, probe)
+	}
+	if result.RemoteAddress == "" {
+		result.FailedPhase = CheckPhaseConnect
+		result.Error = lastErr.Error()
+	}
+}
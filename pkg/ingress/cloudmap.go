@@ -0,0 +1,142 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	sdtypes "github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+)
+
+// cloudMapScheme prefixes privateApiUrl values naming an AWS Cloud Map
+// service, such as cloudmap://internal.local/orders
+const cloudMapScheme = "cloudmap://"
+
+// cloudMapCacheTTL is how long a warm Lambda reuses the instances of a
+// service, each request still picks one of them at random
+const cloudMapCacheTTL = 5 * time.Second
+
+// cloudMapAPITimeout bounds the API call before falling back to DNS, without
+// a VPC endpoint for Cloud Map it would wait for the connect to time out
+const cloudMapAPITimeout = 3 * time.Second
+
+var serviceDiscoveryClient = sync.OnceValues(func() (*servicediscovery.Client, error) {
+	awsCfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	return servicediscovery.NewFromConfig(awsCfg), nil
+})
+
+// cloudMapInstances caches the addresses of services by namespace/service
+var cloudMapInstances = struct {
+	mu      sync.Mutex
+	entries map[string]cloudMapEntry
+}{entries: map[string]cloudMapEntry{}}
+
+type cloudMapEntry struct {
+	addresses []string
+	expires   time.Time
+}
+
+// parseCloudMapURL splits cloudmap://namespace/service
+func parseCloudMapURL(apiEndpoint string) (namespace, service string, err error) {
+	rest := strings.TrimSuffix(strings.TrimPrefix(apiEndpoint, cloudMapScheme), "/")
+	namespace, service, ok := strings.Cut(rest, "/")
+	if !ok || namespace == "" || service == "" || strings.Contains(service, "/") {
+		return "", "", fmt.Errorf("failed to use Cloud Map service %q: expected cloudmap://namespace/service", apiEndpoint)
+	}
+	return namespace, service, nil
+}
+
+// resolveCloudMap returns the http:// endpoint of a healthy instance of the
+// service in namespace. Instances are discovered through the Cloud Map API,
+// or through the service's SRV record if the API can't be reached, e.g.
+// from a VPC without an endpoint for it.
+func resolveCloudMap(ctx context.Context, namespace, service string) (string, error) {
+	key := namespace + "/" + service
+	cloudMapInstances.mu.Lock()
+	entry, ok := cloudMapInstances.entries[key]
+	cloudMapInstances.mu.Unlock()
+
+	if !ok || time.Now().After(entry.expires) {
+		addresses, err := discoverInstances(ctx, namespace, service)
+		if err != nil {
+			log.Printf("Failed to discover instances of %s, trying DNS: %v", key, err)
+			addresses, err = lookupSRV(ctx, namespace, service)
+			if err != nil {
+				return "", err
+			}
+		}
+		if len(addresses) == 0 {
+			return "", fmt.Errorf("failed to resolve Cloud Map service %s: no instances", key)
+		}
+		entry = cloudMapEntry{addresses: addresses, expires: time.Now().Add(cloudMapCacheTTL)}
+		cloudMapInstances.mu.Lock()
+		cloudMapInstances.entries[key] = entry
+		cloudMapInstances.mu.Unlock()
+	}
+	return "http://" + entry.addresses[rand.IntN(len(entry.addresses))], nil
+}
+
+// discoverInstances returns the addresses of the healthy instances of a
+// service, or of all if none is healthy
+func discoverInstances(ctx context.Context, namespace, service string) ([]string, error) {
+	client, err := serviceDiscoveryClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cloudMapAPITimeout)
+	defer cancel()
+	output, err := client.DiscoverInstances(ctx, &servicediscovery.DiscoverInstancesInput{
+		NamespaceName: aws.String(namespace),
+		ServiceName:   aws.String(service),
+		HealthStatus:  sdtypes.HealthStatusFilterHealthyOrElseAll,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("discover instances: %w", err)
+	}
+	var addresses []string
+	for _, instance := range output.Instances {
+		ip := instance.Attributes["AWS_INSTANCE_IPV4"]
+		if ip == "" {
+			continue
+		}
+		port := instance.Attributes["AWS_INSTANCE_PORT"]
+		if port == "" {
+			port = "80"
+		}
+		addresses = append(addresses, net.JoinHostPort(ip, port))
+	}
+	return addresses, nil
+}
+
+// lookupSRV returns the targets of the SRV record Cloud Map maintains for
+// services of DNS namespaces registered with one
+func lookupSRV(ctx context.Context, namespace, service string) ([]string, error) {
+	resolver := upstreamResolver(os.Getenv(DNSServerEnv))
+	_, records, err := resolver.LookupSRV(ctx, "", "", service+"."+namespace)
+	if err != nil {
+		return nil, fmt.Errorf("resolve SRV record of %s.%s: %w", service, namespace, err)
+	}
+	// Instances of a lower priority are only for failover
+	var addresses []string
+	for _, record := range records {
+		if record.Priority != records[0].Priority {
+			break
+		}
+		target := strings.TrimSuffix(record.Target, ".")
+		addresses = append(addresses, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+	}
+	return addresses, nil
+}
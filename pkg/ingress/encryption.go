@@ -0,0 +1,99 @@
+package ingress
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// maxCachedDataKeys bounds the decrypted data keys kept by a warm Lambda
+const maxCachedDataKeys = 100
+
+var dataKeyCache = struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}{keys: make(map[string][]byte)}
+
+// EncryptBody seals plaintext with AES-256-GCM under dataKey and returns the
+// base64 of nonce and ciphertext, ready for an envelope body
+func EncryptBody(dataKey, plaintext []byte) (string, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// DecryptBody opens an envelope body produced by EncryptBody
+func DecryptBody(dataKey []byte, body string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode encrypted body: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("failed to decrypt body: too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt body: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("create GCM: %w", err)
+	}
+	return aead, nil
+}
+
+// decryptDataKey returns the plaintext of a KMS-encrypted data key. The CLI
+// reuses data keys for a while, so decrypted keys are cached.
+func decryptDataKey(ctx context.Context, encryptedKey string) ([]byte, error) {
+	dataKeyCache.mu.Lock()
+	key, ok := dataKeyCache.keys[encryptedKey]
+	dataKeyCache.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode data key: %w", err)
+	}
+	client, err := kmsClient()
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return nil, fmt.Errorf("decrypt data key: %w", err)
+	}
+
+	dataKeyCache.mu.Lock()
+	if len(dataKeyCache.keys) >= maxCachedDataKeys {
+		clear(dataKeyCache.keys)
+	}
+	dataKeyCache.keys[encryptedKey] = out.Plaintext
+	dataKeyCache.mu.Unlock()
+	return out.Plaintext, nil
+}
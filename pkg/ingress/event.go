@@ -0,0 +1,108 @@
+package ingress
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// FunctionURLOnlyEnv marks a deployment that can only be reached through its
+// AWS_IAM function URL because no principal may call lambda:InvokeFunction on
+// it. Only there the caller in the function URL event can be trusted, a
+// direct Invoke can send the same event with any caller.
+const FunctionURLOnlyEnv = "FUNCTION_URL_ONLY"
+
+// verifiedCallerKey carries the IAM-verified caller of a function URL request
+type verifiedCallerKey struct{}
+
+// HandleEvent is the Lambda entry point. It accepts a ProxyRequest from a
+// direct Invoke, a function URL event carrying the ProxyRequest as its body
+// and an SQS event carrying ProxyRequests as message bodies. Function URL
+// responses wrap the ProxyResponse in a 200 response, otherwise the URL
+// would interpret its statusCode and headers itself. With FUNCTION_URL_ONLY
+// set only function URL events are accepted.
+func HandleEvent(ctx context.Context, payload json.RawMessage) (any, error) {
+	functionURLOnly := os.Getenv(FunctionURLOnlyEnv) == "true"
+
+	var probe struct {
+		RequestContext *json.RawMessage `json:"requestContext"`
+		RawPath        *string          `json:"rawPath"`
+		Records        []struct {
+			EventSource string `json:"eventSource"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return nil, fmt.Errorf("unmarshal event: %w", err)
+	}
+
+	isFunctionURL := probe.RequestContext != nil && probe.RawPath != nil
+	if functionURLOnly && !isFunctionURL {
+		return nil, fmt.Errorf("failed to handle event: this function only serves its function URL")
+	}
+
+	if len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:sqs" {
+		var event events.SQSEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("unmarshal SQS event: %w", err)
+		}
+		return handleSQS(ctx, event), nil
+	}
+
+	if !isFunctionURL {
+		var request ProxyRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, fmt.Errorf("unmarshal proxy request: %w", err)
+		}
+		return Handler(ctx, request)
+	}
+
+	var event events.LambdaFunctionURLRequest
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("unmarshal function URL event: %w", err)
+	}
+
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(event.Body)
+		if err != nil {
+			return nil, fmt.Errorf("decode function URL body: %w", err)
+		}
+		body = decoded
+	}
+
+	var request ProxyRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("failed to parse proxy request: %v", err),
+		}, nil
+	}
+
+	// With AWS_IAM auth the function URL reports the verified caller, which
+	// takes precedence over whatever the envelope claims. Anyone allowed to
+	// invoke the function directly can forge the event, so it only counts
+	// where the function URL is the only way in.
+	if authorizer := event.RequestContext.Authorizer; functionURLOnly && authorizer != nil && authorizer.IAM != nil && authorizer.IAM.UserARN != "" {
+		ctx = context.WithValue(ctx, verifiedCallerKey{}, authorizer.IAM.UserARN)
+	}
+
+	response, err := Handler(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("marshal proxy response: %w", err)
+	}
+
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseJSON),
+	}, nil
+}
@@ -0,0 +1,203 @@
+package ingress
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const adminARN = "arn:aws:iam::1:user/admin"
+
+// withAdminPolicy configures a policy that only lets adminARN through
+func withAdminPolicy(t *testing.T) {
+	t.Setenv(PolicySSMParameterEnv, "/awsctl/policy")
+	policyCache.mu.Lock()
+	policyCache.policy = &Policy{Rules: []PolicyRule{{Principals: []string{adminARN}}}}
+	policyCache.loadedAt = time.Now()
+	policyCache.mu.Unlock()
+	t.Cleanup(func() {
+		policyCache.mu.Lock()
+		policyCache.policy = nil
+		policyCache.mu.Unlock()
+	})
+}
+
+// forwardedUsers starts an upstream recording the X-Forwarded-User of every
+// request
+func forwardedUsers(t *testing.T) (*httptest.Server, *[]string) {
+	var users []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		users = append(users, r.Header.Get("X-Forwarded-User"))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &users
+}
+
+// functionURLEvent wraps request in a function URL event claiming callerARN
+func functionURLEvent(t *testing.T, request ProxyRequest, callerARN string) json.RawMessage {
+	t.Helper()
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(map[string]any{
+		"rawPath": "/",
+		"requestContext": map[string]any{
+			"authorizer": map[string]any{"iam": map[string]any{"userArn": callerARN}},
+		},
+		"body": string(body),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+// urlResponse unwraps the ProxyResponse from a function URL response
+func urlResponse(t *testing.T, result any) ProxyResponse {
+	t.Helper()
+	urlResp, ok := result.(events.LambdaFunctionURLResponse)
+	if !ok {
+		t.Fatalf("result = %T, want a function URL response", result)
+	}
+	var response ProxyResponse
+	if err := json.Unmarshal([]byte(urlResp.Body), &response); err != nil {
+		t.Fatalf("failed to parse %q: %v", urlResp.Body, err)
+	}
+	return response
+}
+
+// Regression: a direct Invoke forging a function URL event passed the policy
+// as the caller it claimed
+func TestForgedFunctionURLEventDenied(t *testing.T) {
+	withAdminPolicy(t)
+	upstream, users := forwardedUsers(t)
+
+	result, err := HandleEvent(context.Background(), functionURLEvent(t, ProxyRequest{Method: http.MethodGet, Path: "/", PrivateApiUrl: upstream.URL}, adminARN))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response := urlResponse(t, result); response.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d (%s), want 403", response.StatusCode, response.Body)
+	}
+	if len(*users) != 0 {
+		t.Errorf("upstream was called as %q, want no call", *users)
+	}
+}
+
+func TestForgedFunctionURLEventNotAttributed(t *testing.T) {
+	upstream, users := forwardedUsers(t)
+
+	result, err := HandleEvent(context.Background(), functionURLEvent(t, ProxyRequest{Method: http.MethodGet, Path: "/", PrivateApiUrl: upstream.URL}, adminARN))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response := urlResponse(t, result); response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", response.StatusCode, response.Body)
+	}
+	if len(*users) != 1 || (*users)[0] != "" {
+		t.Errorf("X-Forwarded-User = %q, want none", *users)
+	}
+}
+
+func TestFunctionURLOnly(t *testing.T) {
+	t.Setenv(FunctionURLOnlyEnv, "true")
+	withAdminPolicy(t)
+	upstream, users := forwardedUsers(t)
+	request := ProxyRequest{Method: http.MethodGet, Path: "/", PrivateApiUrl: upstream.URL}
+
+	direct, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, payload := range map[string]json.RawMessage{
+		"direct Invoke": direct,
+		"SQS":           json.RawMessage(`{"Records":[{"eventSource":"aws:sqs","messageId":"1","body":"{}"}]}`),
+	} {
+		if _, err := HandleEvent(context.Background(), payload); err == nil {
+			t.Errorf("%s was accepted, want an error", name)
+		}
+	}
+
+	result, err := HandleEvent(context.Background(), functionURLEvent(t, request, adminARN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := urlResponse(t, result); response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", response.StatusCode, response.Body)
+	}
+	if len(*users) != 1 || (*users)[0] != adminARN {
+		t.Errorf("X-Forwarded-User = %q, want %s", *users, adminARN)
+	}
+}
+
+// Regression: envelopes the Lambda rejected itself were deleted from the
+// queue as delivered
+func TestSQSRejectedIsBatchItemFailure(t *testing.T) {
+	withAdminPolicy(t)
+	upstream, users := forwardedUsers(t)
+	body, err := json.Marshal(ProxyRequest{Method: http.MethodGet, Path: "/", PrivateApiUrl: upstream.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := handleSQS(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: "denied", Body: string(body)}}})
+
+	if len(response.BatchItemFailures) != 1 || response.BatchItemFailures[0].ItemIdentifier != "denied" {
+		t.Errorf("batch item failures = %v, want the denied message", response.BatchItemFailures)
+	}
+	if len(*users) != 0 {
+		t.Errorf("upstream was called as %q, want no call", *users)
+	}
+}
+
+func TestSQSUpstreamForbiddenIsDelivered(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(upstream.Close)
+	body, err := json.Marshal(ProxyRequest{Method: http.MethodGet, Path: "/", PrivateApiUrl: upstream.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := handleSQS(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: "forbidden", Body: string(body)}}})
+
+	if len(response.BatchItemFailures) != 0 {
+		t.Errorf("batch item failures = %v, want none for the upstream's own 403", response.BatchItemFailures)
+	}
+}
+
+// Regression: asynchronous and batch envelopes were dispatched before their
+// signature was checked, so an unsigned envelope could write any response
+// key
+func TestUnsignedEnvelopeRejectedBeforeDispatch(t *testing.T) {
+	t.Setenv(SigningKMSKeyEnv, "alias/awsctl-signing")
+	t.Setenv(AsyncResponseBucketEnv, "awsctl-responses")
+	upstream, users := forwardedUsers(t)
+	request := ProxyRequest{Method: http.MethodGet, Path: "/", PrivateApiUrl: upstream.URL}
+
+	for name, envelope := range map[string]ProxyRequest{
+		"asynchronous": {Method: http.MethodGet, Path: "/", PrivateApiUrl: upstream.URL, ResponseKey: "0123456789abcdef"},
+		"batch":        {Batch: []ProxyRequest{request, request}},
+		"deadline":     {Method: http.MethodGet, Path: "/", PrivateApiUrl: upstream.URL, DeadlineMs: 1000},
+	} {
+		response, err := Handler(context.Background(), envelope)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if response.StatusCode != http.StatusUnauthorized || !response.Rejected {
+			t.Errorf("%s: status = %d (%s), want it rejected with 401", name, response.StatusCode, response.Body)
+		}
+	}
+	if len(*users) != 0 {
+		t.Errorf("upstream was called %d times, want no call", len(*users))
+	}
+}
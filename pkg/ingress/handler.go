@@ -0,0 +1,510 @@
+// Package ingress implements the Lambda side of the proxy: it receives a
+// ProxyRequest envelope, forwards it to the private API and returns the
+// ProxyResponse. It is importable so the CLI can run it in-process.
+package ingress
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// ProxyRequest represents the incoming request from the local proxy
+type ProxyRequest struct {
+	Method        string              `json:"method"`
+	Path          string              `json:"path"`
+	RawPath       string              `json:"rawPath,omitempty"`
+	Headers       map[string][]string `json:"headers"`
+	Body          string              `json:"body"`
+	Query         string              `json:"query"`
+	PrivateApiUrl string              `json:"privateApiUrl"`
+	HostOverrides map[string]string   `json:"hostOverrides,omitempty"`
+	// KnownBodyHash is the BodyHash of the body the CLI has for this
+	// request, an identical response body is then left out
+	KnownBodyHash string `json:"knownBodyHash,omitempty"`
+	Caller        string `json:"caller,omitempty"`
+	Timestamp     string `json:"timestamp,omitempty"`
+	Signature     string `json:"signature,omitempty"`
+	EncryptedKey  string `json:"encryptedKey,omitempty"`
+	// ResponseKey asks the Lambda to store the response in S3 under this
+	// ID, for asynchronous invocations
+	ResponseKey string `json:"responseKey,omitempty"`
+	// Batch carries sub-requests the Lambda runs concurrently instead of
+	// this request, each one signed and encrypted on its own
+	Batch []ProxyRequest `json:"batch,omitempty"`
+	// Timeouts override the Lambda's timeouts for the upstream call
+	Timeouts *UpstreamTimeouts `json:"timeouts,omitempty"`
+	// DeadlineMs is how long the CLI still waits for the response when it
+	// sends the envelope, the Lambda gives up on the request after it
+	DeadlineMs int64 `json:"deadlineMs,omitempty"`
+}
+
+// ProxyResponse represents the response to send back
+type ProxyResponse struct {
+	StatusCode int                 `json:"statusCode"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body"`
+	Trailers   map[string][]string `json:"trailers,omitempty"`
+	Encrypted  bool                `json:"encrypted,omitempty"`
+	Timing     *UpstreamTiming     `json:"timing,omitempty"`
+	// BodyUnchanged means the body matched KnownBodyHash and was left out
+	BodyUnchanged bool `json:"bodyUnchanged,omitempty"`
+	// Batch holds the responses to a batch request in its order
+	Batch []ProxyResponse `json:"batch,omitempty"`
+	// Check reports the outcome of a tcp:// or tls:// connectivity check
+	Check *CheckResult `json:"check,omitempty"`
+	// Rejected means the Lambda refused the envelope itself, by its
+	// signature, the policy or its host overrides, without calling the
+	// upstream
+	Rejected bool `json:"-"`
+}
+
+// UpstreamTiming describes the call to the private API
+type UpstreamTiming struct {
+	// Attempts counts connects, more than one means addresses failed
+	Attempts   int   `json:"attempts"`
+	ConnectMs  int64 `json:"connectMs"`
+	UpstreamMs int64 `json:"upstreamMs"`
+	// Reused means a connection kept from an earlier call was used
+	Reused bool `json:"reused,omitempty"`
+	// Protocol is the upstream's HTTP version, e.g. HTTP/2.0
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// UpstreamTimeouts bound the phases of the upstream call in milliseconds, 0
+// keeps the Lambda's setting
+type UpstreamTimeouts struct {
+	// DialMs covers DNS and all connect attempts
+	DialMs         int64 `json:"dialMs,omitempty"`
+	TLSHandshakeMs int64 `json:"tlsHandshakeMs,omitempty"`
+	// ResponseHeaderMs is the time from sending the request to the first
+	// byte of the response
+	ResponseHeaderMs int64 `json:"responseHeaderMs,omitempty"`
+	// TotalMs covers the whole call including reading the body
+	TotalMs int64 `json:"totalMs,omitempty"`
+}
+
+// Handler is the main Lambda function handler
+func Handler(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	// Reject unsigned, tampered or replayed envelopes when signing is
+	// enabled, before anything in them is run or stored
+	if err := verifySignature(ctx, request, time.Now()); err != nil {
+		log.Printf("Rejected %s %s%s: %v", request.Method, request.PrivateApiUrl, request.Path, err)
+		return &ProxyResponse{
+			StatusCode: 401,
+			Rejected:   true,
+			Body:       fmt.Sprintf("failed to verify envelope: %v", err),
+		}, nil
+	}
+
+	// Don't pay for upstream calls whose result nobody reads anymore
+	if request.DeadlineMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(request.DeadlineMs)*time.Millisecond)
+		defer cancel()
+	}
+
+	// A batch envelope only carries sub-requests, which are verified and
+	// authorized on their own
+	if len(request.Batch) > 0 {
+		return handleBatch(ctx, request.Batch), nil
+	}
+
+	// Get the private API endpoint from the request
+	if request.PrivateApiUrl == "" {
+		return &ProxyResponse{
+			StatusCode: 400,
+			Body:       "Missing required privateApiUrl in request",
+		}, nil
+	}
+
+	// The envelope is signed as sent, so the verified caller replaces the
+	// claimed one only afterwards
+	if caller, ok := ctx.Value(verifiedCallerKey{}).(string); ok {
+		request.Caller = caller
+	}
+
+	// Enforce the per-user policy, if one is configured
+	violation, err := authorize(ctx, request)
+	if err != nil {
+		return &ProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("failed to evaluate policy: %v", err),
+		}, nil
+	}
+	if violation != "" {
+		log.Printf("Denied %s %s%s: %s", request.Method, request.PrivateApiUrl, request.Path, violation)
+		return &ProxyResponse{
+			StatusCode: 403,
+			Rejected:   true,
+			Body:       violation,
+		}, nil
+	}
+
+	// Overrides choose the address that is dialed, which neither the policy
+	// nor the response limits see
+	violation, err = checkHostOverrides(request.HostOverrides)
+	if err != nil {
+		return &ProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("failed to check host overrides: %v", err),
+		}, nil
+	}
+	if violation != "" {
+		log.Printf("Denied %s %s%s: %s", request.Method, request.PrivateApiUrl, request.Path, violation)
+		return &ProxyResponse{
+			StatusCode: 403,
+			Rejected:   true,
+			Body:       violation,
+		}, nil
+	}
+
+	if request.ResponseKey != "" {
+		return handleAsync(ctx, request)
+	}
+	return forward(ctx, request)
+}
+
+// forward calls the upstream of a request Handler has admitted
+func forward(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	apiEndpoint := request.PrivateApiUrl
+
+	// tcp:// and tls:// targets are connected to without an HTTP request,
+	// to diagnose security groups and certificates
+	if isCheck(apiEndpoint) {
+		return handleCheck(ctx, request), nil
+	}
+
+	// Sockets on the Lambda's filesystem, e.g. of extensions or sidecars, are
+	// called over HTTP with a placeholder host
+	socket, isSocket := strings.CutPrefix(apiEndpoint, unixScheme)
+	if isSocket {
+		if !path.IsAbs(socket) || path.Clean(socket) != socket {
+			return &ProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("failed to use socket %q: expected unix:///absolute/path.sock", socket),
+			}, nil
+		}
+		apiEndpoint = "http://" + unixSocketHost
+	}
+
+	// Cloud Map services are resolved to one of their instances for every
+	// request, so the target follows tasks being replaced
+	var serviceHost string
+	if strings.HasPrefix(apiEndpoint, cloudMapScheme) {
+		namespace, service, err := parseCloudMapURL(apiEndpoint)
+		if err != nil {
+			return &ProxyResponse{
+				StatusCode: 400,
+				Body:       err.Error(),
+			}, nil
+		}
+		if apiEndpoint, err = resolveCloudMap(ctx, namespace, service); err != nil {
+			return &ProxyResponse{
+				StatusCode: 502,
+				Body:       err.Error(),
+			}, nil
+		}
+		serviceHost = service + "." + namespace
+	}
+
+	// Kubernetes services are resolved by the cluster's DNS server
+	if strings.HasPrefix(apiEndpoint, k8sScheme) {
+		cluster, namespace, service, port, err := parseK8sURL(apiEndpoint)
+		if err != nil {
+			return &ProxyResponse{
+				StatusCode: 400,
+				Body:       err.Error(),
+			}, nil
+		}
+		if apiEndpoint, serviceHost, err = resolveK8s(ctx, cluster, namespace, service, port); err != nil {
+			return &ProxyResponse{
+				StatusCode: 502,
+				Body:       err.Error(),
+			}, nil
+		}
+	}
+
+	// Construct the full URL
+	upstreamURL, err := buildUpstreamURL(apiEndpoint, request)
+	if err != nil {
+		return &ProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("failed to build upstream URL: %v", err),
+		}, nil
+	}
+
+	// Operators may limit the size and type of responses leaving the VPC
+	limits, err := limitsFor(request.PrivateApiUrl)
+	if err != nil {
+		return &ProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("failed to load response limits: %v", err),
+		}, nil
+	}
+
+	// Create HTTP client with timeout and skip TLS verification
+	var client *http.Client
+	if isSocket {
+		client, err = newSocketClient(socket, request.Timeouts)
+	} else {
+		// Some upstreams require Windows integrated authentication with
+		// credentials from Secrets Manager
+		auth, authErr := upstreamAuthFor(ctx, request.PrivateApiUrl)
+		if authErr != nil {
+			return &ProxyResponse{
+				StatusCode: 500,
+				Body:       fmt.Sprintf("failed to load upstream credentials: %v", authErr),
+			}, nil
+		}
+		client, err = newUpstreamClient(request.HostOverrides, request.Timeouts, auth)
+	}
+	if err != nil {
+		return &ProxyResponse{
+			StatusCode: 400,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	// Encrypted envelopes carry a KMS-encrypted data key for both bodies
+	var dataKey []byte
+	if request.EncryptedKey != "" {
+		dataKey, err = decryptDataKey(ctx, request.EncryptedKey)
+		if err != nil {
+			return &ProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("failed to decrypt payload key: %v", err),
+			}, nil
+		}
+	}
+
+	// Create the request
+	var bodyReader io.Reader
+	if request.Body != "" {
+		var bodyBytes []byte
+		if dataKey != nil {
+			bodyBytes, err = DecryptBody(dataKey, request.Body)
+		} else {
+			bodyBytes, err = base64.StdEncoding.DecodeString(request.Body)
+		}
+		if err != nil {
+			return &ProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("failed to decode body: %v", err),
+			}, nil
+		}
+		// A bytes.Reader lets net/http set GetBody, so a request it retries
+		// on a fresh connection sends the complete body again. It only
+		// retries GET, HEAD, OPTIONS and TRACE requests and those with an
+		// Idempotency-Key or X-Idempotency-Key header when a reused
+		// connection fails.
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+
+	upstreamCtx, stats := withDialStats(ctx)
+	req, err := http.NewRequestWithContext(upstreamCtx, request.Method, upstreamURL.String(), bodyReader)
+	if err != nil {
+		return &ProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("failed to create HTTP request: %v", err),
+		}, nil
+	}
+	// Keep the exact URL, parsing its string form would normalise the path
+	req.URL = upstreamURL
+	if serviceHost != "" {
+		req.Host = serviceHost
+	}
+
+	// Set headers from the original request
+	for key, values := range request.Headers {
+		// Skip host header as it will be set automatically
+		lowerKey := strings.ToLower(key)
+		if lowerKey == "host" {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	// The body length is taken from the decoded body, not the client's header.
+	// Expect is dropped too, the complete body is already at hand and waiting
+	// for 100-continue would only stall the upstream call.
+	RemoveHopByHopHeaders(req.Header)
+	req.Header.Del("Content-Length")
+	req.Header.Del("Expect")
+
+	// Attribute tunneled traffic to the AWS identity of the CLI user, it
+	// replaces any client-supplied value
+	req.Header.Del("X-Forwarded-User")
+	if request.Caller != "" {
+		req.Header.Set("X-Forwarded-User", request.Caller)
+		log.Printf("Forwarding %s %s for %s", request.Method, request.Path, request.Caller)
+	}
+
+	// Make the request to the private API Gateway
+	upstreamStart := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		attempts, _, _ := stats.timing()
+		return &ProxyResponse{
+			StatusCode: 502,
+			Body:       fmt.Sprintf("failed to call private API after %d connect attempts: %v", attempts, err),
+		}, nil
+	}
+	defer resp.Body.Close()
+
+	// Read the response body, up to the limit
+	respBody, err := readLimited(resp.Body, limits.maxBytes)
+	if errors.Is(err, errResponseTooLarge) {
+		log.Printf("Blocked response to %s %s%s: larger than %d bytes", request.Method, request.PrivateApiUrl, request.Path, limits.maxBytes)
+		return &ProxyResponse{
+			StatusCode: 413,
+			Body:       fmt.Sprintf("failed to return API response: larger than the limit of %d bytes", limits.maxBytes),
+		}, nil
+	}
+	if err != nil {
+		return &ProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("failed to read API response: %v", err),
+		}, nil
+	}
+	// Whatever a misbehaving upstream sends, responses to HEAD and with
+	// statuses like 304 carry no body through the envelope
+	if !BodyAllowed(request.Method, resp.StatusCode) {
+		respBody = nil
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); len(respBody) > 0 && !limits.allowsContentType(contentType) {
+		log.Printf("Blocked response to %s %s%s: content type %q is not allowed", request.Method, request.PrivateApiUrl, request.Path, contentType)
+		return &ProxyResponse{
+			StatusCode: 502,
+			Body:       fmt.Sprintf("failed to return API response: content type %q is not allowed", contentType),
+		}, nil
+	}
+
+	attempts, connectTime, reused := stats.timing()
+	timing := &UpstreamTiming{
+		Attempts:   attempts,
+		ConnectMs:  connectTime.Milliseconds(),
+		UpstreamMs: time.Since(upstreamStart).Milliseconds(),
+		Reused:     reused,
+		Protocol:   resp.Proto,
+	}
+	if attempts > 1 {
+		log.Printf("Connected to %s after %d attempts", upstreamURL.Host, attempts)
+	}
+
+	// Copy response headers. Content-Length no longer matches once the body is
+	// re-encoded, except for HEAD where it describes the GET representation.
+	RemoveHopByHopHeaders(resp.Header)
+	if request.Method != http.MethodHead {
+		resp.Header.Del("Content-Length")
+	}
+	responseHeaders := make(map[string][]string)
+	for key, values := range resp.Header {
+		responseHeaders[key] = values
+	}
+
+	// Trailers are only known once the body has been read completely
+	var responseTrailers map[string][]string
+	if len(resp.Trailer) > 0 {
+		responseTrailers = make(map[string][]string)
+		for key, values := range resp.Trailer {
+			responseTrailers[key] = values
+		}
+	}
+
+	// The CLI already has this body, don't send it again
+	if request.KnownBodyHash != "" && BodyHash(respBody) == request.KnownBodyHash {
+		return &ProxyResponse{
+			StatusCode:    resp.StatusCode,
+			Headers:       responseHeaders,
+			Trailers:      responseTrailers,
+			Timing:        timing,
+			BodyUnchanged: true,
+		}, nil
+	}
+
+	// Always encode response body as base64, encrypted if the request was
+	responseBody := base64.StdEncoding.EncodeToString(respBody)
+	if dataKey != nil {
+		responseBody, err = EncryptBody(dataKey, respBody)
+		if err != nil {
+			return &ProxyResponse{
+				StatusCode: 500,
+				Body:       fmt.Sprintf("failed to encrypt response body: %v", err),
+			}, nil
+		}
+	}
+
+	// Return the proxied response
+	return &ProxyResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    responseHeaders,
+		Body:       responseBody,
+		Trailers:   responseTrailers,
+		Encrypted:  dataKey != nil,
+		Timing:     timing,
+	}, nil
+}
+
+// BodyHash identifies a response body for ProxyRequest.KnownBodyHash
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// buildUpstreamURL joins the API endpoint with the request path. When the
+// envelope carries the escaped path it is used verbatim, so encoded
+// characters such as %2F are neither decoded nor re-encoded.
+func buildUpstreamURL(apiEndpoint string, request ProxyRequest) (*url.URL, error) {
+	// Without a leading slash the path would extend the endpoint's host,
+	// e.g. "@other-host" or ".other-domain", and escape the target
+	for _, path := range []string{request.Path, request.RawPath} {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("failed to use path %q: must start with /", path)
+		}
+	}
+
+	if request.RawPath == "" {
+		u, err := url.Parse(fmt.Sprintf("%s%s", apiEndpoint, request.Path))
+		if err != nil {
+			return nil, fmt.Errorf("parse URL: %w", err)
+		}
+		u.RawQuery = request.Query
+		return u, nil
+	}
+
+	u, err := url.Parse(apiEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse API endpoint: %w", err)
+	}
+
+	path, err := url.PathUnescape(request.RawPath)
+	if err != nil {
+		return nil, fmt.Errorf("unescape path: %w", err)
+	}
+
+	escapedPath := strings.TrimSuffix(u.EscapedPath(), "/") + request.RawPath
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = escapedPath
+	if u.EscapedPath() != escapedPath {
+		// url.URL normalises RawPath it considers invalid, fall back to an
+		// opaque URL which is written to the wire exactly as given
+		u.Opaque = "//" + u.Host + escapedPath
+	}
+	u.RawQuery = request.Query
+
+	return u, nil
+}
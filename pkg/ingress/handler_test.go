@@ -0,0 +1,127 @@
+package ingress
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testEndpoint = "https://api.internal.example.com/base"
+
+// Regression: a path without a leading slash extended the endpoint's host
+func TestBuildUpstreamURLRejectsRelativePath(t *testing.T) {
+	for _, request := range []ProxyRequest{
+		{Path: "@evil.example.com/x"},
+		{Path: ".evil.example.com/x"},
+		{Path: "/x", RawPath: "@evil.example.com/x"},
+		{Path: ":8080/x"},
+	} {
+		if u, err := buildUpstreamURL(testEndpoint, request); err == nil {
+			t.Errorf("buildUpstreamURL(%q, %q) = %s, want an error", request.Path, request.RawPath, u)
+		}
+	}
+}
+
+func TestBuildUpstreamURL(t *testing.T) {
+	tests := []struct {
+		request ProxyRequest
+		want    string
+	}{
+		{ProxyRequest{Path: "/users/42"}, "/base/users/42"},
+		{ProxyRequest{Path: "/search", Query: "q=a+b&q=c"}, "/base/search?q=a+b&q=c"},
+		{ProxyRequest{Path: "/files/a/b", RawPath: "/files/a%2Fb"}, "/base/files/a%2Fb"},
+		{ProxyRequest{Path: "/files/100%", RawPath: "/files/100%25"}, "/base/files/100%25"},
+	}
+	for _, test := range tests {
+		u, err := buildUpstreamURL(testEndpoint, test.request)
+		if err != nil {
+			t.Errorf("buildUpstreamURL(%q): %v", test.request.Path, err)
+			continue
+		}
+		if got := strings.TrimPrefix(u.RequestURI(), "https://"+u.Host); got != test.want {
+			t.Errorf("buildUpstreamURL(%q) request URI = %q, want %q", test.request.Path, got, test.want)
+		}
+	}
+}
+
+func FuzzBuildUpstreamURL(f *testing.F) {
+	f.Add("/users/42", "", "a=1")
+	f.Add("/files/a/b", "/files/a%2Fb", "")
+	f.Add("/files/100%", "/files/100%25", "q=%26")
+	f.Add("@evil.example.com", "", "")
+	f.Add("/x", "/%zz", "")
+	f.Add("//evil.example.com/x", "", "")
+
+	f.Fuzz(func(t *testing.T, path, rawPath, query string) {
+		u, err := buildUpstreamURL(testEndpoint, ProxyRequest{Path: path, RawPath: rawPath, Query: query})
+		if err != nil {
+			return
+		}
+		if u.Scheme != "https" || u.Host != "api.internal.example.com" {
+			t.Fatalf("path %q, raw path %q escaped the endpoint: %s://%s", path, rawPath, u.Scheme, u.Host)
+		}
+		// Opaque URLs are sent in absolute form
+		requestURI := strings.TrimPrefix(u.RequestURI(), "https://"+u.Host)
+		if !strings.HasPrefix(requestURI, "/base") {
+			t.Fatalf("path %q, raw path %q: request URI %q left the endpoint's base path", path, rawPath, u.RequestURI())
+		}
+	})
+}
+
+// FuzzProxyRequestJSON decodes arbitrary envelopes: decoding must never
+// panic, and a decoded envelope must encode to the same bytes after another
+// round trip
+func FuzzProxyRequestJSON(f *testing.F) {
+	f.Add([]byte(`{"method":"GET","path":"/users/42","headers":{"Accept":["application/json"]}}`))
+	f.Add([]byte(`{"method":"POST","path":"/x","body":"aGVsbG8=","timeouts":{"dialMs":100}}`))
+	f.Add([]byte(`{"batch":[{"method":"GET","path":"/a"},{"method":"GET","path":"/b"}]}`))
+	f.Add([]byte(`{"path":"\u0000","deadlineMs":-1}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var request ProxyRequest
+		if err := json.Unmarshal(data, &request); err != nil {
+			return
+		}
+		first, err := json.Marshal(request)
+		if err != nil {
+			t.Fatalf("failed to encode decoded envelope: %v", err)
+		}
+		var again ProxyRequest
+		if err := json.Unmarshal(first, &again); err != nil {
+			t.Fatalf("failed to decode %s: %v", first, err)
+		}
+		second, err := json.Marshal(again)
+		if err != nil {
+			t.Fatalf("failed to encode envelope: %v", err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Fatalf("envelope changed in a round trip:\n%s\n%s", first, second)
+		}
+	})
+}
+
+// FuzzDecryptBody feeds arbitrary encrypted bodies to DecryptBody and checks
+// that bodies from EncryptBody round trip
+func FuzzDecryptBody(f *testing.F) {
+	dataKey := bytes.Repeat([]byte{7}, 32)
+	f.Add([]byte("hello"), "")
+	f.Add([]byte{}, "AAAA")
+	f.Add([]byte{0, 0xff}, "not base64!")
+
+	f.Fuzz(func(t *testing.T, plaintext []byte, body string) {
+		DecryptBody(dataKey, body)
+
+		sealed, err := EncryptBody(dataKey, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened, err := DecryptBody(dataKey, sealed)
+		if err != nil {
+			t.Fatalf("failed to decrypt a sealed body: %v", err)
+		}
+		if !bytes.Equal(opened, plaintext) {
+			t.Fatalf("body = %q, want %q", opened, plaintext)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package ingress
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders apply to a single connection and must not be forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHopHeaders deletes hop-by-hop headers, including those named in
+// the Connection header
+func RemoveHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// BodyAllowed reports whether a response to method with statusCode may carry
+// a body
+func BodyAllowed(method string, statusCode int) bool {
+	if method == http.MethodHead {
+		return false
+	}
+	switch {
+	case statusCode >= 100 && statusCode < 200:
+		return false
+	case statusCode == http.StatusNoContent, statusCode == http.StatusResetContent, statusCode == http.StatusNotModified:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package ingress
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":        {"keep-alive, X-Session"},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"Te":                {"trailers"},
+		"Upgrade":           {"websocket"},
+		"X-Session":         {"abc"},
+		"Content-Type":      {"application/json"},
+		"Content-Length":    {"42"},
+	}
+	RemoveHopByHopHeaders(header)
+
+	for _, name := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Te", "Upgrade", "X-Session"} {
+		if values, ok := header[name]; ok {
+			t.Errorf("%s = %q, want it removed", name, values)
+		}
+	}
+	for _, name := range []string{"Content-Type", "Content-Length"} {
+		if header.Get(name) == "" {
+			t.Errorf("%s was removed, want it kept", name)
+		}
+	}
+}
+
+func TestBodyAllowed(t *testing.T) {
+	tests := []struct {
+		method string
+		status int
+		want   bool
+	}{
+		{http.MethodGet, http.StatusOK, true},
+		{http.MethodPost, http.StatusCreated, true},
+		{http.MethodGet, http.StatusNotFound, true},
+		{http.MethodHead, http.StatusOK, false},
+		{http.MethodHead, http.StatusNotFound, false},
+		{http.MethodGet, http.StatusContinue, false},
+		{http.MethodGet, http.StatusNoContent, false},
+		{http.MethodDelete, http.StatusNoContent, false},
+		{http.MethodPost, http.StatusResetContent, false},
+		{http.MethodGet, http.StatusNotModified, false},
+	}
+	for _, test := range tests {
+		if got := BodyAllowed(test.method, test.status); got != test.want {
+			t.Errorf("BodyAllowed(%s, %d) = %v, want %v", test.method, test.status, got, test.want)
+		}
+	}
+}
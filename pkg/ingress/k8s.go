@@ -0,0 +1,74 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// K8sClustersEnv maps cluster names to the DNS server answering for their
+// services, e.g. prod=10.0.12.10,staging=10.1.0.10:5353, for k8s:// targets
+const K8sClustersEnv = "K8S_CLUSTERS"
+
+// K8sClusterDomainEnv is the cluster domain of the clusters, cluster.local
+// by default
+const K8sClusterDomainEnv = "K8S_CLUSTER_DOMAIN"
+
+// k8sScheme prefixes privateApiUrl values naming a Kubernetes service, such
+// as k8s://prod/payments/ledger:8080
+const k8sScheme = "k8s://"
+
+// parseK8sURL splits k8s://cluster/namespace/service[:port], the port
+// defaults to 80
+func parseK8sURL(apiEndpoint string) (cluster, namespace, service string, port int, err error) {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(apiEndpoint, k8sScheme), "/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", 0, fmt.Errorf("failed to use Kubernetes service %q: expected k8s://cluster/namespace/service:port", apiEndpoint)
+	}
+	cluster, namespace, service = parts[0], parts[1], parts[2]
+	port = 80
+	if name, portValue, ok := strings.Cut(service, ":"); ok {
+		port, err = strconv.Atoi(portValue)
+		if err != nil || port < 1 || port > 65535 {
+			return "", "", "", 0, fmt.Errorf("failed to use Kubernetes service %q: invalid port %q", apiEndpoint, portValue)
+		}
+		service = name
+	}
+	return cluster, namespace, service, port, nil
+}
+
+// k8sDNSServer returns the DNS server of cluster from K8S_CLUSTERS
+func k8sDNSServer(cluster string) (string, error) {
+	for _, entry := range splitList(os.Getenv(K8sClustersEnv)) {
+		name, server, ok := strings.Cut(entry, "=")
+		if ok && strings.TrimSpace(name) == cluster {
+			return strings.TrimSpace(server), nil
+		}
+	}
+	return "", fmt.Errorf("failed to use Kubernetes cluster %s: it is not in %s", cluster, K8sClustersEnv)
+}
+
+// resolveK8s returns the http:// endpoint of the service and its cluster DNS
+// name, which the cluster's DNS server resolves to the service's ClusterIP,
+// or to the pod IPs of a headless service
+func resolveK8s(ctx context.Context, cluster, namespace, service string, port int) (endpoint, host string, err error) {
+	server, err := k8sDNSServer(cluster)
+	if err != nil {
+		return "", "", err
+	}
+	domain := os.Getenv(K8sClusterDomainEnv)
+	if domain == "" {
+		domain = "cluster.local"
+	}
+	host = fmt.Sprintf("%s.%s.svc.%s", service, namespace, domain)
+	ips, err := upstreamResolver(server).LookupHost(ctx, host)
+	if err != nil {
+		return "", "", fmt.Errorf("resolve %s in cluster %s: %w", host, cluster, err)
+	}
+	ip := ips[rand.IntN(len(ips))]
+	return "http://" + net.JoinHostPort(ip, strconv.Itoa(port)), host, nil
+}
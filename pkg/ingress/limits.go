@@ -0,0 +1,141 @@
+package ingress
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables limiting what the tunnel returns from the VPC.
+// MAX_RESPONSE_BYTES and ALLOWED_CONTENT_TYPES apply to all targets,
+// RESPONSE_LIMITS holds per-target exceptions as a JSON list of
+// ResponseLimits.
+const (
+	MaxResponseBytesEnv    = "MAX_RESPONSE_BYTES"
+	AllowedContentTypesEnv = "ALLOWED_CONTENT_TYPES"
+	ResponseLimitsEnv      = "RESPONSE_LIMITS"
+)
+
+// sizeUnits are the suffixes of MAX_RESPONSE_BYTES and maxBytes
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+// errResponseTooLarge is returned by readLimited for bodies over the limit
+var errResponseTooLarge = errors.New("response too large")
+
+// ResponseLimits bound the responses of targets matching one of Targets,
+// patterns in which "*" matches any sequence of characters like in a policy
+type ResponseLimits struct {
+	Targets []string `json:"targets"`
+	// MaxBytes is a size like 5MB or 512KB, empty or 0 for no limit
+	MaxBytes string `json:"maxBytes,omitempty"`
+	// ContentTypes are media types like application/json or text/*, empty
+	// allows all
+	ContentTypes []string `json:"contentTypes,omitempty"`
+}
+
+// responseLimits are the limits applying to one request
+type responseLimits struct {
+	maxBytes     int64
+	contentTypes []string
+}
+
+// limitsFor returns the limits of the first RESPONSE_LIMITS entry matching
+// target, or those of MAX_RESPONSE_BYTES and ALLOWED_CONTENT_TYPES
+func limitsFor(target string) (responseLimits, error) {
+	limits := ResponseLimits{
+		MaxBytes:     os.Getenv(MaxResponseBytesEnv),
+		ContentTypes: splitList(os.Getenv(AllowedContentTypesEnv)),
+	}
+	if raw := os.Getenv(ResponseLimitsEnv); raw != "" {
+		var exceptions []ResponseLimits
+		if err := json.Unmarshal([]byte(raw), &exceptions); err != nil {
+			return responseLimits{}, fmt.Errorf("parse %s: %w", ResponseLimitsEnv, err)
+		}
+		for _, exception := range exceptions {
+			if matchesAny(exception.Targets, strings.TrimSuffix(target, "/")) {
+				limits = exception
+				break
+			}
+		}
+	}
+
+	maxBytes, err := parseSize(limits.MaxBytes)
+	if err != nil {
+		return responseLimits{}, err
+	}
+	return responseLimits{maxBytes: maxBytes, contentTypes: limits.ContentTypes}, nil
+}
+
+// parseSize parses a number of bytes with an optional unit like 5MB, units
+// are powers of 1024
+func parseSize(size string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(size))
+	if number == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if cut, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(cut), unit.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("failed to parse size %q: expected bytes or a size like 5MB", size)
+	}
+	return n * multiplier, nil
+}
+
+// readLimited reads body, failing with errResponseTooLarge as soon as it
+// exceeds maxBytes, so an oversized body is never buffered completely
+func readLimited(body io.Reader, maxBytes int64) ([]byte, error) {
+	if maxBytes <= 0 {
+		return io.ReadAll(body)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, errResponseTooLarge
+	}
+	return data, nil
+}
+
+// allowsContentType reports whether contentType matches one of the allowed
+// media types
+func (l responseLimits) allowsContentType(contentType string) bool {
+	if len(l.contentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range l.contentTypes {
+		if globMatch(strings.ToLower(strings.TrimSpace(allowed)), mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,219 @@
+package ingress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Environment variables selecting where the authorization policy is stored.
+// Without either of them every caller may reach every target.
+const (
+	PolicySSMParameterEnv  = "POLICY_SSM_PARAMETER"
+	PolicyDynamoDBTableEnv = "POLICY_DYNAMODB_TABLE"
+)
+
+// policyTTL is how long a loaded policy is reused by a warm Lambda
+const policyTTL = time.Minute
+
+// PolicyRule allows principals matching one of Principals to call targets
+// matching one of Targets with one of Methods below one of PathPrefixes.
+// Patterns may contain "*", which matches any sequence of characters. Empty
+// lists match everything.
+type PolicyRule struct {
+	Principals   []string `json:"principals" dynamodbav:"principals"`
+	Targets      []string `json:"targets" dynamodbav:"targets"`
+	Methods      []string `json:"methods" dynamodbav:"methods"`
+	PathPrefixes []string `json:"pathPrefixes" dynamodbav:"pathPrefixes"`
+}
+
+// Policy is the authorization document, a request is allowed if any rule
+// matches it
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+var policyCache struct {
+	mu       sync.Mutex
+	policy   *Policy
+	loadedAt time.Time
+}
+
+// authorize checks request against the configured policy and returns a
+// violation reason if it is not allowed. Only a caller the Lambda verified
+// itself is authorized, which requires a FUNCTION_URL_ONLY deployment. The
+// caller in the envelope is whatever the client claims.
+func authorize(ctx context.Context, request ProxyRequest) (string, error) {
+	parameter := os.Getenv(PolicySSMParameterEnv)
+	table := os.Getenv(PolicyDynamoDBTableEnv)
+	if parameter == "" && table == "" {
+		return "", nil
+	}
+
+	policy, err := cachedPolicy(ctx, parameter, table)
+	if err != nil {
+		return "", err
+	}
+
+	caller, ok := ctx.Value(verifiedCallerKey{}).(string)
+	if !ok || caller == "" {
+		return "policy violation: caller not verified, use -transport function-url with the function_url of the Terraform module", nil
+	}
+	if !policy.Allows(caller, request.Method, request.PrivateApiUrl, request.Path) {
+		return fmt.Sprintf("policy violation: %s may not %s %s%s", caller, request.Method, request.PrivateApiUrl, request.Path), nil
+	}
+	return "", nil
+}
+
+func cachedPolicy(ctx context.Context, parameter, table string) (*Policy, error) {
+	policyCache.mu.Lock()
+	defer policyCache.mu.Unlock()
+
+	if policyCache.policy != nil && time.Since(policyCache.loadedAt) < policyTTL {
+		return policyCache.policy, nil
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+
+	var policy *Policy
+	if parameter != "" {
+		policy, err = loadSSMPolicy(ctx, awsCfg, parameter)
+	} else {
+		policy, err = loadDynamoDBPolicy(ctx, awsCfg, table)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	policyCache.policy = policy
+	policyCache.loadedAt = time.Now()
+	return policy, nil
+}
+
+// loadSSMPolicy reads a JSON Policy from a (possibly SecureString) parameter
+func loadSSMPolicy(ctx context.Context, awsCfg aws.Config, name string) (*Policy, error) {
+	out, err := ssm.NewFromConfig(awsCfg).GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           &name,
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get policy parameter: %w", err)
+	}
+
+	var policy Policy
+	if err := json.Unmarshal([]byte(aws.ToString(out.Parameter.Value)), &policy); err != nil {
+		return nil, fmt.Errorf("unmarshal policy: %w", err)
+	}
+	return &policy, nil
+}
+
+// loadDynamoDBPolicy reads one PolicyRule per item of table
+func loadDynamoDBPolicy(ctx context.Context, awsCfg aws.Config, table string) (*Policy, error) {
+	paginator := dynamodb.NewScanPaginator(dynamodb.NewFromConfig(awsCfg), &dynamodb.ScanInput{
+		TableName:      &table,
+		ConsistentRead: aws.Bool(true),
+	})
+
+	var policy Policy
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("scan policy table: %w", err)
+		}
+		var rules []PolicyRule
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &rules); err != nil {
+			return nil, fmt.Errorf("unmarshal policy rules: %w", err)
+		}
+		policy.Rules = append(policy.Rules, rules...)
+	}
+	return &policy, nil
+}
+
+// Allows reports whether any rule permits caller to send method to target
+// at requestPath
+func (p *Policy) Allows(caller, method, target, requestPath string) bool {
+	for _, rule := range p.Rules {
+		if rule.matches(caller, method, target, requestPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PolicyRule) matches(caller, method, target, requestPath string) bool {
+	if !matchesAny(r.Principals, caller) || !matchesAny(r.Targets, strings.TrimSuffix(target, "/")) {
+		return false
+	}
+	if len(r.Methods) > 0 && !containsFold(r.Methods, method) {
+		return false
+	}
+	if len(r.PathPrefixes) == 0 {
+		return true
+	}
+
+	// Both the path as sent and its cleaned form must be below the prefix,
+	// so dot segments can't escape it
+	cleaned := path.Clean("/" + requestPath)
+	for _, prefix := range r.PathPrefixes {
+		if strings.HasPrefix(requestPath, prefix) && strings.HasPrefix(cleaned, strings.TrimSuffix(prefix, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if globMatch(strings.TrimSuffix(pattern, "/"), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches value against pattern where "*" matches any sequence of
+// characters, including "/"
+func globMatch(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(value, part)
+		if index < 0 {
+			return false
+		}
+		value = value[index+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
@@ -0,0 +1,172 @@
+package ingress
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// SigningKMSKeyEnv names the KMS HMAC key envelopes must be signed with.
+// Without it signatures are neither required nor checked.
+const SigningKMSKeyEnv = "SIGNING_KMS_KEY"
+
+// SignatureMaxSkew is how far an envelope timestamp may be from the
+// Lambda's clock. The Lambda doesn't remember envelopes it has seen, so a
+// captured payload can be replayed for this long.
+const SignatureMaxSkew = 5 * time.Minute
+
+// signatureAlgorithm prefixes the string to sign so the format can evolve
+const signatureAlgorithm = "AWSCTL3-HMAC-SHA256"
+
+var kmsClient = sync.OnceValues(func() (*kms.Client, error) {
+	awsCfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	return kms.NewFromConfig(awsCfg), nil
+})
+
+// SigningDigest returns the SHA-256 digest of the canonical envelope that is
+// signed. It covers everything forwarded upstream, the timestamp and the
+// fields changing how the Lambda handles the request, but not the signature
+// itself. Every string is prefixed with its length and every list with its
+// count, so no value can pass for a separator, e.g. a header value with a
+// comma for two values or one with a newline for another header.
+func SigningDigest(request ProxyRequest) []byte {
+	var headerNames []string
+	for name := range request.Headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	headerHash := sha256.New()
+	writeLength(headerHash, len(headerNames))
+	for _, name := range headerNames {
+		writeField(headerHash, strings.ToLower(name))
+		writeLength(headerHash, len(request.Headers[name]))
+		for _, value := range request.Headers[name] {
+			writeField(headerHash, value)
+		}
+	}
+	bodyHash := sha256.Sum256([]byte(request.Body))
+
+	// Overrides decide which address is dialed, so they are signed too
+	var hosts []string
+	for host := range request.HostOverrides {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var timeouts []int64
+	if t := request.Timeouts; t != nil {
+		timeouts = []int64{t.DialMs, t.TLSHandshakeMs, t.ResponseHeaderMs, t.TotalMs}
+	}
+
+	canonical := sha256.New()
+	for _, field := range []string{
+		signatureAlgorithm,
+		request.Timestamp,
+		request.Method,
+		request.PrivateApiUrl,
+		request.Path,
+		request.RawPath,
+		request.Query,
+		request.Caller,
+	} {
+		writeField(canonical, field)
+	}
+	writeLength(canonical, len(hosts))
+	for _, host := range hosts {
+		writeField(canonical, host)
+		writeField(canonical, request.HostOverrides[host])
+	}
+	for _, field := range []string{
+		hex.EncodeToString(headerHash.Sum(nil)),
+		hex.EncodeToString(bodyHash[:]),
+		request.EncryptedKey,
+		request.ResponseKey,
+		request.KnownBodyHash,
+	} {
+		writeField(canonical, field)
+	}
+	writeLength(canonical, len(timeouts))
+	for _, timeout := range timeouts {
+		writeField(canonical, strconv.FormatInt(timeout, 10))
+	}
+	writeField(canonical, strconv.FormatInt(request.DeadlineMs, 10))
+	// A batch envelope is signed over its sub-requests, which carry their
+	// own signatures
+	writeLength(canonical, len(request.Batch))
+	for _, sub := range request.Batch {
+		writeField(canonical, hex.EncodeToString(SigningDigest(sub)))
+	}
+	return canonical.Sum(nil)
+}
+
+// writeLength writes n as a fixed-size big-endian number
+func writeLength(w io.Writer, n int) {
+	binary.Write(w, binary.BigEndian, uint64(n))
+}
+
+// writeField writes value prefixed with its length
+func writeField(w io.Writer, value string) {
+	writeLength(w, len(value))
+	io.WriteString(w, value)
+}
+
+// verifySignature checks the envelope's timestamp and its KMS HMAC signature
+// if a signing key is configured
+func verifySignature(ctx context.Context, request ProxyRequest, now time.Time) error {
+	keyID := os.Getenv(SigningKMSKeyEnv)
+	if keyID == "" {
+		return nil
+	}
+
+	if request.Signature == "" {
+		return fmt.Errorf("failed to find signature, start the proxy with -sign-kms-key")
+	}
+	timestamp, err := time.Parse(time.RFC3339, request.Timestamp)
+	if err != nil {
+		return fmt.Errorf("parse timestamp: %w", err)
+	}
+	if skew := now.Sub(timestamp).Abs(); skew > SignatureMaxSkew {
+		return fmt.Errorf("failed to accept timestamp %s: %s outside the allowed clock skew", request.Timestamp, skew.Round(time.Second))
+	}
+
+	mac, err := base64.StdEncoding.DecodeString(request.Signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+
+	client, err := kmsClient()
+	if err != nil {
+		return err
+	}
+	out, err := client.VerifyMac(ctx, &kms.VerifyMacInput{
+		KeyId:        &keyID,
+		Message:      SigningDigest(request),
+		Mac:          mac,
+		MacAlgorithm: kmstypes.MacAlgorithmSpecHmacSha256,
+	})
+	if err != nil {
+		return fmt.Errorf("verify signature: %w", err)
+	}
+	if !out.MacValid {
+		return fmt.Errorf("failed to verify signature: MAC mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package ingress
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Regression: header values were joined with commas and headers with
+// newlines, so different envelopes could share a signature
+func TestSigningDigestUnambiguous(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b ProxyRequest
+	}{
+		{
+			"comma in a header value",
+			ProxyRequest{Headers: map[string][]string{"Accept": {"x,y"}}},
+			ProxyRequest{Headers: map[string][]string{"Accept": {"x", "y"}}},
+		},
+		{
+			"newline in a header value",
+			ProxyRequest{Headers: map[string][]string{"A": {"1\nb:2"}}},
+			ProxyRequest{Headers: map[string][]string{"A": {"1"}, "B": {"2"}}},
+		},
+		{
+			"comma in a host override",
+			ProxyRequest{HostOverrides: map[string]string{"a": "10.0.0.1,b=10.0.0.2"}},
+			ProxyRequest{HostOverrides: map[string]string{"a": "10.0.0.1", "b": "10.0.0.2"}},
+		},
+		{
+			"newline in the path",
+			ProxyRequest{Path: "/a\n/b"},
+			ProxyRequest{Path: "/a", RawPath: "/b"},
+		},
+		{
+			"no timeouts and zero timeouts",
+			ProxyRequest{},
+			ProxyRequest{Timeouts: &UpstreamTimeouts{}},
+		},
+	}
+	for _, test := range tests {
+		if bytes.Equal(SigningDigest(test.a), SigningDigest(test.b)) {
+			t.Errorf("%s: digests are equal, want them to differ", test.name)
+		}
+	}
+}
+
+func TestSigningDigestHeaderOrder(t *testing.T) {
+	a := ProxyRequest{Headers: map[string][]string{"Accept": {"x"}, "X-Trace": {"1"}}, HostOverrides: map[string]string{"a": "10.0.0.1", "b": "10.0.0.2"}}
+	b := ProxyRequest{Headers: map[string][]string{"X-Trace": {"1"}, "Accept": {"x"}}, HostOverrides: map[string]string{"b": "10.0.0.2", "a": "10.0.0.1"}}
+	for range 10 {
+		if !bytes.Equal(SigningDigest(a), SigningDigest(b)) {
+			t.Fatal("digests of the same envelope differ")
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package ingress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// handleSQS runs the envelopes of an SQS batch. Records that fail, that the
+// Lambda rejects or whose upstream answers with a 5xx status are reported
+// back so SQS delivers them again and moves them to the dead-letter queue
+// after the queue's maxReceiveCount. This needs ReportBatchItemFailures on the event source
+// mapping, without it SQS would redeliver the whole batch.
+func handleSQS(ctx context.Context, event events.SQSEvent) events.SQSEventResponse {
+	response := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+	for _, record := range event.Records {
+		if err := handleSQSRecord(ctx, record); err != nil {
+			log.Printf("Failed to deliver message %s (receive %s): %v", record.MessageId, record.Attributes["ApproximateReceiveCount"], err)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+	return response
+}
+
+func handleSQSRecord(ctx context.Context, record events.SQSMessage) error {
+	var request ProxyRequest
+	if err := json.Unmarshal([]byte(record.Body), &request); err != nil {
+		// Redelivering can't fix the message, it is logged and dropped
+		log.Printf("Dropped message %s: unmarshal proxy request: %v", record.MessageId, err)
+		return nil
+	}
+
+	response, err := Handler(ctx, request)
+	if err != nil {
+		return err
+	}
+	// A rejected envelope, e.g. signed too long ago or denied by the policy,
+	// is kept in the dead-letter queue to be redriven once that's fixed
+	if response.Rejected {
+		return fmt.Errorf("failed to forward %s%s: rejected with status %d: %s", request.PrivateApiUrl, request.Path, response.StatusCode, response.Body)
+	}
+	if response.StatusCode >= 500 {
+		return fmt.Errorf("failed to call %s%s: status %d", request.PrivateApiUrl, request.Path, response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package ingress
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// partialUpstream answers /warm normally and hangs up on the first /upload
+// after reading half of its body, on a connection the client reuses. Later
+// uploads are read completely and recorded.
+type partialUpstream struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	attempts int
+	bodies   []string
+}
+
+func newPartialUpstream(t *testing.T) *partialUpstream {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &partialUpstream{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(conn)
+		}
+	}()
+	return u
+}
+
+func (u *partialUpstream) URL() string {
+	return "http://" + u.listener.Addr().String()
+}
+
+func (u *partialUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if req.URL.Path == "/upload" {
+			u.mu.Lock()
+			u.attempts++
+			first := u.attempts == 1
+			u.mu.Unlock()
+			if first {
+				io.CopyN(io.Discard, req.Body, req.ContentLength/2)
+				return
+			}
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+		if req.URL.Path == "/upload" {
+			u.mu.Lock()
+			u.bodies = append(u.bodies, string(body))
+			u.mu.Unlock()
+		}
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	}
+}
+
+func (u *partialUpstream) result() (int, []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.attempts, u.bodies
+}
+
+// uploadAfterPartialWrite warms up a pooled connection to a fresh upstream
+// and then sends an upload the upstream hangs up on halfway through its body
+func uploadAfterPartialWrite(t *testing.T, method string, header map[string][]string) (*ProxyResponse, *partialUpstream, string) {
+	t.Helper()
+	upstream := newPartialUpstream(t)
+	ctx := context.Background()
+
+	warm, err := Handler(ctx, ProxyRequest{Method: http.MethodGet, Path: "/warm", PrivateApiUrl: upstream.URL()})
+	if err != nil || warm.StatusCode != http.StatusOK {
+		t.Fatalf("failed to warm up the connection: %v %+v", err, warm)
+	}
+
+	payload := strings.Repeat("0123456789abcdef", 256)
+	response, err := Handler(ctx, ProxyRequest{
+		Method:        method,
+		Path:          "/upload",
+		Headers:       header,
+		Body:          base64.StdEncoding.EncodeToString([]byte(payload)),
+		PrivateApiUrl: upstream.URL(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, upstream, payload
+}
+
+func TestHandlerRetriesAfterPartialWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header map[string][]string
+	}{
+		{"PUT with Idempotency-Key", http.MethodPut, map[string][]string{"Idempotency-Key": {"upload-1"}}},
+		{"POST with Idempotency-Key", http.MethodPost, map[string][]string{"Idempotency-Key": {"upload-1"}}},
+		{"POST with X-Idempotency-Key", http.MethodPost, map[string][]string{"X-Idempotency-Key": {"upload-1"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, upstream, payload := uploadAfterPartialWrite(t, test.method, test.header)
+
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d (%s), want the retry's 200", response.StatusCode, response.Body)
+			}
+			attempts, bodies := upstream.result()
+			if attempts != 2 {
+				t.Errorf("upstream saw %d attempts, want 2", attempts)
+			}
+			if len(bodies) != 1 || bodies[0] != payload {
+				t.Errorf("retry sent %d bodies, want the complete payload of %d bytes once", len(bodies), len(payload))
+			}
+		})
+	}
+}
+
+// Without an idempotency key net/http must not send a POST or PUT the
+// upstream may have acted on a second time
+func TestHandlerDoesNotRetryAfterPartialWrite(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		t.Run(method, func(t *testing.T) {
+			response, upstream, _ := uploadAfterPartialWrite(t, method, nil)
+
+			if response.StatusCode != http.StatusBadGateway {
+				t.Errorf("status = %d (%s), want 502", response.StatusCode, response.Body)
+			}
+			if attempts, _ := upstream.result(); attempts != 1 {
+				t.Errorf("upstream saw %d attempts, want the %s sent once", attempts, method)
+			}
+		})
+	}
+}
+
+func TestCheckHostOverrides(t *testing.T) {
+	tests := []struct {
+		cidrs     string
+		overrides map[string]string
+		allowed   bool
+	}{
+		{"", nil, true},
+		{"", map[string]string{"billing.internal": "10.0.1.5"}, false},
+		{"10.0.0.0/16", map[string]string{"billing.internal": "10.0.1.5"}, true},
+		{"10.0.0.0/16", map[string]string{"billing.internal": "10.1.1.5"}, false},
+		{"10.0.0.0/16, 169.254.169.254", map[string]string{"metadata": "169.254.169.254"}, true},
+		{"10.0.0.0/16", map[string]string{"billing.internal": "::ffff:10.0.1.5"}, true},
+		{"fd00::/8", map[string]string{"billing.internal": "fd00::1"}, true},
+		{"fd00::/8", map[string]string{"billing.internal": "10.0.1.5"}, false},
+		{"10.0.0.0/16", map[string]string{"billing.internal": "billing.other"}, false},
+	}
+	for _, test := range tests {
+		t.Setenv(HostOverrideCIDRsEnv, test.cidrs)
+		violation, err := checkHostOverrides(test.overrides)
+		if err != nil {
+			t.Errorf("checkHostOverrides(%v) with %q: %v", test.overrides, test.cidrs, err)
+			continue
+		}
+		if got := violation == ""; got != test.allowed {
+			t.Errorf("checkHostOverrides(%v) with %q allowed = %v (%s), want %v", test.overrides, test.cidrs, got, violation, test.allowed)
+		}
+	}
+
+	t.Setenv(HostOverrideCIDRsEnv, "10.0.0.0/33")
+	if _, err := checkHostOverrides(map[string]string{"billing.internal": "10.0.1.5"}); err == nil {
+		t.Error("invalid HOST_OVERRIDE_CIDRS accepted, want an error")
+	}
+}
+
+// Regression: a caller could point an allowed target's host at any address
+// the Lambda reaches
+func TestHandlerRefusesHostOverrides(t *testing.T) {
+	upstream := newPartialUpstream(t)
+	_, port, err := net.SplitHostPort(upstream.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := ProxyRequest{
+		Method:        http.MethodGet,
+		Path:          "/warm",
+		PrivateApiUrl: "http://billing.internal:" + port,
+		HostOverrides: map[string]string{"billing.internal": "127.0.0.1"},
+	}
+
+	for cidrs, want := range map[string]int{"": http.StatusForbidden, "10.0.0.0/8": http.StatusForbidden, "127.0.0.0/8": http.StatusOK} {
+		t.Setenv(HostOverrideCIDRsEnv, cidrs)
+		response, err := Handler(context.Background(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != want {
+			t.Errorf("with %s=%q: status = %d (%s), want %d", HostOverrideCIDRsEnv, cidrs, response.StatusCode, response.Body, want)
+		}
+	}
+}
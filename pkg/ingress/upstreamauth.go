@@ -0,0 +1,249 @@
+package ingress
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-ntlmssp"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	krbclient "github.com/jcmturner/gokrb5/v8/client"
+	krbconfig "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// UpstreamAuthEnv holds a JSON list of UpstreamAuth. Targets matching one of
+// them are called with Windows integrated authentication, which takes
+// several round trips on one connection and so can't be done by the CLI
+// through the envelope.
+const UpstreamAuthEnv = "UPSTREAM_AUTH"
+
+// upstreamAuthTTL is how long credentials read from Secrets Manager are
+// reused by a warm Lambda
+const upstreamAuthTTL = 5 * time.Minute
+
+// Schemes of UpstreamCredentials
+const (
+	// authSchemeNTLM answers NTLM challenges and Negotiate challenges with
+	// NTLM, which needs nothing but the credentials
+	authSchemeNTLM = "ntlm"
+	// authSchemeKerberos sends a Kerberos ticket as SPNEGO Negotiate token,
+	// the Lambda must reach a KDC of the realm
+	authSchemeKerberos = "kerberos"
+)
+
+// UpstreamAuth authenticates the calls to targets matching one of Targets,
+// patterns in which "*" matches any sequence of characters like in a policy
+type UpstreamAuth struct {
+	Targets []string `json:"targets"`
+	// Secret is the name or ARN of a Secrets Manager secret holding
+	// UpstreamCredentials as JSON
+	Secret string `json:"secret"`
+}
+
+// UpstreamCredentials are the contents of an UpstreamAuth secret
+type UpstreamCredentials struct {
+	// Scheme is ntlm or kerberos
+	Scheme   string `json:"scheme"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Domain is the NTLM domain, e.g. CORP, or the Kerberos realm, e.g.
+	// CORP.EXAMPLE.COM
+	Domain string `json:"domain,omitempty"`
+	// KDCs are the Kerberos KDCs as host[:port], without them they are
+	// looked up in DNS
+	KDCs []string `json:"kdcs,omitempty"`
+	// SPN is the Kerberos service principal, HTTP/<host> by default
+	SPN string `json:"spn,omitempty"`
+}
+
+// upstreamAuthCache keeps the credentials, and the Kerberos client logged in
+// with them, per secret
+var upstreamAuthCache = struct {
+	mu      sync.Mutex
+	secrets map[string]*upstreamAuthenticator
+}{secrets: map[string]*upstreamAuthenticator{}}
+
+// upstreamAuthenticator signs calls with the credentials of one secret
+type upstreamAuthenticator struct {
+	credentials UpstreamCredentials
+	loadedAt    time.Time
+	kerberos    *krbclient.Client
+}
+
+// upstreamAuthFor returns the authenticator of the first UPSTREAM_AUTH entry
+// matching target, nil if there is none
+func upstreamAuthFor(ctx context.Context, target string) (*upstreamAuthenticator, error) {
+	raw := os.Getenv(UpstreamAuthEnv)
+	if raw == "" {
+		return nil, nil
+	}
+	var entries []UpstreamAuth
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", UpstreamAuthEnv, err)
+	}
+	for _, entry := range entries {
+		if matchesAny(entry.Targets, strings.TrimSuffix(target, "/")) {
+			return cachedAuthenticator(ctx, entry.Secret)
+		}
+	}
+	return nil, nil
+}
+
+func cachedAuthenticator(ctx context.Context, secret string) (*upstreamAuthenticator, error) {
+	upstreamAuthCache.mu.Lock()
+	defer upstreamAuthCache.mu.Unlock()
+
+	cached := upstreamAuthCache.secrets[secret]
+	if cached != nil && time.Since(cached.loadedAt) < upstreamAuthTTL {
+		return cached, nil
+	}
+
+	credentials, err := loadCredentials(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	// A rotated secret needs a new Kerberos login, an unchanged one keeps
+	// the tickets of the current one
+	if cached != nil && sameCredentials(cached.credentials, credentials) {
+		cached.loadedAt = time.Now()
+		return cached, nil
+	}
+	authenticator, err := newUpstreamAuthenticator(credentials)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil && cached.kerberos != nil {
+		cached.kerberos.Destroy()
+	}
+	upstreamAuthCache.secrets[secret] = authenticator
+	return authenticator, nil
+}
+
+// loadCredentials reads UpstreamCredentials from a Secrets Manager secret
+func loadCredentials(ctx context.Context, secret string) (UpstreamCredentials, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return UpstreamCredentials{}, fmt.Errorf("load AWS config: %w", err)
+	}
+	out, err := secretsmanager.NewFromConfig(awsCfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: &secret,
+	})
+	if err != nil {
+		return UpstreamCredentials{}, fmt.Errorf("get upstream credentials secret: %w", err)
+	}
+
+	var credentials UpstreamCredentials
+	if err := json.Unmarshal([]byte(aws.ToString(out.SecretString)), &credentials); err != nil {
+		return UpstreamCredentials{}, fmt.Errorf("unmarshal upstream credentials: %w", err)
+	}
+	return credentials, nil
+}
+
+func sameCredentials(a, b UpstreamCredentials) bool {
+	return a.Scheme == b.Scheme && a.Username == b.Username && a.Password == b.Password &&
+		a.Domain == b.Domain && strings.Join(a.KDCs, ",") == strings.Join(b.KDCs, ",") && a.SPN == b.SPN
+}
+
+// newUpstreamAuthenticator checks credentials and, for Kerberos, prepares a
+// client that logs in with them on first use
+func newUpstreamAuthenticator(credentials UpstreamCredentials) (*upstreamAuthenticator, error) {
+	if credentials.Username == "" || credentials.Password == "" {
+		return nil, fmt.Errorf("failed to use upstream credentials: username and password are required")
+	}
+	authenticator := &upstreamAuthenticator{credentials: credentials, loadedAt: time.Now()}
+
+	switch strings.ToLower(credentials.Scheme) {
+	case authSchemeNTLM:
+	case authSchemeKerberos:
+		realm := strings.ToUpper(credentials.Domain)
+		if realm == "" {
+			return nil, fmt.Errorf("failed to use upstream credentials: kerberos needs the realm as domain")
+		}
+		var kdcs []string
+		for _, kdc := range credentials.KDCs {
+			if _, _, err := net.SplitHostPort(kdc); err != nil {
+				kdc = net.JoinHostPort(kdc, "88")
+			}
+			kdcs = append(kdcs, kdc)
+		}
+		krbCfg := krbconfig.New()
+		krbCfg.LibDefaults.DefaultRealm = realm
+		krbCfg.LibDefaults.DNSLookupKDC = len(kdcs) == 0
+		krbCfg.Realms = []krbconfig.Realm{{Realm: realm, KDC: kdcs}}
+		// Active Directory doesn't support FAST
+		authenticator.kerberos = krbclient.NewWithPassword(credentials.Username, realm, credentials.Password, krbCfg, krbclient.DisablePAFXFAST(true))
+	default:
+		return nil, fmt.Errorf("failed to use upstream credentials: unknown scheme %q, expected ntlm or kerberos", credentials.Scheme)
+	}
+	return authenticator, nil
+}
+
+// client returns a client sending its calls through client's connections,
+// authenticated with the credentials. They replace any Authorization header
+// of the request.
+func (a *upstreamAuthenticator) client(client *http.Client) *http.Client {
+	authenticated := *client
+	if a.kerberos != nil {
+		authenticated.Transport = kerberosTransport{next: client.Transport, client: a.kerberos, spn: a.credentials.SPN}
+		return &authenticated
+	}
+
+	username := a.credentials.Username
+	if a.credentials.Domain != "" && !strings.ContainsAny(username, `\@`) {
+		username = a.credentials.Domain + `\` + username
+	}
+	authenticated.Transport = ntlmTransport{
+		next:     ntlmssp.Negotiator{RoundTripper: client.Transport},
+		username: username,
+		password: a.credentials.Password,
+	}
+	return &authenticated
+}
+
+// ntlmTransport hands the credentials to the NTLM negotiator, which only
+// takes them from a request's basic auth. They are never sent as such.
+type ntlmTransport struct {
+	next               http.RoundTripper
+	username, password string
+}
+
+func (t ntlmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.username, t.password)
+	return t.next.RoundTrip(req)
+}
+
+// kerberosTransport sends a SPNEGO token for the upstream host with every
+// request, the client caches the service ticket between them
+type kerberosTransport struct {
+	next   http.RoundTripper
+	client *krbclient.Client
+	spn    string
+}
+
+func (t kerberosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	spn := t.spn
+	if spn == "" {
+		// Host is the service name of Cloud Map and k8s:// targets
+		host := strings.TrimSuffix(cmp.Or(req.Host, req.URL.Host), ".")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		spn = "HTTP/" + host
+	}
+	req = req.Clone(req.Context())
+	if err := spnego.SetSPNEGOHeader(t.client, req, spn); err != nil {
+		return nil, fmt.Errorf("get kerberos ticket for %s: %w", spn, err)
+	}
+	return t.next.RoundTrip(req)
+}
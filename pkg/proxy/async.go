@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jkblume/awsctl/pkg/ingress"
+)
+
+// LongRunningHeader marks a request as long-running, like the longRunning
+// flag of its target
+const LongRunningHeader = "X-Awsctl-Long-Running"
+
+// Headers of fire-and-forget requests: AsyncHeader asks for one, the 202
+// response carries the ID of its outcome in TrackingIDHeader
+const (
+	AsyncHeader      = "X-Awsctl-Async"
+	TrackingIDHeader = "X-Awsctl-Tracking-Id"
+)
+
+const (
+	// asyncTimeout bounds the wait for a stored response, a little over the
+	// 15 minutes a Lambda can run
+	asyncTimeout = 16 * time.Minute
+	// asyncMaxPoll is the longest pause between two polls
+	asyncMaxPoll = 5 * time.Second
+	// keepAliveInterval is how often a waiting client gets 102 Processing
+	keepAliveInterval = 15 * time.Second
+)
+
+type longRunningContextKey struct{}
+
+type fireAndForgetContextKey struct{}
+
+// WithLongRunning returns ctx marking its request as long-running
+func WithLongRunning(ctx context.Context) context.Context {
+	return context.WithValue(ctx, longRunningContextKey{}, true)
+}
+
+// IsLongRunning reports whether WithLongRunning marked ctx
+func IsLongRunning(ctx context.Context) bool {
+	longRunning, _ := ctx.Value(longRunningContextKey{}).(bool)
+	return longRunning
+}
+
+// WithFireAndForget returns ctx asking for its request to be invoked without
+// waiting for the response
+func WithFireAndForget(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fireAndForgetContextKey{}, true)
+}
+
+// IsFireAndForget reports whether WithFireAndForget marked ctx
+func IsFireAndForget(ctx context.Context) bool {
+	fireAndForget, _ := ctx.Value(fireAndForgetContextKey{}).(bool)
+	return fireAndForget
+}
+
+// EventInvoker is a transport that can invoke the Lambda without waiting for
+// its response
+type EventInvoker interface {
+	InvokeEvent(ctx context.Context, request ProxyRequest) error
+}
+
+// AsyncTransport invokes long-running requests asynchronously, so they are
+// neither cut off by the synchronous invocation's connection nor limited to
+// its 6 MB response. The Lambda stores the response in S3 under a random ID
+// and the transport polls for it, then deletes it. Fire-and-forget requests
+// are answered with 202 and the ID right away, their outcome stays in S3 for
+// awsctl status. Other requests are passed on to next.
+type AsyncTransport struct {
+	next      Transport
+	events    EventInvoker
+	responses *responseStore
+	verbose   bool
+}
+
+// responseStore collects the responses the Lambda stores in S3 for envelopes
+// with a ResponseKey
+type responseStore struct {
+	client *s3.Client
+	bucket string
+}
+
+// NewAsyncTransport collects responses from bucket, the Lambda's
+// ASYNC_RESPONSE_BUCKET. next must be able to invoke asynchronously.
+func NewAsyncTransport(ctx context.Context, next Transport, bucket, region, profile string, verbose bool) (*AsyncTransport, error) {
+	events, ok := next.(EventInvoker)
+	if !ok {
+		return nil, fmt.Errorf("failed to create async transport: %s can't invoke asynchronously", DescribeTransport(next))
+	}
+	responses, err := newResponseStore(ctx, bucket, region, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &AsyncTransport{next: next, events: events, responses: responses, verbose: verbose}, nil
+}
+
+func newResponseStore(ctx context.Context, bucket, region, profile string) (*responseStore, error) {
+	awsCfg, err := LoadAWSConfig(ctx, region, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &responseStore{client: s3.NewFromConfig(awsCfg), bucket: bucket}, nil
+}
+
+func (t *AsyncTransport) String() string {
+	return fmt.Sprintf("%s (long-running requests async via s3://%s)", DescribeTransport(t.next), t.responses.bucket)
+}
+
+func (t *AsyncTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	if IsFireAndForget(ctx) {
+		return t.fireAndForget(ctx, request)
+	}
+	if !IsLongRunning(ctx) {
+		return t.next.Invoke(ctx, request)
+	}
+
+	responseKey, err := newResponseKey()
+	if err != nil {
+		return nil, err
+	}
+	request.ResponseKey = responseKey
+	if err := resign(ctx, &request); err != nil {
+		return nil, err
+	}
+
+	if err := t.events.InvokeEvent(ctx, request); err != nil {
+		return nil, err
+	}
+	if t.verbose {
+		log.Printf("Invoked %s %s asynchronously, waiting for response %s", request.Method, request.Path, responseKey)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, asyncTimeout)
+	defer cancel()
+	for pause := 500 * time.Millisecond; ; pause = min(2*pause, asyncMaxPoll) {
+		response, err := t.responses.collect(ctx, responseKey)
+		if err != nil || response != nil {
+			return response, err
+		}
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("wait for async response %s: %w", responseKey, ctx.Err())
+		}
+	}
+}
+
+// fireAndForget invokes request asynchronously and answers with its tracking
+// ID
+func (t *AsyncTransport) fireAndForget(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	trackingID, err := newResponseKey()
+	if err != nil {
+		return nil, err
+	}
+	request.ResponseKey = trackingID
+	if err := resign(ctx, &request); err != nil {
+		return nil, err
+	}
+	if err := t.events.InvokeEvent(ctx, request); err != nil {
+		return nil, err
+	}
+	if t.verbose {
+		log.Printf("Invoked %s %s without waiting, tracking ID %s", request.Method, request.Path, trackingID)
+	}
+
+	return acceptedResponse(trackingID)
+}
+
+// acceptedResponse answers a request whose outcome isn't waited for
+func acceptedResponse(trackingID string) (*ProxyResponse, error) {
+	body, err := json.Marshal(map[string]string{"trackingId": trackingID})
+	if err != nil {
+		return nil, fmt.Errorf("marshal tracking ID: %w", err)
+	}
+	return &ProxyResponse{
+		StatusCode: http.StatusAccepted,
+		Headers: map[string][]string{
+			"Content-Type":   {"application/json"},
+			TrackingIDHeader: {trackingID},
+		},
+		Body: encodeBody(body),
+	}, nil
+}
+
+// newResponseKey returns a random ID to store a response under
+func newResponseKey() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("generate response key: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// FetchAsyncResponse returns the response stored in bucket for the tracking
+// ID of a fire-and-forget request, nil if there is none (yet)
+func FetchAsyncResponse(ctx context.Context, bucket, region, profile, trackingID string) (*ProxyResponse, error) {
+	if !ingress.IsResponseKey(trackingID) {
+		return nil, fmt.Errorf("failed to fetch response: invalid tracking ID %q", trackingID)
+	}
+	responses, err := newResponseStore(ctx, bucket, region, profile)
+	if err != nil {
+		return nil, err
+	}
+	return responses.fetch(ctx, trackingID)
+}
+
+// collect returns the response stored under responseKey and deletes it. It
+// returns nil if there is none yet.
+func (s *responseStore) collect(ctx context.Context, responseKey string) (*ProxyResponse, error) {
+	response, err := s.fetch(ctx, responseKey)
+	if err != nil || response == nil {
+		return response, err
+	}
+	key := ingress.AsyncResponseKey(responseKey)
+	if _, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &s.bucket, Key: aws.String(key)}); err != nil {
+		log.Printf("Failed to delete async response s3://%s/%s: %v", s.bucket, key, err)
+	}
+	return response, nil
+}
+
+// fetch returns the response stored under responseKey, nil if there is none
+func (s *responseStore) fetch(ctx context.Context, responseKey string) (*ProxyResponse, error) {
+	key := ingress.AsyncResponseKey(responseKey)
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		var noSuchKey *s3types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get async response: %w", err)
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read async response: %w", err)
+	}
+
+	var response ProxyResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("unmarshal async response: %w", err)
+	}
+	return &response, nil
+}
+
+// isLongRunning reports whether the request's header or its target marks it
+// as long-running
+func isLongRunning(r *http.Request, targets *Targets, privateApiUrl string) bool {
+	if value := r.Header.Get(LongRunningHeader); value != "" {
+		longRunning, _ := strconv.ParseBool(value)
+		return longRunning
+	}
+	return targets.LongRunning(privateApiUrl)
+}
+
+// keepAlive sends 102 Processing to the client every keepAliveInterval until
+// stop is called, so it and proxies in between don't give up on a response
+// that takes minutes. It lifts the server's write timeout for the request.
+func keepAlive(w http.ResponseWriter) (stop func()) {
+	controller := http.NewResponseController(w)
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to lift write timeout: %v", err)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(keepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.WriteHeader(http.StatusProcessing)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// AuditRecord is the metadata kept about every proxied request
+type AuditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	User      string    `json:"user"`
+	Method    string    `json:"method"`
+	Target    string    `json:"target"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// AuditSink ships a batch of audit records
+type AuditSink interface {
+	Write(ctx context.Context, records []AuditRecord) error
+}
+
+// CallerIdentity returns the ARN of the AWS identity behind cfg
+func CallerIdentity(ctx context.Context, cfg aws.Config) (string, error) {
+	out, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("get caller identity: %w", err)
+	}
+	return aws.ToString(out.Arn), nil
+}
+
+// AuditTransport appends an AuditRecord for every request to a local buffer
+// file and ships the buffer to an AuditSink in the background. Records stay
+// in the buffer until the sink accepts them, so network failures and
+// restarts lose nothing.
+type AuditTransport struct {
+	next       Transport
+	sink       AuditSink
+	user       string
+	bufferPath string
+	verbose    bool
+
+	mu sync.Mutex
+}
+
+func NewAuditTransport(next Transport, sink AuditSink, user, bufferPath string, verbose bool) *AuditTransport {
+	return &AuditTransport{next: next, sink: sink, user: user, bufferPath: bufferPath, verbose: verbose}
+}
+
+func (t *AuditTransport) String() string {
+	return fmt.Sprintf("%s (audited as %s)", DescribeTransport(t.next), t.user)
+}
+
+func (t *AuditTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	resp, err := t.next.Invoke(ctx, request)
+
+	record := AuditRecord{
+		Timestamp: time.Now().UTC(),
+		User:      t.user,
+		Method:    request.Method,
+		Target:    request.PrivateApiUrl,
+		Path:      request.Path,
+	}
+	if err != nil {
+		record.Status = http.StatusBadGateway
+		record.Error = err.Error()
+	} else {
+		record.Status = resp.StatusCode
+	}
+	if bufferErr := t.append(record); bufferErr != nil {
+		log.Printf("Failed to buffer audit record: %v", bufferErr)
+	}
+
+	return resp, err
+}
+
+func (t *AuditTransport) append(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal audit record: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	file, err := os.OpenFile(t.bufferPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit buffer: %w", err)
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Run ships buffered records every interval until ctx is done
+func (t *AuditTransport) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := t.Flush(ctx); err != nil {
+			log.Printf("Failed to ship audit records, keeping them buffered: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush ships all buffered records and removes them from the buffer
+func (t *AuditTransport) Flush(ctx context.Context) error {
+	t.mu.Lock()
+	data, err := os.ReadFile(t.bufferPath)
+	t.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) || len(data) == 0 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read audit buffer: %w", err)
+	}
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Drop corrupt lines rather than blocking the queue forever
+			log.Printf("Failed to parse buffered audit record: %v", err)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	if len(records) > 0 {
+		if err := t.sink.Write(ctx, records); err != nil {
+			return err
+		}
+		if t.verbose {
+			log.Printf("Shipped %d audit records", len(records))
+		}
+	}
+
+	// Records are only ever appended, drop the prefix that was shipped
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current, err := os.ReadFile(t.bufferPath)
+	if err != nil {
+		return fmt.Errorf("read audit buffer: %w", err)
+	}
+	return os.WriteFile(t.bufferPath, current[len(data):], 0o600)
+}
+
+// CloudWatchAuditSink writes records as JSON log events to a log stream
+type CloudWatchAuditSink struct {
+	client        *cloudwatchlogs.Client
+	logGroup      string
+	logStream     string
+	streamCreated bool
+}
+
+func NewCloudWatchAuditSink(cfg aws.Config, logGroup, logStream string) *CloudWatchAuditSink {
+	return &CloudWatchAuditSink{client: cloudwatchlogs.NewFromConfig(cfg), logGroup: logGroup, logStream: logStream}
+}
+
+func (s *CloudWatchAuditSink) Write(ctx context.Context, records []AuditRecord) error {
+	if !s.streamCreated {
+		_, err := s.client.CreateLogStream(ctx, &cloudwatchlogs.CreateLogStreamInput{
+			LogGroupName:  &s.logGroup,
+			LogStreamName: &s.logStream,
+		})
+		var exists *cwltypes.ResourceAlreadyExistsException
+		if err != nil && !errors.As(err, &exists) {
+			return fmt.Errorf("create log stream: %w", err)
+		}
+		s.streamCreated = true
+	}
+
+	// PutLogEvents accepts at most 10,000 events per call
+	for start := 0; start < len(records); start += 1000 {
+		end := min(start+1000, len(records))
+		var events []cwltypes.InputLogEvent
+		for _, record := range records[start:end] {
+			message, err := json.Marshal(record)
+			if err != nil {
+				return fmt.Errorf("marshal audit record: %w", err)
+			}
+			events = append(events, cwltypes.InputLogEvent{
+				Message:   aws.String(string(message)),
+				Timestamp: aws.Int64(record.Timestamp.UnixMilli()),
+			})
+		}
+		if _, err := s.client.PutLogEvents(ctx, &cloudwatchlogs.PutLogEventsInput{
+			LogGroupName:  &s.logGroup,
+			LogStreamName: &s.logStream,
+			LogEvents:     events,
+		}); err != nil {
+			return fmt.Errorf("put log events: %w", err)
+		}
+	}
+	return nil
+}
+
+// S3AuditSink writes each batch as a JSON lines object below a prefix
+type S3AuditSink struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	name   string
+}
+
+// NewS3AuditSink creates a sink for an s3://bucket/prefix URL, name keeps
+// object keys of concurrent proxies apart
+func NewS3AuditSink(cfg aws.Config, s3URL, name string) (*S3AuditSink, error) {
+	location, ok := strings.CutPrefix(s3URL, "s3://")
+	if !ok {
+		return nil, fmt.Errorf("failed to parse S3 URL %q: expected s3://bucket/prefix", s3URL)
+	}
+	bucket, prefix, _ := strings.Cut(location, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("failed to parse S3 URL %q: missing bucket", s3URL)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &S3AuditSink{client: s3.NewFromConfig(cfg), bucket: bucket, prefix: prefix, name: name}, nil
+}
+
+func (s *S3AuditSink) Write(ctx context.Context, records []AuditRecord) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("marshal audit record: %w", err)
+		}
+	}
+
+	first := records[0].Timestamp
+	key := fmt.Sprintf("%s%s/%s-%s.jsonl", s.prefix, first.Format("2006/01/02"), first.Format("150405.000000000"), s.name)
+	if _, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &s.bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(body.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	}); err != nil {
+		return fmt.Errorf("put audit object: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/ingress"
+)
+
+// maxBatchedBody is the largest request body BatchTransport batches
+const maxBatchedBody = 16 << 10
+
+// batchCall is a request waiting for its batch. done is closed once
+// response or err is set.
+type batchCall struct {
+	ctx      context.Context
+	request  ProxyRequest
+	done     chan struct{}
+	response *ProxyResponse
+	err      error
+}
+
+// BatchTransport coalesces small concurrent requests into one invocation
+// carrying all of them, which the Lambda runs concurrently. Chatty clients
+// firing many small requests at once then pay for one round trip instead of
+// many. Only GET, HEAD and OPTIONS requests are batched: when a batch fails,
+// its requests are retried one by one, which is safe for them, and a Lambda
+// too old to know batches is handled the same way.
+type BatchTransport struct {
+	next    Transport
+	window  time.Duration
+	max     int
+	verbose bool
+
+	mu      sync.Mutex
+	pending []*batchCall
+	timer   *time.Timer
+}
+
+// NewBatchTransport waits up to window for more requests to join a batch and
+// sends it early once it has max requests
+func NewBatchTransport(next Transport, window time.Duration, max int, verbose bool) (*BatchTransport, error) {
+	if max < 2 || max > ingress.MaxBatch {
+		return nil, fmt.Errorf("failed to create batch transport: batch size must be between 2 and %d", ingress.MaxBatch)
+	}
+	return &BatchTransport{next: next, window: window, max: max, verbose: verbose}, nil
+}
+
+func (t *BatchTransport) String() string {
+	return fmt.Sprintf("%s (batching up to %d requests within %s)", DescribeTransport(t.next), t.max, t.window)
+}
+
+func (t *BatchTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return t.next.Invoke(ctx, request)
+	}
+	// Requests answered before they run can't share an invocation
+	if len(request.Body) > maxBatchedBody || IsLongRunning(ctx) || IsFireAndForget(ctx) || IsReliable(ctx) {
+		return t.next.Invoke(ctx, request)
+	}
+
+	call := &batchCall{ctx: ctx, request: request, done: make(chan struct{})}
+	t.mu.Lock()
+	t.pending = append(t.pending, call)
+	if len(t.pending) >= t.max {
+		batch := t.take()
+		t.mu.Unlock()
+		go t.send(batch)
+	} else {
+		if len(t.pending) == 1 {
+			t.timer = time.AfterFunc(t.window, t.flush)
+		}
+		t.mu.Unlock()
+	}
+
+	select {
+	case <-call.done:
+		return call.response, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// take returns the pending requests and starts a new batch. t.mu must be
+// held.
+func (t *BatchTransport) take() []*batchCall {
+	batch := t.pending
+	t.pending = nil
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	return batch
+}
+
+// flush sends the pending requests once the window has passed
+func (t *BatchTransport) flush() {
+	t.mu.Lock()
+	batch := t.take()
+	t.mu.Unlock()
+	t.send(batch)
+}
+
+// send invokes the batch and hands every request its response
+func (t *BatchTransport) send(batch []*batchCall) {
+	switch len(batch) {
+	case 0:
+		return
+	case 1:
+		t.single(batch[0])
+		return
+	}
+
+	requests := make([]ProxyRequest, len(batch))
+	for i, call := range batch {
+		requests[i] = call.request
+	}
+	if t.verbose {
+		log.Printf("Invoking batch of %d requests", len(batch))
+	}
+
+	// The batch serves several clients, none of them may cancel it alone.
+	// The Lambda verifies the envelope before running its sub-requests.
+	ctx := context.WithoutCancel(batch[0].ctx)
+	envelope := ProxyRequest{Batch: requests}
+	err := resign(ctx, &envelope)
+	var response *ProxyResponse
+	if err == nil {
+		response, err = t.next.Invoke(ctx, envelope)
+	}
+	if err == nil && len(response.Batch) != len(batch) {
+		err = fmt.Errorf("failed to run batch: got %d responses for %d requests", len(response.Batch), len(batch))
+	}
+	if err != nil {
+		if t.verbose {
+			log.Printf("Retrying batch of %d requests one by one: %v", len(batch), err)
+		}
+		var wg sync.WaitGroup
+		for _, call := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.single(call)
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	for i, call := range batch {
+		call.response = &response.Batch[i]
+		close(call.done)
+	}
+}
+
+// single invokes call on its own
+func (t *BatchTransport) single(call *batchCall) {
+	call.response, call.err = t.next.Invoke(call.ctx, call.request)
+	close(call.done)
+}
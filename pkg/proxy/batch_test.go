@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingBatches fails every batch invocation, as if the Lambda hung up
+// while the batch was on its way, and answers single requests with their
+// body. It records the requests it received.
+type failingBatches struct {
+	mu       sync.Mutex
+	batches  int
+	requests []ProxyRequest
+}
+
+func (t *failingBatches) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(request.Batch) > 0 {
+		t.batches++
+		return nil, errors.New("connection reset by peer")
+	}
+	t.requests = append(t.requests, request)
+	if request.Method == http.MethodPost {
+		return nil, errors.New("connection reset by peer")
+	}
+	return &ProxyResponse{StatusCode: http.StatusOK, Body: request.Body}, nil
+}
+
+func TestBatchRetriesOneByOne(t *testing.T) {
+	next := &failingBatches{}
+	transport, err := NewBatchTransport(next, time.Second, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := []string{encodeBody([]byte("first body")), encodeBody([]byte("second body"))}
+	responses := make([]*ProxyResponse, len(bodies))
+	errs := make([]error, len(bodies))
+	var wg sync.WaitGroup
+	for i, body := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = transport.Invoke(context.Background(), ProxyRequest{Method: http.MethodGet, Path: "/items", Body: body})
+		}()
+	}
+	wg.Wait()
+
+	if next.batches != 1 {
+		t.Fatalf("sent %d batches, want 1", next.batches)
+	}
+	if len(next.requests) != len(bodies) {
+		t.Fatalf("retried %d requests one by one, want %d", len(next.requests), len(bodies))
+	}
+	for i, body := range bodies {
+		if errs[i] != nil {
+			t.Errorf("request %d failed: %v", i, errs[i])
+			continue
+		}
+		if responses[i].Body != body {
+			t.Errorf("request %d was retried with body %q, want its complete body %q", i, responses[i].Body, body)
+		}
+	}
+}
+
+func TestBatchDoesNotRetryPost(t *testing.T) {
+	next := &failingBatches{}
+	transport, err := NewBatchTransport(next, time.Millisecond, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = transport.Invoke(context.Background(), ProxyRequest{Method: http.MethodPost, Path: "/orders", Body: encodeBody([]byte("order"))})
+	if err == nil {
+		t.Fatal("POST succeeded, want the transport's error")
+	}
+	if next.batches != 0 || len(next.requests) != 1 {
+		t.Errorf("POST sent in %d batches and %d single invocations, want one single invocation", next.batches, len(next.requests))
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// benchmarkSizes are the body sizes the pipeline benchmarks run with
+var benchmarkSizes = []int{1 << 10, 64 << 10, 1 << 20}
+
+// BenchmarkForward measures the proxy side of a request: reading and encoding
+// the client body, invoking a stub transport and decoding and writing the
+// response
+func BenchmarkForward(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			body := bytes.Repeat([]byte("x"), size)
+			server := NewServer(staticTransport(ProxyResponse{
+				StatusCode: http.StatusOK,
+				Headers:    map[string][]string{"Content-Type": {"application/octet-stream"}},
+				Body:       encodeBody(body),
+			}), nil, false)
+
+			b.SetBytes(int64(2 * size))
+			b.ReportAllocs()
+			for b.Loop() {
+				recorder := httptest.NewRecorder()
+				request := httptest.NewRequest(http.MethodPost, "/items", bytes.NewReader(body))
+				server.Forward(recorder, request, "http://upstream.internal", "/items")
+				if recorder.Code != http.StatusOK {
+					b.Fatalf("status = %d, want 200", recorder.Code)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkEnvelopeJSON measures the envelope round trip through JSON the
+// Lambda runtime does on every invocation: encoding the request, decoding it,
+// encoding the response and decoding it again
+func BenchmarkEnvelopeJSON(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			body := encodeBody(bytes.Repeat([]byte("x"), size))
+			request := ProxyRequest{
+				Method:        http.MethodPost,
+				Path:          "/items",
+				Headers:       map[string][]string{"Content-Type": {"application/json"}},
+				Body:          body,
+				PrivateApiUrl: "http://upstream.internal",
+			}
+			response := ProxyResponse{StatusCode: http.StatusOK, Body: body}
+
+			b.SetBytes(int64(2 * size))
+			b.ReportAllocs()
+			for b.Loop() {
+				requestJSON, err := json.Marshal(request)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var decodedRequest ProxyRequest
+				if err := json.Unmarshal(requestJSON, &decodedRequest); err != nil {
+					b.Fatal(err)
+				}
+				responseJSON, err := json.Marshal(response)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var decodedResponse ProxyResponse
+				if err := json.Unmarshal(responseJSON, &decodedResponse); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,467 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStatusHeader tells the client how the cache answered a request
+const CacheStatusHeader = "X-Awsctl-Cache"
+
+// cacheEntry is the on-disk format of a cached response. A response with
+// Vary is stored under a key including the request headers it names, the
+// entry under the plain key then only holds their names in Vary.
+type cacheEntry struct {
+	StoredAt time.Time      `json:"storedAt"`
+	Expires  time.Time      `json:"expires"`
+	Response *ProxyResponse `json:"response,omitempty"`
+	Vary     []string       `json:"vary,omitempty"`
+}
+
+// CacheTransport serves GET responses from a disk cache while they are fresh
+// and revalidates stale entries with If-None-Match/If-Modified-Since, so
+// static assets of internal web UIs don't round-trip through Lambda every
+// time. Only responses that allow caching and are either fresh or carry a
+// validator are stored. Requests with credentials and private responses are
+// never cached, they could be served to another client of the proxy.
+// Entries survive restarts; once the directory exceeds its size limit, the
+// least recently used entries are evicted.
+type CacheTransport struct {
+	next     Transport
+	dir      string
+	verbose  bool
+	maxBytes int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+// CacheInfo summarizes a cache directory
+type CacheInfo struct {
+	Entries int
+	Bytes   int64
+	Fresh   int
+	Oldest  time.Time
+	Newest  time.Time
+}
+
+func NewCacheTransport(next Transport, dir string, verbose bool) (*CacheTransport, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create cache directory: %w", err)
+	}
+	entries, err := cacheFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	t := &CacheTransport{next: next, dir: dir, verbose: verbose}
+	for _, entry := range entries {
+		t.size += entry.size
+	}
+	return t, nil
+}
+
+// SetMaxSize limits the cache directory to maxBytes, 0 means no limit
+func (t *CacheTransport) SetMaxSize(maxBytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxBytes = maxBytes
+	t.evict()
+}
+
+// DefaultCacheDir returns ~/.awsctl/cache
+func DefaultCacheDir() (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cache"), nil
+}
+
+func (t *CacheTransport) String() string {
+	return fmt.Sprintf("%s (caching in %s)", DescribeTransport(t.next), t.dir)
+}
+
+// cacheKey identifies request, including the values of the request headers
+// named by vary
+func cacheKey(request ProxyRequest, vary []string) string {
+	hash := sha256.New()
+	for _, part := range []string{request.Method, request.PrivateApiUrl, request.RawPath, request.Path, request.Query} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	for _, name := range vary {
+		hash.Write([]byte(name + ":" + strings.Join(http.Header(request.Headers).Values(name), ",")))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// varyHeaders returns the canonical, sorted names of the request headers
+// response varies on
+func varyHeaders(response *ProxyResponse) []string {
+	var names []string
+	for _, value := range http.Header(response.Headers).Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return slices.Compact(names)
+}
+
+// lookup returns the key of request and its entry, if there is one
+func (t *CacheTransport) lookup(request ProxyRequest) (string, *cacheEntry) {
+	key := cacheKey(request, nil)
+	entry := t.load(key)
+	if entry == nil || len(entry.Vary) == 0 {
+		return key, entry
+	}
+	key = cacheKey(request, entry.Vary)
+	if entry = t.load(key); entry == nil || entry.Response == nil {
+		return key, nil
+	}
+	return key, entry
+}
+
+func (t *CacheTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	// Entries hold complete bodies, a range request answered from one would
+	// restart a resumed download instead of continuing it
+	requestHeader := http.Header(request.Headers)
+	if request.Method != http.MethodGet || requestHeader.Get("Range") != "" {
+		return t.next.Invoke(ctx, request)
+	}
+	// Responses to requests with credentials belong to their user
+	if requestHeader.Get("Authorization") != "" || requestHeader.Get("Cookie") != "" {
+		return t.next.Invoke(ctx, request)
+	}
+
+	key, entry := t.lookup(request)
+
+	now := time.Now()
+	clientNoCache := strings.Contains(requestHeader.Get("Cache-Control"), "no-cache") || requestHeader.Get("Pragma") == "no-cache"
+	if entry != nil && !clientNoCache && now.Before(entry.Expires) {
+		if t.verbose {
+			log.Printf("Cache hit for %s %s", request.Method, request.Path)
+		}
+		t.touch(key, now)
+		// No upstream call was made, the stored timing is not this request's
+		cached := entry.responseFor(request, "hit")
+		cached.Timing = nil
+		return cached, nil
+	}
+
+	// Revalidate a stale entry unless the client sent its own validators
+	revalidating := false
+	upstreamRequest := request
+	if entry != nil && requestHeader.Get("If-None-Match") == "" && requestHeader.Get("If-Modified-Since") == "" {
+		entryHeader := http.Header(entry.Response.Headers)
+		conditional := requestHeader.Clone()
+		if etag := entryHeader.Get("Etag"); etag != "" {
+			conditional.Set("If-None-Match", etag)
+			revalidating = true
+		}
+		if lastModified := entryHeader.Get("Last-Modified"); lastModified != "" {
+			conditional.Set("If-Modified-Since", lastModified)
+			revalidating = true
+		}
+		upstreamRequest.Headers = conditional
+	}
+
+	response, err := t.next.Invoke(ctx, upstreamRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if revalidating && response.StatusCode == http.StatusNotModified {
+		if t.verbose {
+			log.Printf("Cache revalidated %s %s", request.Method, request.Path)
+		}
+		entry.StoredAt = now
+		entry.Expires = now.Add(freshnessLifetime(http.Header(response.Headers), now))
+		t.store(key, entry)
+		revalidated := entry.responseFor(request, "revalidated")
+		revalidated.Timing = response.Timing
+		return revalidated, nil
+	}
+
+	if isCacheable(response) {
+		expires := now.Add(freshnessLifetime(http.Header(response.Headers), now))
+		vary := varyHeaders(response)
+		if len(vary) > 0 {
+			t.store(cacheKey(request, nil), &cacheEntry{StoredAt: now, Expires: expires, Vary: vary})
+		}
+		t.store(cacheKey(request, vary), &cacheEntry{
+			StoredAt: now,
+			Expires:  expires,
+			Response: response,
+		})
+	}
+
+	return withCacheStatus(response, "miss"), nil
+}
+
+// responseFor answers request from the entry, with 304 when the client's
+// validator matches
+func (e *cacheEntry) responseFor(request ProxyRequest, status string) *ProxyResponse {
+	entryHeader := http.Header(e.Response.Headers)
+	if etag := entryHeader.Get("Etag"); etag != "" && http.Header(request.Headers).Get("If-None-Match") == etag {
+		headers := http.Header{}
+		for _, name := range []string{"Etag", "Cache-Control", "Expires", "Last-Modified", "Vary"} {
+			if values := entryHeader.Values(name); len(values) > 0 {
+				headers[name] = values
+			}
+		}
+		return withCacheStatus(&ProxyResponse{StatusCode: http.StatusNotModified, Headers: headers}, status)
+	}
+	return withCacheStatus(e.Response, status)
+}
+
+func withCacheStatus(response *ProxyResponse, status string) *ProxyResponse {
+	copied := *response
+	headers := http.Header(response.Headers).Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	headers.Set(CacheStatusHeader, status)
+	copied.Headers = headers
+	return &copied
+}
+
+// isCacheable reports whether a 200 response may be stored by a shared
+// cache and is either fresh for a while or can be revalidated
+func isCacheable(response *ProxyResponse) bool {
+	if response.StatusCode != http.StatusOK {
+		return false
+	}
+	header := http.Header(response.Headers)
+	cacheControl := strings.ToLower(header.Get("Cache-Control"))
+	if strings.Contains(cacheControl, "no-store") || strings.Contains(cacheControl, "private") || header.Get("Vary") == "*" {
+		return false
+	}
+	return freshnessLifetime(header, time.Now()) > 0 || header.Get("Etag") != "" || header.Get("Last-Modified") != ""
+}
+
+// freshnessLifetime derives how long a response stays fresh from
+// Cache-Control max-age or Expires. no-cache responses are always stale.
+func freshnessLifetime(header http.Header, now time.Time) time.Duration {
+	for _, directive := range strings.Split(strings.ToLower(header.Get("Cache-Control")), ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "no-cache" {
+			return 0
+		}
+		if value, ok := strings.CutPrefix(directive, "max-age="); ok {
+			seconds, err := strconv.Atoi(value)
+			if err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+			return 0
+		}
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil && expires.After(now) {
+		return expires.Sub(now)
+	}
+	return 0
+}
+
+func (t *CacheTransport) load(key string) *cacheEntry {
+	data, err := os.ReadFile(filepath.Join(t.dir, key+".json"))
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || (entry.Response == nil && len(entry.Vary) == 0) {
+		return nil
+	}
+	return &entry
+}
+
+func (t *CacheTransport) store(key string, entry *cacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to marshal cache entry: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Write to a temporary file first so concurrent readers never see a
+	// partial entry
+	path := filepath.Join(t.dir, key+".json")
+	var previous int64
+	if info, err := os.Stat(path); err == nil {
+		previous = info.Size()
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Printf("Failed to write cache entry: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("Failed to store cache entry: %v", err)
+		return
+	}
+	t.size += int64(len(data)) - previous
+	t.evict()
+}
+
+// touch marks an entry as used, eviction goes by modification time
+func (t *CacheTransport) touch(key string, now time.Time) {
+	path := filepath.Join(t.dir, key+".json")
+	if err := os.Chtimes(path, now, now); err != nil && t.verbose {
+		log.Printf("Failed to mark cache entry as used: %v", err)
+	}
+}
+
+// evict removes the least recently used entries until the cache is below 90%
+// of its limit, so not every store has to scan the directory. t.mu must be
+// held.
+func (t *CacheTransport) evict() {
+	if t.maxBytes <= 0 || t.size <= t.maxBytes {
+		return
+	}
+	entries, err := cacheFiles(t.dir)
+	if err != nil {
+		log.Printf("Failed to evict cache entries: %v", err)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+
+	t.size = 0
+	for _, entry := range entries {
+		t.size += entry.size
+	}
+	evicted := 0
+	for _, entry := range entries {
+		if t.size <= t.maxBytes*9/10 {
+			break
+		}
+		if err := os.Remove(entry.path); err != nil {
+			log.Printf("Failed to evict cache entry: %v", err)
+			continue
+		}
+		t.size -= entry.size
+		evicted++
+	}
+	if t.verbose {
+		log.Printf("Evicted %d cache entries, %d bytes left", evicted, t.size)
+	}
+}
+
+// cacheFile is an entry file in a cache directory
+type cacheFile struct {
+	path string
+	size int64
+	used time.Time
+}
+
+func cacheFiles(dir string) ([]cacheFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read cache directory: %w", err)
+	}
+	var files []cacheFile
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since the directory was read
+			continue
+		}
+		files = append(files, cacheFile{path: filepath.Join(dir, entry.Name()), size: info.Size(), used: info.ModTime()})
+	}
+	return files, nil
+}
+
+// CacheStats summarizes the entries in dir
+func CacheStats(dir string) (CacheInfo, error) {
+	files, err := cacheFiles(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return CacheInfo{}, nil
+	}
+	if err != nil {
+		return CacheInfo{}, err
+	}
+
+	var info CacheInfo
+	now := time.Now()
+	for _, file := range files {
+		data, err := os.ReadFile(file.path)
+		if err != nil {
+			continue
+		}
+		var entry cacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+		info.Bytes += file.size
+		// Entries naming the headers of a response with Vary hold no response
+		if entry.Response == nil {
+			continue
+		}
+		info.Entries++
+		if now.Before(entry.Expires) {
+			info.Fresh++
+		}
+		if info.Oldest.IsZero() || entry.StoredAt.Before(info.Oldest) {
+			info.Oldest = entry.StoredAt
+		}
+		if entry.StoredAt.After(info.Newest) {
+			info.Newest = entry.StoredAt
+		}
+	}
+	return info, nil
+}
+
+// PurgeCache removes the entries in dir, only those that are no longer fresh
+// if staleOnly is set. It returns the number of entries and bytes removed.
+// Stale entries with validators could still be revalidated, purging them
+// means refetching.
+func PurgeCache(dir string, staleOnly bool) (int, int64, error) {
+	files, err := cacheFiles(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed, bytes := 0, int64(0)
+	now := time.Now()
+	for _, file := range files {
+		if staleOnly {
+			data, err := os.ReadFile(file.path)
+			if err != nil {
+				continue
+			}
+			var entry cacheEntry
+			if json.Unmarshal(data, &entry) == nil && now.Before(entry.Expires) {
+				continue
+			}
+		}
+		if err := os.Remove(file.path); err != nil {
+			return removed, bytes, fmt.Errorf("remove cache entry: %w", err)
+		}
+		removed++
+		bytes += file.size
+	}
+	return removed, bytes, nil
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// ChaosHeader marks responses whose failure was injected by ChaosHook
+const ChaosHeader = "X-Awsctl-Chaos"
+
+// ChaosConfig describes faults injected into requests to a target
+type ChaosConfig struct {
+	// LatencyMs delays every request by this many milliseconds
+	LatencyMs int `json:"latencyMs,omitempty"`
+	// ErrorRate is the share of requests, between 0 and 1, answered with
+	// Status instead of being invoked
+	ErrorRate float64 `json:"errorRate,omitempty"`
+	// Status of injected errors, 503 if not set
+	Status int `json:"status,omitempty"`
+}
+
+// Enabled reports whether c injects anything
+func (c ChaosConfig) Enabled() bool {
+	return c.LatencyMs > 0 || c.ErrorRate > 0
+}
+
+func (c ChaosConfig) validate() error {
+	if c.LatencyMs < 0 {
+		return fmt.Errorf("failed to use chaos config: negative latency")
+	}
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return fmt.Errorf("failed to use chaos config: error rate %g is not between 0 and 1", c.ErrorRate)
+	}
+	if c.Status != 0 && (c.Status < 100 || c.Status > 999) {
+		return fmt.Errorf("failed to use chaos config: invalid status %d", c.Status)
+	}
+	return nil
+}
+
+// ChaosHook injects latency and errors locally, before and instead of
+// invoking the Lambda, so teams can check how their clients handle a slow or
+// failing private API. Targets with their own "chaos" use it, all others
+// defaults.
+func ChaosHook(defaults ChaosConfig, targets *Targets) (RequestHook, error) {
+	if err := defaults.validate(); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, request *ProxyRequest) (*ProxyResponse, error) {
+		config := defaults
+		if targetConfig := targets.Chaos(request.PrivateApiUrl); targetConfig != nil {
+			config = *targetConfig
+		}
+
+		if config.LatencyMs > 0 {
+			select {
+			case <-time.After(time.Duration(config.LatencyMs) * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if config.ErrorRate == 0 || rand.Float64() >= config.ErrorRate {
+			return nil, nil
+		}
+
+		status := config.Status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		log.Printf("Injected %d into %s %s", status, request.Method, request.Path)
+		response := TextResponse(status, fmt.Sprintf("Injected fault: %d %s", status, http.StatusText(status)))
+		response.Headers[ChaosHeader] = []string{"injected"}
+		return response, nil
+	}, nil
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// coalescedCall is an invocation shared by identical requests
+type coalescedCall struct {
+	done     chan struct{}
+	response *ProxyResponse
+	err      error
+	// waiters counts the requests still waiting for the invocation, it is
+	// cancelled when all of them went away
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// CoalesceTransport sends concurrent identical GET requests as a single
+// invocation and hands its response to all of them, e.g. when a browser
+// requests the same assets of an internal UI from several tabs at once.
+// Requests are identical when their envelopes are, headers included, so a
+// client never gets a response made for another client's credentials.
+type CoalesceTransport struct {
+	next    Transport
+	verbose bool
+
+	mu       sync.Mutex
+	inFlight map[string]*coalescedCall
+}
+
+func NewCoalesceTransport(next Transport, verbose bool) *CoalesceTransport {
+	return &CoalesceTransport{next: next, verbose: verbose, inFlight: map[string]*coalescedCall{}}
+}
+
+func (t *CoalesceTransport) String() string {
+	return fmt.Sprintf("%s (coalescing identical GET requests)", DescribeTransport(t.next))
+}
+
+func (t *CoalesceTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	// Every fire-and-forget and reliable request must reach the upstream
+	if request.Method != http.MethodGet || request.Body != "" || IsFireAndForget(ctx) || IsReliable(ctx) {
+		return t.next.Invoke(ctx, request)
+	}
+	key, err := coalesceKey(request)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	call, ok := t.inFlight[key]
+	if ok {
+		call.waiters++
+	} else {
+		call = t.start(ctx, key, request)
+	}
+	t.mu.Unlock()
+	if ok && t.verbose {
+		log.Printf("Coalesced %s %s with an identical request in flight", request.Method, request.Path)
+	}
+
+	select {
+	case <-call.done:
+		if call.err != nil {
+			return nil, call.err
+		}
+		return copyResponse(call.response), nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if call.waiters--; call.waiters == 0 {
+			call.cancel()
+			if t.inFlight[key] == call {
+				delete(t.inFlight, key)
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// start invokes request for its first waiter, t.mu must be held. The
+// invocation keeps the first waiter's deadline but isn't cancelled with it,
+// later waiters may still need the response.
+func (t *CoalesceTransport) start(ctx context.Context, key string, request ProxyRequest) *coalescedCall {
+	callCtx := context.WithoutCancel(ctx)
+	var cancel context.CancelFunc
+	if deadline, ok := ctx.Deadline(); ok {
+		callCtx, cancel = context.WithDeadline(callCtx, deadline)
+	} else {
+		callCtx, cancel = context.WithCancel(callCtx)
+	}
+	call := &coalescedCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	t.inFlight[key] = call
+
+	go func() {
+		defer cancel()
+		response, err := t.next.Invoke(callCtx, request)
+		t.mu.Lock()
+		call.response, call.err = response, err
+		if t.inFlight[key] == call {
+			delete(t.inFlight, key)
+		}
+		t.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// coalesceKey hashes the whole envelope of request
+func coalesceKey(request ProxyRequest) (string, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("marshal request: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// copyResponse copies response for one waiter, so hooks changing the
+// headers of one copy don't affect the others
+func copyResponse(response *ProxyResponse) *ProxyResponse {
+	copied := *response
+	copied.Headers = http.Header(response.Headers).Clone()
+	copied.Trailers = http.Header(response.Trailers).Clone()
+	if response.Timing != nil {
+		timing := *response.Timing
+		copied.Timing = &timing
+	}
+	return &copied
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// CompressionTransport asks upstreams for gzip on behalf of clients that
+// don't accept any encoding, so bodies cross the tunnel compressed and count
+// against the Lambda's payload limit as such. It decompresses them again
+// before the transports, hooks and clients above it see the response.
+type CompressionTransport struct {
+	next     Transport
+	maxBytes int64
+}
+
+// NewCompressionTransport decompresses bodies up to maxBytes, larger ones
+// fail the request
+func NewCompressionTransport(next Transport, maxBytes int64) *CompressionTransport {
+	return &CompressionTransport{next: next, maxBytes: maxBytes}
+}
+
+func (t *CompressionTransport) String() string {
+	return fmt.Sprintf("%s (compressed bodies up to %d bytes)", DescribeTransport(t.next), t.maxBytes)
+}
+
+func (t *CompressionTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	if !acceptsGzip(request) {
+		return t.next.Invoke(ctx, request)
+	}
+	headers := http.Header(request.Headers).Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	headers.Set("Accept-Encoding", "gzip")
+	request.Headers = headers
+
+	response, err := t.next.Invoke(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return decompressResponse(response, t.maxBytes)
+}
+
+// acceptsGzip reports whether gzip may be asked for on behalf of the client
+// of request. Ranges and HEAD responses describe the uncompressed body, so
+// net/http doesn't ask for gzip with them either.
+func acceptsGzip(request ProxyRequest) bool {
+	headers := http.Header(request.Headers)
+	return headers.Get("Accept-Encoding") == "" && headers.Get("Range") == "" && request.Method != http.MethodHead
+}
+
+// decompressResponse returns a copy of response with a gzip body decompressed
+// and Content-Encoding and Content-Length removed. Other responses are
+// returned as they are.
+func decompressResponse(response *ProxyResponse, maxBytes int64) (*ProxyResponse, error) {
+	headers := http.Header(response.Headers)
+	if !strings.EqualFold(headers.Get("Content-Encoding"), "gzip") {
+		return response, nil
+	}
+	compressed, err := base64.StdEncoding.DecodeString(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decode response body: %w", err)
+	}
+	// A response without content, e.g. a 304, may still name the encoding
+	if len(compressed) == 0 {
+		return response, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("read gzip header: %w", err)
+	}
+	// A few bytes of gzip can expand to gigabytes
+	body, err := io.ReadAll(io.LimitReader(reader, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress response body: %w", err)
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, fmt.Errorf("failed to decompress response body: larger than %d bytes", maxBytes)
+	}
+
+	decompressed := *response
+	decompressed.Headers = headers.Clone()
+	http.Header(decompressed.Headers).Del("Content-Encoding")
+	http.Header(decompressed.Headers).Del("Content-Length")
+	decompressed.Body = encodeBody(body)
+	return &decompressed, nil
+}
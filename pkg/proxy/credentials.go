@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go"
+)
+
+// credentialCheckInterval is how often paused requests check whether the
+// credentials were refreshed
+const credentialCheckInterval = 5 * time.Second
+
+// credentialErrorCodes are the API error codes AWS returns for expired or
+// unknown credentials
+var credentialErrorCodes = map[string]bool{
+	"ExpiredToken":                true,
+	"ExpiredTokenException":       true,
+	"InvalidClientTokenId":        true,
+	"UnrecognizedClientException": true,
+}
+
+// credentialErrorMessages catch credential errors without an error code, like
+// a function URL's 403 body or a failed SSO token refresh
+var credentialErrorMessages = []string{
+	"security token included in the request is expired",
+	"security token included in the request is invalid",
+	"failed to refresh cached credentials",
+}
+
+var (
+	credentialCachesMu sync.Mutex
+	credentialCaches   []*aws.CredentialsCache
+)
+
+// trackCredentials remembers the credential cache of cfg for
+// InvalidateCredentials
+func trackCredentials(cfg aws.Config) {
+	cache, ok := cfg.Credentials.(*aws.CredentialsCache)
+	if !ok {
+		return
+	}
+	credentialCachesMu.Lock()
+	defer credentialCachesMu.Unlock()
+	credentialCaches = append(credentialCaches, cache)
+}
+
+// InvalidateCredentials makes every client created from LoadAWSConfig fetch
+// new credentials on its next call, e.g. after aws sso login
+func InvalidateCredentials() {
+	credentialCachesMu.Lock()
+	defer credentialCachesMu.Unlock()
+	for _, cache := range credentialCaches {
+		cache.Invalidate()
+	}
+}
+
+// IsCredentialError reports whether err means the AWS credentials expired or
+// are not valid anymore
+func IsCredentialError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && credentialErrorCodes[apiErr.ErrorCode()] {
+		return true
+	}
+	message := err.Error()
+	for _, m := range credentialErrorMessages {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// CredentialsCheck returns a check that succeeds once the credentials of
+// profile work again. Every check loads them anew, so refreshed SSO tokens
+// and credential files are picked up.
+func CredentialsCheck(region, profile string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		awsCfg, err := loadAWSConfig(ctx, region, profile)
+		if err != nil {
+			return err
+		}
+		_, err = CallerIdentity(ctx, awsCfg)
+		return err
+	}
+}
+
+// CredentialGuardTransport pauses all requests when the next transport fails
+// because the AWS credentials expired. It notifies the user once, checks
+// periodically until the credentials work again and then retries the
+// requests that were waiting instead of failing them.
+type CredentialGuardTransport struct {
+	next    Transport
+	profile string
+	check   func(ctx context.Context) error
+	notify  func(message string)
+
+	mu sync.Mutex
+	// resumed is closed when the credentials work again, nil while they do
+	resumed chan struct{}
+	waiting int
+}
+
+// NewCredentialGuardTransport guards next. check reports whether the
+// credentials work again, notify tells the user about expiry and refresh.
+func NewCredentialGuardTransport(next Transport, profile string, check func(ctx context.Context) error, notify func(message string)) *CredentialGuardTransport {
+	return &CredentialGuardTransport{next: next, profile: profile, check: check, notify: notify}
+}
+
+func (t *CredentialGuardTransport) String() string {
+	return DescribeTransport(t.next)
+}
+
+func (t *CredentialGuardTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	if err := t.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	response, err := t.next.Invoke(ctx, request)
+	if !IsCredentialError(err) {
+		return response, err
+	}
+
+	t.pause(err)
+	if err := t.wait(ctx); err != nil {
+		return nil, err
+	}
+	// The envelope holds the complete body, the retry sends it unchanged
+	return t.next.Invoke(ctx, request)
+}
+
+// wait blocks while the transport is paused
+func (t *CredentialGuardTransport) wait(ctx context.Context) error {
+	t.mu.Lock()
+	resumed := t.resumed
+	if resumed != nil {
+		t.waiting++
+	}
+	t.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+
+	defer func() {
+		t.mu.Lock()
+		t.waiting--
+		t.mu.Unlock()
+	}()
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("wait for refreshed AWS credentials: %w", ctx.Err())
+	}
+}
+
+// pause holds new requests until the credentials work again
+func (t *CredentialGuardTransport) pause(cause error) {
+	t.mu.Lock()
+	paused := t.resumed != nil
+	if !paused {
+		t.resumed = make(chan struct{})
+		go t.waitForRefresh(t.resumed)
+	}
+	t.mu.Unlock()
+	if paused {
+		return
+	}
+
+	login := "aws sso login"
+	if t.profile != "" {
+		login += " --profile " + t.profile
+	}
+	t.notify(fmt.Sprintf("AWS credentials expired, run %s or update your credentials file. Requests are paused until then: %v", login, cause))
+}
+
+func (t *CredentialGuardTransport) waitForRefresh(resumed chan struct{}) {
+	ticker := time.NewTicker(credentialCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), credentialCheckInterval)
+		err := t.check(ctx)
+		cancel()
+		if err == nil {
+			break
+		}
+	}
+
+	// Clients still hold the expired credentials in their caches
+	InvalidateCredentials()
+
+	t.mu.Lock()
+	waiting := t.waiting
+	t.resumed = nil
+	close(resumed)
+	t.mu.Unlock()
+	t.notify(fmt.Sprintf("AWS credentials refreshed, resuming %d waiting requests", waiting))
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// debugInvocation is what a base transport learned about one invocation
+type debugInvocation struct {
+	// RequestID is the Lambda request ID, if the transport learned it
+	RequestID  string       `json:"requestId,omitempty"`
+	Transport  string       `json:"transport"`
+	Started    time.Time    `json:"started"`
+	DurationMs int64        `json:"durationMs"`
+	Envelope   ProxyRequest `json:"envelope"`
+	// Logs are the decoded tail of the Lambda's log output
+	Logs  string `json:"logs,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// debugTrace collects the invocations made for one client request
+type debugTrace struct {
+	redactor *Redactor
+
+	mu          sync.Mutex
+	invocations []debugInvocation
+}
+
+// debugRecord is the content of a file in the debug directory
+type debugRecord struct {
+	RequestID   string            `json:"requestId"`
+	Time        time.Time         `json:"time"`
+	DurationMs  int64             `json:"durationMs"`
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	Target      string            `json:"target"`
+	Invocations []debugInvocation `json:"invocations"`
+	Response    *ProxyResponse    `json:"response,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+type debugTraceContextKey struct{}
+
+// withDebugTrace returns a context whose base transport records its
+// invocations in the returned trace
+func withDebugTrace(ctx context.Context, redactor *Redactor) (context.Context, *debugTrace) {
+	trace := &debugTrace{redactor: redactor}
+	return context.WithValue(ctx, debugTraceContextKey{}, trace), trace
+}
+
+// traceInvocation records an invocation of request by transport in the
+// trace of ctx, if it has one
+func traceInvocation(ctx context.Context, transport Transport, request ProxyRequest, started time.Time, requestID, logResult string, err error) {
+	trace, _ := ctx.Value(debugTraceContextKey{}).(*debugTrace)
+	if trace == nil {
+		return
+	}
+	invocation := debugInvocation{
+		RequestID:  requestID,
+		Transport:  DescribeTransport(transport),
+		Started:    started,
+		DurationMs: time.Since(started).Milliseconds(),
+		Envelope:   trace.redactor.Request(request),
+	}
+	if logs, decodeErr := base64.StdEncoding.DecodeString(logResult); decodeErr == nil {
+		invocation.Logs = string(logs)
+	}
+	if err != nil {
+		invocation.Error = err.Error()
+	}
+
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	trace.invocations = append(trace.invocations, invocation)
+}
+
+// requestID returns the Lambda request ID of the last invocation that has
+// one, or a new ID
+func (t *debugTrace) requestID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.invocations) - 1; i >= 0; i-- {
+		if id := t.invocations[i].RequestID; id != "" {
+			return id
+		}
+	}
+	return newRequestID()
+}
+
+// SetDebugDir writes a file per request to dir, named by the Lambda request
+// ID, with the envelopes, the Lambda's log tail, timing and the response,
+// redacted by redactor. Clients get the ID in X-Awsctl-Request-Id. An
+// empty dir disables the files.
+func (s *Server) SetDebugDir(dir string, redactor *Redactor) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fmt.Errorf("create debug directory: %w", err)
+		}
+	}
+	s.debugDir = dir
+	s.debugRedactor = redactor
+	return nil
+}
+
+// writeDebugFile writes the record of a request to the debug directory and
+// returns its request ID
+func (s *Server) writeDebugFile(r *http.Request, target string, trace *debugTrace, started time.Time, response *ProxyResponse, err error) string {
+	trace.mu.Lock()
+	invocations := trace.invocations
+	trace.mu.Unlock()
+	record := debugRecord{
+		RequestID:   trace.requestID(),
+		Time:        started,
+		DurationMs:  time.Since(started).Milliseconds(),
+		Method:      r.Method,
+		URL:         r.URL.String(),
+		Target:      target,
+		Invocations: invocations,
+		Response:    s.debugRedactor.Response(response),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	data, marshalErr := json.MarshalIndent(record, "", "  ")
+	if marshalErr != nil {
+		log.Printf("Failed to marshal debug record: %v", marshalErr)
+		return record.RequestID
+	}
+	path := filepath.Join(s.debugDir, record.RequestID+".json")
+	if writeErr := os.WriteFile(path, append(data, '\n'), 0o600); writeErr != nil {
+		log.Printf("Failed to write debug record: %v", writeErr)
+	}
+	return record.RequestID
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/jkblume/awsctl/pkg/ingress"
+)
+
+// deltaMemory caps the bodies DeltaTransport keeps in memory
+const deltaMemory = 64 << 20
+
+// deltaBody is a remembered response body
+type deltaBody struct {
+	key  string
+	hash string
+	body string
+}
+
+// DeltaTransport remembers large GET response bodies and sends their hash
+// with the next request for the same URL. When the upstream body is still
+// the same, the Lambda leaves it out of the response and the remembered body
+// is used, so polling a large, rarely changing resource costs a small
+// invocation payload instead of the whole body every time.
+type DeltaTransport struct {
+	next     Transport
+	minBytes int
+	verbose  bool
+
+	mu     sync.Mutex
+	bodies map[string]*list.Element
+	lru    *list.List
+	size   int
+}
+
+// NewDeltaTransport remembers bodies of at least minBytes
+func NewDeltaTransport(next Transport, minBytes int, verbose bool) *DeltaTransport {
+	return &DeltaTransport{next: next, minBytes: minBytes, verbose: verbose, bodies: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (t *DeltaTransport) String() string {
+	return fmt.Sprintf("%s (delta responses from %d bytes)", DescribeTransport(t.next), t.minBytes)
+}
+
+func (t *DeltaTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	if request.Method != http.MethodGet {
+		return t.next.Invoke(ctx, request)
+	}
+
+	key := cacheKey(request, nil)
+	known := t.lookup(key)
+	if known != nil {
+		request.KnownBodyHash = known.hash
+	}
+
+	response, err := t.next.Invoke(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.BodyUnchanged {
+		if known == nil {
+			return nil, fmt.Errorf("failed to restore unchanged body: no body was sent for %s", request.Path)
+		}
+		if t.verbose {
+			log.Printf("Body of %s %s unchanged, %d bytes not transferred", request.Method, request.Path, len(known.body))
+		}
+		restored := *response
+		restored.Body = known.body
+		restored.BodyUnchanged = false
+		return &restored, nil
+	}
+
+	if response.StatusCode == http.StatusOK && !response.Encrypted {
+		body, err := base64.StdEncoding.DecodeString(response.Body)
+		if err == nil && len(body) >= t.minBytes {
+			t.remember(&deltaBody{key: key, hash: ingress.BodyHash(body), body: response.Body})
+		} else if known != nil {
+			t.forget(key)
+		}
+	}
+	return response, nil
+}
+
+func (t *DeltaTransport) lookup(key string) *deltaBody {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	element, ok := t.bodies[key]
+	if !ok {
+		return nil
+	}
+	t.lru.MoveToFront(element)
+	return element.Value.(*deltaBody)
+}
+
+// remember stores body and drops the least recently used bodies beyond
+// deltaMemory
+func (t *DeltaTransport) remember(body *deltaBody) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if element, ok := t.bodies[body.key]; ok {
+		t.size -= len(element.Value.(*deltaBody).body)
+		t.lru.Remove(element)
+	}
+	t.bodies[body.key] = t.lru.PushFront(body)
+	t.size += len(body.body)
+
+	for t.size > deltaMemory && t.lru.Len() > 1 {
+		oldest := t.lru.Back()
+		t.lru.Remove(oldest)
+		evicted := oldest.Value.(*deltaBody)
+		delete(t.bodies, evicted.key)
+		t.size -= len(evicted.body)
+	}
+}
+
+func (t *DeltaTransport) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if element, ok := t.bodies[key]; ok {
+		t.size -= len(element.Value.(*deltaBody).body)
+		t.lru.Remove(element)
+		delete(t.bodies, key)
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/jkblume/awsctl/pkg/ingress"
+)
+
+// dataKeyLifetime is how long a data key is reused before a new one is
+// generated, which keeps KMS calls off the hot path
+const dataKeyLifetime = 5 * time.Minute
+
+// EncryptingTransport encrypts request bodies with a KMS data key and
+// decrypts the response bodies the ingress Lambda encrypts with the same
+// key. Bodies are then unreadable to anything between the CLI and the
+// Lambda handler, such as invocation logging or Lambda extensions.
+type EncryptingTransport struct {
+	next   Transport
+	client *kms.Client
+	keyID  string
+
+	mu           sync.Mutex
+	dataKey      []byte
+	encryptedKey string
+	expires      time.Time
+}
+
+func NewEncryptingTransport(ctx context.Context, next Transport, keyID, region, profile string) (*EncryptingTransport, error) {
+	awsCfg, err := LoadAWSConfig(ctx, region, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptingTransport{next: next, client: kms.NewFromConfig(awsCfg), keyID: keyID}, nil
+}
+
+func (t *EncryptingTransport) String() string {
+	return fmt.Sprintf("%s (encrypted with %s)", DescribeTransport(t.next), t.keyID)
+}
+
+// currentDataKey returns the plaintext and encrypted form of the data key,
+// generating a new one when the current key has expired
+func (t *EncryptingTransport) currentDataKey(ctx context.Context) ([]byte, string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.dataKey != nil && time.Now().Before(t.expires) {
+		return t.dataKey, t.encryptedKey, nil
+	}
+
+	out, err := t.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   &t.keyID,
+		KeySpec: kmstypes.DataKeySpecAes256,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("generate data key: %w", err)
+	}
+	t.dataKey = out.Plaintext
+	t.encryptedKey = base64.StdEncoding.EncodeToString(out.CiphertextBlob)
+	t.expires = time.Now().Add(dataKeyLifetime)
+	return t.dataKey, t.encryptedKey, nil
+}
+
+func (t *EncryptingTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	dataKey, encryptedKey, err := t.currentDataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := base64.StdEncoding.DecodeString(request.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decode request body: %w", err)
+	}
+	request.Body, err = ingress.EncryptBody(dataKey, body)
+	if err != nil {
+		return nil, err
+	}
+	request.EncryptedKey = encryptedKey
+
+	resp, err := t.next.Invoke(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Encrypted {
+		return resp, nil
+	}
+
+	plaintext, err := ingress.DecryptBody(dataKey, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := *resp
+	decrypted.Body = encodeBody(plaintext)
+	decrypted.Encrypted = false
+	return &decrypted, nil
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/ingress"
+)
+
+// The envelope types are the ingress handler's, so the CLI and the Lambda
+// can't disagree on the format
+type (
+	ProxyRequest   = ingress.ProxyRequest
+	ProxyResponse  = ingress.ProxyResponse
+	UpstreamTiming = ingress.UpstreamTiming
+)
+
+// stampDeadline sets DeadlineMs of request to the time left until ctx's
+// deadline, so the Lambda stops working on requests the CLI gave up on. A
+// deadline stamped before signing is kept.
+func stampDeadline(ctx context.Context, request ProxyRequest) ProxyRequest {
+	if deadline, ok := ctx.Deadline(); ok && request.DeadlineMs == 0 {
+		request.DeadlineMs = max(time.Until(deadline).Milliseconds(), 1)
+	}
+	return request
+}
+
+// encodeBody encodes a body for the envelope, bodies are always base64 so
+// binary content survives JSON
+func encodeBody(body []byte) string {
+	return base64.StdEncoding.EncodeToString(body)
+}
+
+// TextResponse builds a plain text response, e.g. for hooks that block a
+// request
+func TextResponse(statusCode int, text string) *ProxyResponse {
+	return &ProxyResponse{
+		StatusCode: statusCode,
+		Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:       encodeBody([]byte(text)),
+	}
+}
+
+// validateResponse rejects responses that can't be written to a client,
+// such as a Lambda error payload that unmarshals to a zero status code
+func validateResponse(r *ProxyResponse) error {
+	if r == nil {
+		return fmt.Errorf("failed to use response: empty response")
+	}
+	if r.StatusCode < 100 || r.StatusCode > 999 {
+		return fmt.Errorf("failed to use response: invalid status code %d", r.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Regression: a zero or out of range status code from the transport panicked
+// in WriteHeader
+func TestForwardInvalidStatus(t *testing.T) {
+	for _, status := range []int{0, -1, 99, 1000} {
+		server := NewServer(staticTransport(ProxyResponse{StatusCode: status}), nil, false)
+		recorder := httptest.NewRecorder()
+
+		server.Forward(recorder, httptest.NewRequest(http.MethodGet, "/", nil), "http://upstream.internal", "/")
+
+		if recorder.Code != http.StatusBadGateway {
+			t.Errorf("status %d: proxy answered %d, want 502", status, recorder.Code)
+		}
+	}
+}
+
+func TestValidateResponseNil(t *testing.T) {
+	if validateResponse(nil) == nil {
+		t.Error("validateResponse(nil) = nil, want an error")
+	}
+}
+
+func FuzzValidateResponse(f *testing.F) {
+	for _, status := range []int{0, 99, 100, 200, 204, 304, 599, 999, 1000, -200} {
+		f.Add(status)
+	}
+
+	f.Fuzz(func(t *testing.T, status int) {
+		if err := validateResponse(&ProxyResponse{StatusCode: status}); err != nil {
+			return
+		}
+		// A valid response must be writable, httptest panics like net/http
+		// does on invalid codes
+		httptest.NewRecorder().WriteHeader(status)
+	})
+}
+
+// targetRequest serves path through the /t/ routes and returns the request
+// the transport received, nil if none reached it
+func targetRequest(t *testing.T, path string) (*ProxyRequest, int) {
+	t.Helper()
+	var received *ProxyRequest
+	server := NewServer(TransportFunc(func(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+		received = &request
+		return &ProxyResponse{StatusCode: http.StatusOK}, nil
+	}), nil, false)
+	mux := http.NewServeMux()
+	server.Register(mux, false)
+
+	request, err := http.NewRequest(http.MethodGet, "http://proxy.local"+path, http.NoBody)
+	if err != nil {
+		return nil, 0
+	}
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	return received, recorder.Code
+}
+
+// Regression: a percent-encoded target segment leaked into the upstream path
+func TestServeTargetEncodedSegment(t *testing.T) {
+	// aHR0cDovL2E is http://a, with the "a" and "0" percent-encoded
+	for _, path := range []string{"/t/%61HR0cDovL2E/x", "/t/aHR%30cDovL2E/x", "/t/aHR0cDovL2E%2F/x"} {
+		received, status := targetRequest(t, path)
+		if received != nil {
+			t.Errorf("%s reached the upstream as %s %s", path, received.PrivateApiUrl, received.RawPath)
+		}
+		if status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", path, status)
+		}
+	}
+
+	received, _ := targetRequest(t, "/t/aHR0cDovL2E/files/a%2Fb")
+	if received == nil || received.PrivateApiUrl != "http://a" || received.RawPath != "/files/a%2Fb" {
+		t.Errorf("plain target forwarded as %+v, want http://a and /files/a%%2Fb", received)
+	}
+}
+
+func FuzzServeTarget(f *testing.F) {
+	f.Add("/t/aHR0cDovL2E/x")
+	f.Add("/t/aHR0cDovL2E")
+	f.Add("/t/aHR0cDovL2E/a%2Fb/c%20d?q=1")
+	f.Add("/t/%61HR0cDovL2E/x")
+	f.Add("/t/aHR0cDovL2E=/x")
+	f.Add("/t//x")
+
+	f.Fuzz(func(t *testing.T, path string) {
+		if !strings.HasPrefix(path, "/t/") {
+			return
+		}
+		request, err := http.NewRequest(http.MethodGet, "http://proxy.local"+path, nil)
+		if err != nil {
+			return
+		}
+		received, _ := targetRequest(t, path)
+		if received == nil {
+			return
+		}
+
+		// The upstream gets exactly what follows the target segment
+		segment, rest, found := strings.Cut(strings.TrimPrefix(request.URL.EscapedPath(), "/t/"), "/")
+		want := "/" + rest
+		if !found {
+			want = "/"
+		}
+		if strings.Contains(segment, "%") {
+			t.Fatalf("%s: percent-encoded target segment %q was accepted", path, segment)
+		}
+		if received.RawPath != want {
+			t.Fatalf("%s: upstream path = %q, want %q", path, received.RawPath, want)
+		}
+		if !strings.HasPrefix(received.Path, "/") {
+			t.Fatalf("%s: upstream path %q does not start with /", path, received.Path)
+		}
+	})
+}
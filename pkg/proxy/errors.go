@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+// Error codes of the errors the proxy generates itself, as opposed to error
+// responses from the upstream
+const (
+	ErrorCodeBadRequest       = "bad-request"
+	ErrorCodeTargetResolution = "target-resolution"
+	ErrorCodeNotProxied       = "not-proxied"
+	ErrorCodeInvokeFailed     = "invoke-failed"
+	ErrorCodeInvokeThrottled  = "invoke-throttled"
+	ErrorCodeQueueFull        = "queue-full"
+	ErrorCodeUpstreamTimeout  = "upstream-timeout"
+	ErrorCodePayloadTooLarge  = "payload-too-large"
+	ErrorCodeInternal         = "internal"
+)
+
+// Error formats accepted by SetErrorFormat
+const (
+	ErrorFormatText = "text"
+	ErrorFormatJSON = "json"
+)
+
+// RequestIDHeader carries the ID of a failed request in both error formats
+const RequestIDHeader = "X-Awsctl-Request-Id"
+
+var errorHints = map[string]string{
+	ErrorCodeBadRequest:       "Use /t/<base64url-target>/<path>, the X-Awsctl-Target header or /api_url/<url-encoded-target>/proxy/<path>",
+	ErrorCodeTargetResolution: "Use a full URL or an alias from the targets file (~/.awsctl/targets.json or -targets)",
+	ErrorCodeNotProxied:       "Add the domain to -pac-domains",
+	ErrorCodeInvokeFailed:     "Check the function name, region and AWS credentials, -verbose logs the full error",
+	ErrorCodeInvokeThrottled:  "The Lambda's concurrency is exhausted, retry later or raise its reserved concurrency",
+	ErrorCodeQueueFull:        "Too many requests of this client or target are waiting, retry later or raise -queue-limit",
+	ErrorCodeUpstreamTimeout:  "The Lambda did not finish in time, check that it can reach the upstream or raise its timeout",
+	ErrorCodePayloadTooLarge:  "Lambda limits synchronous payloads to 6 MB, about 4.5 MB of body after base64 encoding",
+}
+
+// Problem is an RFC 9457 problem details document
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Code      string `json:"code"`
+	RequestID string `json:"requestId"`
+	Hint      string `json:"hint,omitempty"`
+}
+
+// SetErrorFormat selects plain text (the default) or application/problem+json
+// bodies for errors generated by the proxy
+func (s *Server) SetErrorFormat(format string) error {
+	switch format {
+	case ErrorFormatText, ErrorFormatJSON:
+		s.errorFormat = format
+		return nil
+	default:
+		return fmt.Errorf("failed to use error format %q: expected %s or %s", format, ErrorFormatText, ErrorFormatJSON)
+	}
+}
+
+// WriteError answers with an error generated by the proxy itself. requestID
+// may be empty, a random ID is used then.
+func (s *Server) WriteError(w http.ResponseWriter, status int, code, detail, requestID string) {
+	s.stats.error(code, detail)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, requestID)
+
+	if s.errorFormat != ErrorFormatJSON {
+		http.Error(w, detail, status)
+		return
+	}
+
+	// Hints contain placeholders like <path>, keep them readable
+	var problem bytes.Buffer
+	encoder := json.NewEncoder(&problem)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(Problem{
+		Type:      "urn:awsctl:error:" + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Code:      code,
+		RequestID: requestID,
+		Hint:      errorHints[code],
+	})
+	if err != nil {
+		http.Error(w, detail, status)
+		return
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if _, err := w.Write(problem.Bytes()); err != nil {
+		log.Printf("Failed to write error response: %v", err)
+	}
+}
+
+// classifyInvokeError maps a transport error to a status, an error code and
+// the AWS request ID if there is one
+func classifyInvokeError(err error) (status int, code, requestID string) {
+	requestID = serviceRequestID(err)
+
+	var throttled *lambdatypes.TooManyRequestsException
+	var tooLarge *lambdatypes.RequestTooLargeException
+	switch {
+	case errors.As(err, &throttled):
+		return http.StatusTooManyRequests, ErrorCodeInvokeThrottled, requestID
+	case errors.Is(err, ErrQueueFull):
+		return http.StatusTooManyRequests, ErrorCodeQueueFull, requestID
+	case errors.As(err, &tooLarge), errors.Is(err, ErrMessageTooLarge):
+		return http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge, requestID
+	case errors.Is(err, context.DeadlineExceeded), strings.Contains(err.Error(), "Task timed out"):
+		return http.StatusGatewayTimeout, ErrorCodeUpstreamTimeout, requestID
+	}
+	return http.StatusBadGateway, ErrorCodeInvokeFailed, requestID
+}
+
+// serviceRequestID returns the AWS request ID of a failed call, or ""
+func serviceRequestID(err error) string {
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.ServiceRequestID()
+	}
+	return ""
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FunctionTransport sends requests to targets with "function" through the
+// transport of that ingress Lambda and all others through next, so one proxy
+// reaches APIs in VPCs served by different Lambdas. Each function has its
+// own transport and client. It must be the innermost transport, batches of
+// requests for different functions are split up.
+type FunctionTransport struct {
+	next      Transport
+	functions map[string]Transport
+	targets   *Targets
+}
+
+// NewFunctionTransport routes requests by the "function" of their target to
+// the transports in functions, keyed by function
+func NewFunctionTransport(next Transport, functions map[string]Transport, targets *Targets) *FunctionTransport {
+	return &FunctionTransport{next: next, functions: functions, targets: targets}
+}
+
+func (t *FunctionTransport) String() string {
+	names := make([]string, 0, len(t.functions))
+	for function := range t.functions {
+		names = append(names, function)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%s (and %s for their targets)", DescribeTransport(t.next), strings.Join(names, ", "))
+}
+
+// transportFor returns the transport of the function serving privateApiUrl
+func (t *FunctionTransport) transportFor(privateApiUrl string) Transport {
+	if function := t.targets.Function(privateApiUrl); function != "" {
+		if transport, ok := t.functions[function]; ok {
+			return transport
+		}
+	}
+	return t.next
+}
+
+func (t *FunctionTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	if len(request.Batch) > 0 {
+		return t.invokeBatch(ctx, request.Batch)
+	}
+	return t.transportFor(request.PrivateApiUrl).Invoke(ctx, request)
+}
+
+// InvokeEvent invokes the function serving request asynchronously
+func (t *FunctionTransport) InvokeEvent(ctx context.Context, request ProxyRequest) error {
+	transport := t.transportFor(request.PrivateApiUrl)
+	events, ok := transport.(EventInvoker)
+	if !ok {
+		return fmt.Errorf("failed to invoke asynchronously: %s can't invoke asynchronously", DescribeTransport(transport))
+	}
+	return events.InvokeEvent(ctx, request)
+}
+
+// invokeBatch sends the requests of a batch to their functions, a batch per
+// function, and returns the responses in the order of the requests
+func (t *FunctionTransport) invokeBatch(ctx context.Context, batch []ProxyRequest) (*ProxyResponse, error) {
+	groups := map[Transport][]int{}
+	for i, request := range batch {
+		transport := t.transportFor(request.PrivateApiUrl)
+		groups[transport] = append(groups[transport], i)
+	}
+	if len(groups) == 1 {
+		for transport := range groups {
+			return sendBatch(ctx, transport, batch)
+		}
+	}
+
+	responses := make([]ProxyResponse, len(batch))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for transport, indexes := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			requests := make([]ProxyRequest, len(indexes))
+			for i, index := range indexes {
+				requests[i] = batch[index]
+			}
+			response, err := sendBatch(ctx, transport, requests)
+			if err == nil && len(response.Batch) != len(requests) {
+				err = fmt.Errorf("failed to run batch: got %d responses for %d requests", len(response.Batch), len(requests))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			for i, index := range indexes {
+				responses[index] = response.Batch[i]
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return &ProxyResponse{Batch: responses}, nil
+}
+
+// sendBatch sends requests as a batch envelope, signed like the envelope
+// it was split from
+func sendBatch(ctx context.Context, transport Transport, requests []ProxyRequest) (*ProxyResponse, error) {
+	envelope := ProxyRequest{Batch: requests}
+	if err := resign(ctx, &envelope); err != nil {
+		return nil, err
+	}
+	return transport.Invoke(ctx, envelope)
+}
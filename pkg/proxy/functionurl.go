@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// FunctionURLTransport posts envelopes to the ingress Lambda's function URL,
+// signed with SigV4 for AWS_IAM authorization. It avoids the Invoke API and
+// works where only HTTPS egress to lambda-url endpoints is allowed.
+type FunctionURLTransport struct {
+	functionURL string
+	awsCfg      aws.Config
+	signer      *v4.Signer
+	httpClient  *http.Client
+	verbose     bool
+	redactor    *Redactor
+	// logBodyLimit is how many bytes of bodies verbose logs show
+	logBodyLimit int
+}
+
+func NewFunctionURLTransport(ctx context.Context, functionURL, region, profile string, verbose bool) (*FunctionURLTransport, error) {
+	if functionURL == "" {
+		return nil, fmt.Errorf("failed to create function URL transport: missing function URL")
+	}
+
+	awsCfg, err := LoadAWSConfig(ctx, region, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FunctionURLTransport{
+		functionURL:  functionURL,
+		awsCfg:       awsCfg,
+		signer:       v4.NewSigner(),
+		httpClient:   &http.Client{Timeout: 15 * time.Minute},
+		verbose:      verbose,
+		logBodyLimit: DefaultLogBodyLimit,
+	}, nil
+}
+
+func (t *FunctionURLTransport) String() string {
+	return fmt.Sprintf("function URL %s", t.functionURL)
+}
+
+func (t *FunctionURLTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	request = stampDeadline(ctx, request)
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	if t.verbose {
+		log.Printf("Posting to function URL %s with payload: %s", t.functionURL, t.redactor.RequestLog(request, t.logBodyLimit))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.functionURL, bytes.NewReader(requestJSON))
+	if err != nil {
+		return nil, fmt.Errorf("create function URL request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	credentials, err := t.awsCfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve AWS credentials: %w", err)
+	}
+	payloadHash := sha256.Sum256(requestJSON)
+	if err := t.signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(payloadHash[:]), "lambda", t.awsCfg.Region, time.Now()); err != nil {
+		return nil, fmt.Errorf("sign function URL request: %w", err)
+	}
+
+	started := time.Now()
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		traceInvocation(ctx, t, request, started, "", "", err)
+		return nil, fmt.Errorf("call function URL: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("read function URL response: %w", err)
+	} else if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("failed to call function URL: status %d: %s", resp.StatusCode, string(body))
+	}
+	traceInvocation(ctx, t, request, started, resp.Header.Get("X-Amzn-Requestid"), "", err)
+	if err != nil {
+		return nil, err
+	}
+
+	var proxyResp ProxyResponse
+	if err := json.Unmarshal(body, &proxyResp); err != nil {
+		return nil, fmt.Errorf("unmarshal function URL response: %w", err)
+	}
+	if t.verbose {
+		if body := t.redactor.ResponseBodyLog(&proxyResp, t.logBodyLimit); body != "" {
+			log.Print(body)
+		}
+	}
+
+	return &proxyResp, nil
+}
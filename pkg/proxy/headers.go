@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// DefaultDeniedRequestHeaders are not forwarded upstream unless defaults are
+// disabled: awsctl's own control headers and the identity header the Lambda
+// sets with -forward-user, which clients could otherwise forge
+var DefaultDeniedRequestHeaders = []string{
+	"X-Awsctl-*",
+	"X-Forwarded-User",
+}
+
+// DefaultDeniedResponseHeaders are not passed to local clients unless
+// defaults are disabled: AWS-internal IDs and headers revealing the upstream
+// software or debugging state
+var DefaultDeniedResponseHeaders = []string{
+	"X-Amzn-*",
+	"X-Amz-Apigw-Id",
+	"X-Amz-Cf-*",
+	"Server",
+	"X-Powered-By",
+	"X-AspNet-Version",
+	"X-AspNetMvc-Version",
+	"X-Debug-*",
+}
+
+// The filters of a Server until SetHeaderFilters is called, the patterns
+// are constant and compile
+var (
+	defaultRequestFilter, _  = NewHeaderFilter(nil, nil, DefaultDeniedRequestHeaders, true)
+	defaultResponseFilter, _ = NewHeaderFilter(nil, nil, DefaultDeniedResponseHeaders, true)
+)
+
+// essentialHeaders describe the body or the byte range of it, or come from
+// awsctl itself, and pass an allow list regardless. Without the range headers
+// interrupted downloads couldn't resume.
+var essentialHeaders, _ = headerPatterns([]string{"Content-Type", "Content-Encoding", "Content-Length", "Content-Range", "Range", "If-Range", "Accept-Ranges", "X-Awsctl-*"})
+
+// HeaderFilter removes headers by name. Patterns are case-insensitive and
+// "*" matches any sequence of characters. A header is removed if it matches
+// a deny pattern, or if there are allow patterns and it matches none of
+// them. The headers describing the body and awsctl's own headers always pass
+// the allow patterns.
+type HeaderFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// NewHeaderFilter creates a HeaderFilter from allow and deny patterns. With
+// defaults the given default deny patterns are included.
+func NewHeaderFilter(allow, deny, defaultDeny []string, defaults bool) (*HeaderFilter, error) {
+	if defaults {
+		deny = append(append([]string(nil), defaultDeny...), deny...)
+	}
+	f := &HeaderFilter{}
+	var err error
+	if f.allow, err = headerPatterns(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = headerPatterns(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func headerPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return nil, fmt.Errorf("failed to parse header pattern: empty pattern")
+		}
+		parts := strings.Split(pattern, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		re, err := regexp.Compile("(?i)^" + strings.Join(parts, ".*") + "$")
+		if err != nil {
+			return nil, fmt.Errorf("compile header pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Apply removes the headers f doesn't let pass from header. A nil filter
+// removes nothing.
+func (f *HeaderFilter) Apply(header http.Header) {
+	if f == nil {
+		return
+	}
+	for name := range header {
+		if !f.allows(name) {
+			delete(header, name)
+		}
+	}
+}
+
+func (f *HeaderFilter) allows(name string) bool {
+	for _, re := range f.deny {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, patterns := range [][]*regexp.Regexp{essentialHeaders, f.allow} {
+		for _, re := range patterns {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import "context"
+
+// RequestHook inspects or mutates an envelope before it is sent. Returning a
+// non-nil response answers the request without invoking the transport, which
+// is how hooks block requests.
+type RequestHook func(ctx context.Context, request *ProxyRequest) (*ProxyResponse, error)
+
+// ResponseHook inspects or mutates a response before it is written to the
+// local client
+type ResponseHook func(ctx context.Context, request *ProxyRequest, response *ProxyResponse) error
+
+// OnRequest registers a hook that runs before every invoke, in registration
+// order
+func (s *Server) OnRequest(hook RequestHook) {
+	s.requestHooks = append(s.requestHooks, hook)
+}
+
+// OnResponse registers a hook that runs after every invoke, in registration
+// order
+func (s *Server) OnResponse(hook ResponseHook) {
+	s.responseHooks = append(s.responseHooks, hook)
+}
+
+// CallerHook stamps every envelope with the caller's AWS identity ARN, which
+// the ingress handler forwards upstream as X-Forwarded-User
+func CallerHook(caller string) RequestHook {
+	return func(ctx context.Context, request *ProxyRequest) (*ProxyResponse, error) {
+		request.Caller = caller
+		return nil, nil
+	}
+}
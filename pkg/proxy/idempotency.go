@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// DefaultIdempotencyHeader is the header of the IETF draft and most APIs
+const DefaultIdempotencyHeader = "Idempotency-Key"
+
+// safeMethods don't change upstream state and get no idempotency key
+var safeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// IdempotencyHook sets header to a random UUID on requests with methods that
+// change state, unless the client sent one. The key is part of the envelope,
+// so retries of the request, e.g. after expired credentials or a failed
+// batch, send the same key and upstreams that support idempotency keys
+// apply the write only once.
+func IdempotencyHook(header string) RequestHook {
+	return func(ctx context.Context, request *ProxyRequest) (*ProxyResponse, error) {
+		if safeMethods[request.Method] || http.Header(request.Headers).Get(header) != "" {
+			return nil, nil
+		}
+		key, err := newIdempotencyKey()
+		if err != nil {
+			return nil, err
+		}
+		if request.Headers == nil {
+			request.Headers = map[string][]string{}
+		}
+		http.Header(request.Headers).Set(header, key)
+		return nil, nil
+	}
+}
+
+// newIdempotencyKey returns a random version 4 UUID
+func newIdempotencyKey() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("generate idempotency key: %w", err)
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16]), nil
+}
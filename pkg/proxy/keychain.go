@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Auth schemes a target can have its credentials injected with
+const (
+	AuthBasic  = "basic"
+	AuthBearer = "bearer"
+	// AuthOAuth2 gets tokens with the client-credentials grant, see
+	// OAuth2Hook
+	AuthOAuth2 = "oauth2"
+)
+
+// keychainService is the service name credentials are stored under in the OS
+// keychain, the target alias is the account
+const keychainService = "awsctl"
+
+// keychainTTL is how long a credential read from the keychain is reused, so
+// awsctl creds set takes effect without restarting the proxy
+const keychainTTL = 5 * time.Minute
+
+// ErrNoCredentials means the keychain holds no credentials for a target
+var ErrNoCredentials = errors.New("no credentials in keychain")
+
+// GetTargetCredentials returns the secret stored for the target alias in the
+// OS keychain: "user:password" for basic auth, the token for bearer auth and
+// the client secret for OAuth2
+func GetTargetCredentials(alias string) (string, error) {
+	secret, err := keychainGet(keychainService, alias)
+	if err != nil {
+		return "", fmt.Errorf("read credentials of %s: %w", alias, err)
+	}
+	return secret, nil
+}
+
+// SetTargetCredentials stores the secret for the target alias in the OS
+// keychain: macOS Keychain, Windows Credential Manager or the Secret Service
+// (libsecret) elsewhere
+func SetTargetCredentials(alias, secret string) error {
+	if err := keychainSet(keychainService, alias, secret); err != nil {
+		return fmt.Errorf("store credentials of %s: %w", alias, err)
+	}
+	return nil
+}
+
+// DeleteTargetCredentials removes the secret of the target alias from the OS
+// keychain
+func DeleteTargetCredentials(alias string) error {
+	if err := keychainDelete(keychainService, alias); err != nil {
+		return fmt.Errorf("delete credentials of %s: %w", alias, err)
+	}
+	return nil
+}
+
+// cachedSecret is a keychain secret and when it was read
+type cachedSecret struct {
+	secret string
+	read   time.Time
+}
+
+// KeychainAuthHook sets the Authorization header of requests to targets with
+// an auth scheme from the credentials stored in the OS keychain, so they
+// never appear in config files. An Authorization header sent by the client
+// is kept. Requests to a target without stored credentials fail.
+func KeychainAuthHook(targets *Targets) RequestHook {
+	var (
+		mu    sync.Mutex
+		cache = map[string]cachedSecret{}
+	)
+	secretOf := func(alias string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cached, ok := cache[alias]; ok && time.Since(cached.read) < keychainTTL {
+			return cached.secret, nil
+		}
+		secret, err := GetTargetCredentials(alias)
+		if err != nil {
+			return "", err
+		}
+		cache[alias] = cachedSecret{secret: secret, read: time.Now()}
+		return secret, nil
+	}
+
+	return func(ctx context.Context, request *ProxyRequest) (*ProxyResponse, error) {
+		alias, scheme := targets.Auth(request.PrivateApiUrl)
+		if scheme != AuthBasic && scheme != AuthBearer || http.Header(request.Headers).Get("Authorization") != "" {
+			return nil, nil
+		}
+		secret, err := secretOf(alias)
+		if errors.Is(err, ErrNoCredentials) {
+			return nil, fmt.Errorf("%w, store them with awsctl creds set %s", err, alias)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var authorization string
+		switch scheme {
+		case AuthBasic:
+			if !strings.Contains(secret, ":") {
+				return nil, fmt.Errorf("failed to use credentials of %s: expected user:password for basic auth", alias)
+			}
+			authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(secret))
+		case AuthBearer:
+			authorization = "Bearer " + secret
+		}
+		if request.Headers == nil {
+			request.Headers = map[string][]string{}
+		}
+		http.Header(request.Headers).Set("Authorization", authorization)
+		return nil, nil
+	}
+}
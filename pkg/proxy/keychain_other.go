@@ -0,0 +1,82 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// keychainGet reads a secret with the keychain tool of the OS: security on
+// macOS and secret-tool (libsecret) elsewhere
+func keychainGet(service, account string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	}
+	out, err := runKeychainTool(cmd, "")
+	if err != nil {
+		// security exits with 44 if there is no such item, secret-tool fails
+		// silently
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && (exitErr.ExitCode() == 44 || runtime.GOOS != "darwin" && len(exitErr.Stderr) == 0) {
+			return "", ErrNoCredentials
+		}
+		return "", err
+	}
+	secret := strings.TrimSuffix(out, "\n")
+	if secret == "" {
+		return "", ErrNoCredentials
+	}
+	return secret, nil
+}
+
+// keychainSet stores a secret, replacing an existing one. The secret is
+// passed on stdin, never as an argument other users could see.
+func keychainSet(service, account, secret string) error {
+	if runtime.GOOS == "darwin" {
+		command := fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n", securityQuote(service), securityQuote(account), securityQuote(secret))
+		_, err := runKeychainTool(exec.Command("security", "-i"), command)
+		return err
+	}
+	cmd := exec.Command("secret-tool", "store", "--label", "awsctl "+account, "service", service, "account", account)
+	_, err := runKeychainTool(cmd, secret)
+	return err
+}
+
+// keychainDelete removes a secret
+func keychainDelete(service, account string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "delete-generic-password", "-s", service, "-a", account)
+	} else {
+		cmd = exec.Command("secret-tool", "clear", "service", service, "account", account)
+	}
+	_, err := runKeychainTool(cmd, "")
+	return err
+}
+
+// runKeychainTool runs cmd with stdin and returns its output
+func runKeychainTool(cmd *exec.Cmd, stdin string) (string, error) {
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(bytes.TrimSpace(exitErr.Stderr)) > 0 {
+			return "", fmt.Errorf("run %s: %w: %s", cmd.Args[0], err, bytes.TrimSpace(exitErr.Stderr))
+		}
+		return "", fmt.Errorf("run %s: %w", cmd.Args[0], err)
+	}
+	return string(out), nil
+}
+
+// securityQuote quotes an argument for the command line of security -i
+func securityQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultLogBodyLimit is how many bytes of a body verbose logs show
+const DefaultLogBodyLimit = 2048
+
+// hexdumpPreview caps the bytes of a binary body shown as a hexdump
+const hexdumpPreview = 128
+
+// formatBody renders a base64 envelope body for verbose logs: JSON
+// pretty-printed, text as is and binary data as a hexdump, each cut off
+// after limit bytes. It returns "" for empty bodies and a limit of 0.
+func formatBody(kind string, headers map[string][]string, body string, limit int) string {
+	if body == "" || limit <= 0 {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		decoded = []byte(body)
+	}
+	contentType := http.Header(headers).Get("Content-Type")
+	label := fmt.Sprintf("%s body (%d bytes)", kind, len(decoded))
+	if contentType != "" {
+		label = fmt.Sprintf("%s body (%s, %d bytes)", kind, contentType, len(decoded))
+	}
+
+	var text string
+	switch {
+	case isJSON(contentType, decoded):
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, decoded, "", "  "); err == nil {
+			text = indented.String()
+		} else {
+			text = string(decoded)
+		}
+	case utf8.Valid(decoded):
+		text = string(decoded)
+	default:
+		shown := decoded[:min(len(decoded), limit, hexdumpPreview)]
+		dump := strings.TrimSuffix(hex.Dump(shown), "\n")
+		if rest := len(decoded) - len(shown); rest > 0 {
+			dump += fmt.Sprintf("\n... %d more bytes", rest)
+		}
+		return label + ":\n" + dump
+	}
+
+	if len(text) > limit {
+		// Cut at a character boundary
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = fmt.Sprintf("%s\n... %d more bytes", text[:cut], len(text)-cut)
+	}
+	return label + ":\n" + text
+}
+
+// isJSON reports whether a body is JSON by its media type, or by its
+// content when the type is missing or generic
+func isJSON(contentType string, body []byte) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		return true
+	}
+	if mediaType != "" && mediaType != "application/octet-stream" && mediaType != "text/plain" {
+		return false
+	}
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed)
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/ingress"
+)
+
+// mirrorTimeout bounds a mirrored request, which no client waits for
+const mirrorTimeout = 60 * time.Second
+
+// MirrorConfig sends a share of a target's requests to a second private URL
+// as well, e.g. a new version of the service
+type MirrorConfig struct {
+	URL string `json:"url"`
+	// Percent of requests mirrored, between 0 and 100
+	Percent float64 `json:"percent"`
+}
+
+func (c MirrorConfig) validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("failed to use mirror config: missing url")
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("failed to use mirror config: percent %g is not between 0 and 100", c.Percent)
+	}
+	return nil
+}
+
+// MirrorHook sends requests to targets with "mirror" to the mirror URL as
+// well, through transport and after the target answered. The mirror's
+// response is compared with the target's and differences in status or body
+// hash are logged. Nobody waits for mirrored requests, the client gets the
+// target's response right away.
+func MirrorHook(targets *Targets, transport Transport) ResponseHook {
+	return func(ctx context.Context, request *ProxyRequest, response *ProxyResponse) error {
+		config := targets.Mirror(request.PrivateApiUrl)
+		if config == nil || rand.Float64()*100 >= config.Percent {
+			return nil
+		}
+
+		mirrored := *request
+		mirrored.Headers = http.Header(request.Headers).Clone()
+		mirrored.PrivateApiUrl = config.URL
+		mirrored.HostOverrides = targets.HostOverrides(config.URL)
+		status, hash := response.StatusCode, responseBodyHash(response)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mirrorTimeout)
+			defer cancel()
+			mirrorResponse, err := transport.Invoke(ctx, mirrored)
+			if err != nil {
+				log.Printf("Failed to mirror %s %s to %s: %v", mirrored.Method, mirrored.Path, config.URL, err)
+				return
+			}
+			mirrorHash := responseBodyHash(mirrorResponse)
+			switch {
+			case mirrorResponse.StatusCode != status:
+				log.Printf("Mirror difference for %s %s: status %d, mirror %s answered %d", mirrored.Method, mirrored.Path, status, config.URL, mirrorResponse.StatusCode)
+			case mirrorHash != hash:
+				log.Printf("Mirror difference for %s %s: body %.12s, mirror %s answered %.12s", mirrored.Method, mirrored.Path, hash, config.URL, mirrorHash)
+			}
+		}()
+		return nil
+	}
+}
+
+// responseBodyHash hashes the decoded body of response
+func responseBodyHash(response *ProxyResponse) string {
+	body, err := base64.StdEncoding.DecodeString(response.Body)
+	if err != nil {
+		body = []byte(response.Body)
+	}
+	return ingress.BodyHash(body)
+}
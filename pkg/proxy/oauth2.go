@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oauth2Timeout bounds a token request
+	oauth2Timeout = 30 * time.Second
+	// oauth2RefreshBefore is how long before expiry a token is refreshed in
+	// the background, at most a quarter of its lifetime
+	oauth2RefreshBefore = time.Minute
+	// oauth2DefaultLifetime applies to tokens issued without expires_in
+	oauth2DefaultLifetime = 5 * time.Minute
+	// oauth2RetryAfter is the pause after a failed background refresh
+	oauth2RetryAfter = 10 * time.Second
+)
+
+// OAuth2Config describes the client-credentials grant of a target with
+// "auth": "oauth2". The client secret is stored with awsctl creds set.
+type OAuth2Config struct {
+	// TokenURL is the IdP's token endpoint, requested through the Lambda
+	TokenURL string   `json:"tokenUrl"`
+	ClientID string   `json:"clientId"`
+	Scopes   []string `json:"scopes,omitempty"`
+	// Audience is sent as audience parameter, which some IdPs require
+	Audience string `json:"audience,omitempty"`
+}
+
+// oauth2Token is an access token and when it expires
+type oauth2Token struct {
+	accessToken string
+	expires     time.Time
+	refreshAt   time.Time
+}
+
+// oauth2Source gets and caches the access token of one target. At most one
+// token request is in flight, requests arriving meanwhile wait for it.
+type oauth2Source struct {
+	alias     string
+	config    OAuth2Config
+	targets   *Targets
+	transport Transport
+
+	mu         sync.Mutex
+	current    *oauth2Token
+	refreshing chan struct{}
+	err        error
+}
+
+// OAuth2Hook sets the Authorization header of requests to targets with
+// "auth": "oauth2" to a token from the client-credentials grant. The token
+// request is sent through transport, so IdPs only reachable through the
+// Lambda work. Tokens are cached and refreshed in the background shortly
+// before they expire. An Authorization header sent by the client is kept.
+func OAuth2Hook(targets *Targets, transport Transport) RequestHook {
+	var (
+		mu      sync.Mutex
+		sources = map[string]*oauth2Source{}
+	)
+	sourceOf := func(alias string, config OAuth2Config) *oauth2Source {
+		mu.Lock()
+		defer mu.Unlock()
+		source, ok := sources[alias]
+		if !ok {
+			source = &oauth2Source{alias: alias, config: config, targets: targets, transport: transport}
+			sources[alias] = source
+		}
+		return source
+	}
+
+	return func(ctx context.Context, request *ProxyRequest) (*ProxyResponse, error) {
+		alias, scheme := targets.Auth(request.PrivateApiUrl)
+		if scheme != AuthOAuth2 || http.Header(request.Headers).Get("Authorization") != "" {
+			return nil, nil
+		}
+		token, err := sourceOf(alias, *targets.Targets[alias].OAuth2).token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if request.Headers == nil {
+			request.Headers = map[string][]string{}
+		}
+		http.Header(request.Headers).Set("Authorization", "Bearer "+token)
+		return nil, nil
+	}
+}
+
+// token returns a valid access token, requesting a new one if there is none
+func (s *oauth2Source) token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	if token := s.current; token != nil && time.Now().Before(token.expires) {
+		if time.Now().After(token.refreshAt) && s.refreshing == nil {
+			s.refresh()
+		}
+		s.mu.Unlock()
+		return token.accessToken, nil
+	}
+	done := s.refreshing
+	if done == nil {
+		done = s.refresh()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return "", s.err
+	}
+	return s.current.accessToken, nil
+}
+
+// refresh starts a token request and returns a channel closed once it is
+// done. s.mu must be held.
+func (s *oauth2Source) refresh() chan struct{} {
+	done := make(chan struct{})
+	s.refreshing = done
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(context.Background(), oauth2Timeout)
+		defer cancel()
+		token, err := s.fetch(ctx)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.refreshing = nil
+		s.err = err
+		if err != nil {
+			log.Printf("Failed to get OAuth2 token for %s: %v", s.alias, err)
+			// Keep using the current token while it lasts
+			if s.current != nil {
+				s.current.refreshAt = time.Now().Add(oauth2RetryAfter)
+			}
+			return
+		}
+		s.current = token
+		log.Printf("Got OAuth2 token for %s, valid until %s", s.alias, token.expires.Format(time.TimeOnly))
+	}()
+	return done
+}
+
+// fetch runs the client-credentials grant against the token URL
+func (s *oauth2Source) fetch(ctx context.Context) (*oauth2Token, error) {
+	secret, err := GetTargetCredentials(s.alias)
+	if err != nil {
+		return nil, err
+	}
+	tokenURL, err := url.Parse(s.config.TokenURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse token URL: %w", err)
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+	if s.config.Audience != "" {
+		form.Set("audience", s.config.Audience)
+	}
+	// RFC 6749 2.3.1 form-encodes the client credentials of basic auth
+	clientAuth := url.QueryEscape(s.config.ClientID) + ":" + url.QueryEscape(secret)
+	baseURL := tokenURL.Scheme + "://" + tokenURL.Host
+	request := ProxyRequest{
+		Method:  http.MethodPost,
+		Path:    tokenURL.Path,
+		RawPath: tokenURL.EscapedPath(),
+		Headers: map[string][]string{
+			"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(clientAuth))},
+			"Content-Type":  {"application/x-www-form-urlencoded"},
+			"Accept":        {"application/json"},
+		},
+		Body:          encodeBody([]byte(form.Encode())),
+		Query:         tokenURL.RawQuery,
+		PrivateApiUrl: baseURL,
+		HostOverrides: s.targets.HostOverrides(baseURL),
+	}
+
+	issued := time.Now()
+	response, err := s.transport.Invoke(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("request token: %w", err)
+	}
+	body, err := base64.StdEncoding.DecodeString(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decode token response: %w", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get token from %s: status %d: %s", s.config.TokenURL, response.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("parse token response: %w", err)
+	}
+	if payload.AccessToken == "" {
+		return nil, fmt.Errorf("failed to get token from %s: response has no access_token", s.config.TokenURL)
+	}
+
+	lifetime := time.Duration(payload.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = oauth2DefaultLifetime
+	}
+	expires := issued.Add(lifetime)
+	return &oauth2Token{
+		accessToken: payload.AccessToken,
+		expires:     expires,
+		refreshAt:   expires.Add(-min(oauth2RefreshBefore, lifetime/4)),
+	}, nil
+}
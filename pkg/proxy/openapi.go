@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+// ContractViolationHeader reports request and response violations of a
+// target's OpenAPI document on the response
+const ContractViolationHeader = "X-Awsctl-Contract-Violation"
+
+// maxViolationLength cuts violations reported in ContractViolationHeader
+const maxViolationLength = 1024
+
+// validationOptions check bodies, parameters and status codes, but leave
+// authentication to the API
+var validationOptions = &openapi3filter.Options{
+	IncludeResponseStatus: true,
+	MultiError:            true,
+	SkipSettingDefaults:   true,
+	AuthenticationFunc:    openapi3filter.NoopAuthenticationFunc,
+}
+
+// ContractValidator checks requests and responses of targets with an
+// "openapi" document against it, which turns the proxy into a contract
+// testing tool for internal APIs. Violations are logged and reported in
+// ContractViolationHeader. In strict mode violating requests are answered
+// with 422 without invoking the Lambda and violating responses are replaced
+// with 502.
+type ContractValidator struct {
+	// routers holds the router of each target's document by target URL
+	routers map[string]routers.Router
+	strict  bool
+}
+
+// NewContractValidator loads the OpenAPI documents of targets. The servers
+// they list are replaced with the target URL, so documents written for
+// another environment still match.
+func NewContractValidator(targets *Targets, strict bool) (*ContractValidator, error) {
+	v := &ContractValidator{routers: map[string]routers.Router{}, strict: strict}
+	for alias, t := range targets.Targets {
+		if t.OpenAPI == "" {
+			continue
+		}
+		loader := openapi3.NewLoader()
+		loader.IsExternalRefsAllowed = true
+		doc, err := loader.LoadFromFile(t.OpenAPI)
+		if err != nil {
+			return nil, fmt.Errorf("load OpenAPI document of %s: %w", alias, err)
+		}
+		if err := doc.Validate(loader.Context); err != nil {
+			return nil, fmt.Errorf("validate OpenAPI document of %s: %w", alias, err)
+		}
+		doc.Servers = openapi3.Servers{{URL: strings.TrimSuffix(t.URL, "/")}}
+		router, err := gorillamux.NewRouter(doc)
+		if err != nil {
+			return nil, fmt.Errorf("route OpenAPI document of %s: %w", alias, err)
+		}
+		v.routers[strings.TrimSuffix(t.URL, "/")] = router
+	}
+	return v, nil
+}
+
+// RequestHook blocks requests violating the contract in strict mode
+func (v *ContractValidator) RequestHook() RequestHook {
+	return func(ctx context.Context, request *ProxyRequest) (*ProxyResponse, error) {
+		if !v.strict {
+			return nil, nil
+		}
+		_, violation := v.validateRequest(ctx, *request)
+		if violation == "" {
+			return nil, nil
+		}
+		log.Printf("Blocked %s %s: request violates contract: %s", request.Method, request.Path, violation)
+		response := TextResponse(http.StatusUnprocessableEntity, "Request violates the OpenAPI contract: "+violation)
+		response.Headers[ContractViolationHeader] = []string{reportedViolation("request", violation)}
+		return response, nil
+	}
+}
+
+// ResponseHook checks the request and its response and reports violations
+func (v *ContractValidator) ResponseHook() ResponseHook {
+	return func(ctx context.Context, request *ProxyRequest, response *ProxyResponse) error {
+		input, requestViolation := v.validateRequest(ctx, *request)
+		if input == nil && requestViolation == "" {
+			return nil
+		}
+		var violations []string
+		if requestViolation != "" {
+			log.Printf("Contract violation by request %s %s: %s", request.Method, request.Path, requestViolation)
+			violations = append(violations, reportedViolation("request", requestViolation))
+		}
+		// The route is needed to check the response
+		if input != nil {
+			if responseViolation := v.validateResponse(ctx, input, response); responseViolation != "" {
+				log.Printf("Contract violation by response to %s %s: %s", request.Method, request.Path, responseViolation)
+				if v.strict {
+					*response = *TextResponse(http.StatusBadGateway, "Response violates the OpenAPI contract: "+responseViolation)
+				}
+				violations = append(violations, reportedViolation("response", responseViolation))
+			}
+		}
+		if len(violations) == 0 {
+			return nil
+		}
+
+		headers := http.Header(response.Headers).Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		headers[ContractViolationHeader] = violations
+		response.Headers = headers
+		return nil
+	}
+}
+
+// validateRequest checks request against the document of its target. It
+// returns the validation input for the response, nil if the target has no
+// document or the request matches no operation, and the violation if any.
+func (v *ContractValidator) validateRequest(ctx context.Context, request ProxyRequest) (*openapi3filter.RequestValidationInput, string) {
+	router, ok := v.routers[strings.TrimSuffix(request.PrivateApiUrl, "/")]
+	if !ok {
+		return nil, ""
+	}
+
+	body, err := base64.StdEncoding.DecodeString(request.Body)
+	if err != nil {
+		return nil, fmt.Sprintf("failed to decode body: %v", err)
+	}
+	path := request.RawPath
+	if path == "" {
+		path = request.Path
+	}
+	upstreamURL, err := url.Parse(strings.TrimSuffix(request.PrivateApiUrl, "/") + path)
+	if err != nil {
+		return nil, fmt.Sprintf("failed to parse URL: %v", err)
+	}
+	upstreamURL.RawQuery = request.Query
+	req, err := http.NewRequestWithContext(ctx, request.Method, upstreamURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Sprintf("failed to create request: %v", err)
+	}
+	req.Header = http.Header(request.Headers).Clone()
+
+	route, pathParams, err := router.FindRoute(req)
+	if err != nil {
+		return nil, fmt.Sprintf("no operation for %s %s: %v", request.Method, request.Path, err)
+	}
+	input := &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: pathParams,
+		Route:      route,
+		Options:    validationOptions,
+	}
+	if err := openapi3filter.ValidateRequest(ctx, input); err != nil {
+		return input, oneLine(err.Error())
+	}
+	return input, ""
+}
+
+// validateResponse checks response against the operation of input
+func (v *ContractValidator) validateResponse(ctx context.Context, input *openapi3filter.RequestValidationInput, response *ProxyResponse) string {
+	body, err := base64.StdEncoding.DecodeString(response.Body)
+	if err != nil {
+		return fmt.Sprintf("failed to decode body: %v", err)
+	}
+	err = openapi3filter.ValidateResponse(ctx, &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 response.StatusCode,
+		Header:                 http.Header(response.Headers),
+		Body:                   io.NopCloser(bytes.NewReader(body)),
+		Options:                validationOptions,
+	})
+	if err != nil {
+		return oneLine(err.Error())
+	}
+	return ""
+}
+
+// oneLine collapses the multi-line errors of schema validation
+func oneLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// reportedViolation fits a violation into a header value
+func reportedViolation(side, violation string) string {
+	violation = side + ": " + violation
+	if len(violation) > maxViolationLength {
+		violation = strings.ToValidUTF8(violation[:maxViolationLength], "") + "..."
+	}
+	return violation
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pagination styles a target can declare for prefetching
+const (
+	// PaginationLink follows Link: <...>; rel="next" headers (RFC 8288)
+	PaginationLink = "link"
+	// PaginationNextToken repeats the request with the nextToken of a JSON
+	// body as query parameter, the API Gateway and AWS API convention
+	PaginationNextToken = "next-token"
+)
+
+const (
+	// prefetchLifetime is how long a prefetched page waits to be requested
+	prefetchLifetime = 30 * time.Second
+	// prefetchTimeout bounds a background fetch
+	prefetchTimeout = time.Minute
+	// maxPrefetched caps the pages held in memory
+	maxPrefetched = 64
+)
+
+// nextTokenFields are the JSON body fields PaginationNextToken looks for
+var nextTokenFields = []string{"nextToken", "NextToken"}
+
+// prefetch is a page fetched in the background. done is closed once
+// response or err is set.
+type prefetch struct {
+	done     chan struct{}
+	response *ProxyResponse
+	err      error
+	fetched  time.Time
+}
+
+// PrefetchTransport fetches the next page of paginated GET responses in the
+// background while the client is still busy with the current one. When the
+// client asks for that page, it's served from memory or joins the fetch
+// still running, hiding the Lambda round trip.
+type PrefetchTransport struct {
+	next    Transport
+	styles  func(privateApiUrl string) string
+	verbose bool
+
+	mu    sync.Mutex
+	pages map[string]*prefetch
+}
+
+// NewPrefetchTransport prefetches for targets styles returns a pagination
+// style for, e.g. Targets.Pagination
+func NewPrefetchTransport(next Transport, styles func(privateApiUrl string) string, verbose bool) *PrefetchTransport {
+	return &PrefetchTransport{next: next, styles: styles, verbose: verbose, pages: map[string]*prefetch{}}
+}
+
+func (t *PrefetchTransport) String() string {
+	return fmt.Sprintf("%s (prefetching next pages)", DescribeTransport(t.next))
+}
+
+func (t *PrefetchTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	style := t.styles(request.PrivateApiUrl)
+	if request.Method != http.MethodGet || style == "" {
+		return t.next.Invoke(ctx, request)
+	}
+
+	response, err := t.prefetched(ctx, request)
+	if response == nil && err == nil {
+		response, err = t.next.Invoke(ctx, request)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusOK {
+		if next, ok := nextPage(style, request, response); ok {
+			t.start(ctx, next)
+		}
+	}
+	return response, nil
+}
+
+// prefetched returns the prefetched response for request, waiting for it if
+// the fetch is still running. It returns nil if there is none.
+func (t *PrefetchTransport) prefetched(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	key := cacheKey(request, nil)
+	t.mu.Lock()
+	page := t.pages[key]
+	delete(t.pages, key)
+	t.mu.Unlock()
+	if page == nil {
+		return nil, nil
+	}
+
+	select {
+	case <-page.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// A failed or outdated prefetch is retried by the client's own request
+	if page.err != nil || time.Since(page.fetched) > prefetchLifetime {
+		return nil, nil
+	}
+	if t.verbose {
+		log.Printf("Serving prefetched %s %s?%s", request.Method, request.Path, request.Query)
+	}
+	response := *page.response
+	response.Headers = http.Header(page.response.Headers).Clone()
+	http.Header(response.Headers).Set(CacheStatusHeader, "prefetch")
+	return &response, nil
+}
+
+// start fetches request in the background unless it's already pending
+func (t *PrefetchTransport) start(ctx context.Context, request ProxyRequest) {
+	key := cacheKey(request, nil)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.pages[key]; ok {
+		return
+	}
+	t.evict()
+	if len(t.pages) >= maxPrefetched {
+		return
+	}
+	page := &prefetch{done: make(chan struct{})}
+	t.pages[key] = page
+
+	// The fetch outlives the client's request but keeps its client for
+	// fair queueing
+	fetchCtx, cancel := context.WithTimeout(WithClient(context.Background(), ClientFromContext(ctx)), prefetchTimeout)
+	go func() {
+		defer cancel()
+		if t.verbose {
+			log.Printf("Prefetching %s %s?%s", request.Method, request.Path, request.Query)
+		}
+		page.response, page.err = t.next.Invoke(fetchCtx, request)
+		page.fetched = time.Now()
+		close(page.done)
+	}()
+}
+
+// evict drops finished pages nobody asked for in time. t.mu must be held.
+func (t *PrefetchTransport) evict() {
+	for key, page := range t.pages {
+		select {
+		case <-page.done:
+			if time.Since(page.fetched) > prefetchLifetime {
+				delete(t.pages, key)
+			}
+		default:
+		}
+	}
+}
+
+// nextPage returns the request for the page after response
+func nextPage(style string, request ProxyRequest, response *ProxyResponse) (ProxyRequest, bool) {
+	next := request
+	next.Body = ""
+	switch style {
+	case PaginationLink:
+		target := linkNext(http.Header(response.Headers).Values("Link"))
+		if target == "" {
+			return ProxyRequest{}, false
+		}
+		current, err := url.Parse(strings.TrimSuffix(request.PrivateApiUrl, "/") + request.RawPath)
+		if err != nil {
+			return ProxyRequest{}, false
+		}
+		nextURL, err := current.Parse(target)
+		if err != nil {
+			return ProxyRequest{}, false
+		}
+		// Only pages of the same target, the envelope can't reach others
+		base := strings.TrimSuffix(request.PrivateApiUrl, "/")
+		rawPath, ok := strings.CutPrefix(nextURL.Scheme+"://"+nextURL.Host+nextURL.EscapedPath(), base)
+		if !ok {
+			return ProxyRequest{}, false
+		}
+		if rawPath == "" {
+			rawPath = "/"
+		}
+		next.RawPath = rawPath
+		if next.Path, err = url.PathUnescape(rawPath); err != nil {
+			return ProxyRequest{}, false
+		}
+		next.Query = nextURL.RawQuery
+	case PaginationNextToken:
+		token := bodyNextToken(response.Body)
+		if token == "" {
+			return ProxyRequest{}, false
+		}
+		next.Query = withNextToken(request.Query, token)
+	default:
+		return ProxyRequest{}, false
+	}
+	return next, true
+}
+
+// withNextToken sets nextToken in query and keeps the other parameters in
+// their order, so the prefetched page matches the client's request for it
+func withNextToken(query, token string) string {
+	var params []string
+	for _, param := range strings.Split(query, "&") {
+		if param != "" && !strings.HasPrefix(param, "nextToken=") {
+			params = append(params, param)
+		}
+	}
+	return strings.Join(append(params, "nextToken="+url.QueryEscape(token)), "&")
+}
+
+// linkNext returns the target of the rel="next" link in Link header values
+func linkNext(values []string) string {
+	for _, value := range values {
+		for _, link := range strings.Split(value, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+			if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				name, rels, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if !strings.EqualFold(name, "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(rels, `"`)) {
+					if strings.EqualFold(rel, "next") {
+						return strings.Trim(target, "<>")
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// bodyNextToken returns the next token of a base64 JSON object body
+func bodyNextToken(body string) string {
+	data, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return ""
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ""
+	}
+	for _, name := range nextTokenFields {
+		if token, ok := fields[name].(string); ok && token != "" {
+			return token
+		}
+	}
+	return ""
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Keys FairQueueTransport can share invocations by
+const (
+	QueueByClient = "client"
+	QueueByTarget = "target"
+)
+
+// ErrQueueFull is returned when a client or target already has the maximum
+// number of requests waiting
+var ErrQueueFull = errors.New("failed to queue request: too many requests waiting")
+
+type clientContextKey struct{}
+
+// WithClient returns ctx carrying the address of the local client a request
+// came from
+func WithClient(ctx context.Context, remoteAddr string) context.Context {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return context.WithValue(ctx, clientContextKey{}, host)
+}
+
+// ClientFromContext returns the client IP stored by WithClient
+func ClientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientContextKey{}).(string)
+	return client
+}
+
+// FairQueueTransport limits the invocations in flight and shares them fairly
+// between clients or targets when requests have to wait, so a bulk job can't
+// starve interactive use. It uses start-time fair queueing: every waiting
+// request is tagged with the virtual time its flow is due, advancing by
+// 1/weight per request, and the request with the lowest tag runs next.
+type FairQueueTransport struct {
+	next    Transport
+	slots   int
+	by      string
+	weights map[string]float64
+	limit   int
+
+	mu      sync.Mutex
+	running int
+	waiting int
+	vtime   float64
+	seq     uint64
+	flows   map[string]*queueFlow
+}
+
+// queueFlow holds the waiting requests of one client or target
+type queueFlow struct {
+	weight  float64
+	finish  float64
+	waiting []*queuedRequest
+}
+
+type queuedRequest struct {
+	start      float64
+	seq        uint64
+	ready      chan struct{}
+	dispatched bool
+}
+
+// NewFairQueueTransport runs at most slots invocations of next at a time.
+// by is QueueByClient or QueueByTarget, weights maps client IPs or target URLs
+// to their share (default 1) and limit caps the waiting requests per client
+// or target, 0 means no cap.
+func NewFairQueueTransport(next Transport, slots int, by string, weights map[string]float64, limit int) (*FairQueueTransport, error) {
+	if slots < 1 {
+		return nil, fmt.Errorf("failed to create fair queue: need at least one slot")
+	}
+	if by != QueueByClient && by != QueueByTarget {
+		return nil, fmt.Errorf("failed to create fair queue: unknown key %q, expected %s or %s", by, QueueByClient, QueueByTarget)
+	}
+	for key, weight := range weights {
+		if weight <= 0 {
+			return nil, fmt.Errorf("failed to create fair queue: weight of %s must be positive", key)
+		}
+	}
+	return &FairQueueTransport{
+		next:    next,
+		slots:   slots,
+		by:      by,
+		weights: weights,
+		limit:   limit,
+		flows:   map[string]*queueFlow{},
+	}, nil
+}
+
+func (t *FairQueueTransport) String() string {
+	return fmt.Sprintf("%s (fair queue by %s, %d slots)", DescribeTransport(t.next), t.by, t.slots)
+}
+
+func (t *FairQueueTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	key := request.PrivateApiUrl
+	if t.by == QueueByClient {
+		key = ClientFromContext(ctx)
+	}
+
+	if err := t.acquire(ctx, key); err != nil {
+		return nil, err
+	}
+	defer t.release()
+	return t.next.Invoke(ctx, request)
+}
+
+// acquire returns once the request may invoke
+func (t *FairQueueTransport) acquire(ctx context.Context, key string) error {
+	t.mu.Lock()
+	if t.running < t.slots && t.waiting == 0 {
+		t.running++
+		t.mu.Unlock()
+		return nil
+	}
+
+	flow := t.flows[key]
+	if flow == nil {
+		weight, ok := t.weights[key]
+		if !ok {
+			weight = 1
+		}
+		flow = &queueFlow{weight: weight}
+		t.flows[key] = flow
+	}
+	if t.limit > 0 && len(flow.waiting) >= t.limit {
+		t.mu.Unlock()
+		return ErrQueueFull
+	}
+
+	t.seq++
+	queued := &queuedRequest{start: max(t.vtime, flow.finish), seq: t.seq, ready: make(chan struct{})}
+	flow.finish = queued.start + 1/flow.weight
+	flow.waiting = append(flow.waiting, queued)
+	t.waiting++
+	t.mu.Unlock()
+
+	select {
+	case <-queued.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	if queued.dispatched {
+		// The slot was handed over just as the client gave up
+		t.mu.Unlock()
+		t.release()
+		return fmt.Errorf("wait in queue: %w", ctx.Err())
+	}
+	for i, q := range flow.waiting {
+		if q == queued {
+			flow.waiting = append(flow.waiting[:i], flow.waiting[i+1:]...)
+			break
+		}
+	}
+	t.waiting--
+	t.mu.Unlock()
+	return fmt.Errorf("wait in queue: %w", ctx.Err())
+}
+
+// release hands the slot to the waiting request with the lowest start tag
+func (t *FairQueueTransport) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var next *queueFlow
+	for key, flow := range t.flows {
+		if len(flow.waiting) == 0 {
+			// A flow that's caught up has no credit left to remember
+			if flow.finish <= t.vtime {
+				delete(t.flows, key)
+			}
+			continue
+		}
+		head, best := flow.waiting[0], (*queuedRequest)(nil)
+		if next != nil {
+			best = next.waiting[0]
+		}
+		if best == nil || head.start < best.start || (head.start == best.start && head.seq < best.seq) {
+			next = flow
+		}
+	}
+	if next == nil {
+		t.running--
+		return
+	}
+
+	queued := next.waiting[0]
+	next.waiting = next.waiting[1:]
+	t.waiting--
+	t.vtime = queued.start
+	queued.dispatched = true
+	close(queued.ready)
+}
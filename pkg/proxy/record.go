@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// recording is the on-disk format of a recorded exchange
+type recording struct {
+	Method        string         `json:"method"`
+	PrivateApiUrl string         `json:"privateApiUrl"`
+	Path          string         `json:"path"`
+	Query         string         `json:"query"`
+	Response      *ProxyResponse `json:"response"`
+}
+
+// recordingKey identifies a request by method, target, path, query and body
+func recordingKey(request ProxyRequest) string {
+	hash := sha256.New()
+	for _, part := range []string{request.Method, request.PrivateApiUrl, request.Path, request.Query, request.Body} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func recordingPath(dir string, request ProxyRequest) string {
+	return filepath.Join(dir, recordingKey(request)+".json")
+}
+
+// RecordTransport forwards requests to the wrapped transport and stores
+// every response on disk for later playback. Recordings are redacted with
+// the default rules unless SetRedactor is called.
+type RecordTransport struct {
+	next     Transport
+	dir      string
+	verbose  bool
+	redactor *Redactor
+}
+
+func NewRecordTransport(next Transport, dir string, verbose bool) (*RecordTransport, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create recording directory: %w", err)
+	}
+	return &RecordTransport{next: next, dir: dir, verbose: verbose}, nil
+}
+
+// SetRedactor replaces the rules applied before recordings are written
+func (t *RecordTransport) SetRedactor(redactor *Redactor) {
+	t.redactor = redactor
+}
+
+func (t *RecordTransport) String() string {
+	return fmt.Sprintf("%s (recording to %s)", DescribeTransport(t.next), t.dir)
+}
+
+func (t *RecordTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	resp, err := t.next.Invoke(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(recording{
+		Method:        request.Method,
+		PrivateApiUrl: request.PrivateApiUrl,
+		Path:          request.Path,
+		Query:         t.redactor.Request(request).Query,
+		Response:      t.redactor.Response(resp),
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal recording: %w", err)
+	}
+
+	path := recordingPath(t.dir, request)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		// A failed recording must not break the proxied request
+		log.Printf("Failed to write recording %s: %v", path, err)
+	} else if t.verbose {
+		log.Printf("Recorded %s %s to %s", request.Method, request.Path, path)
+	}
+
+	return resp, nil
+}
+
+// PlaybackTransport serves previously recorded responses from disk and never
+// reaches AWS or the upstream
+type PlaybackTransport struct {
+	dir     string
+	verbose bool
+}
+
+func NewPlaybackTransport(dir string, verbose bool) *PlaybackTransport {
+	return &PlaybackTransport{dir: dir, verbose: verbose}
+}
+
+func (t *PlaybackTransport) String() string {
+	return fmt.Sprintf("recordings in %s", t.dir)
+}
+
+func (t *PlaybackTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	path := recordingPath(t.dir, request)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to find recording for %s %s", request.Method, request.Path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read recording: %w", err)
+	}
+
+	var rec recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("unmarshal recording %s: %w", path, err)
+	}
+
+	if t.verbose {
+		log.Printf("Playing back %s %s from %s", request.Method, request.Path, path)
+	}
+
+	return rec.Response, nil
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// redacted replaces every value removed by a Redactor
+const redacted = "[REDACTED]"
+
+// DefaultRedactedHeaders are well-known credential headers that are redacted
+// unless defaults are disabled
+var DefaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+	"X-Amz-Security-Token",
+}
+
+// DefaultRedactedJSON are top-level JSON fields of OAuth2 token responses that
+// are redacted unless defaults are disabled
+var DefaultRedactedJSON = []string{
+	"access_token",
+	"refresh_token",
+	"id_token",
+}
+
+// Redactor removes secrets from envelopes before they are written to
+// recordings or verbose logs. Headers are matched by name, JSON bodies by
+// dotted paths like "credentials.password" where "*" matches any key or array
+// element, and regular expressions are applied to header values, queries and
+// text bodies. A nil Redactor applies the default header rules.
+type Redactor struct {
+	headers   map[string]bool
+	jsonPaths [][]string
+	patterns  []*regexp.Regexp
+}
+
+var defaultRedactor, _ = NewRedactor(nil, nil, nil, true)
+
+func headerSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+	return set
+}
+
+// NewRedactor creates a Redactor from header names, JSON paths and regular
+// expressions. With defaults the DefaultRedactedHeaders are included.
+func NewRedactor(headers, jsonPaths, patterns []string, defaults bool) (*Redactor, error) {
+	if defaults {
+		headers = append(append([]string(nil), DefaultRedactedHeaders...), headers...)
+		jsonPaths = append(append([]string(nil), DefaultRedactedJSON...), jsonPaths...)
+	}
+	r := &Redactor{headers: headerSet(headers)}
+
+	for _, path := range jsonPaths {
+		path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+		if path == "" {
+			return nil, fmt.Errorf("failed to parse JSON path: empty path")
+		}
+		r.jsonPaths = append(r.jsonPaths, strings.Split(path, "."))
+	}
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("compile redaction pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+func (r *Redactor) rules() *Redactor {
+	if r == nil {
+		return defaultRedactor
+	}
+	return r
+}
+
+// Request returns a copy of request with secrets redacted
+func (r *Redactor) Request(request ProxyRequest) ProxyRequest {
+	r = r.rules()
+	request.Headers = r.redactHeaders(request.Headers)
+	request.Query = r.redactText(request.Query)
+	request.Body = r.redactBody(request.Body)
+	return request
+}
+
+// Response returns a copy of response with secrets redacted
+func (r *Redactor) Response(response *ProxyResponse) *ProxyResponse {
+	if response == nil {
+		return nil
+	}
+	r = r.rules()
+	copied := *response
+	copied.Headers = r.redactHeaders(response.Headers)
+	copied.Trailers = r.redactHeaders(response.Trailers)
+	copied.Body = r.redactBody(response.Body)
+	return &copied
+}
+
+// loggedRequest leaves the body out of the JSON of a request, verbose logs
+// show it decoded below
+type loggedRequest struct {
+	ProxyRequest
+	Body string `json:"body,omitempty"`
+}
+
+// RequestLog marshals the redacted request for logging, followed by its body
+// formatted for reading and cut off after bodyLimit bytes
+func (r *Redactor) RequestLog(request ProxyRequest, bodyLimit int) string {
+	request = r.Request(request)
+	data, err := json.Marshal(loggedRequest{ProxyRequest: request})
+	if err != nil {
+		return fmt.Sprintf("<failed to marshal request: %v>", err)
+	}
+	if body := formatBody("Request", request.Headers, request.Body, bodyLimit); body != "" {
+		return string(data) + "\n" + body
+	}
+	return string(data)
+}
+
+// ResponseBodyLog formats the redacted body of response for logging like
+// RequestLog, it returns "" if there is no body to show
+func (r *Redactor) ResponseBodyLog(response *ProxyResponse, bodyLimit int) string {
+	response = r.Response(response)
+	if response == nil {
+		return ""
+	}
+	return formatBody("Response", response.Headers, response.Body, bodyLimit)
+}
+
+func (r *Redactor) redactHeaders(headers map[string][]string) map[string][]string {
+	if headers == nil {
+		return nil
+	}
+	copied := make(map[string][]string, len(headers))
+	for key, values := range headers {
+		if r.headers[http.CanonicalHeaderKey(key)] {
+			copied[key] = []string{redacted}
+			continue
+		}
+		copied[key] = make([]string, len(values))
+		for i, value := range values {
+			copied[key][i] = r.redactText(value)
+		}
+	}
+	return copied
+}
+
+func (r *Redactor) redactText(text string) string {
+	for _, re := range r.patterns {
+		text = re.ReplaceAllString(text, redacted)
+	}
+	return text
+}
+
+// redactBody redacts a base64 envelope body, binary bodies are left alone
+func (r *Redactor) redactBody(body string) string {
+	if len(r.jsonPaths) == 0 && len(r.patterns) == 0 {
+		return body
+	}
+	decoded, err := base64.StdEncoding.DecodeString(body)
+	if err != nil || !utf8.Valid(decoded) {
+		return body
+	}
+
+	if len(r.jsonPaths) > 0 {
+		var document any
+		if err := json.Unmarshal(decoded, &document); err == nil {
+			for _, path := range r.jsonPaths {
+				document = redactJSONPath(document, path)
+			}
+			if data, err := json.Marshal(document); err == nil {
+				decoded = data
+			}
+		}
+	}
+	return encodeBody([]byte(r.redactText(string(decoded))))
+}
+
+func redactJSONPath(node any, path []string) any {
+	if len(path) == 0 {
+		return redacted
+	}
+	switch value := node.(type) {
+	case map[string]any:
+		for key, child := range value {
+			if path[0] == "*" || path[0] == key {
+				value[key] = redactJSONPath(child, path[1:])
+			}
+		}
+	case []any:
+		for i, child := range value {
+			if path[0] == "*" || path[0] == fmt.Sprint(i) {
+				value[i] = redactJSONPath(child, path[1:])
+			}
+		}
+	}
+	return node
+}
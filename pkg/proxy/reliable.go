@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// maxMessageSize is the largest SQS message body
+const maxMessageSize = 1 << 20
+
+// ErrMessageTooLarge is returned for envelopes that don't fit into an SQS
+// message
+var ErrMessageTooLarge = errors.New("failed to enqueue request: envelope exceeds the SQS message size limit")
+
+type reliableContextKey struct{}
+
+// WithReliable returns ctx marking its request for delivery through SQS
+func WithReliable(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reliableContextKey{}, true)
+}
+
+// IsReliable reports whether WithReliable marked ctx
+func IsReliable(ctx context.Context) bool {
+	reliable, _ := ctx.Value(reliableContextKey{}).(bool)
+	return reliable
+}
+
+// ReliableTransport enqueues requests to reliable targets to an SQS queue the
+// Lambda consumes, instead of invoking it. Once SendMessage returned, the
+// request is delivered at least once even if this machine goes to sleep or
+// offline, failed deliveries are retried and end up in the queue's
+// dead-letter queue. Clients get 202 with a tracking ID right away, with a
+// bucket the outcome can be looked up with awsctl status. Other requests are
+// passed on to next.
+type ReliableTransport struct {
+	next     Transport
+	client   *sqs.Client
+	queueURL string
+	bucket   string
+	verbose  bool
+}
+
+// NewReliableTransport sends to queueURL. bucket is the Lambda's
+// ASYNC_RESPONSE_BUCKET, empty if outcomes aren't stored.
+func NewReliableTransport(ctx context.Context, next Transport, queueURL, bucket, region, profile string, verbose bool) (*ReliableTransport, error) {
+	awsCfg, err := LoadAWSConfig(ctx, region, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &ReliableTransport{next: next, client: sqs.NewFromConfig(awsCfg), queueURL: queueURL, bucket: bucket, verbose: verbose}, nil
+}
+
+func (t *ReliableTransport) String() string {
+	return fmt.Sprintf("%s (reliable targets via %s)", DescribeTransport(t.next), t.queueURL)
+}
+
+func (t *ReliableTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	if !IsReliable(ctx) {
+		return t.next.Invoke(ctx, request)
+	}
+
+	trackingID, err := newResponseKey()
+	if err != nil {
+		return nil, err
+	}
+	// The Lambda can only store the outcome if it has a bucket
+	if t.bucket != "" {
+		request.ResponseKey = trackingID
+	}
+	if err := resign(ctx, &request); err != nil {
+		return nil, err
+	}
+	message, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	if len(message) > maxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	out, err := t.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    &t.queueURL,
+		MessageBody: aws.String(string(message)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("send message: %w", err)
+	}
+	if t.verbose {
+		log.Printf("Enqueued %s %s as message %s, tracking ID %s", request.Method, request.Path, aws.ToString(out.MessageId), trackingID)
+	}
+	return acceptedResponse(trackingID)
+}
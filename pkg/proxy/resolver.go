@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResolverAPIVersion identifies the protocol spoken with exec resolvers
+const ResolverAPIVersion = "awsctl.resolver/v1"
+
+// resolverTimeout bounds a single run of an exec resolver
+const resolverTimeout = 10 * time.Second
+
+// resolverTTL is how long a resolved target is reused when the resolver
+// doesn't say
+const resolverTTL = 5 * time.Minute
+
+// ResolvedTarget is a target alias resolved by a TargetResolver
+type ResolvedTarget struct {
+	URL string `json:"url"`
+	// Headers are set on every request to the target the client didn't set
+	// itself, e.g. Authorization with a token from a service catalog
+	Headers map[string]string `json:"headers,omitempty"`
+	// TTLSeconds is how long the target and its headers are reused, 0 means
+	// 5 minutes
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+}
+
+// TargetResolver resolves aliases that aren't in the targets file, e.g.
+// from an internal service catalog. ResolveTarget returns nil for aliases
+// the resolver doesn't know.
+type TargetResolver interface {
+	ResolveTarget(ctx context.Context, alias string) (*ResolvedTarget, error)
+}
+
+// resolverRequest is written to the stdin of an exec resolver
+type resolverRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Alias      string `json:"alias"`
+}
+
+// resolverResponse is read from the stdout of an exec resolver, an empty URL
+// means the alias is unknown
+type resolverResponse struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	ResolvedTarget
+}
+
+// execResolver runs a command per alias, like git credential helpers
+type execResolver struct {
+	command []string
+}
+
+// ExecResolver returns a resolver running command, split at spaces, for
+// every alias it resolves. The command reads
+// {"apiVersion": "awsctl.resolver/v1", "alias": "orders"} from stdin and
+// writes a ResolvedTarget as JSON to stdout, or {} if it doesn't know the
+// alias. A non-zero exit status fails the resolution with stderr as reason.
+func ExecResolver(command string) (TargetResolver, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("failed to use resolver: empty command")
+	}
+	return &execResolver{command: fields}, nil
+}
+
+func (r *execResolver) ResolveTarget(ctx context.Context, alias string) (*ResolvedTarget, error) {
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+
+	input, err := json.Marshal(resolverRequest{APIVersion: ResolverAPIVersion, Alias: alias})
+	if err != nil {
+		return nil, fmt.Errorf("marshal resolver request: %w", err)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, r.command[0], r.command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if reason := strings.TrimSpace(stderr.String()); reason != "" {
+			return nil, fmt.Errorf("run %s: %w: %s", r.command[0], err, reason)
+		}
+		return nil, fmt.Errorf("run %s: %w", r.command[0], err)
+	}
+
+	var response resolverResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("parse output of %s: %w", r.command[0], err)
+	}
+	if response.APIVersion != "" && response.APIVersion != ResolverAPIVersion {
+		return nil, fmt.Errorf("failed to use %s: unsupported apiVersion %q, expected %s", r.command[0], response.APIVersion, ResolverAPIVersion)
+	}
+	if response.URL == "" {
+		return nil, nil
+	}
+	return &response.ResolvedTarget, nil
+}
+
+// resolvedTarget is a resolved alias and when it has to be resolved again
+type resolvedTarget struct {
+	target  ResolvedTarget
+	expires time.Time
+}
+
+// resolverChain asks its resolvers in order and caches their answers
+type resolverChain struct {
+	resolvers []TargetResolver
+
+	mu       sync.Mutex
+	resolved map[string]resolvedTarget
+}
+
+// resolve returns the target of alias from the cache or the first resolver
+// knowing it, nil if none does
+func (c *resolverChain) resolve(ctx context.Context, alias string) (*ResolvedTarget, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.resolved[alias]; ok && time.Now().Before(cached.expires) {
+		return &cached.target, nil
+	}
+	for _, resolver := range c.resolvers {
+		target, err := resolver.ResolveTarget(ctx, alias)
+		if err != nil {
+			return nil, fmt.Errorf("resolve target %s: %w", alias, err)
+		}
+		if target == nil {
+			continue
+		}
+		if u, err := url.Parse(target.URL); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("failed to resolve target %s: invalid url %q", alias, target.URL)
+		}
+		ttl := resolverTTL
+		if target.TTLSeconds > 0 {
+			ttl = time.Duration(target.TTLSeconds) * time.Second
+		}
+		if c.resolved == nil {
+			c.resolved = map[string]resolvedTarget{}
+		}
+		c.resolved[alias] = resolvedTarget{target: *target, expires: time.Now().Add(ttl)}
+		return target, nil
+	}
+	delete(c.resolved, alias)
+	return nil, nil
+}
+
+// aliasOf returns the resolved alias whose URL is privateApiUrl
+func (c *resolverChain) aliasOf(privateApiUrl string) (string, bool) {
+	privateApiUrl = strings.TrimSuffix(privateApiUrl, "/")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for alias, cached := range c.resolved {
+		if strings.TrimSuffix(cached.target.URL, "/") == privateApiUrl {
+			return alias, true
+		}
+	}
+	return "", false
+}
+
+// AddResolver asks r for aliases missing from the targets file, after the
+// resolvers added before
+func (c *Targets) AddResolver(r TargetResolver) {
+	if c.resolvers == nil {
+		c.resolvers = &resolverChain{}
+	}
+	c.resolvers.resolvers = append(c.resolvers.resolvers, r)
+}
+
+// HasResolvers reports whether any resolvers were added
+func (c *Targets) HasResolvers() bool {
+	return c.resolvers != nil
+}
+
+// ResolverHeadersHook sets the headers resolvers returned for their targets
+// on requests to them. Headers sent by the client are kept. The target is
+// resolved again once its answer expired, so resolvers can hand out
+// short-lived tokens.
+func ResolverHeadersHook(targets *Targets) RequestHook {
+	return func(ctx context.Context, request *ProxyRequest) (*ProxyResponse, error) {
+		if targets.resolvers == nil {
+			return nil, nil
+		}
+		alias, ok := targets.resolvers.aliasOf(request.PrivateApiUrl)
+		if !ok {
+			return nil, nil
+		}
+		target, err := targets.resolvers.resolve(ctx, alias)
+		if err != nil {
+			return nil, err
+		}
+		if target == nil {
+			return nil, fmt.Errorf("failed to refresh target %s: no resolver knows it anymore", alias)
+		}
+		if len(target.Headers) > 0 && request.Headers == nil {
+			request.Headers = map[string][]string{}
+		}
+		for name, value := range target.Headers {
+			if http.Header(request.Headers).Get(name) == "" {
+				http.Header(request.Headers).Set(name, value)
+			}
+		}
+		return nil, nil
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// rewritableTypes are the content types whose bodies are scanned for links
+var rewritableTypes = []string{
+	"text/html",
+	"text/css",
+	"text/javascript",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"text/xml",
+}
+
+// EnableLinkRewriting makes the server replace absolute links to known
+// private URLs in redirects and text bodies with the corresponding local
+// proxy URLs, so internal web apps keep working in the browser
+func (s *Server) EnableLinkRewriting() {
+	s.rewriteLinks = true
+}
+
+// SetPathPrefix tells the server that its routes are mounted below prefix,
+// e.g. /dev, so the local links it generates include it
+func (s *Server) SetPathPrefix(prefix string) {
+	s.pathPrefix = strings.TrimSuffix(prefix, "/")
+}
+
+// linkReplacer maps every known private URL to its /t/ URL on localHost
+func (s *Server) linkReplacer(localHost, privateApiUrl string) *strings.Replacer {
+	urls := map[string]bool{strings.TrimSuffix(privateApiUrl, "/"): true}
+	for _, t := range s.targets.Targets {
+		urls[strings.TrimSuffix(t.URL, "/")] = true
+		for _, u := range t.Upstreams {
+			urls[strings.TrimSuffix(u.URL, "/")] = true
+		}
+	}
+
+	// Longer URLs first so a target with a base path wins over its host
+	var sorted []string
+	for u := range urls {
+		sorted = append(sorted, u)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	var pairs []string
+	for _, privateURL := range sorted {
+		localURL := "http://" + localHost + s.pathPrefix + TargetPath(privateURL)
+		pairs = append(pairs, privateURL, localURL)
+		// JSON encoders may escape slashes
+		pairs = append(pairs, strings.ReplaceAll(privateURL, "/", `\/`), strings.ReplaceAll(localURL, "/", `\/`))
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// rewriteResponseLinks returns a copy of response with private links replaced
+func (s *Server) rewriteResponseLinks(r *http.Request, request *ProxyRequest, response *ProxyResponse) *ProxyResponse {
+	// Requests arriving through the browser proxy already use the private
+	// hostname, rewriting would send the browser away from it
+	if u, err := url.Parse(request.PrivateApiUrl); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return response
+	}
+
+	replacer := s.linkReplacer(r.Host, request.PrivateApiUrl)
+	rewritten := *response
+
+	headers := http.Header(response.Headers).Clone()
+	for _, name := range []string{"Location", "Content-Location", "Refresh"} {
+		if values := headers.Values(name); len(values) > 0 {
+			headers.Del(name)
+			for _, value := range values {
+				headers.Add(name, replacer.Replace(value))
+			}
+		}
+	}
+	rewritten.Headers = headers
+
+	// Rewriting changes the length of the body, which would no longer match
+	// the Content-Range of a partial response
+	if response.StatusCode == http.StatusPartialContent || headers.Get("Content-Encoding") != "" || !isRewritable(headers.Get("Content-Type")) {
+		return &rewritten
+	}
+
+	body, err := base64.StdEncoding.DecodeString(response.Body)
+	if err != nil {
+		return &rewritten
+	}
+	rewritten.Body = encodeBody([]byte(replacer.Replace(string(body))))
+	return &rewritten
+}
+
+// upstreamDestination maps a Destination header from the proxy URL the client
+// knows to the upstream URL. localPrefix is the part of the local path in
+// front of the upstream path, e.g. /t/<target>. Destinations on other hosts
+// or outside the target are left alone.
+func (s *Server) upstreamDestination(r *http.Request, privateApiUrl, localPrefix, destination string) string {
+	u, err := url.Parse(destination)
+	if err != nil || (u.Host != "" && !strings.EqualFold(u.Host, r.Host)) {
+		return destination
+	}
+	rest, ok := strings.CutPrefix(u.EscapedPath(), s.pathPrefix+localPrefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return destination
+	}
+	upstream := strings.TrimSuffix(privateApiUrl, "/") + rest
+	if u.RawQuery != "" {
+		upstream += "?" + u.RawQuery
+	}
+	return upstream
+}
+
+func isRewritable(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, rewritable := range rewritableTypes {
+		if mediaType == rewritable {
+			return true
+		}
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
@@ -0,0 +1,285 @@
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+	"github.com/jkblume/awsctl/pkg/proxytest"
+)
+
+// echo answers with the method, escaped path, raw query and body it received
+func echo(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("X-Method", r.Method)
+	w.Header().Set("X-Path", r.URL.EscapedPath())
+	w.Header().Set("X-Query", r.URL.RawQuery)
+	w.Header().Set("X-Content-Type", r.Header.Get("Content-Type"))
+	w.Write(body)
+}
+
+func TestRoundTripGet(t *testing.T) {
+	h := proxytest.New(t, http.HandlerFunc(echo))
+
+	resp, body := h.Get("/items/42")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Method"); got != http.MethodGet {
+		t.Errorf("upstream method = %q, want GET", got)
+	}
+	if got := resp.Header.Get("X-Path"); got != "/items/42" {
+		t.Errorf("upstream path = %q, want /items/42", got)
+	}
+	if len(body) != 0 {
+		t.Errorf("body = %q, want empty", body)
+	}
+}
+
+func TestRoundTripPost(t *testing.T) {
+	h := proxytest.New(t, http.HandlerFunc(echo))
+	payload := `{"name":"widget","tags":["a","b"]}` + "\n\x00\xff binary tail"
+
+	resp, body := h.Do(http.MethodPost, "/items", strings.NewReader(payload), http.Header{"Content-Type": {"application/json"}})
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Method"); got != http.MethodPost {
+		t.Errorf("upstream method = %q, want POST", got)
+	}
+	if got := resp.Header.Get("X-Content-Type"); got != "application/json" {
+		t.Errorf("upstream Content-Type = %q, want application/json", got)
+	}
+	if string(body) != payload {
+		t.Errorf("body = %q, want %q", body, payload)
+	}
+}
+
+func TestRoundTripEscapedPath(t *testing.T) {
+	h := proxytest.New(t, http.HandlerFunc(echo))
+
+	for _, path := range []string{
+		"/files/a%2Fb",
+		"/files/with%20space",
+		"/files/%E2%82%AC",
+		"/files/100%25",
+		"/files/a%3Fb",
+		"/files/trailing/",
+	} {
+		resp, _ := h.Get(path)
+		if got := resp.Header.Get("X-Path"); got != path {
+			t.Errorf("upstream path for %s = %q, want it unchanged", path, got)
+		}
+	}
+}
+
+func TestRoundTripQuery(t *testing.T) {
+	h := proxytest.New(t, http.HandlerFunc(echo))
+
+	for _, query := range []string{
+		"a=1",
+		"a=1&a=2&b=3",
+		"q=hello+world&r=%26%3D",
+		"flag",
+		"empty=",
+	} {
+		resp, _ := h.Get("/search?" + query)
+		if got := resp.Header.Get("X-Query"); got != query {
+			t.Errorf("upstream query for %s = %q, want it unchanged", query, got)
+		}
+		if got := resp.Header.Get("X-Path"); got != "/search" {
+			t.Errorf("upstream path for %s = %q, want /search", query, got)
+		}
+	}
+}
+
+// BenchmarkRoundTrip measures the whole pipeline: client, proxy, the
+// in-process ingress handler and the upstream
+func BenchmarkRoundTrip(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			payload := strings.Repeat("x", size)
+			h := proxytest.New(b, http.HandlerFunc(echo))
+
+			b.SetBytes(int64(2 * size))
+			b.ReportAllocs()
+			for b.Loop() {
+				resp, body := h.Do(http.MethodPost, "/items", strings.NewReader(payload), nil)
+				if resp.StatusCode != http.StatusOK || len(body) != size {
+					b.Fatalf("status = %d with %d bytes, want 200 with %d", resp.StatusCode, len(body), size)
+				}
+			}
+		})
+	}
+}
+
+// rawResponse answers with response written verbatim to the connection, so
+// the upstream can send what net/http would refuse to, such as a 304 with a
+// body
+func rawResponse(w http.ResponseWriter, response string) {
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	buf.WriteString(response)
+	buf.Flush()
+}
+
+// rawRequest sends a request for path to the proxy over a fresh connection that
+// is closed after the response and returns the status line and headers and
+// everything that followed them
+func rawRequest(t *testing.T, h *proxytest.Harness, method, path string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	target, err := url.Parse(h.URL(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", target.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n", method, target.RequestURI(), target.Host)
+	for key, values := range header {
+		for _, value := range values {
+			request += key + ": " + value + "\r\n"
+		}
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, rest, found := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !found {
+		t.Fatalf("%s %s: incomplete response %q", method, path, raw)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(append(head, "\r\n\r\n"...))), nil)
+	if err != nil {
+		t.Fatalf("%s %s: failed to parse response %q: %v", method, path, head, err)
+	}
+	return resp, rest
+}
+
+// TestRoundTripNoBody sends HEAD, conditional and bodyless requests to an
+// upstream that wrongly attaches bodies and lengths, and checks neither the
+// envelope nor the client response passes them on
+func TestRoundTripNoBody(t *testing.T) {
+	var mu sync.Mutex
+	var envelopes []*proxy.ProxyResponse
+	local := &proxy.LocalTransport{}
+	recording := proxy.TransportFunc(func(ctx context.Context, request proxy.ProxyRequest) (*proxy.ProxyResponse, error) {
+		response, err := local.Invoke(ctx, request)
+		if err == nil {
+			mu.Lock()
+			envelopes = append(envelopes, response)
+			mu.Unlock()
+		}
+		return response, err
+	})
+
+	h := proxytest.New(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/etag":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				rawResponse(w, "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\nContent-Length: 5\r\nConnection: close\r\n\r\nstale")
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("fresh"))
+		case "/modified":
+			if r.Header.Get("If-Modified-Since") != "" {
+				rawResponse(w, "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\nConnection: close\r\n\r\nstale")
+				return
+			}
+			w.Write([]byte("fresh"))
+		case "/no-content":
+			rawResponse(w, "HTTP/1.1 204 No Content\r\nContent-Length: 5\r\nConnection: close\r\n\r\nstale")
+		case "/reset":
+			rawResponse(w, "HTTP/1.1 205 Reset Content\r\nContent-Length: 5\r\nConnection: close\r\n\r\nstale")
+		case "/head":
+			rawResponse(w, "HTTP/1.1 200 OK\r\nContent-Length: 1234\r\nConnection: close\r\n\r\n")
+		}
+	}), proxytest.WithTransport(recording))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		header     http.Header
+		wantStatus int
+		// wantLength is the Content-Length the client may see, "" for none
+		wantLength string
+		wantETag   string
+	}{
+		{"If-None-Match", http.MethodGet, "/etag", http.Header{"If-None-Match": {`"v1"`}}, http.StatusNotModified, "", `"v1"`},
+		{"If-Modified-Since", http.MethodGet, "/modified", http.Header{"If-Modified-Since": {"Sat, 17 Oct 2026 00:00:00 GMT"}}, http.StatusNotModified, "", ""},
+		{"204", http.MethodDelete, "/no-content", nil, http.StatusNoContent, "", ""},
+		{"205", http.MethodPost, "/reset", nil, http.StatusResetContent, "0", ""},
+		{"HEAD", http.MethodHead, "/head", nil, http.StatusOK, "1234", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mu.Lock()
+			envelopes = nil
+			mu.Unlock()
+
+			resp, rest := rawRequest(t, h, test.method, test.path, test.header)
+
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, test.wantStatus)
+			}
+			if len(rest) != 0 {
+				t.Errorf("client got %q after the headers, want nothing", rest)
+			}
+			if got := resp.Header.Get("Content-Length"); got != test.wantLength {
+				t.Errorf("client Content-Length = %q, want %q", got, test.wantLength)
+			}
+			if got := resp.Header.Get("Transfer-Encoding"); got != "" {
+				t.Errorf("client Transfer-Encoding = %q, want none", got)
+			}
+			if got := resp.Header.Get("Etag"); got != test.wantETag {
+				t.Errorf("client ETag = %q, want %q", got, test.wantETag)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(envelopes) != 1 {
+				t.Fatalf("recorded %d envelopes, want 1", len(envelopes))
+			}
+			envelope := envelopes[0]
+			if envelope.Body != "" {
+				t.Errorf("envelope body = %q, want none", envelope.Body)
+			}
+			wantEnvelopeLength := ""
+			if test.method == http.MethodHead {
+				wantEnvelopeLength = test.wantLength
+			}
+			if got := http.Header(envelope.Headers).Get("Content-Length"); got != wantEnvelopeLength {
+				t.Errorf("envelope Content-Length = %q, want %q", got, wantEnvelopeLength)
+			}
+		})
+	}
+
+	// Without the precondition the representation comes back in full
+	resp, body := h.Get("/etag")
+	if resp.StatusCode != http.StatusOK || string(body) != "fresh" {
+		t.Errorf("unconditional GET = %d %q, want 200 \"fresh\"", resp.StatusCode, body)
+	}
+}
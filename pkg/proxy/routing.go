@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamHeader names the upstream URL that answered a request to a target
+// with several upstreams
+const UpstreamHeader = "X-Awsctl-Upstream"
+
+// healthCheckTimeout bounds a single health check
+const healthCheckTimeout = 10 * time.Second
+
+// Upstream is one of several private URLs serving a target
+type Upstream struct {
+	URL string `json:"url"`
+	// Weight is the upstream's share of requests relative to the others, 0
+	// drains it
+	Weight int `json:"weight"`
+	// Health is a path checked with GET, the upstream gets no requests while
+	// it doesn't answer with 2xx or 3xx
+	Health string `json:"health,omitempty"`
+}
+
+// StickyConfig pins the requests of a client session to one upstream by
+// hashing a cookie or header
+type StickyConfig struct {
+	Cookie string `json:"cookie,omitempty"`
+	Header string `json:"header,omitempty"`
+}
+
+func (c StickyConfig) validate() error {
+	if (c.Cookie == "") == (c.Header == "") {
+		return fmt.Errorf("failed to use sticky config: set either cookie or header")
+	}
+	return nil
+}
+
+// key returns the value requests are pinned by, empty if request has none
+func (c StickyConfig) key(request ProxyRequest) string {
+	if c.Header != "" {
+		return http.Header(request.Headers).Get(c.Header)
+	}
+	cookie, err := (&http.Request{Header: request.Headers}).Cookie(c.Cookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// RoutingTransport sends each request to a target with "upstreams" to one of
+// them, picked at random by weight among the healthy ones, e.g. to drive a
+// blue/green test of an internal service. Targets with "sticky" send requests
+// with the same cookie or header value to the same upstream while it stays
+// healthy. It must wrap SigV4Transport so
+// requests are signed for the upstream they go to.
+type RoutingTransport struct {
+	next    Transport
+	targets *Targets
+
+	mu sync.Mutex
+	// unhealthy holds the upstreams that failed their last health check
+	unhealthy map[Upstream]bool
+}
+
+func NewRoutingTransport(next Transport, targets *Targets) *RoutingTransport {
+	return &RoutingTransport{next: next, targets: targets, unhealthy: map[Upstream]bool{}}
+}
+
+func (t *RoutingTransport) String() string {
+	return fmt.Sprintf("%s (routing to weighted upstreams)", DescribeTransport(t.next))
+}
+
+func (t *RoutingTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	upstreams := t.targets.Upstreams(request.PrivateApiUrl)
+	if len(upstreams) == 0 {
+		return t.next.Invoke(ctx, request)
+	}
+	var key string
+	if sticky := t.targets.Sticky(request.PrivateApiUrl); sticky != nil {
+		key = sticky.key(request)
+	}
+	upstream := t.pick(upstreams, key)
+	request.PrivateApiUrl = upstream.URL
+	request.HostOverrides = t.targets.HostOverrides(upstream.URL)
+
+	response, err := t.next.Invoke(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	headers := http.Header(response.Headers).Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	headers.Set(UpstreamHeader, upstream.URL)
+	response.Headers = headers
+	return response, nil
+}
+
+// pick chooses an upstream by weight, skipping unhealthy ones unless all
+// are unhealthy. With a sticky key the choice is a weighted rendezvous hash
+// of it, so only keys of an upstream that goes away or changes its weight
+// move.
+func (t *RoutingTransport) pick(upstreams []Upstream, key string) Upstream {
+	t.mu.Lock()
+	var healthy []Upstream
+	for _, u := range upstreams {
+		if !t.unhealthy[u] {
+			healthy = append(healthy, u)
+		}
+	}
+	t.mu.Unlock()
+	if totalWeight(healthy) == 0 {
+		healthy = upstreams
+	}
+	if key != "" {
+		return rendezvous(healthy, key)
+	}
+
+	n := rand.IntN(totalWeight(healthy))
+	for _, u := range healthy {
+		if n < u.Weight {
+			return u
+		}
+		n -= u.Weight
+	}
+	return healthy[len(healthy)-1]
+}
+
+// Run checks the health of upstreams with a health path every interval
+// until ctx is done
+func (t *RoutingTransport) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		t.checkHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth checks all upstreams with a health path concurrently
+func (t *RoutingTransport) checkHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for alias, target := range t.targets.Targets {
+		for _, u := range target.Upstreams {
+			if u.Health == "" {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := t.check(ctx, u)
+
+				t.mu.Lock()
+				defer t.mu.Unlock()
+				switch {
+				case err != nil && !t.unhealthy[u]:
+					log.Printf("Upstream %s of %s is unhealthy: %v", u.URL, alias, err)
+					t.unhealthy[u] = true
+				case err == nil && t.unhealthy[u]:
+					log.Printf("Upstream %s of %s is healthy again", u.URL, alias)
+					delete(t.unhealthy, u)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// check sends a GET to the health path of u through the Lambda
+func (t *RoutingTransport) check(ctx context.Context, u Upstream) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	path := "/" + strings.TrimPrefix(u.Health, "/")
+	path, query, _ := strings.Cut(path, "?")
+	response, err := t.next.Invoke(ctx, ProxyRequest{
+		Method:        http.MethodGet,
+		Path:          path,
+		Headers:       map[string][]string{},
+		Query:         query,
+		PrivateApiUrl: u.URL,
+		HostOverrides: t.targets.HostOverrides(u.URL),
+	})
+	if err != nil {
+		return err
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("failed health check: status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// rendezvous returns the upstream with the highest weighted score for key
+func rendezvous(upstreams []Upstream, key string) Upstream {
+	best, bestScore := upstreams[0], math.Inf(-1)
+	for _, u := range upstreams {
+		if u.Weight == 0 {
+			continue
+		}
+		sum := sha256.Sum256([]byte(u.URL + "\x00" + key))
+		// Map the hash into (0, 1), the score grows with the weight
+		unit := (float64(binary.BigEndian.Uint64(sum[:])>>11) + 0.5) / (1 << 53)
+		if score := -float64(u.Weight) / math.Log(unit); score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+	return best
+}
+
+// totalWeight sums the weights of upstreams
+func totalWeight(upstreams []Upstream) int {
+	total := 0
+	for _, u := range upstreams {
+		total += u.Weight
+	}
+	return total
+}
@@ -0,0 +1,423 @@
+// Package proxy implements the local side of awsctl proxy: it turns HTTP
+// requests into envelopes and delivers them through a pluggable Transport.
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jkblume/awsctl/pkg/ingress"
+)
+
+// Server turns local HTTP requests into envelopes and sends them through a
+// Transport
+type Server struct {
+	transport     Transport
+	targets       *Targets
+	verbose       bool
+	requestHooks  []RequestHook
+	responseHooks []ResponseHook
+	rewriteLinks  bool
+	errorFormat   string
+	pathPrefix    string
+	fireAndForget bool
+	// requestHeaders and responseHeaders filter what is forwarded
+	requestHeaders  *HeaderFilter
+	responseHeaders *HeaderFilter
+	// userAgent, version and versionHeader identify the proxy upstream
+	userAgent     string
+	version       string
+	versionHeader bool
+	// throttle limits response delivery in bytes per second
+	throttle int64
+	// upstreamTimeouts are sent with every envelope, nil keeps the Lambda's
+	upstreamTimeouts *ingress.UpstreamTimeouts
+	// requestTimeout bounds the time a request may take, 0 means no limit
+	requestTimeout time.Duration
+	// debugDir receives a file per request, see SetDebugDir
+	debugDir      string
+	debugRedactor *Redactor
+	// stats counts responses and errors for Stats
+	stats serverStats
+}
+
+func NewServer(transport Transport, targets *Targets, verbose bool) *Server {
+	if targets == nil {
+		targets = &Targets{Targets: map[string]Target{}}
+	}
+	return &Server{
+		transport:       transport,
+		targets:         targets,
+		verbose:         verbose,
+		errorFormat:     ErrorFormatText,
+		requestHeaders:  defaultRequestFilter,
+		responseHeaders: defaultResponseFilter,
+		userAgent:       UserAgentPreserve,
+	}
+}
+
+// SetHeaderFilters replaces the filters of request headers forwarded
+// upstream and response headers passed to clients, nil filters nothing
+func (s *Server) SetHeaderFilters(request, response *HeaderFilter) {
+	s.requestHeaders = request
+	s.responseHeaders = response
+}
+
+// SetUpstreamTimeouts asks the Lambda to use timeouts for the upstream call
+// of every request instead of its own, zero fields keep the Lambda's
+func (s *Server) SetUpstreamTimeouts(timeouts ingress.UpstreamTimeouts) {
+	if timeouts == (ingress.UpstreamTimeouts{}) {
+		s.upstreamTimeouts = nil
+		return
+	}
+	s.upstreamTimeouts = &timeouts
+}
+
+// SetRequestTimeout gives up on requests that aren't long-running after
+// timeout, e.g. the local server's write timeout after which the response
+// can't be delivered anyway. The Lambda learns the deadline from the
+// envelope. 0 means no limit.
+func (s *Server) SetRequestTimeout(timeout time.Duration) {
+	s.requestTimeout = timeout
+}
+
+// EnableFireAndForget accepts requests with AsyncHeader, the transport must
+// handle them, e.g. an AsyncTransport
+func (s *Server) EnableFireAndForget() {
+	s.fireAndForget = true
+}
+
+// Transport returns the transport requests are sent through
+func (s *Server) Transport() Transport {
+	return s.transport
+}
+
+// Register adds the proxy routes to mux. The legacy
+// /api_url/<url-encoded-api-url>/proxy/<path> scheme is optional.
+func (s *Server) Register(mux *http.ServeMux, legacyPaths bool) {
+	mux.HandleFunc("/t/{target}", s.ServeTarget)
+	mux.HandleFunc("/t/{target}/{path...}", s.ServeTarget)
+	if legacyPaths {
+		mux.HandleFunc("/api_url/{path...}", s.ServeLegacy)
+	}
+}
+
+// TargetHeaderMiddleware forwards requests carrying X-Awsctl-Target with their
+// path untouched, bypassing the path-based schemes
+func (s *Server) TargetHeaderMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aliasOrURL := r.Header.Get(TargetHeader)
+		if aliasOrURL == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(TargetHeader)
+
+		privateApiUrl, err := s.targets.Resolve(aliasOrURL)
+		if err != nil {
+			s.WriteError(w, http.StatusBadRequest, ErrorCodeTargetResolution, fmt.Sprintf("Failed to resolve target: %v", err), "")
+			return
+		}
+
+		s.Forward(w, r, privateApiUrl, r.URL.EscapedPath())
+	})
+}
+
+// ServeLegacy serves /api_url/<url-encoded-api-url>/proxy/<path>
+func (s *Server) ServeLegacy(w http.ResponseWriter, r *http.Request) {
+	// Work on the escaped path so a fully encoded API URL never contains a
+	// literal "/proxy/" and only the first occurrence separates the two parts
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api_url/")
+	if path == "" {
+		s.WriteError(w, http.StatusBadRequest, ErrorCodeBadRequest, "Missing path", "")
+		return
+	}
+
+	encodedApiUrl, escapedApiPath, found := strings.Cut(path, "/proxy/")
+	if !found {
+		s.WriteError(w, http.StatusBadRequest, ErrorCodeBadRequest, "Invalid path format. Expected: /api_url/<encoded-api-url>/proxy/<path>", "")
+		return
+	}
+
+	// Decode the API URL
+	privateApiUrl, err := url.QueryUnescape(encodedApiUrl)
+	if err != nil {
+		s.WriteError(w, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("Failed to decode API URL: %v", err), "")
+		return
+	}
+
+	s.Forward(w, r, privateApiUrl, "/"+escapedApiPath)
+}
+
+// TargetPath returns the /t/ path the proxy serves privateApiUrl under
+func TargetPath(privateApiUrl string) string {
+	return "/t/" + base64.RawURLEncoding.EncodeToString([]byte(privateApiUrl))
+}
+
+// ServeTarget serves /t/<base64url-api-url>/<path>, where the target is a single
+// path segment and everything after it is passed to the upstream unchanged
+func (s *Server) ServeTarget(w http.ResponseWriter, r *http.Request) {
+	target, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.PathValue("target"), "="))
+	if err != nil {
+		s.WriteError(w, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("Failed to decode base64url API URL: %v", err), "")
+		return
+	}
+
+	// Take the upstream path from the escaped request path, the target
+	// segment is base64url and therefore never escaped
+	prefix := "/t/" + r.PathValue("target")
+	escapedApiPath, found := strings.CutPrefix(r.URL.EscapedPath(), prefix)
+	if !found {
+		s.WriteError(w, http.StatusBadRequest, ErrorCodeBadRequest, "Invalid target segment: base64url must not be percent-encoded", "")
+		return
+	}
+	if escapedApiPath == "" {
+		escapedApiPath = "/"
+	}
+
+	s.Forward(w, r, string(target), escapedApiPath)
+}
+
+// Forward sends the request to privateApiUrl+escapedApiPath through the
+// transport and writes the upstream response. The path is passed in its
+// escaped form so encoded characters reach the upstream unchanged.
+func (s *Server) Forward(w http.ResponseWriter, r *http.Request, privateApiUrl, escapedApiPath string) {
+	if tag := r.Header.Get(TagHeader); tag != "" {
+		tagged := &tagWriter{ResponseWriter: w}
+		w = tagged
+		defer func(started time.Time) {
+			s.stats.tagged(tag, tagged.status, time.Since(started))
+		}(time.Now())
+	}
+
+	apiPath, err := url.PathUnescape(escapedApiPath)
+	if err != nil {
+		s.WriteError(w, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("Failed to decode API path: %v", err), "")
+		return
+	}
+
+	// Read request body
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.WriteError(w, http.StatusRequestEntityTooLarge, ErrorCodePayloadTooLarge, fmt.Sprintf("Failed to read request body: %v", err), "")
+			return
+		}
+		s.WriteError(w, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("Failed to read request body: %v", err), "")
+		return
+	}
+	defer r.Body.Close()
+
+	// Convert headers to map[string][]string
+	requestHeader := r.Header.Clone()
+	ingress.RemoveHopByHopHeaders(requestHeader)
+	requestHeader.Del("Content-Length")
+	// net/http already answered "Expect: 100-continue" when the body was read,
+	// the buffered body is sent upstream in one piece
+	requestHeader.Del("Expect")
+	requestHeader.Del(LongRunningHeader)
+	requestHeader.Del(AsyncHeader)
+	requestHeader.Del(TagHeader)
+	// WebDAV COPY and MOVE name their destination by its URL on the proxy
+	if destination := requestHeader.Get("Destination"); destination != "" {
+		localPrefix := strings.TrimSuffix(r.URL.EscapedPath(), escapedApiPath)
+		requestHeader.Set("Destination", s.upstreamDestination(r, privateApiUrl, localPrefix, destination))
+	}
+	s.requestHeaders.Apply(requestHeader)
+	s.applyUserAgent(requestHeader)
+	headers := make(map[string][]string)
+	for key, values := range requestHeader {
+		headers[key] = values
+	}
+
+	// Encode body as base64 to handle binary data
+	bodyEncoded := encodeBody(bodyBytes)
+
+	// Prepare proxy request
+	proxyReq := ProxyRequest{
+		Method:        r.Method,
+		Path:          apiPath,
+		RawPath:       escapedApiPath,
+		Headers:       headers,
+		Body:          bodyEncoded,
+		Query:         r.URL.RawQuery,
+		PrivateApiUrl: privateApiUrl,
+		HostOverrides: s.targets.HostOverrides(privateApiUrl),
+		Timeouts:      s.upstreamTimeouts,
+	}
+
+	// Invoke Lambda function
+	// A client that hangs up cancels the context, which abandons the
+	// invocation
+	ctx := WithClient(r.Context(), r.RemoteAddr)
+	ctx = context.WithValue(ctx, serverStatsKey{}, &s.stats)
+	var trace *debugTrace
+	if s.debugDir != "" {
+		ctx, trace = withDebugTrace(ctx, s.debugRedactor)
+	}
+	started := time.Now()
+	if async, _ := strconv.ParseBool(r.Header.Get(AsyncHeader)); async {
+		if !s.fireAndForget {
+			s.WriteError(w, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("%s needs the proxy to run with -async-bucket", AsyncHeader), "")
+			return
+		}
+		ctx = WithFireAndForget(ctx)
+	}
+	if s.targets.Reliable(privateApiUrl) {
+		ctx = WithReliable(ctx)
+	}
+	stopKeepAlive := func() {}
+	if isLongRunning(r, s.targets, privateApiUrl) {
+		ctx = WithLongRunning(ctx)
+		stopKeepAlive = keepAlive(w)
+	} else if s.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancel()
+	}
+	lambdaResp, err := s.RoundTrip(ctx, &proxyReq)
+	stopKeepAlive()
+	var requestID string
+	if trace != nil {
+		requestID = s.writeDebugFile(r, privateApiUrl, trace, started, lambdaResp, err)
+	}
+	// The Lambda may still answer, e.g. with the upstream error of the
+	// cancelled call, but nobody reads it
+	if r.Context().Err() != nil {
+		log.Printf("Client disconnected, abandoned %s %s", r.Method, apiPath)
+		return
+	}
+	if err != nil {
+		log.Printf("Lambda invocation error: %v", err)
+		status, code, invokeRequestID := classifyInvokeError(err)
+		s.WriteError(w, status, code, fmt.Sprintf("Lambda invocation failed: %v", err), cmp.Or(requestID, invokeRequestID))
+		return
+	}
+	if requestID != "" {
+		w.Header().Set(RequestIDHeader, requestID)
+	}
+
+	if s.rewriteLinks {
+		lambdaResp = s.rewriteResponseLinks(r, &proxyReq, lambdaResp)
+	}
+
+	s.writeResponse(w, r, lambdaResp)
+}
+
+// RoundTrip runs the request hooks, sends the envelope through the transport
+// and runs the response hooks
+func (s *Server) RoundTrip(ctx context.Context, request *ProxyRequest) (*ProxyResponse, error) {
+	for _, hook := range s.requestHooks {
+		response, err := hook(ctx, request)
+		if err != nil {
+			return nil, fmt.Errorf("run request hook: %w", err)
+		}
+		if response != nil {
+			return response, nil
+		}
+	}
+
+	response, err := s.transport.Invoke(ctx, *request)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateResponse(response); err != nil {
+		return nil, err
+	}
+
+	for _, hook := range s.responseHooks {
+		if err := hook(ctx, request, response); err != nil {
+			return nil, fmt.Errorf("run response hook: %w", err)
+		}
+	}
+
+	return response, nil
+}
+
+// writeResponse writes a proxied response to the local client
+func (s *Server) writeResponse(w http.ResponseWriter, r *http.Request, lambdaResp *ProxyResponse) {
+	// Set response headers
+	for key, values := range lambdaResp.Headers {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	ingress.RemoveHopByHopHeaders(w.Header())
+	s.responseHeaders.Apply(w.Header())
+	if timing := lambdaResp.Timing; timing != nil {
+		w.Header().Add("Server-Timing", fmt.Sprintf("upstream;dur=%d, connect;dur=%d;desc=\"attempts=%d\"", timing.UpstreamMs, timing.ConnectMs, timing.Attempts))
+	}
+
+	// Decode base64 response body
+	responseBody, err := base64.StdEncoding.DecodeString(lambdaResp.Body)
+	if err != nil {
+		log.Printf("Failed to decode base64 response: %v", err)
+		responseBody = []byte(lambdaResp.Body)
+	}
+
+	// Content-Length must describe the decoded body. HEAD responses keep the
+	// upstream value, 1xx/204/304 responses carry neither body nor length.
+	// Trailers need a chunked response, so no length is set when there are any.
+	writeBody := ingress.BodyAllowed(r.Method, lambdaResp.StatusCode)
+	if writeBody && len(lambdaResp.Trailers) == 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
+	} else if r.Method != http.MethodHead {
+		w.Header().Del("Content-Length")
+	}
+
+	// Write status code
+	w.WriteHeader(lambdaResp.StatusCode)
+	s.stats.response(lambdaResp.StatusCode)
+
+	if writeBody {
+		if s.throttle > 0 {
+			err = writeThrottled(r.Context(), w, responseBody, s.throttle)
+		} else {
+			_, err = w.Write(responseBody)
+		}
+		if err != nil {
+			log.Printf("Failed to write response: %v", err)
+		}
+
+		if len(lambdaResp.Trailers) > 0 {
+			// Flushing commits to a chunked response, which is required for
+			// trailers announced through http.TrailerPrefix
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				log.Printf("Failed to flush response before trailers: %v", err)
+			}
+			trailers := http.Header(lambdaResp.Trailers).Clone()
+			s.responseHeaders.Apply(trailers)
+			for key, values := range trailers {
+				for _, value := range values {
+					w.Header().Add(http.TrailerPrefix+key, value)
+				}
+			}
+		}
+	}
+
+	if s.verbose {
+		if timing := lambdaResp.Timing; timing != nil {
+			connection := "new connection"
+			if timing.Reused {
+				connection = "reused connection"
+			}
+			if timing.Protocol != "" {
+				connection += " over " + timing.Protocol
+			}
+			log.Printf("Response to %s %s: %d (upstream %dms, connect %dms, %d attempts, %s)", r.Method, r.URL.Path, lambdaResp.StatusCode, timing.UpstreamMs, timing.ConnectMs, timing.Attempts, connection)
+		} else {
+			log.Printf("Response to %s %s: %d", r.Method, r.URL.Path, lambdaResp.StatusCode)
+		}
+	}
+}
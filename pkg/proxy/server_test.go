@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// staticTransport answers every request with a copy of response
+func staticTransport(response ProxyResponse) Transport {
+	return TransportFunc(func(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+		copied := response
+		copied.Headers = http.Header(response.Headers).Clone()
+		return &copied, nil
+	})
+}
+
+// The bodyless cases are covered end to end by TestRoundTripNoBody
+func TestForwardStaleContentLength(t *testing.T) {
+	server := NewServer(staticTransport(ProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string][]string{"Content-Length": {"999"}, "Transfer-Encoding": {"chunked"}},
+		Body:       encodeBody([]byte("hello")),
+	}), nil, false)
+	recorder := httptest.NewRecorder()
+
+	server.Forward(recorder, httptest.NewRequest(http.MethodGet, "/", nil), "http://upstream.internal", "/")
+
+	if got := recorder.Header().Get("Content-Length"); got != "5" {
+		t.Errorf("Content-Length = %q, want the re-encoded body's 5", got)
+	}
+	if got := recorder.Header().Get("Transfer-Encoding"); got != "" {
+		t.Errorf("Transfer-Encoding = %q, want it removed", got)
+	}
+	if got := recorder.Body.String(); got != "hello" {
+		t.Errorf("body = %q, want %q", got, "hello")
+	}
+}
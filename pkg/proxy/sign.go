@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/jkblume/awsctl/pkg/ingress"
+)
+
+// SigningTransport timestamps every envelope and signs it with a KMS HMAC
+// key. An ingress Lambda configured with the same key rejects envelopes that
+// were altered, are unsigned or are older than ingress.SignatureMaxSkew, so
+// other principals with invoke access can replay captured payloads only
+// within that window.
+type SigningTransport struct {
+	next   Transport
+	client *kms.Client
+	keyID  string
+}
+
+func NewSigningTransport(ctx context.Context, next Transport, keyID, region, profile string) (*SigningTransport, error) {
+	awsCfg, err := LoadAWSConfig(ctx, region, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningTransport{next: next, client: kms.NewFromConfig(awsCfg), keyID: keyID}, nil
+}
+
+func (t *SigningTransport) String() string {
+	return fmt.Sprintf("%s (signed with %s)", DescribeTransport(t.next), t.keyID)
+}
+
+// signerKey carries the SigningTransport that signed a request to the
+// transports it passes the request on to
+type signerKey struct{}
+
+func (t *SigningTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	if err := t.Sign(ctx, &request); err != nil {
+		return nil, err
+	}
+	return t.next.Invoke(context.WithValue(ctx, signerKey{}, t), request)
+}
+
+// Sign timestamps and signs request without sending it, e.g. for the
+// sub-requests of a batch envelope. The signature covers the deadline, so
+// it is stamped here already.
+func (t *SigningTransport) Sign(ctx context.Context, request *ProxyRequest) error {
+	*request = stampDeadline(ctx, *request)
+	request.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	request.Signature = ""
+
+	out, err := t.client.GenerateMac(ctx, &kms.GenerateMacInput{
+		KeyId:        &t.keyID,
+		Message:      ingress.SigningDigest(*request),
+		MacAlgorithm: kmstypes.MacAlgorithmSpecHmacSha256,
+	})
+	if err != nil {
+		return fmt.Errorf("sign envelope: %w", err)
+	}
+	request.Signature = base64.StdEncoding.EncodeToString(out.Mac)
+	return nil
+}
+
+// resign signs request again for transports that change a signed request,
+// e.g. give it a ResponseKey. Unsigned requests are left unsigned.
+func resign(ctx context.Context, request *ProxyRequest) error {
+	signer, ok := ctx.Value(signerKey{}).(*SigningTransport)
+	if !ok {
+		return nil
+	}
+	return signer.Sign(ctx, request)
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// DefaultSigV4Service is the service requests are signed for unless the
+// target names another, API Gateway's
+const DefaultSigV4Service = "execute-api"
+
+// sigV4Headers are the headers SigV4 signing sets
+var sigV4Headers = []string{"Authorization", "X-Amz-Date", "X-Amz-Security-Token"}
+
+// sigV4Unsigned are left out of the signature because the Lambda may change
+// them on the way upstream
+var sigV4Unsigned = []string{"X-Forwarded-User"}
+
+// SigV4Config asks for requests to a target to be signed with the
+// developer's own AWS credentials, e.g. for API Gateway IAM authorization
+type SigV4Config struct {
+	// Service defaults to DefaultSigV4Service, e.g. lambda for function URLs
+	// or es for OpenSearch
+	Service string `json:"service,omitempty"`
+	// Region defaults to the session's region
+	Region string `json:"region,omitempty"`
+}
+
+// SigV4Transport signs requests to targets with "sigv4" for the upstream API
+// with the session's AWS credentials. The Lambda forwards the signed headers
+// untouched, so the API authorizes the developer instead of the Lambda's
+// role. It must wrap transports that change the envelope's body, like
+// encryption, so the signature covers the plain body.
+type SigV4Transport struct {
+	next        Transport
+	targets     *Targets
+	credentials aws.CredentialsProvider
+	signer      *v4.Signer
+	region      string
+}
+
+func NewSigV4Transport(ctx context.Context, next Transport, targets *Targets, region, profile string) (*SigV4Transport, error) {
+	awsCfg, err := LoadAWSConfig(ctx, region, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &SigV4Transport{
+		next:        next,
+		targets:     targets,
+		credentials: awsCfg.Credentials,
+		signer:      v4.NewSigner(),
+		region:      awsCfg.Region,
+	}, nil
+}
+
+func (t *SigV4Transport) String() string {
+	return fmt.Sprintf("%s (SigV4-signing requests to IAM-auth targets)", DescribeTransport(t.next))
+}
+
+func (t *SigV4Transport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	config := t.targets.SigV4(request.PrivateApiUrl)
+	if config == nil {
+		return t.next.Invoke(ctx, request)
+	}
+	signed, err := t.sign(ctx, request, *config)
+	if err != nil {
+		return nil, err
+	}
+	return t.next.Invoke(ctx, signed)
+}
+
+// sign returns request with the SigV4 headers for the upstream call the
+// Lambda will make
+func (t *SigV4Transport) sign(ctx context.Context, request ProxyRequest, config SigV4Config) (ProxyRequest, error) {
+	service, region := config.Service, config.Region
+	if service == "" {
+		service = DefaultSigV4Service
+	}
+	if region == "" {
+		region = t.region
+	}
+
+	body, err := base64.StdEncoding.DecodeString(request.Body)
+	if err != nil {
+		return ProxyRequest{}, fmt.Errorf("decode body: %w", err)
+	}
+	path := request.RawPath
+	if path == "" {
+		path = request.Path
+	}
+	upstreamURL, err := url.Parse(strings.TrimSuffix(request.PrivateApiUrl, "/") + path)
+	if err != nil {
+		return ProxyRequest{}, fmt.Errorf("parse upstream URL: %w", err)
+	}
+	upstreamURL.RawQuery = request.Query
+
+	req, err := http.NewRequestWithContext(ctx, request.Method, upstreamURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return ProxyRequest{}, fmt.Errorf("create request to sign: %w", err)
+	}
+	req.Header = http.Header(request.Headers).Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	for _, name := range sigV4Headers {
+		req.Header.Del(name)
+	}
+	for _, name := range sigV4Unsigned {
+		req.Header.Del(name)
+	}
+	req.Header.Del("Host")
+
+	credentials, err := t.credentials.Retrieve(ctx)
+	if err != nil {
+		return ProxyRequest{}, fmt.Errorf("retrieve AWS credentials: %w", err)
+	}
+	payloadHash := sha256.Sum256(body)
+	if err := t.signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(payloadHash[:]), service, region, time.Now()); err != nil {
+		return ProxyRequest{}, fmt.Errorf("sign request: %w", err)
+	}
+
+	headers := http.Header(request.Headers).Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	for _, name := range sigV4Headers {
+		headers.Del(name)
+		if value := req.Header.Get(name); value != "" {
+			headers.Set(name, value)
+		}
+	}
+	request.Headers = headers
+	return request, nil
+}
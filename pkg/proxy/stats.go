@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TagHeader attributes a request to a feature or flow, e.g. checkout-flow.
+// The server aggregates statistics per tag and doesn't forward the header.
+const TagHeader = "X-Awsctl-Tag"
+
+// maxTags bounds the tags a server keeps statistics for, later ones are
+// counted as OtherTag
+const maxTags = 100
+
+// OtherTag collects the requests of tags beyond the first 100
+const OtherTag = "(other)"
+
+// ServerStats counts what a server answered since it started, for status
+// reports
+type ServerStats struct {
+	// Responses counts upstream responses by status class, e.g. 2xx
+	Responses map[string]int64 `json:"responses"`
+	// Errors counts the errors the proxy answered itself by error code,
+	// e.g. invoke-failed
+	Errors      map[string]int64 `json:"errors"`
+	LastError   string           `json:"lastError,omitempty"`
+	LastErrorAt time.Time        `json:"lastErrorAt,omitzero"`
+	// LambdaVersion is the function version that ran the last invocation,
+	// e.g. $LATEST or 7
+	LambdaVersion string `json:"lambdaVersion,omitempty"`
+	// Tags has the statistics of requests carrying TagHeader by tag
+	Tags map[string]TagStats `json:"tags,omitempty"`
+}
+
+// TagStats aggregates the requests of a tag. Errors are responses with a
+// status of 500 and above, including those the proxy answered itself, and
+// requests the client abandoned.
+type TagStats struct {
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	ErrorRate    float64 `json:"errorRate"`
+	AvgLatencyMs int64   `json:"avgLatencyMs"`
+	MaxLatencyMs int64   `json:"maxLatencyMs"`
+	// totalLatency is the sum AvgLatencyMs is computed from
+	totalLatency time.Duration
+}
+
+// serverStats guards the ServerStats of a server
+type serverStats struct {
+	mu    sync.Mutex
+	stats ServerStats
+}
+
+// serverStatsKey carries the *serverStats of the server handling a request,
+// so the base transport can report the Lambda version
+type serverStatsKey struct{}
+
+func (s *serverStats) response(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats.Responses == nil {
+		s.stats.Responses = map[string]int64{}
+	}
+	s.stats.Responses[fmt.Sprintf("%dxx", status/100)]++
+}
+
+func (s *serverStats) error(code, detail string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats.Errors == nil {
+		s.stats.Errors = map[string]int64{}
+	}
+	s.stats.Errors[code]++
+	s.stats.LastError = detail
+	s.stats.LastErrorAt = time.Now().UTC()
+}
+
+// tagged records a completed request of tag. Status is 0 if no response was
+// written.
+func (s *serverStats) tagged(tag string, status int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats.Tags == nil {
+		s.stats.Tags = map[string]TagStats{}
+	}
+	if _, ok := s.stats.Tags[tag]; !ok && len(s.stats.Tags) >= maxTags {
+		tag = OtherTag
+	}
+	stats := s.stats.Tags[tag]
+	stats.Requests++
+	if status == 0 || status >= http.StatusInternalServerError {
+		stats.Errors++
+	}
+	stats.ErrorRate = float64(stats.Errors) / float64(stats.Requests)
+	stats.totalLatency += latency
+	stats.AvgLatencyMs = (stats.totalLatency / time.Duration(stats.Requests)).Milliseconds()
+	stats.MaxLatencyMs = max(stats.MaxLatencyMs, latency.Milliseconds())
+	s.stats.Tags[tag] = stats
+}
+
+// tagWriter remembers the status of a tagged request
+type tagWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *tagWriter) WriteHeader(statusCode int) {
+	if w.status == 0 && statusCode >= 200 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *tagWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *tagWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// recordLambdaVersion stores the version that ran an invocation in the stats
+// of the server handling ctx's request, if any
+func recordLambdaVersion(ctx context.Context, version string) {
+	s, _ := ctx.Value(serverStatsKey{}).(*serverStats)
+	if s == nil || version == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.LambdaVersion = version
+}
+
+// Stats returns a copy of the server's counters
+func (s *Server) Stats() ServerStats {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	stats := s.stats.stats
+	stats.Responses = maps.Clone(stats.Responses)
+	stats.Errors = maps.Clone(stats.Errors)
+	stats.Tags = maps.Clone(stats.Tags)
+	if stats.Responses == nil {
+		stats.Responses = map[string]int64{}
+	}
+	if stats.Errors == nil {
+		stats.Errors = map[string]int64{}
+	}
+	return stats
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+)
+
+// stepFunctionsTimeout bounds the wait for an execution. Standard executions
+// may run for a year, a client won't wait that long.
+const stepFunctionsTimeout = time.Hour
+
+// StepFunctionsTransport runs long-running requests as executions of a
+// Standard state machine invoking the ingress Lambda, see the Terraform
+// module's enable_step_functions. The execution retries failed invocations,
+// survives the local connection and shows up in the Step Functions console.
+// The output of an execution is limited to 256 KB, larger responses need a
+// bucket the Lambda stores them in. Other requests are passed on to next.
+type StepFunctionsTransport struct {
+	next         Transport
+	client       *sfn.Client
+	stateMachine string
+	responses    *responseStore
+	verbose      bool
+}
+
+// NewStepFunctionsTransport starts executions of stateMachine. With a bucket,
+// the Lambda's ASYNC_RESPONSE_BUCKET, responses are collected from S3 instead
+// of the execution output.
+func NewStepFunctionsTransport(ctx context.Context, next Transport, stateMachine, bucket, region, profile string, verbose bool) (*StepFunctionsTransport, error) {
+	awsCfg, err := LoadAWSConfig(ctx, region, profile)
+	if err != nil {
+		return nil, err
+	}
+	t := &StepFunctionsTransport{next: next, client: sfn.NewFromConfig(awsCfg), stateMachine: stateMachine, verbose: verbose}
+	if bucket != "" {
+		t.responses = &responseStore{client: s3.NewFromConfig(awsCfg), bucket: bucket}
+	}
+	return t, nil
+}
+
+func (t *StepFunctionsTransport) String() string {
+	return fmt.Sprintf("%s (long-running requests via state machine %s)", DescribeTransport(t.next), t.stateMachine)
+}
+
+func (t *StepFunctionsTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	if !IsLongRunning(ctx) {
+		return t.next.Invoke(ctx, request)
+	}
+
+	responseKey, err := newResponseKey()
+	if err != nil {
+		return nil, err
+	}
+	if t.responses != nil {
+		request.ResponseKey = responseKey
+	}
+	if err := resign(ctx, &request); err != nil {
+		return nil, err
+	}
+	input, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	out, err := t.client.StartExecution(ctx, &sfn.StartExecutionInput{
+		StateMachineArn: &t.stateMachine,
+		Name:            aws.String("awsctl-" + responseKey),
+		Input:           aws.String(string(input)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("start execution: %w", err)
+	}
+	if t.verbose {
+		log.Printf("Started execution %s for %s %s", *out.ExecutionArn, request.Method, request.Path)
+	}
+
+	execution, err := t.wait(ctx, *out.ExecutionArn)
+	if err != nil {
+		return nil, err
+	}
+	if execution.Status != sfntypes.ExecutionStatusSucceeded {
+		return nil, fmt.Errorf("failed to run execution %s: %s: %s: %s", *out.ExecutionArn, execution.Status, aws.ToString(execution.Error), aws.ToString(execution.Cause))
+	}
+
+	if t.responses != nil {
+		response, err := t.responses.collect(ctx, responseKey)
+		if err != nil {
+			return nil, err
+		}
+		if response == nil {
+			return nil, fmt.Errorf("failed to collect response of execution %s: nothing stored in s3://%s", *out.ExecutionArn, t.responses.bucket)
+		}
+		return response, nil
+	}
+	var response ProxyResponse
+	if err := json.Unmarshal([]byte(aws.ToString(execution.Output)), &response); err != nil {
+		return nil, fmt.Errorf("unmarshal execution output: %w", err)
+	}
+	return &response, nil
+}
+
+// wait polls the execution until it has finished. An execution whose client
+// gives up is stopped.
+func (t *StepFunctionsTransport) wait(ctx context.Context, executionArn string) (*sfn.DescribeExecutionOutput, error) {
+	ctx, cancel := context.WithTimeout(ctx, stepFunctionsTimeout)
+	defer cancel()
+	for pause := time.Second; ; pause = min(2*pause, asyncMaxPoll) {
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			stopCtx, stopCancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+			defer stopCancel()
+			if _, err := t.client.StopExecution(stopCtx, &sfn.StopExecutionInput{
+				ExecutionArn: &executionArn,
+				Error:        aws.String("awsctl.ClientGone"),
+				Cause:        aws.String(ctx.Err().Error()),
+			}); err != nil {
+				log.Printf("Failed to stop execution %s: %v", executionArn, err)
+			}
+			return nil, fmt.Errorf("wait for execution %s: %w", executionArn, ctx.Err())
+		}
+
+		execution, err := t.client.DescribeExecution(ctx, &sfn.DescribeExecutionInput{ExecutionArn: &executionArn})
+		if err != nil {
+			return nil, fmt.Errorf("describe execution: %w", err)
+		}
+		if execution.Status != sfntypes.ExecutionStatusRunning && execution.Status != sfntypes.ExecutionStatusPendingRedrive {
+			return execution, nil
+		}
+	}
+}
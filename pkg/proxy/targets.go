@@ -0,0 +1,504 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TargetHeader selects the target by alias or URL instead of the request path
+const TargetHeader = "X-Awsctl-Target"
+
+// Target is a private API reachable under an alias
+type Target struct {
+	// URL defaults to the first upstream's if the target has upstreams
+	URL string `json:"url"`
+	// Upstreams spreads requests over several private URLs by weight
+	Upstreams []Upstream `json:"upstreams,omitempty"`
+	// Sticky pins client sessions to one of the upstreams
+	Sticky *StickyConfig `json:"sticky,omitempty"`
+	// Hosts maps host names to the IP addresses the Lambda connects to
+	// instead of resolving them, e.g. for APIs in peered VPCs
+	Hosts map[string]string `json:"hosts,omitempty"`
+	// Pagination is PaginationLink or PaginationNextToken to prefetch the
+	// next page of GET responses
+	Pagination string `json:"pagination,omitempty"`
+	// LongRunning invokes requests asynchronously with -async-bucket and
+	// keeps the client waiting with 102 Processing
+	LongRunning bool `json:"longRunning,omitempty"`
+	// Reliable enqueues requests to -reliable-queue instead of invoking the
+	// Lambda, clients get 202 right away
+	Reliable bool `json:"reliable,omitempty"`
+	// Auth is AuthBasic, AuthBearer or AuthOAuth2 to send credentials
+	// stored with awsctl creds set as Authorization header
+	Auth   string        `json:"auth,omitempty"`
+	OAuth2 *OAuth2Config `json:"oauth2,omitempty"`
+	// SigV4 signs requests with the developer's AWS credentials for APIs
+	// with IAM authorization
+	SigV4 *SigV4Config `json:"sigv4,omitempty"`
+	// OpenAPI is the path of an OpenAPI document requests and responses are
+	// validated against, relative to the targets file
+	OpenAPI string `json:"openapi,omitempty"`
+	// Chaos injects latency and errors into requests to the target instead
+	// of the -inject-* flags
+	Chaos *ChaosConfig `json:"chaos,omitempty"`
+	// Mirror sends a share of requests to a second URL as well and logs
+	// differences in the responses
+	Mirror *MirrorConfig `json:"mirror,omitempty"`
+	// Function is the ingress Lambda serving the target instead of
+	// -function, a name, name:alias or ARN, e.g. for an API in another VPC
+	Function string `json:"function,omitempty"`
+}
+
+// serves reports whether privateApiUrl is the URL of t or of one of its
+// upstreams
+func (t Target) serves(privateApiUrl string) bool {
+	privateApiUrl = strings.TrimSuffix(privateApiUrl, "/")
+	if strings.TrimSuffix(t.URL, "/") == privateApiUrl {
+		return true
+	}
+	for _, u := range t.Upstreams {
+		if strings.TrimSuffix(u.URL, "/") == privateApiUrl {
+			return true
+		}
+	}
+	return false
+}
+
+// Targets is the targets file, by default ~/.awsctl/targets.json
+type Targets struct {
+	Targets map[string]Target `json:"targets"`
+
+	// resolvers resolve aliases the file doesn't have, see AddResolver
+	resolvers *resolverChain
+}
+
+// StateDir returns the directory holding awsctl state, usually ~/.awsctl
+func StateDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("find home directory: %w", err)
+	}
+	return filepath.Join(home, ".awsctl"), nil
+}
+
+// DefaultTargetsPath returns ~/.awsctl/targets.json
+func DefaultTargetsPath() (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "targets.json"), nil
+}
+
+// LoadTargets reads the targets file. A missing file at the default location
+// yields an empty config, a missing explicit file is an error.
+func LoadTargets(path string) (*Targets, error) {
+	explicit := path != ""
+	if !explicit {
+		var err error
+		path, err = DefaultTargetsPath()
+		if err != nil {
+			return nil, fmt.Errorf("locate targets file: %w", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return &Targets{Targets: map[string]Target{}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read targets file: %w", err)
+	}
+
+	var config Targets
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parse targets file %s: %w", path, err)
+	}
+	if config.Targets == nil {
+		config.Targets = map[string]Target{}
+	}
+
+	for alias, t := range config.Targets {
+		if len(t.Upstreams) > 0 {
+			if err := validateUpstreams(t.Upstreams); err != nil {
+				return nil, fmt.Errorf("failed to load target %s: %w", alias, err)
+			}
+			if t.URL == "" {
+				t.URL = t.Upstreams[0].URL
+				config.Targets[alias] = t
+			}
+		}
+		if t.URL == "" {
+			return nil, fmt.Errorf("failed to load target %s: missing url", alias)
+		}
+		if t.Sticky != nil {
+			if len(t.Upstreams) == 0 {
+				return nil, fmt.Errorf("failed to load target %s: sticky needs upstreams", alias)
+			}
+			if err := t.Sticky.validate(); err != nil {
+				return nil, fmt.Errorf("failed to load target %s: %w", alias, err)
+			}
+		}
+		for host, ip := range t.Hosts {
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("failed to load target %s: host %s maps to %q, which is not an IP address", alias, host, ip)
+			}
+		}
+		if t.Pagination != "" && t.Pagination != PaginationLink && t.Pagination != PaginationNextToken {
+			return nil, fmt.Errorf("failed to load target %s: unknown pagination %q, expected %s or %s", alias, t.Pagination, PaginationLink, PaginationNextToken)
+		}
+		switch t.Auth {
+		case "", AuthBasic, AuthBearer:
+		case AuthOAuth2:
+			if t.OAuth2 == nil || t.OAuth2.TokenURL == "" || t.OAuth2.ClientID == "" {
+				return nil, fmt.Errorf("failed to load target %s: auth %s needs oauth2.tokenUrl and oauth2.clientId", alias, AuthOAuth2)
+			}
+			if u, err := url.Parse(t.OAuth2.TokenURL); err != nil || u.Host == "" {
+				return nil, fmt.Errorf("failed to load target %s: invalid oauth2.tokenUrl %q", alias, t.OAuth2.TokenURL)
+			}
+		default:
+			return nil, fmt.Errorf("failed to load target %s: unknown auth %q, expected %s, %s or %s", alias, t.Auth, AuthBasic, AuthBearer, AuthOAuth2)
+		}
+		if t.Auth != "" && t.SigV4 != nil {
+			return nil, fmt.Errorf("failed to load target %s: auth and sigv4 both set the Authorization header", alias)
+		}
+		if t.Chaos != nil {
+			if err := t.Chaos.validate(); err != nil {
+				return nil, fmt.Errorf("failed to load target %s: %w", alias, err)
+			}
+		}
+		if t.Mirror != nil {
+			if err := t.Mirror.validate(); err != nil {
+				return nil, fmt.Errorf("failed to load target %s: %w", alias, err)
+			}
+		}
+		if t.OpenAPI != "" && !filepath.IsAbs(t.OpenAPI) {
+			t.OpenAPI = filepath.Join(filepath.Dir(path), t.OpenAPI)
+			config.Targets[alias] = t
+		}
+	}
+
+	return &config, nil
+}
+
+// AddTargets adds targets under their aliases to the targets file at path,
+// or the default one, creating it if needed. Existing targets are kept as
+// they are in the file, an alias that already exists is an error.
+func AddTargets(path string, targets map[string]Target) error {
+	if path == "" {
+		var err error
+		path, err = DefaultTargetsPath()
+		if err != nil {
+			return fmt.Errorf("locate targets file: %w", err)
+		}
+	}
+
+	file := map[string]json.RawMessage{}
+	existing := map[string]json.RawMessage{}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read targets file: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("parse targets file %s: %w", path, err)
+		}
+		if raw, ok := file["targets"]; ok {
+			if err := json.Unmarshal(raw, &existing); err != nil {
+				return fmt.Errorf("parse targets file %s: %w", path, err)
+			}
+		}
+	}
+
+	for alias, target := range targets {
+		if _, ok := existing[alias]; ok {
+			return fmt.Errorf("failed to add target %s: the alias exists in %s", alias, path)
+		}
+		raw, err := json.Marshal(target)
+		if err != nil {
+			return fmt.Errorf("marshal target %s: %w", alias, err)
+		}
+		existing[alias] = raw
+	}
+	raw, err := json.Marshal(existing)
+	if err != nil {
+		return fmt.Errorf("marshal targets: %w", err)
+	}
+	file["targets"] = raw
+	data, err = json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal targets file: %w", err)
+	}
+
+	// Write to a temporary file first so a running proxy never reads a
+	// partial file
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create targets directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("write targets file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replace targets file: %w", err)
+	}
+	return nil
+}
+
+// validateUpstreams checks the upstreams of a target
+func validateUpstreams(upstreams []Upstream) error {
+	total := 0
+	for _, u := range upstreams {
+		if parsed, err := url.Parse(u.URL); err != nil || parsed.Host == "" {
+			return fmt.Errorf("failed to use upstream: invalid url %q", u.URL)
+		}
+		if u.Weight < 0 {
+			return fmt.Errorf("failed to use upstream %s: negative weight", u.URL)
+		}
+		total += u.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("failed to use upstreams: all weights are 0")
+	}
+	return nil
+}
+
+// Resolve turns an alias or URL into the private API URL, asking the
+// resolvers for aliases missing from the targets file
+func (c *Targets) Resolve(aliasOrURL string) (string, error) {
+	if strings.Contains(aliasOrURL, "://") {
+		return aliasOrURL, nil
+	}
+	if t, ok := c.Targets[aliasOrURL]; ok {
+		return t.URL, nil
+	}
+	if c.resolvers != nil {
+		resolved, err := c.resolvers.resolve(context.Background(), aliasOrURL)
+		if err != nil {
+			return "", err
+		}
+		if resolved != nil {
+			return resolved.URL, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find target alias %q", aliasOrURL)
+}
+
+// Alias returns the alias of the target with URL privateApiUrl, from the
+// targets file or a resolver, "" if it has none
+func (c *Targets) Alias(privateApiUrl string) string {
+	for alias, t := range c.Targets {
+		if t.serves(privateApiUrl) {
+			return alias
+		}
+	}
+	if c.resolvers != nil {
+		if alias, ok := c.resolvers.aliasOf(privateApiUrl); ok {
+			return alias
+		}
+	}
+	return ""
+}
+
+// LongRunning reports whether the target with URL privateApiUrl is marked
+// as long-running
+func (c *Targets) LongRunning(privateApiUrl string) bool {
+	for _, t := range c.Targets {
+		if t.serves(privateApiUrl) {
+			return t.LongRunning
+		}
+	}
+	return false
+}
+
+// Reliable reports whether the target with URL privateApiUrl is marked as
+// reliable
+func (c *Targets) Reliable(privateApiUrl string) bool {
+	for _, t := range c.Targets {
+		if t.serves(privateApiUrl) {
+			return t.Reliable
+		}
+	}
+	return false
+}
+
+// Auth returns the alias and auth scheme of the target with URL
+// privateApiUrl, an empty scheme if it has none
+func (c *Targets) Auth(privateApiUrl string) (alias, scheme string) {
+	for alias, t := range c.Targets {
+		if t.Auth != "" && t.serves(privateApiUrl) {
+			return alias, t.Auth
+		}
+	}
+	return "", ""
+}
+
+// SigV4 returns the SigV4 signing config of the target with URL
+// privateApiUrl, nil if its requests aren't signed
+func (c *Targets) SigV4(privateApiUrl string) *SigV4Config {
+	for _, t := range c.Targets {
+		if t.SigV4 != nil && t.serves(privateApiUrl) {
+			return t.SigV4
+		}
+	}
+	return nil
+}
+
+// HasSigV4 reports whether any target has its requests SigV4-signed
+func (c *Targets) HasSigV4() bool {
+	for _, t := range c.Targets {
+		if t.SigV4 != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// HasOpenAPI reports whether any target has an OpenAPI document
+func (c *Targets) HasOpenAPI() bool {
+	for _, t := range c.Targets {
+		if t.OpenAPI != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Chaos returns the chaos config of the target with URL privateApiUrl, nil
+// if it has none
+func (c *Targets) Chaos(privateApiUrl string) *ChaosConfig {
+	for _, t := range c.Targets {
+		if t.Chaos != nil && t.serves(privateApiUrl) {
+			return t.Chaos
+		}
+	}
+	return nil
+}
+
+// HasChaos reports whether any target has a chaos config
+func (c *Targets) HasChaos() bool {
+	for _, t := range c.Targets {
+		if t.Chaos != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Mirror returns the mirror config of the target with URL privateApiUrl, nil
+// if it has none
+func (c *Targets) Mirror(privateApiUrl string) *MirrorConfig {
+	for _, t := range c.Targets {
+		if t.Mirror != nil && t.serves(privateApiUrl) {
+			return t.Mirror
+		}
+	}
+	return nil
+}
+
+// HasMirror reports whether any target has a mirror
+func (c *Targets) HasMirror() bool {
+	for _, t := range c.Targets {
+		if t.Mirror != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Function returns the ingress Lambda serving the target with URL
+// privateApiUrl, empty for the session's
+func (c *Targets) Function(privateApiUrl string) string {
+	for _, t := range c.Targets {
+		if t.Function != "" && t.serves(privateApiUrl) {
+			return t.Function
+		}
+	}
+	return ""
+}
+
+// Functions returns the distinct ingress Lambdas of targets with "function"
+func (c *Targets) Functions() []string {
+	seen := map[string]bool{}
+	var functions []string
+	for _, t := range c.Targets {
+		if t.Function != "" && !seen[t.Function] {
+			seen[t.Function] = true
+			functions = append(functions, t.Function)
+		}
+	}
+	sort.Strings(functions)
+	return functions
+}
+
+// Upstreams returns the upstreams of the target with URL privateApiUrl, none
+// if it has a single URL
+func (c *Targets) Upstreams(privateApiUrl string) []Upstream {
+	for _, t := range c.Targets {
+		if len(t.Upstreams) > 0 && t.serves(privateApiUrl) {
+			return t.Upstreams
+		}
+	}
+	return nil
+}
+
+// Sticky returns the sticky session config of the target with URL
+// privateApiUrl, nil if it has none
+func (c *Targets) Sticky(privateApiUrl string) *StickyConfig {
+	for _, t := range c.Targets {
+		if t.Sticky != nil && t.serves(privateApiUrl) {
+			return t.Sticky
+		}
+	}
+	return nil
+}
+
+// HasUpstreams reports whether any target has several upstreams
+func (c *Targets) HasUpstreams() bool {
+	for _, t := range c.Targets {
+		if len(t.Upstreams) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Pagination returns the pagination style of the target with URL
+// privateApiUrl, empty if it has none
+func (c *Targets) Pagination(privateApiUrl string) string {
+	for _, t := range c.Targets {
+		if t.serves(privateApiUrl) {
+			return t.Pagination
+		}
+	}
+	return ""
+}
+
+// Paginated reports whether any target declares a pagination style
+func (c *Targets) Paginated() bool {
+	for _, t := range c.Targets {
+		if t.Pagination != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// HostOverrides returns the host to IP overrides of the target with URL
+// privateApiUrl, also when it was given as URL instead of alias
+func (c *Targets) HostOverrides(privateApiUrl string) map[string]string {
+	for _, t := range c.Targets {
+		if len(t.Hosts) > 0 && t.serves(privateApiUrl) {
+			return t.Hosts
+		}
+	}
+	return nil
+}
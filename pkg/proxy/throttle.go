@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// throttleInterval is how often a throttled response is flushed to the client
+const throttleInterval = 100 * time.Millisecond
+
+// bandwidthPrefixes are the decimal prefixes of ParseBandwidth
+var bandwidthPrefixes = map[string]float64{"": 1, "k": 1e3, "m": 1e6, "g": 1e9}
+
+// ParseBandwidth parses a rate in bits like 1Mbps, 512kbps or 10Mb/s, or in
+// bytes like 2MB/s or 2MBps, into bytes per second. Prefixes are decimal.
+func ParseBandwidth(rate string) (int64, error) {
+	var number, prefix string
+	var bitsPerUnit float64
+	rate = strings.TrimSpace(rate)
+	// A capital B counts bytes, as in MB/s or MBps
+	switch lower := strings.ToLower(rate); {
+	case strings.HasSuffix(rate, "B/s"), strings.HasSuffix(rate, "Bps"):
+		number, bitsPerUnit = lower[:len(lower)-3], 8
+	case strings.HasSuffix(lower, "b/s"), strings.HasSuffix(lower, "bps"):
+		number, bitsPerUnit = lower[:len(lower)-3], 1
+	default:
+		return 0, fmt.Errorf("failed to parse bandwidth %q: expected a unit like kbps, Mbps or MB/s", rate)
+	}
+	if n := len(number); n > 0 {
+		if _, ok := bandwidthPrefixes[number[n-1:]]; ok {
+			number, prefix = number[:n-1], number[n-1:]
+		}
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("failed to parse bandwidth %q: expected a positive number", rate)
+	}
+	bytesPerSecond := int64(value * bandwidthPrefixes[prefix] * bitsPerUnit / 8)
+	if bytesPerSecond < 1 {
+		return 0, fmt.Errorf("failed to parse bandwidth %q: less than one byte per second", rate)
+	}
+	return bytesPerSecond, nil
+}
+
+// SetThrottle limits the delivery of response bodies to local clients to
+// bytesPerSecond, e.g. to see how a dashboard loads over a remote office's
+// link. 0 disables throttling.
+func (s *Server) SetThrottle(bytesPerSecond int64) {
+	s.throttle = bytesPerSecond
+}
+
+// writeThrottled writes body at bytesPerSecond, flushing a chunk every
+// throttleInterval, until it is written or the client goes away
+func writeThrottled(ctx context.Context, w http.ResponseWriter, body []byte, bytesPerSecond int64) error {
+	controller := http.NewResponseController(w)
+	chunk := max(int(bytesPerSecond*int64(throttleInterval)/int64(time.Second)), 1)
+	start := time.Now()
+	written := 0
+	for written < len(body) {
+		n := min(chunk, len(body)-written)
+		if _, err := w.Write(body[written : written+n]); err != nil {
+			return err
+		}
+		if err := controller.Flush(); err != nil {
+			return err
+		}
+		written += n
+
+		// Sleep until the bytes written so far are due
+		due := start.Add(time.Duration(int64(written) * int64(time.Second) / bytesPerSecond))
+		select {
+		case <-time.After(time.Until(due)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/jkblume/awsctl/pkg/ingress"
+)
+
+// Transport delivers a ProxyRequest to the ingress handler and returns its
+// response. Transports may implement fmt.Stringer to describe themselves in
+// startup output.
+type Transport interface {
+	Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error)
+}
+
+// TransportFunc adapts a function to the Transport interface
+type TransportFunc func(ctx context.Context, request ProxyRequest) (*ProxyResponse, error)
+
+func (f TransportFunc) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	return f(ctx, request)
+}
+
+// DescribeTransport returns a human readable description of t
+func DescribeTransport(t Transport) string {
+	if stringer, ok := t.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return fmt.Sprintf("%T", t)
+}
+
+// TransportOptions are passed to transport factories
+type TransportOptions struct {
+	FunctionName string
+	FunctionURL  string
+	Region       string
+	Profile      string
+	Verbose      bool
+	// EndpointURL overrides the Lambda API endpoint, e.g. a VPC interface
+	// endpoint or localstack
+	EndpointURL string
+	// Redactor scrubs payloads in verbose logs, nil applies the defaults
+	Redactor *Redactor
+	// LogBodyLimit is how many bytes of bodies verbose logs show, 0 omits
+	// them
+	LogBodyLimit int
+}
+
+// TransportFactory creates a transport from options
+type TransportFactory func(ctx context.Context, options TransportOptions) (Transport, error)
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]TransportFactory{}
+)
+
+// RegisterTransport makes a transport available under name, replacing any
+// transport registered under the same name
+func RegisterTransport(name string, factory TransportFactory) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[name] = factory
+}
+
+// TransportNames returns the names of all registered transports
+func TransportNames() []string {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+
+	var names []string
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewTransport creates the transport registered under name
+func NewTransport(ctx context.Context, name string, options TransportOptions) (Transport, error) {
+	transportsMu.RLock()
+	factory, ok := transports[name]
+	transportsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("failed to find transport %q, available: %v", name, TransportNames())
+	}
+	return factory(ctx, options)
+}
+
+func init() {
+	RegisterTransport("lambda", func(ctx context.Context, options TransportOptions) (Transport, error) {
+		t, err := NewLambdaTransport(ctx, options.FunctionName, options.Region, options.Profile, options.EndpointURL, options.Verbose)
+		if err != nil {
+			return nil, err
+		}
+		t.redactor = options.Redactor
+		t.logBodyLimit = options.LogBodyLimit
+		return t, nil
+	})
+	RegisterTransport("function-url", func(ctx context.Context, options TransportOptions) (Transport, error) {
+		t, err := NewFunctionURLTransport(ctx, options.FunctionURL, options.Region, options.Profile, options.Verbose)
+		if err != nil {
+			return nil, err
+		}
+		t.redactor = options.Redactor
+		t.logBodyLimit = options.LogBodyLimit
+		return t, nil
+	})
+	RegisterTransport("local", func(ctx context.Context, options TransportOptions) (Transport, error) {
+		return &LocalTransport{Verbose: options.Verbose, Redactor: options.Redactor, LogBodyLimit: options.LogBodyLimit}, nil
+	})
+	RegisterTransport("mock", func(ctx context.Context, options TransportOptions) (Transport, error) {
+		return &MockTransport{}, nil
+	})
+}
+
+// LoadAWSConfig loads the default AWS configuration for region and profile
+func LoadAWSConfig(ctx context.Context, region, profile string) (aws.Config, error) {
+	awsCfg, err := loadAWSConfig(ctx, region, profile)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	trackCredentials(awsCfg)
+	return awsCfg, nil
+}
+
+func loadAWSConfig(ctx context.Context, region, profile string) (aws.Config, error) {
+	var awsConfigOptions []func(*config.LoadOptions) error
+
+	// Set region
+	if region != "" {
+		awsConfigOptions = append(awsConfigOptions, config.WithRegion(region))
+	}
+
+	// Set profile if specified
+	if profile != "" {
+		awsConfigOptions = append(awsConfigOptions, config.WithSharedConfigProfile(profile))
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, awsConfigOptions...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("load AWS config: %w", err)
+	}
+	return awsCfg, nil
+}
+
+// LambdaTransport invokes the deployed ingress Lambda function
+type LambdaTransport struct {
+	lambdaClient       *lambda.Client
+	lambdaFunctionName string
+	verbose            bool
+	redactor           *Redactor
+	logBodyLimit       int
+}
+
+// NewLambdaTransport creates a transport for functionName. A non-empty
+// endpointURL replaces the regional Lambda endpoint.
+func NewLambdaTransport(ctx context.Context, functionName, region, profile, endpointURL string, verbose bool) (*LambdaTransport, error) {
+	awsCfg, err := LoadAWSConfig(ctx, region, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create Lambda client
+	lambdaClient := lambda.NewFromConfig(awsCfg, func(o *lambda.Options) {
+		if endpointURL != "" {
+			o.BaseEndpoint = aws.String(endpointURL)
+		}
+	})
+
+	return &LambdaTransport{
+		lambdaClient:       lambdaClient,
+		lambdaFunctionName: functionName,
+		verbose:            verbose,
+		logBodyLimit:       DefaultLogBodyLimit,
+	}, nil
+}
+
+func (t *LambdaTransport) String() string {
+	return fmt.Sprintf("lambda function %s", t.lambdaFunctionName)
+}
+
+func (t *LambdaTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	// Marshal the request to JSON
+	request = stampDeadline(ctx, request)
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	if t.verbose {
+		log.Printf("Invoking Lambda function %s with payload: %s", t.lambdaFunctionName, t.redactor.RequestLog(request, t.logBodyLimit))
+	}
+
+	// Invoke Lambda function
+	started := time.Now()
+	result, err := t.lambdaClient.Invoke(ctx, &lambda.InvokeInput{
+		FunctionName: &t.lambdaFunctionName,
+		Payload:      requestJSON,
+		LogType:      "Tail", // Include logs in response
+	})
+
+	if err != nil {
+		traceInvocation(ctx, t, request, started, serviceRequestID(err), "", err)
+		return nil, fmt.Errorf("invoke Lambda: %w", err)
+	}
+	var functionErr error
+	if result.FunctionError != nil {
+		functionErr = fmt.Errorf("lambda function error: %s: %s", *result.FunctionError, result.Payload)
+	}
+	requestID, _ := awsmiddleware.GetRequestIDMetadata(result.ResultMetadata)
+	traceInvocation(ctx, t, request, started, requestID, aws.ToString(result.LogResult), functionErr)
+	recordLambdaVersion(ctx, aws.ToString(result.ExecutedVersion))
+
+	// Check if Lambda returned an error, the payload describes it
+	if result.FunctionError != nil {
+		var functionErr struct {
+			ErrorMessage string `json:"errorMessage"`
+		}
+		if json.Unmarshal(result.Payload, &functionErr) == nil && functionErr.ErrorMessage != "" {
+			return nil, fmt.Errorf("lambda function error: %s: %s", *result.FunctionError, functionErr.ErrorMessage)
+		}
+		return nil, fmt.Errorf("lambda function error: %s", *result.FunctionError)
+	}
+
+	// Parse Lambda response
+	var lambdaResp ProxyResponse
+	if err := json.Unmarshal(result.Payload, &lambdaResp); err != nil {
+		return nil, fmt.Errorf("unmarshal Lambda response: %w", err)
+	}
+
+	if t.verbose && result.LogResult != nil {
+		log.Printf("Lambda logs: %s", *result.LogResult)
+	}
+	if t.verbose {
+		if body := t.redactor.ResponseBodyLog(&lambdaResp, t.logBodyLimit); body != "" {
+			log.Print(body)
+		}
+	}
+
+	return &lambdaResp, nil
+}
+
+// InvokeEvent invokes the Lambda asynchronously, it only waits for the
+// invocation to be queued
+func (t *LambdaTransport) InvokeEvent(ctx context.Context, request ProxyRequest) error {
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+
+	if t.verbose {
+		log.Printf("Invoking Lambda function %s asynchronously with payload: %s", t.lambdaFunctionName, t.redactor.RequestLog(request, t.logBodyLimit))
+	}
+
+	if _, err := t.lambdaClient.Invoke(ctx, &lambda.InvokeInput{
+		FunctionName:   &t.lambdaFunctionName,
+		Payload:        requestJSON,
+		InvocationType: lambdatypes.InvocationTypeEvent,
+	}); err != nil {
+		return fmt.Errorf("invoke Lambda asynchronously: %w", err)
+	}
+	return nil
+}
+
+// LocalTransport runs the ingress handler in-process, so the whole pipeline
+// works without AWS credentials. Upstream calls are made from this machine,
+// which makes it suitable for locally-running HTTP targets.
+type LocalTransport struct {
+	Verbose  bool
+	Redactor *Redactor
+	// LogBodyLimit is how many bytes of bodies verbose logs show, 0 omits
+	// them
+	LogBodyLimit int
+}
+
+func (t *LocalTransport) String() string {
+	return "in-process ingress handler"
+}
+
+func (t *LocalTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	// Round trip through JSON exactly like the Lambda runtime does
+	request = stampDeadline(ctx, request)
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	if t.Verbose {
+		log.Printf("Invoking local handler with payload: %s", t.Redactor.RequestLog(request, t.LogBodyLimit))
+	}
+
+	var ingressReq ingress.ProxyRequest
+	if err := json.Unmarshal(requestJSON, &ingressReq); err != nil {
+		return nil, fmt.Errorf("unmarshal ingress request: %w", err)
+	}
+
+	started := time.Now()
+	ingressResp, err := ingress.Handler(ctx, ingressReq)
+	traceInvocation(ctx, t, request, started, "", "", err)
+	if err != nil {
+		return nil, fmt.Errorf("run ingress handler: %w", err)
+	}
+
+	responseJSON, err := json.Marshal(ingressResp)
+	if err != nil {
+		return nil, fmt.Errorf("marshal ingress response: %w", err)
+	}
+
+	var resp ProxyResponse
+	if err := json.Unmarshal(responseJSON, &resp); err != nil {
+		return nil, fmt.Errorf("unmarshal ingress response: %w", err)
+	}
+	if t.Verbose {
+		if body := t.Redactor.ResponseBodyLog(&resp, t.LogBodyLimit); body != "" {
+			log.Print(body)
+		}
+	}
+
+	return &resp, nil
+}
+
+// MockTransport answers every request with Response and Err without
+// contacting anything. With a nil Response it echoes the envelope back as a
+// JSON body. Received requests are recorded for inspection in tests.
+type MockTransport struct {
+	Response *ProxyResponse
+	Err      error
+
+	mu       sync.Mutex
+	requests []ProxyRequest
+}
+
+func (t *MockTransport) String() string {
+	return "mock transport"
+}
+
+func (t *MockTransport) Invoke(ctx context.Context, request ProxyRequest) (*ProxyResponse, error) {
+	t.mu.Lock()
+	t.requests = append(t.requests, request)
+	t.mu.Unlock()
+
+	if t.Err != nil {
+		return nil, t.Err
+	}
+	if t.Response != nil {
+		return t.Response, nil
+	}
+
+	echo, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("marshal echo: %w", err)
+	}
+	return &ProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string][]string{"Content-Type": {"application/json"}},
+		Body:       encodeBody(echo),
+	}, nil
+}
+
+// Requests returns the requests received so far
+func (t *MockTransport) Requests() []ProxyRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]ProxyRequest(nil), t.requests...)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// User-Agent policies accepted by SetUserAgent
+const (
+	// UserAgentPreserve forwards the client's User-Agent unchanged
+	UserAgentPreserve = "preserve"
+	// UserAgentReplace sends awsctl-proxy/<version> instead of it
+	UserAgentReplace = "replace"
+	// UserAgentAppend adds awsctl-proxy/<version> after it
+	UserAgentAppend = "append"
+)
+
+// VersionHeader carries the proxy version upstream when enabled with
+// SetUserAgent
+const VersionHeader = "X-Awsctl-Version"
+
+// userAgentProduct names the proxy in User-Agent headers
+const userAgentProduct = "awsctl-proxy"
+
+// SetUserAgent selects how the User-Agent sent upstream identifies the
+// proxy: preserve (the default), replace or append. With versionHeader every
+// request also carries X-Awsctl-Version, so upstream teams can tell proxied
+// traffic and its awsctl version apart without parsing User-Agents.
+func (s *Server) SetUserAgent(policy, version string, versionHeader bool) error {
+	switch policy {
+	case UserAgentPreserve, UserAgentReplace, UserAgentAppend:
+	default:
+		return fmt.Errorf("failed to use User-Agent policy %q: expected %s, %s or %s", policy, UserAgentPreserve, UserAgentReplace, UserAgentAppend)
+	}
+	s.userAgent = policy
+	s.version = version
+	s.versionHeader = versionHeader
+	return nil
+}
+
+// applyUserAgent sets the User-Agent and version headers of a request going
+// upstream according to the policy
+func (s *Server) applyUserAgent(header http.Header) {
+	product := fmt.Sprintf("%s/%s", userAgentProduct, s.version)
+	switch s.userAgent {
+	case UserAgentReplace:
+		header.Set("User-Agent", product)
+	case UserAgentAppend:
+		if userAgent := header.Get("User-Agent"); userAgent != "" {
+			header.Set("User-Agent", userAgent+" "+product)
+		} else {
+			header.Set("User-Agent", product)
+		}
+	}
+	if s.versionHeader {
+		header.Set(VersionHeader, s.version)
+	}
+}
@@ -0,0 +1,126 @@
+// Package proxytest runs the complete proxy pipeline in-process for
+// end-to-end tests: an httptest upstream, the ingress handler (in-process or
+// deployed to localstack) and the local proxy server in front of it.
+package proxytest
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jkblume/awsctl/pkg/proxy"
+)
+
+// Harness is a running proxy in front of a test upstream
+type Harness struct {
+	// Upstream is the private API stand-in
+	Upstream *httptest.Server
+	// Proxy serves the local proxy routes
+	Proxy *httptest.Server
+	// Server is the proxy server, e.g. for registering hooks
+	Server *proxy.Server
+
+	tb        testing.TB
+	transport proxy.Transport
+	targets   *proxy.Targets
+}
+
+// Option customises a Harness
+type Option func(h *Harness)
+
+// WithTransport replaces the in-process ingress handler
+func WithTransport(transport proxy.Transport) Option {
+	return func(h *Harness) {
+		h.transport = transport
+	}
+}
+
+// WithLocalstack invokes functionName through a localstack endpoint such as
+// http://localhost:4566. The function must be deployed already, and the
+// upstream must be reachable from localstack's container, e.g. with host
+// networking.
+func WithLocalstack(endpointURL, functionName string) Option {
+	return func(h *Harness) {
+		h.tb.Setenv("AWS_ACCESS_KEY_ID", "test")
+		h.tb.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+		transport, err := proxy.NewLambdaTransport(context.Background(), functionName, "us-east-1", "", endpointURL, false)
+		if err != nil {
+			h.tb.Fatalf("failed to create localstack transport: %v", err)
+		}
+		h.transport = transport
+	}
+}
+
+// WithTargets makes aliases available to the X-Awsctl-Target header
+func WithTargets(targets *proxy.Targets) Option {
+	return func(h *Harness) {
+		h.targets = targets
+	}
+}
+
+// New starts upstream and a proxy in front of it. Both are closed when the
+// test finishes.
+func New(tb testing.TB, upstream http.Handler, options ...Option) *Harness {
+	tb.Helper()
+
+	h := &Harness{
+		tb:        tb,
+		transport: &proxy.LocalTransport{},
+		Upstream:  httptest.NewServer(upstream),
+	}
+	tb.Cleanup(h.Upstream.Close)
+
+	for _, option := range options {
+		option(h)
+	}
+
+	h.Server = proxy.NewServer(h.transport, h.targets, false)
+	mux := http.NewServeMux()
+	h.Server.Register(mux, true)
+	h.Proxy = httptest.NewServer(h.Server.TargetHeaderMiddleware(mux))
+	tb.Cleanup(h.Proxy.Close)
+
+	return h
+}
+
+// URL returns the proxy URL for path on the upstream, using the /t/ scheme
+func (h *Harness) URL(path string) string {
+	target := base64.RawURLEncoding.EncodeToString([]byte(h.Upstream.URL))
+	return h.Proxy.URL + "/t/" + target + "/" + strings.TrimPrefix(path, "/")
+}
+
+// Do sends a request for path through the proxy and returns the response
+// with its body read completely
+func (h *Harness) Do(method, path string, body io.Reader, header http.Header) (*http.Response, []byte) {
+	h.tb.Helper()
+
+	req, err := http.NewRequest(method, h.URL(path), body)
+	if err != nil {
+		h.tb.Fatalf("failed to create request: %v", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := h.Proxy.Client().Do(req)
+	if err != nil {
+		h.tb.Fatalf("failed to send %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.tb.Fatalf("failed to read response to %s %s: %v", method, path, err)
+	}
+	return resp, data
+}
+
+// Get is Do for a GET without body or extra headers
+func (h *Harness) Get(path string) (*http.Response, []byte) {
+	h.tb.Helper()
+	return h.Do(http.MethodGet, path, nil, nil)
+}
@@ -8,6 +8,27 @@ data "aws_region" "current" {}
 locals {
   lambda_name          = "awsctl-proxy-ingress-lambda"
   lambda_zip_file_path = "${path.module}/../../cmd/proxy-ingress-lambda/function.zip"
+
+  lambda_environment = {
+    POLICY_SSM_PARAMETER    = var.policy_ssm_parameter
+    POLICY_DYNAMODB_TABLE   = var.policy_dynamodb_table
+    SIGNING_KMS_KEY         = var.signing_kms_key_arn
+    HTTPS_PROXY             = var.https_proxy
+    HTTP_PROXY              = var.https_proxy
+    NO_PROXY                = var.no_proxy
+    DNS_SERVER              = var.dns_server
+    HOST_OVERRIDE_CIDRS     = join(",", var.host_override_cidrs)
+    K8S_CLUSTERS            = join(",", [for name, server in var.k8s_clusters : "${name}=${server}"])
+    ASYNC_RESPONSE_BUCKET   = var.async_response_bucket
+    MAX_RESPONSE_BYTES      = var.max_response_size
+    ALLOWED_CONTENT_TYPES   = join(",", var.allowed_content_types)
+    RESPONSE_LIMITS         = length(var.response_limits) == 0 ? "" : jsonencode(var.response_limits)
+    UPSTREAM_AUTH           = length(var.upstream_auth) == 0 ? "" : jsonencode(var.upstream_auth)
+    UPSTREAM_DIAL_TIMEOUT   = lookup(var.upstream_timeouts, "dial", "")
+    UPSTREAM_TLS_TIMEOUT    = lookup(var.upstream_timeouts, "tls", "")
+    UPSTREAM_HEADER_TIMEOUT = lookup(var.upstream_timeouts, "header", "")
+    UPSTREAM_TIMEOUT        = lookup(var.upstream_timeouts, "total", "")
+  }
 }
 
 resource "aws_iam_role" "this" {
@@ -43,7 +64,7 @@ resource "aws_iam_role_policy" "this" {
 
   policy = jsonencode({
     Version = "2012-10-17"
-    Statement = [
+    Statement = concat([
       {
         Effect = "Allow"
         Action = [
@@ -53,7 +74,50 @@ resource "aws_iam_role_policy" "this" {
         ]
         Resource = "arn:aws:logs:${data.aws_region.current.id}:${data.aws_caller_identity.current.account_id}:*"
       }
-    ]
+      ], var.policy_ssm_parameter == "" ? [] : [
+      {
+        Effect   = "Allow"
+        Action   = ["ssm:GetParameter"]
+        Resource = "arn:aws:ssm:${data.aws_region.current.id}:${data.aws_caller_identity.current.account_id}:parameter/${trimprefix(var.policy_ssm_parameter, "/")}"
+      }
+      ], var.signing_kms_key_arn == "" ? [] : [
+      {
+        Effect   = "Allow"
+        Action   = ["kms:VerifyMac"]
+        Resource = var.signing_kms_key_arn
+      }
+      ], var.payload_kms_key_arn == "" ? [] : [
+      {
+        Effect   = "Allow"
+        Action   = ["kms:Decrypt"]
+        Resource = var.payload_kms_key_arn
+      }
+      ], var.policy_dynamodb_table == "" ? [] : [
+      {
+        Effect   = "Allow"
+        Action   = ["dynamodb:Scan"]
+        Resource = "arn:aws:dynamodb:${data.aws_region.current.id}:${data.aws_caller_identity.current.account_id}:table/${var.policy_dynamodb_table}"
+      }
+      ], var.async_response_bucket == "" ? [] : [
+      {
+        Effect   = "Allow"
+        Action   = ["s3:PutObject"]
+        Resource = "arn:aws:s3:::${var.async_response_bucket}/awsctl-responses/*"
+      }
+      ], !var.enable_cloud_map ? [] : [
+      {
+        Effect   = "Allow"
+        Action   = ["servicediscovery:DiscoverInstances"]
+        Resource = "*"
+      }
+      ], length(var.upstream_auth) == 0 ? [] : [
+      {
+        Effect = "Allow"
+        Action = ["secretsmanager:GetSecretValue"]
+        # Secret ARNs end in a random suffix after the name
+        Resource = [for auth in var.upstream_auth : startswith(auth.secret, "arn:") ? auth.secret : "arn:aws:secretsmanager:${data.aws_region.current.id}:${data.aws_caller_identity.current.account_id}:secret:${auth.secret}-*"]
+      }
+    ])
   })
 }
 
@@ -61,11 +125,15 @@ resource "aws_lambda_function" "this" {
   function_name = local.lambda_name
   role          = aws_iam_role.this.arn
   handler       = "bootstrap"
-  architectures = ["arm64"]
-  runtime       = "provided.al2023"
-  timeout       = 30
+  architectures = [var.architecture]
+  runtime       = var.runtime
+  timeout       = var.timeout
   memory_size   = 128
 
+  tags = {
+    awsctl-proxy = "ingress"
+  }
+
   filename         = local.lambda_zip_file_path
   source_code_hash = filebase64sha256(local.lambda_zip_file_path)
 
@@ -73,6 +141,10 @@ resource "aws_lambda_function" "this" {
     subnet_ids         = var.vpc_subnet_ids
     security_group_ids = [aws_security_group.this.id]
   }
+
+  environment {
+    variables = local.lambda_environment
+  }
 }
 resource "aws_security_group" "this" {
   name        = local.lambda_name
@@ -93,6 +165,36 @@ resource "aws_security_group" "this" {
     protocol    = "TCP"
     cidr_blocks = [data.aws_vpc.vpc.cidr_block]
   }
+  dynamic "egress" {
+    for_each = var.https_proxy == "" ? [] : [var.https_proxy_port]
+    content {
+      description = "Forward proxy"
+      from_port   = egress.value
+      to_port     = egress.value
+      protocol    = "TCP"
+      cidr_blocks = [data.aws_vpc.vpc.cidr_block]
+    }
+  }
+  dynamic "egress" {
+    for_each = var.dns_server == "" ? [] : ["UDP", "TCP"]
+    content {
+      description = "DNS server"
+      from_port   = 53
+      to_port     = 53
+      protocol    = egress.value
+      cidr_blocks = ["${split(":", var.dns_server)[0]}/32"]
+    }
+  }
+  dynamic "egress" {
+    for_each = length(var.k8s_clusters) == 0 ? [] : ["UDP", "TCP"]
+    content {
+      description = "Kubernetes cluster DNS"
+      from_port   = 53
+      to_port     = 53
+      protocol    = egress.value
+      cidr_blocks = [for server in distinct(values(var.k8s_clusters)) : "${split(":", server)[0]}/32"]
+    }
+  }
 }
 
 
@@ -100,3 +202,158 @@ resource "aws_cloudwatch_log_group" "this" {
   name              = "/aws/lambda/${aws_lambda_function.this.function_name}"
   retention_in_days = 14
 }
+
+# The function URL belongs to a function of its own that nothing is granted
+# lambda:InvokeFunction on. Only there the Lambda can trust the caller the URL
+# reports, a direct Invoke could forge the function URL event.
+resource "aws_lambda_function" "url" {
+  count         = var.enable_function_url ? 1 : 0
+  function_name = "${local.lambda_name}-url"
+  role          = aws_iam_role.this.arn
+  handler       = "bootstrap"
+  architectures = [var.architecture]
+  runtime       = var.runtime
+  timeout       = var.timeout
+  memory_size   = 128
+
+  tags = {
+    awsctl-proxy = "ingress-url"
+  }
+
+  filename         = local.lambda_zip_file_path
+  source_code_hash = filebase64sha256(local.lambda_zip_file_path)
+
+  vpc_config {
+    subnet_ids         = var.vpc_subnet_ids
+    security_group_ids = [aws_security_group.this.id]
+  }
+
+  environment {
+    variables = merge(local.lambda_environment, { FUNCTION_URL_ONLY = "true" })
+  }
+}
+
+resource "aws_cloudwatch_log_group" "url" {
+  count             = var.enable_function_url ? 1 : 0
+  name              = "/aws/lambda/${aws_lambda_function.url[0].function_name}"
+  retention_in_days = 14
+}
+
+resource "aws_lambda_function_url" "this" {
+  count              = var.enable_function_url ? 1 : 0
+  function_name      = aws_lambda_function.url[0].function_name
+  authorization_type = "AWS_IAM"
+}
+
+resource "aws_iam_role" "step_functions" {
+  count = var.enable_step_functions ? 1 : 0
+  name  = "${local.lambda_name}-sfn-role"
+
+  assume_role_policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Action = "sts:AssumeRole"
+        Effect = "Allow"
+        Principal = {
+          Service = "states.amazonaws.com"
+        }
+      }
+    ]
+  })
+}
+
+resource "aws_iam_role_policy" "step_functions" {
+  count = var.enable_step_functions ? 1 : 0
+  name  = "${local.lambda_name}-sfn-policy"
+  role  = aws_iam_role.step_functions[0].id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect   = "Allow"
+        Action   = ["lambda:InvokeFunction"]
+        Resource = [aws_lambda_function.this.arn, "${aws_lambda_function.this.arn}:*"]
+      }
+    ]
+  })
+}
+
+resource "aws_sfn_state_machine" "this" {
+  count    = var.enable_step_functions ? 1 : 0
+  name     = local.lambda_name
+  role_arn = aws_iam_role.step_functions[0].arn
+  type     = "STANDARD"
+
+  definition = jsonencode({
+    Comment = "Runs long-running awsctl proxy requests, started by awsctl proxy -state-machine"
+    StartAt = "Invoke"
+    States = {
+      Invoke = {
+        Type     = "Task"
+        Resource = "arn:aws:states:::lambda:invoke"
+        Parameters = {
+          FunctionName = aws_lambda_function.this.arn
+          "Payload.$"  = "$"
+        }
+        OutputPath = "$.Payload"
+        Retry = [
+          {
+            ErrorEquals     = ["Lambda.ServiceException", "Lambda.AWSLambdaException", "Lambda.SdkClientException", "Lambda.TooManyRequestsException"]
+            IntervalSeconds = 2
+            MaxAttempts     = 6
+            BackoffRate     = 2
+          }
+        ]
+        End = true
+      }
+    }
+  })
+}
+
+resource "aws_sqs_queue" "dead_letter" {
+  count                     = var.enable_reliable_delivery ? 1 : 0
+  name                      = "${local.lambda_name}-dlq"
+  message_retention_seconds = 1209600
+}
+
+resource "aws_sqs_queue" "reliable" {
+  count = var.enable_reliable_delivery ? 1 : 0
+  name  = "${local.lambda_name}-reliable"
+  # SQS recommends six times the function timeout
+  visibility_timeout_seconds = 6 * var.timeout
+  message_retention_seconds  = 345600
+
+  redrive_policy = jsonencode({
+    deadLetterTargetArn = aws_sqs_queue.dead_letter[0].arn
+    maxReceiveCount     = var.reliable_max_receive_count
+  })
+}
+
+resource "aws_iam_role_policy" "reliable" {
+  count = var.enable_reliable_delivery ? 1 : 0
+  name  = "${local.lambda_name}-reliable-policy"
+  role  = aws_iam_role.this.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect   = "Allow"
+        Action   = ["sqs:ReceiveMessage", "sqs:DeleteMessage", "sqs:GetQueueAttributes"]
+        Resource = aws_sqs_queue.reliable[0].arn
+      }
+    ]
+  })
+}
+
+resource "aws_lambda_event_source_mapping" "reliable" {
+  count                   = var.enable_reliable_delivery ? 1 : 0
+  event_source_arn        = aws_sqs_queue.reliable[0].arn
+  function_name           = aws_lambda_function.this.arn
+  batch_size              = 10
+  function_response_types = ["ReportBatchItemFailures"]
+
+  depends_on = [aws_iam_role_policy.reliable]
+}
@@ -0,0 +1,24 @@
+output "function_name" {
+  description = "Name of the ingress Lambda function"
+  value       = aws_lambda_function.this.function_name
+}
+
+output "function_url" {
+  description = "Function URL of the ingress Lambda, empty unless enable_function_url is set"
+  value       = var.enable_function_url ? aws_lambda_function_url.this[0].function_url : ""
+}
+
+output "state_machine_arn" {
+  description = "ARN of the state machine for -state-machine, empty unless enable_step_functions is set"
+  value       = var.enable_step_functions ? aws_sfn_state_machine.this[0].arn : ""
+}
+
+output "reliable_queue_url" {
+  description = "URL of the queue for -reliable-queue, empty unless enable_reliable_delivery is set"
+  value       = var.enable_reliable_delivery ? aws_sqs_queue.reliable[0].url : ""
+}
+
+output "dead_letter_queue_url" {
+  description = "URL of the dead-letter queue of undeliverable reliable requests, empty unless enable_reliable_delivery is set"
+  value       = var.enable_reliable_delivery ? aws_sqs_queue.dead_letter[0].url : ""
+}